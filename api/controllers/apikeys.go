@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// GetAPIKeys lists the API keys of the caller's user.
+// @Summary List API Keys
+// @ID getAPIKeys
+// @Description This endpoint lists the API keys of the caller's user with their label, scopes, creation, last use and expiry. The keys themselves are never returned.
+// @Tags Authentication
+// @Accept json
+// @Produce json
+// @Success 200 {array} apikeys.Key "Returns the API keys"
+// @Failure 500 {object} Response "Returns an error message if the keys could not be retrieved from Redis"
+// @Router /v1/auth/apikeys [get]
+func GetAPIKeys(c *fiber.Ctx) error {
+
+	keys, err := apikeys.List(callerID(c))
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to list the API keys"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(keys)
+}
+
+// PostAPIKeys creates an API key for the caller's user.
+// @Summary Create API Key
+// @ID postAPIKeys
+// @Description This endpoint creates an API key for the caller's user with a label, a list of scopes (e.g. email:read, calendar:write or admin) and an optional absolute expiry. The key is only returned once.
+// @Tags Authentication
+// @Accept json
+// @Produce json
+// @Param key body APIKeyRequest true "Label, scopes and expiry of the key"
+// @Success 201 {object} CreatedAPIKey "Returns the key and its metadata"
+// @Failure 400 {object} Response "Returns an error message if the scopes or the expiry are invalid"
+// @Failure 500 {object} Response "Returns an error message if the key could not be saved to Redis"
+// @Router /v1/auth/apikeys [post]
+func PostAPIKeys(c *fiber.Ctx) error {
+
+	var request APIKeyRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Unable to parse the API key request"})
+	}
+
+	if request.Label == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "A label is required"})
+	}
+
+	if err := apikeys.ValidateScopes(request.Scopes); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	}
+
+	key, apiKey, err := apikeys.Create(callerID(c), request.Label, request.Scopes, request.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, apikeys.ErrInvalidExpiry) {
+			return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "The expiry must be in the future"})
+		}
+		log.Printf("Error creating API key: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to create the API key"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(CreatedAPIKey{Key: key, APIKey: apiKey})
+}
+
+// DeleteAPIKey revokes an API key of the caller's user.
+// @Summary Revoke API Key
+// @ID deleteAPIKey
+// @Description This endpoint revokes the caller's API key with the given ID, it stops working right away. The keys of other users cannot be revoked.
+// @Tags Authentication
+// @Accept json
+// @Produce json
+// @Param id path string true "ID of the API key"
+// @Success 204 "The key was revoked"
+// @Failure 404 {object} Response "Returns an error message if the caller's user has no such key"
+// @Failure 500 {object} Response "Returns an error message if the key could not be deleted from Redis"
+// @Router /v1/auth/apikeys/{id} [delete]
+func DeleteAPIKey(c *fiber.Ctx) error {
+
+	err := apikeys.Revoke(callerID(c), c.Params("id"))
+	if err == redis.Nil {
+		return c.Status(fiber.StatusNotFound).JSON(Response{Error: "API key not found"})
+	}
+	if err != nil {
+		log.Printf("Error revoking API key: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to revoke the API key"})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// PostRotateAPIKey replaces an API key of the caller's user by a new one.
+// @Summary Rotate API Key
+// @ID postRotateAPIKey
+// @Description This endpoint replaces the caller's API key with the given ID by a new key with the same label, scopes and expiry. The old key stops working right away.
+// @Tags Authentication
+// @Accept json
+// @Produce json
+// @Param id path string true "ID of the API key"
+// @Success 201 {object} CreatedAPIKey "Returns the new key and its metadata"
+// @Failure 404 {object} Response "Returns an error message if the caller's user has no such key"
+// @Failure 500 {object} Response "Returns an error message if the key could not be rotated"
+// @Router /v1/auth/apikeys/{id}/rotate [post]
+func PostRotateAPIKey(c *fiber.Ctx) error {
+
+	key, apiKey, err := apikeys.Rotate(callerID(c), c.Params("id"))
+	if err == redis.Nil {
+		return c.Status(fiber.StatusNotFound).JSON(Response{Error: "API key not found"})
+	}
+	if err != nil {
+		log.Printf("Error rotating API key: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to rotate the API key"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(CreatedAPIKey{Key: key, APIKey: apiKey})
+}
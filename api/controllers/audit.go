@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"log"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetAuditLog returns the latest entries of the audit log.
+// @Summary Get Audit Log
+// @ID getAuditLog
+// @Description This endpoint returns the latest actions the caller's user took on emails, newest first.
+// @Tags Audit
+// @Accept json
+// @Produce json
+// @Param limit query int false "Maximum number of entries to return (default 100)"
+// @Success 200 {array} utils.AuditEntry "Returns the audit log entries"
+// @Failure 400 {object} Response "Returns an error message if the limit is invalid"
+// @Failure 500 {object} Response "Returns an error message if the audit log could not be retrieved from Redis"
+// @Router /v1/audit [get]
+func GetAuditLog(c *fiber.Ctx) error {
+
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid limit"})
+	}
+
+	entries, err := utils.GetAuditLog(callerID(c), int64(limit))
+	if err != nil {
+		log.Printf("Error getting audit log: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve the audit log"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(entries)
+}
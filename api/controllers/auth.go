@@ -1,13 +1,15 @@
 package controllers
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"net/url"
 	"time"
 
-	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/deviceflow"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/users"
 	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/redis/go-redis/v9"
@@ -20,13 +22,15 @@ import (
 // GetOAtuh returns the auth URL for the given OAuth2 provider
 // @Summary Get OAuth2 Authentication URL
 // @ID getOAuth
-// @Description This endpoint generates the OAuth2 authentication URL for the specified provider.
+// @Description This endpoint generates the OAuth2 authentication URL for the specified provider. The returned link opens the flow in the browser and binds it to that browser, the callback is only accepted from it. The flow is bound to the API key of the caller, the account is linked to the key's user, only if the key is still valid once the user is redirected back. Authorizing another account of the provider connects it next to the others, connecting an account that is already connected again must be confirmed with replace=true.
 // @Tags OAuth2
 // @Accept json
 // @Produce json
 // @Param provider query string true "Name of the OAuth2 provider to generate the authentication URL for"
+// @Param replace query bool false "Confirms replacing the tokens of the account if it is already connected"
 // @Success 200 {object} Response "Returns a message with the URL to visit to authorize the application"
 // @Failure 400 {object} Response "Returns an error message if the provided OAuth2 provider is invalid"
+// @Failure 401 {object} Response "Returns an error message if the request was not made with an API key"
 // @Failure 500 {object} Response "Returns an error message if there was an error loading the OAuth2 configuration or generating the OAuth2 URL"
 // @Router /v1/auth/oauth [get]
 func GetOAtuh(c *fiber.Ctx) error {
@@ -42,25 +46,10 @@ func GetOAtuh(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(response)
 	}
 
-	// Check Access Token Status
-	token, err := utils.RetrieveToken(provider)
-	if err != nil && err != redis.Nil {
-		response := Response{
-			Error: "Error Checking Access Token Status",
-		}
-		log.Printf("Error getting token: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(response)
-	}
-
-	if token != nil {
-		// Calculate how many minutes are left until the token expires and round it up to the nearest minute
-		minutesLeft := int(token.Expiry.Sub(time.Now()).Minutes() + 1)
-		if minutesLeft > 0 {
-			response := Response{
-				Error: fmt.Sprintf("Access Token is still valid for %v miutes", minutesLeft),
-			}
-			return c.Status(fiber.StatusOK).JSON(response)
-		}
+	// Bind the flow to the caller
+	link, err := callerLink(c, provider)
+	if err != nil {
+		return linkError(c, err)
 	}
 
 	// Load the OAuth2 config from the JSON file
@@ -72,8 +61,8 @@ func GetOAtuh(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(response)
 	}
 
-	// Get the URL to visit to authorize the application
-	authURL, _, err := utils.GenerateOauthURL(config, provider, "PCKE")
+	// Start the flow, the user is sent to the provider through the portal so that the flow is bound to the user's browser
+	_, state, err := utils.GenerateOauthURL(config, link, "PCKE")
 	if err != nil {
 		response := Response{
 			Error: fmt.Sprintf("Error generating OAuth2 URL: %v", err),
@@ -83,23 +72,77 @@ func GetOAtuh(c *fiber.Ctx) error {
 
 	// Show the user the URL to visit to authorize our application
 	response := Response{
-		Data: fmt.Sprintf("Please complete the authorization workflow by going to the following URL:\n %s", authURL),
+		Data: fmt.Sprintf("Please complete the authorization workflow by going to the following URL:\n %s", c.BaseURL()+oauthStartPath(state)),
 	}
 	return c.Status(200).JSON(response)
 }
 
+// oauthNonceCookie is the cookie holding the nonce of the browser the flow was started in
+const oauthNonceCookie = "oauth_nonce"
+
+// oauthStartPath returns the path of the portal link starting the flow with the given state token in the browser
+func oauthStartPath(state string) string {
+	return "/v1/auth/oauth/start/" + url.PathEscape(state)
+}
+
+// GetOAuthStart binds the flow to the browser and redirects it to the OAuth2 provider
+// @Summary Start OAuth2 Authorization
+// @ID getOAuthStart
+// @Description This endpoint is the link returned by /v1/auth/oauth. It binds the flow to the browser with an HttpOnly cookie and redirects to the provider, the callback is only accepted from the same browser. The link can only be opened once.
+// @Tags OAuth2
+// @Param state path string true "State token of the flow"
+// @Success 302 {string} string "Redirects to the authorization page of the provider"
+// @Failure 400 {object} Response "Returns an error message if the flow has expired or was already started"
+// @Failure 500 {object} Response "Returns an error message if the flow could not be bound to the browser"
+// @Router /v1/auth/oauth/start/{state} [get]
+func GetOAuthStart(c *fiber.Ctx) error {
+
+	nonce, err := utils.GenerateOAuthNonce()
+	if err != nil {
+		log.Printf("Error generating nonce: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error starting the authorization"})
+	}
+
+	authURL, err := utils.BindOAuthState(c.Params("state"), nonce)
+	if err != nil {
+		switch {
+		case err == redis.Nil:
+			return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid state token or state token has expired"})
+		case errors.Is(err, utils.ErrOAuthStateBound):
+			return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "The authorization was already started, request a new link"})
+		}
+		log.Printf("Error binding state token: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error starting the authorization"})
+	}
+
+	// Lax lets the browser send the cookie along with the provider's redirect to the callback
+	c.Cookie(&fiber.Cookie{
+		Name:     oauthNonceCookie,
+		Value:    nonce,
+		Path:     "/v1/auth/oauth",
+		MaxAge:   int((2 * time.Minute).Seconds()),
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
 // GetOAuthCallBack handles the redirect from the OAuth2 provider
 // @Summary OAuth2 Callback Endpoint
 // @ID getOAuthCallBack
-// @Description This endpoint handles the callback from the OAuth2 provider, exchanges the authorization code for an access token, and saves the token.
+// @Description This endpoint handles the callback from the OAuth2 provider, exchanges the authorization code for an access token, and saves the token as the token of the account it was issued for, identified by its email, under the user of the API key that started the flow. The callback must come from the browser that opened the link returned by /v1/auth/oauth. The API key that started the flow must still be valid, and the tokens of an account that is already connected are only replaced if the flow was started with replace=true.
 // @Tags OAuth2
 // @Accept json
 // @Produce json
 // @Param code query string true "Authorization code returned by the OAuth2 provider"
 // @Param state query string true "State token for CSRF protection"
 // @Success 307 {string} string "Redirects to the OAuth success route on successful token exchange and save"
-// @Failure 400 {object} Response "Returns an error message if the authorization code or state token is missing or invalid, or if the OAuth2 provider is invalid"
-// @Failure 500 {object} Response "Returns an error message if there was an error getting the OAuth2 configuration, exchanging the code for a token, or saving the token"
+// @Failure 400 {object} Response "Returns an error message if the authorization code or state token is missing or invalid, if the flow was not started in the same browser, or if the OAuth2 provider is invalid"
+// @Failure 401 {object} Response "Returns an error message if the API key that started the flow was revoked or expired"
+// @Failure 409 {object} Response "Returns an error message if the account is already connected and replacing its tokens was not confirmed"
+// @Failure 500 {object} Response "Returns an error message if there was an error getting the OAuth2 configuration, exchanging the code for a token, retrieving the email of the account, or saving the token"
 // @Router /v1/auth/oauth/callback [get]
 func GetOAuthCallBack(c *fiber.Ctx) error {
 
@@ -117,22 +160,23 @@ func GetOAuthCallBack(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "No state token found in the request"})
 	}
 
-	stateToken, err := redisclient.Rdb.GetDel(context.Background(), fmt.Sprintf("stateToken_%s", state)).Result()
+	link, err := utils.ConsumeOAuthState(state)
 	if err != nil {
 		if err == redis.Nil {
 			return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid state token or state token has expired"})
 		}
-		log.Printf("Error getting state token from Redis: %v", err)
+		log.Printf("Error getting state token: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting state token"})
 	}
 
-	if stateToken != state {
-
-		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid state token"})
+	// The callback must come from the browser the flow was started in, the state token alone is not enough
+	nonce := c.Cookies(oauthNonceCookie)
+	c.Cookie(&fiber.Cookie{Name: oauthNonceCookie, Path: "/v1/auth/oauth", MaxAge: -1, HTTPOnly: true})
+	if !link.VerifyNonce(nonce) {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "The authorization was not started in this browser"})
 	}
 
-	// Parses the state token base on - as the delimiter to get the provider
-	provider := strings.Split(state, "-")[0]
+	provider := link.Provider
 
 	// Check if the provider is valid
 	_, ok := utils.ValidProviders[provider]
@@ -140,6 +184,12 @@ func GetOAuthCallBack(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
 	}
 
+	// The key that started the flow may have been revoked meanwhile
+	_, err = apikeys.Authorize(link.KeyID, apikeys.ScopeAdmin)
+	if err != nil {
+		return linkError(c, err)
+	}
+
 	// Empty OAuth2 config to be filled based on the provider
 	authConfig, err := utils.GetOAuth2Config(provider)
 	if err != nil {
@@ -147,24 +197,98 @@ func GetOAuthCallBack(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting OAuth2 config"})
 	}
 
+	// Get the PKCE code verifier saved when the flow was started
+	verifier, err := utils.ConsumeCodeVerifier(state)
+	if err != nil {
+		if err == redis.Nil {
+			return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Code verifier not found or has expired"})
+		}
+		log.Printf("Error getting code verifier: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting code verifier"})
+	}
+
 	// Exchange the code for an access token here
-	tok, err := utils.ExchangeCodeForToken(authConfig, code)
+	tok, err := utils.ExchangeCodeForToken(authConfig, code, verifier)
 	if err != nil {
 		log.Printf("Error exchanging code for token: %v", err)
-		c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error exchanging code for token"})
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error exchanging code for token"})
 	}
 
-	// Save the token in Redis
-	err = utils.SaveToken(provider, tok)
+	// Save the token in Redis as the token of the account it was issued for
+	account, err := utils.LinkAccount(link, tok)
 	if err != nil {
-		log.Printf("Error saving access token: %v", err)
-		c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error saving access token"})
+		return linkError(c, err)
 	}
 
+	recordLink(link, account)
+
 	// return c.SendString(fmt.Sprintf("Authorization code: %s", code))
 	return c.RedirectToRoute("oauth_success", nil, fiber.StatusTemporaryRedirect)
 }
 
+// callerLink binds the link of the provider's account to the API key of the caller.
+// The replace query parameter confirms replacing the tokens of the account if it is already connected, which is only known once the user authorized it.
+func callerLink(c *fiber.Ctx, provider string) (utils.OAuthLink, error) {
+
+	key, ok := c.Locals("apiKey").(apikeys.Key)
+	if !ok {
+		return utils.OAuthLink{}, apikeys.ErrInvalidAPIKey
+	}
+
+	link := utils.OAuthLink{
+		Provider: provider,
+		User:     key.UserID,
+		KeyID:    key.ID,
+		Replace:  c.QueryBool("replace"),
+	}
+
+	return link, nil
+}
+
+// callerID returns the ID of the user of the caller's API key, the routes without an API key have none
+func callerID(c *fiber.Ctx) string {
+
+	user, ok := c.Locals("user").(users.User)
+	if !ok {
+		return ""
+	}
+
+	return user.ID
+}
+
+// linkError responds with the error of an account link that could not be started or completed
+func linkError(c *fiber.Ctx, err error) error {
+
+	switch {
+	case errors.Is(err, apikeys.ErrInvalidAPIKey):
+		return c.Status(fiber.StatusUnauthorized).JSON(Response{Error: "The API key that started the flow is missing, revoked or expired"})
+	case errors.Is(err, utils.ErrAccountConnected):
+		return c.Status(fiber.StatusConflict).JSON(Response{Error: "The account is already connected, start the flow with replace=true to replace its tokens"})
+	}
+
+	log.Printf("Error linking the account: %v", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error linking the account"})
+}
+
+// recordLink records which API key linked the account in the audit log
+func recordLink(link utils.OAuthLink, account string) {
+
+	entry := utils.AuditEntry{
+		Provider: link.Provider,
+		Account:  utils.AccountName(account),
+		Target:   link.KeyID,
+		Action:   "link_account",
+	}
+	if link.Replace {
+		entry.Action = "replace_account"
+	}
+
+	auditErr := utils.RecordAudit(link.User, entry)
+	if auditErr != nil {
+		log.Printf("Error recording audit entry: %v", auditErr)
+	}
+}
+
 /*
 * Refresh Token
  */
@@ -172,13 +296,16 @@ func GetOAuthCallBack(c *fiber.Ctx) error {
 // GetNewTokenFromRefreshToken handles the redirect from the OAuth2 provider
 // @Summary Get New Token From Refresh Token
 // @ID getNewTokenFromRefreshToken
-// @Description This endpoint retrieves a new access token using the refresh token for the specified provider.
+// @Description This endpoint retrieves a new access token using the refresh token for the caller's connected accounts of the specified provider, or for the selected one.
 // @Tags OAuth2
 // @Accept json
 // @Produce json
 // @Param provider query string true "Name of the OAuth2 provider to get the new access token for"
+// @Param account query string false "Only refresh the token of the connected account with this email"
 // @Success 307 {string} string "Redirects to the OAuth success route on successful token retrieval and update"
 // @Failure 400 {object} Response "Returns an error message if the provided OAuth2 provider is invalid"
+// @Failure 401 {object} Response "Returns an error message if the refresh token is missing or was rejected, the account must be connected again"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
 // @Failure 500 {object} Response "Returns an error message if there was an error getting the OAuth2 configuration, retrieving the token, getting the new token from the refresh token, or updating the token"
 // @Router /v1/auth/oauth/refresh [get]
 func GetNewTokenFromRefreshToken(c *fiber.Ctx) error {
@@ -191,143 +318,94 @@ func GetNewTokenFromRefreshToken(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
 	}
 
-	// Get the OAuth2 config for the provider
-	providerConfig, err := utils.GetOAuth2Config(provider)
+	accounts, err := utils.SelectAccounts(callerID(c), provider, c.Query("account"))
 	if err != nil {
-		log.Printf("Error getting OAuth2 config: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting OAuth2 config"})
+		return accountError(c, provider, err)
 	}
 
-	tok, err := utils.RetrieveToken(provider)
-	if err != nil {
-		log.Printf("Error getting token: %v", err)
+	if len(accounts) == 0 {
 		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Access token not found or has expired"})
 	}
 
-	// Get the token from the refresh token
-	newTok, err := utils.GetTokenFromRefreshToken(providerConfig, tok.RefreshToken)
-	if err != nil {
-		log.Printf("Error getting token from refresh token: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting access token from refresh token"})
-	}
-
-	// Update the token in Redis
-	err = utils.UpdateToken(provider, newTok)
-	if err != nil {
-		log.Printf("Error updating token: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error updating access token"})
+	for _, account := range accounts {
+		// Refresh the token, the other replicas wait for the new one instead of using the same refresh token
+		_, err := utils.RefreshStoredToken(account, true)
+		if err != nil {
+			if err == redis.Nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Access token not found or has expired"})
+			}
+			if errors.Is(err, utils.ErrReconsentRequired) {
+				return c.Status(fiber.StatusUnauthorized).JSON(Response{Error: fmt.Sprintf("The refresh token of %s is missing or no longer valid, connect the account again with /v1/auth/oauth and replace=true", utils.AccountName(account))})
+			}
+			log.Printf("Error refreshing token: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting access token from refresh token"})
+		}
 	}
 
 	return c.RedirectToRoute("oauth_success", nil, fiber.StatusTemporaryRedirect)
 }
 
-/*
-* Internal Auth
- */
-
-// GetAPIKey returns a page to get the initial API key
-// @Summary Get API Key
-// @ID getAPIKey
-// @Description This endpoint checks if the initial password exists in Redis and if it does, renders the API key form. If the initial password does not exist or has been used, it redirects to the home page or prompts the user to restart the server.
-// @Tags Authentication
+// GetTokenStatus reports whether the tokens of the connected accounts are active, refreshable or need the user to connect the account again
+// @Summary Get OAuth2 Token Status
+// @ID getTokenStatus
+// @Description This endpoint reports for each of the caller's connected accounts whether the access token is active, can be refreshed without the user, or the account must be connected again. The providers without any connected account are reported as not connected.
+// @Tags OAuth2
 // @Accept json
 // @Produce json
-// @Success 200 {object} Response "Renders the API key form if the initial password exists and has not been used"
-// @Failure 500 {Object} Response "The initial password has been used. Please check the database for the API key"
-// @Failure 500 {object} Response "Returns an error message if the initial password does not exist or there was an error getting the initial password"
-// @Router /v1/auth/internal/apikey [get]
-func GetAPIKey(c *fiber.Ctx) error {
-
-	// Check if the initial password exists in Redis
-	initialPassword, err := redisclient.Rdb.Get(context.Background(), "initial_password").Result()
-	if err != nil {
-		// If the initial password does not exist, warn the user to restart the server to generate a new password.
-		if err == redis.Nil {
-			return c.
-				Status(fiber.StatusInternalServerError).
-				JSON(Response{Error: "Initial password does not exist. Please restart the server to generate a new password"})
-		}
-		// If there is an error getting the initial password, log the error and return a 500 status code.
-		log.Printf("Error getting initial password: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting initial password"})
-	}
-
-	// If the initial password is an empty string, redirect to the home page. It means that the initial password has been used.
-	if initialPassword == "" {
-		// return c.RedirectToRoute("home", nil, fiber.StatusTemporaryRedirect)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "The initial password has been used. Please check the database for the API key"})
-	}
+// @Param provider query string false "Name of the OAuth2 provider to report on, all providers if omitted"
+// @Param account query string false "Only report on the connected account with this email"
+// @Success 200 {array} utils.TokenStatus "Returns the token status of the accounts"
+// @Failure 400 {object} Response "Returns an error message if the provided OAuth2 provider is invalid"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 500 {object} Response "Returns an error message if there was an error reading the tokens"
+// @Router /v1/auth/oauth/status [get]
+func GetTokenStatus(c *fiber.Ctx) error {
 
-	return c.Render("apikey_form", fiber.Map{})
-}
+	providers := []string{"google", "outlook"}
 
-// PostAPIKey generates and returns a new API key
-// @Summary Post API Key
-// @ID postAPIKey
-// @Description This endpoint checks if the initial password exists in Redis, compares it with the password from the form, generates an API key if the passwords match, saves the API key in Redis with a TTL of 7 days, and sets the initial password to an empty string.
-// @Tags Authentication
-// @Accept json
-// @Produce json
-// @Param password formData string true "Password from the form"
-// @Success 200 {object} Response "Returns the generated API key"
-// @Failure 500 {object} Response "The initial password has been used. Please check the database for the API key"
-// @Failure 400 {object} Response "Returns an error message if the password from the form does not match the initial password"
-// @Failure 500 {object} Response "Returns an error message if the initial password does not exist, there was an error getting the initial password, generating the API key, saving the API key, or deleting the initial password"
-// @Router /v1/auth/internal/apikey [post]
-func PostAPIKey(c *fiber.Ctx) error {
-
-	// Check if the initial password is still in Redis
-	initialPassword, err := redisclient.Rdb.Get(context.Background(), "initial_password").Result()
-	if err != nil {
-		// If the initial password does not exist, warn the user to restart the server to generate a new password.
-		if err == redis.Nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Initial password does not exist. Please restart the server to generate a new password"})
+	provider := c.Query("provider")
+	if provider != "" {
+		_, ok := utils.ValidProviders[provider]
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
 		}
-		// If there is an error getting the initial password, log the error and return a 500 status code.
-		log.Printf("Error getting initial password: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting initial password"})
+		providers = []string{provider}
 	}
 
-	// If the initial password is an empty string, redirect to the home page. It means that the initial password has been used.
-	if initialPassword == "" {
-		// return c.RedirectToRoute("home", nil, fiber.StatusTemporaryRedirect)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Data: "The initial password has been used. Please check the database for the API key"})
-	}
-
-	// Get the password from the form
-	password := c.FormValue("password")
+	selector := c.Query("account")
 
-	// Compare the password with the initial password
-	if password != initialPassword {
-		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid password"})
-	}
+	statuses := []utils.TokenStatus{}
+	for _, provider := range providers {
+		accounts, err := utils.SelectAccounts(callerID(c), provider, selector)
 
-	// Generate an API key.
-	apiKey, err := utils.GenerateAPIKey()
-	if err != nil {
-		log.Printf("Error generating API key: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error generating API key"})
-	}
+		// The account may belong to another provider
+		if errors.Is(err, utils.ErrAccountNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error getting accounts: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting token status"})
+		}
 
-	// Set the API key in Redis with a TTL of 7 days.
-	ttl := 7 * 24 * time.Hour // 7 days in hours
+		if len(accounts) == 0 {
+			statuses = append(statuses, utils.TokenStatus{Provider: provider, Status: utils.TokenStatusNotConnected})
+		}
 
-	// Save the key in the database
-	err = redisclient.Rdb.Set(context.Background(), fmt.Sprintf("apikey_%s", apiKey), apiKey, ttl).Err()
-	if err != nil {
-		log.Printf("Error saving API key: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error saving API key"})
+		for _, account := range accounts {
+			status, err := utils.GetTokenStatus(account)
+			if err != nil {
+				log.Printf("Error getting token status: %v", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting token status"})
+			}
+			statuses = append(statuses, status)
+		}
 	}
 
-	// Set the initial password to an empty string
-	err = redisclient.Rdb.Set(context.Background(), "initial_password", "", 0).Err()
-	if err != nil {
-		log.Printf("Error Deleting the initial password: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error deleting the initial password"})
+	if selector != "" && len(statuses) == 0 {
+		return accountError(c, provider, utils.ErrAccountNotFound)
 	}
 
-	// Return the API key.
-	return c.Status(fiber.StatusOK).JSON(Response{Data: fmt.Sprintf("API key: %s", apiKey)})
+	return c.JSON(statuses)
 }
 
 /*
@@ -348,54 +426,70 @@ func GetAuthSuccess(c *fiber.Ctx) error {
 }
 
 /*
-// * OAuth2 Device Flow
-//  */
-
-// // GetAuthGoogleDevice gets the information for the device flow for Google
-// // @Summary Gets the link and user code for the device flow for Google
-// // @Description Gets the link and user code for the device flow for Google
-// // @Tags OAuth2
-// // @Accept json
-// // @Produce json
-// // @Success 200 {string} string "Please go to https://www.google.com/device and enter the following code xxx-xxx-xxx"
-// // @Failure 500 {string} string "Error loading OAuth2 config"
-// // @Router /v1/auth/oauth/google/device [get]
-// func GetAuthGoogleDevice(c *fiber.Ctx) error {
-
-// 	config, err := utils.GetOAuth2Config("google")
-// 	if err != nil {
-// 		log.Printf("Error getting OAuth2 config: %v", err)
-// 		return c.SendStatus(fiber.StatusInternalServerError)
-// 	}
-
-// 	// Get the URL to visit to authorize the application
-// 	url, deviceCode, err := utils.GenerateOauthURL(config, "google", "Device")
-// 	if err != nil {
-// 		log.Printf("Error getting device flow info: %v", err)
-// 		return c.SendStatus(fiber.StatusInternalServerError)
-// 	}
-
-// 	// Start polling for the token in a non-blocking way
-// 	go func() {
-// 		tok, err := utils.PollToken(config, deviceCode)
-// 		if err != nil {
-// 			log.Println(fmt.Errorf("unable to poll token: %v", err))
-// 			return
-// 		}
-
-// 		// Marshals the token into a JSON object
-// 		tokenJSON, err := json.Marshal(tok)
-// 		if err != nil {
-// 			log.Println(fmt.Errorf("Unable to marshal token: %v", err))
-// 		}
-// 		ttl := 7 * 24 * time.Hour
-// 		err = redisclient.Rdb.Set(context.Background(), "google", tokenJSON, ttl).Err()
-// 		if err != nil {
-// 			log.Println(fmt.Errorf("unable to save the polled token to redis: %w", err))
-// 			return
-// 		}
-// 	}()
-
-// 	// Redirect the user to the authURL
-// 	return c.SendString(url)
-// }
+* OAuth2 Device Flow
+ */
+
+// PostDeviceAuth starts a device authorization flow for the given OAuth2 provider
+// @Summary Start Device Authorization
+// @ID postDeviceAuth
+// @Description This endpoint starts an OAuth2 device authorization flow (RFC 8628) so that an account can be connected from another device, e.g. a phone, without a redirect URL. The user enters the returned user code at the verification URI, the portal polls for the token in the background. The token is saved as the token of the account the user authorized, only if the API key that started the flow is still valid. The tokens of an account that is already connected are only replaced if the flow was started with replace=true, the flow fails otherwise.
+// @Tags OAuth2
+// @Accept json
+// @Produce json
+// @Param provider query string true "Name of the OAuth2 provider (google or outlook)"
+// @Param replace query bool false "Confirms replacing the tokens of the account if it is already connected"
+// @Success 201 {object} deviceflow.Flow "Returns the user code, the verification URI and the ID to check the status of the flow with"
+// @Failure 400 {object} Response "Returns an error message if the provided OAuth2 provider is invalid"
+// @Failure 401 {object} Response "Returns an error message if the request was not made with an API key"
+// @Failure 500 {object} Response "Returns an error message if the device authorization could not be started"
+// @Router /v1/auth/device [post]
+func PostDeviceAuth(c *fiber.Ctx) error {
+
+	provider := c.Query("provider")
+
+	// Check if the provider is valid
+	_, ok := utils.ValidProviders[provider]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
+	}
+
+	// Bind the flow to the caller
+	link, err := callerLink(c, provider)
+	if err != nil {
+		return linkError(c, err)
+	}
+
+	flow, err := deviceflow.Start(link)
+	if err != nil {
+		log.Printf("Error starting device flow: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error starting device authorization"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(flow)
+}
+
+// GetDeviceAuth returns the status of a device authorization flow
+// @Summary Get Device Authorization Status
+// @ID getDeviceAuth
+// @Description This endpoint reports whether the device authorization flow is pending, complete, expired, denied or failed. Flows can be looked up by the user who started them until 10 minutes after their user code expires.
+// @Tags OAuth2
+// @Accept json
+// @Produce json
+// @Param id path string true "ID of the device flow"
+// @Success 200 {object} deviceflow.Flow "Returns the device flow"
+// @Failure 404 {object} Response "Returns an error message if there is no such flow"
+// @Failure 500 {object} Response "Returns an error message if the flow could not be retrieved from Redis"
+// @Router /v1/auth/device/{id} [get]
+func GetDeviceAuth(c *fiber.Ctx) error {
+
+	flow, err := deviceflow.Get(callerID(c), c.Params("id"))
+	if err != nil {
+		if err == redis.Nil {
+			return c.Status(fiber.StatusNotFound).JSON(Response{Error: "Device flow not found or has expired"})
+		}
+		log.Printf("Error getting device flow: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Error getting device flow"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(flow)
+}
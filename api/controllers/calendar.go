@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/url"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/agenda"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/googlecalendar"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/outlook"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetAgenda returns the upcoming events found in the invitations of the synced emails.
+// @Summary Get Agenda
+// @ID getAgenda
+// @Description This endpoint returns the upcoming events the user was invited to by email, soonest first. Invitations that have not been answered are listed as tentative, awaiting response. Cancelled events are left out.
+// @Tags Calendar
+// @Accept json
+// @Produce json
+// @Param account query string false "Only return the events of the invitations received by the connected account with this email"
+// @Success 200 {array} agenda.Item "Returns the agenda"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 500 {object} Response "Returns an error message if the invitations could not be retrieved from Redis"
+// @Router /v1/calendar/agenda [get]
+func GetAgenda(c *fiber.Ctx) error {
+
+	items, err := agenda.GetAgenda(callerID(c), c.Query("account"))
+	if errors.Is(err, utils.ErrAccountNotFound) {
+		return accountError(c, "", err)
+	}
+	if err != nil {
+		log.Printf("Error getting agenda: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve the agenda"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(items)
+}
+
+// invitationEmailID returns the ID of the email carrying the agenda's invitation with the given UID if the account received it, an empty string otherwise
+func invitationEmailID(user string, account string, uid string) string {
+
+	item, err := agenda.GetItem(user, uid)
+	if err != nil {
+		log.Printf("Error getting the invitation %s: %v", uid, err)
+		return ""
+	}
+
+	if item == nil || item.Provider != utils.AccountProvider(account) || item.Account != utils.AccountEmail(account) {
+		return ""
+	}
+
+	return item.EmailID
+}
+
+// PostEventResponse answers a meeting invitation and returns the updated agenda.
+// @Summary Respond to Event
+// @ID postEventResponse
+// @Description This endpoint accepts, tentatively accepts or declines a meeting invitation and notifies the organizer. The answer is recorded in the audit log and the updated agenda is returned, declined events are no longer listed.
+// @Tags Calendar
+// @Accept json
+// @Produce json
+// @Param provider path string true "Name of the calendar provider (google or outlook)"
+// @Param id path string true "UID of the event as listed in the agenda, or the ID of the event in the calendar"
+// @Param account query string false "Email of the account that was invited, required if several accounts of the provider are connected"
+// @Param response body integrations.EventResponse true "Answer (accept, tentative or decline) and an optional comment for the organizer"
+// @Success 200 {object} EventResponseResult "Returns the answer and the updated agenda"
+// @Failure 400 {object} Response "Returns an error message if the provider or the answer is invalid, or if the account is needed"
+// @Failure 401 {object} Response "Returns an error message if the provider is not connected"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 500 {object} Response "Returns an error message if the invitation could not be answered"
+// @Router /v1/calendar/{provider}/events/{id}/respond [post]
+func PostEventResponse(c *fiber.Ctx) error {
+
+	provider := c.Params("provider")
+
+	// UIDs usually contain characters that have to be escaped in the path, e.g. "@"
+	id, err := url.PathUnescape(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid event ID"})
+	}
+
+	var response integrations.EventResponse
+	err = c.BodyParser(&response)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid request body"})
+	}
+
+	err = response.Validate()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	}
+
+	if provider != "google" && provider != "outlook" {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
+	}
+
+	account, ok, err := resolveAccount(c, provider)
+	if !ok {
+		return err
+	}
+
+	// The agenda lists the events by their iCalendar UID, which the path may carry instead of the event ID
+	var uid string
+	switch provider {
+	case "google":
+		uid, err = googlecalendar.RespondToEvent(account, id, response)
+	case "outlook":
+		uid, err = outlook.RespondToEvent(account, id, invitationEmailID(callerID(c), account, id), response)
+	}
+	if uid == "" {
+		uid = id
+	}
+
+	// Every attempt is recorded, including the failed ones
+	entry := utils.AuditEntry{
+		Provider: provider,
+		Account:  utils.AccountName(account),
+		Target:   id,
+		Action:   "respond",
+		Argument: response.Response,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	auditErr := utils.RecordAudit(callerID(c), entry)
+	if auditErr != nil {
+		log.Printf("Error recording audit entry: %v", auditErr)
+	}
+
+	if err != nil {
+		log.Printf("Error responding to %s event %s: %v", provider, id, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to respond to the event"})
+	}
+
+	err = agenda.SaveResponse(callerID(c), uid, response.Response)
+	if err != nil {
+		log.Printf("Error saving event response: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "The invitation was answered but the agenda could not be updated"})
+	}
+
+	items, err := agenda.GetAgenda(callerID(c), "")
+	if err != nil {
+		log.Printf("Error getting agenda: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "The invitation was answered but the agenda could not be retrieved"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(EventResponseResult{Response: response.Response, Agenda: items})
+}
@@ -1,32 +1,202 @@
 package controllers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/classify"
 	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/gmail"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/ingested"
 	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/outlook"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/mailsync"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/todo"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/redis/go-redis/v9"
 )
 
+// getSyncedEmails answers from the email index of the provider's accounts that match the selector, merged newest first.
+// An index is synced first if it has never been populated or if only the emails the caller has not seen are wanted, set caller to an empty string to get every indexed email.
+// The accounts whose emails cannot be read are left out and reported, the error of the first one is returned if none can be read.
+// redis.Nil is returned if the user has not connected the provider.
+func getSyncedEmails(user string, provider string, selector string, caller string) ([]integrations.Email, []integrations.AccountError, error) {
+
+	accounts, err := utils.SelectAccounts(user, provider, selector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(accounts) == 0 {
+		return nil, nil, redis.Nil
+	}
+
+	emails := []integrations.Email{}
+	failed := []integrations.AccountError{}
+	var firstErr error
+
+	for _, account := range accounts {
+		accountEmails, err := getAccountEmails(account, caller)
+		if err != nil {
+			failed = append(failed, mailsync.AccountFailure(account, err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		emails = append(emails, accountEmails...)
+	}
+
+	if len(failed) == len(accounts) {
+		return nil, nil, firstErr
+	}
+
+	integrations.SortNewestFirst(emails)
+
+	return emails, failed, nil
+}
+
+// accountErrorsHeader is the response header listing the accounts left out of a listing, as a JSON array of integrations.AccountError.
+// The body keeps its shape so that the clients reading the emails only are not affected.
+const accountErrorsHeader = "X-Account-Errors"
+
+// reportAccountErrors lists the accounts left out of the listing in the response header
+func reportAccountErrors(c *fiber.Ctx, failed []integrations.AccountError) {
+
+	if len(failed) == 0 {
+		return
+	}
+
+	value, err := json.Marshal(failed)
+	if err != nil {
+		log.Printf("Error marshalling the account errors: %v", err)
+		return
+	}
+
+	c.Set(accountErrorsHeader, string(value))
+}
+
+// getAccountEmails answers from the account's email index, syncing it first if needed
+func getAccountEmails(account string, caller string) ([]integrations.Email, error) {
+
+	synced, err := mailsync.IsSynced(account)
+	if err != nil {
+		return nil, err
+	}
+
+	if caller != "" || !synced {
+		_, err := mailsync.Sync(account)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if caller != "" {
+		return mailsync.GetEmailsSince(account, caller)
+	}
+
+	return mailsync.GetEmails(account)
+}
+
+// sinceLastSyncCaller returns the caller whose unseen emails are wanted if the since_last_sync query parameter is set, an empty string otherwise.
+// Callers are told apart by a hash of their API key so that the key itself is not stored.
+func sinceLastSyncCaller(c *fiber.Ctx) string {
+
+	if !c.QueryBool("since_last_sync") {
+		return ""
+	}
+
+	digest := sha256.Sum256([]byte(c.Get("X-API-KEY")))
+	return hex.EncodeToString(digest[:8])
+}
+
+// resolveAccount returns the single account of the provider connected by the caller's user and selected by the account query parameter.
+// If no account can be resolved, the request is answered and the returned error is the one of sending the answer.
+func resolveAccount(c *fiber.Ctx, provider string) (string, bool, error) {
+
+	account, err := utils.ResolveAccount(callerID(c), provider, c.Query("account"))
+	if err == nil {
+		return account, true, nil
+	}
+
+	return "", false, accountError(c, provider, err)
+}
+
+// accountError answers the request with the status matching the account selection error
+func accountError(c *fiber.Ctx, provider string, err error) error {
+
+	switch {
+	case errors.Is(err, utils.ErrAccountNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(Response{Error: err.Error()})
+	case errors.Is(err, utils.ErrAccountAmbiguous):
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	case err == redis.Nil:
+		return c.Status(fiber.StatusUnauthorized).JSON(Response{Error: fmt.Sprintf("No %s account is connected, please authenticate using provider=%s", provider, provider)})
+	}
+
+	log.Printf("Error resolving %s account: %v", provider, err)
+	return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve the connected accounts"})
+}
+
+// sendEmails answers with the emails filtered by category and scored by priority, with the bulk ones folded into a digest if asked for
+func sendEmails(c *fiber.Ctx, emails []integrations.Email) error {
+
+	categories, err := classify.ParseFilter(c.Query("category"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	}
+
+	emails = classify.Filter(emails, categories)
+
+	if err := prioritizeEmails(c, emails); err != nil {
+		log.Printf("Error scoring emails: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve the priority rules"})
+	}
+
+	if c.QueryBool("digest") {
+		kept, digest := classify.Fold(emails)
+		return c.Status(fiber.StatusOK).JSON(EmailDigest{Emails: kept, Digest: digest})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(emails)
+}
+
 // GetOutlookEmails returns the user's outlook emails.
 // @Summary Get Outlook Emails
 // @ID getOutlookEmails
-// @Description This endpoint retrieves emails from Outlook. If there is an error, it redirects to the Outlook authentication route or returns a server error.
+// @Description This endpoint retrieves emails from Outlook. The emails of every connected Outlook account are merged, newest first, unless one is selected. If there is an error, it redirects to the Outlook authentication route or returns a server error.
 // @Tags Email
 // @Accept json
 // @Produce json
-// @Success 200 {array} integrations.Email "Returns the retrieved emails"
+// @Param account query string false "Only return the emails of the connected account with this email"
+// @Param since_last_sync query bool false "Only return the emails that were not returned to the API key by a previous since_last_sync request"
+// @Param sort query string false "Set to priority to sort the emails by priority score, highest first"
+// @Param category query string false "Only return the emails of the given categories, comma-separated (personal, newsletter, notification, transactional or promotional)"
+// @Param digest query bool false "Fold the newsletters, notifications and promotions into a digest with a line per sender"
+// @Success 200 {array} integrations.Email "Returns the retrieved emails, or an EmailDigest if digest is set"
+// @Failure 400 {object} Response "Returns an error message if a category is invalid"
 // @Failure 500 {Object} Response "Unable to retrieve emails due to server error or token retrieval issue"
 // @Failure 401 {Object} Response "Returns a message if the outlook session has expired"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Header 200 {string} X-Account-Errors "JSON array of the accounts left out because their emails could not be retrieved"
 // @Router /v1/email/outlook [get]
 func GetOutlookEmails(c *fiber.Ctx) error {
 
-	emails, err := outlook.GetEmails()
+	emails, failed, err := getSyncedEmails(callerID(c), "outlook", c.Query("account"), sinceLastSyncCaller(c))
 
 	if err != nil {
 
+		if errors.Is(err, utils.ErrAccountNotFound) {
+			return accountError(c, "outlook", err)
+		}
+
 		// Redis related errors that are not due to the token key not being found
 		if strings.Contains(err.Error(), "redis") && err != redis.Nil {
 			log.Printf("Error getting emails due to redis connection: %v", err)
@@ -45,26 +215,41 @@ func GetOutlookEmails(c *fiber.Ctx) error {
 		// return c.RedirectToRoute("outlook_auth", nil, fiber.StatusTemporaryRedirect)
 		return c.Status(fiber.StatusUnauthorized).JSON(Response{Error: "You gmail session has expired, please re-authenticate using provider=outlook"})
 	}
-	return c.Status(fiber.StatusOK).JSON(emails)
+
+	reportAccountErrors(c, failed)
+
+	return sendEmails(c, emails)
 }
 
 // GetGmailEmails returns the user's Gmail emails.
 // @Summary Get Gmail Emails
 // @ID getGmailEmails
-// @Description This endpoint retrieves emails from Gmail. If there is an error, it redirects to the Google authentication route or returns a server error.
+// @Description This endpoint retrieves emails from Gmail. The emails of every connected Gmail account are merged, newest first, unless one is selected. If there is an error, it redirects to the Google authentication route or returns a server error.
 // @Tags Email
 // @Accept json
 // @Produce json
-// @Success 200 {array} integrations.Email "Returns the retrieved emails"
+// @Param account query string false "Only return the emails of the connected account with this email"
+// @Param since_last_sync query bool false "Only return the emails that were not returned to the API key by a previous since_last_sync request"
+// @Param sort query string false "Set to priority to sort the emails by priority score, highest first"
+// @Param category query string false "Only return the emails of the given categories, comma-separated (personal, newsletter, notification, transactional or promotional)"
+// @Param digest query bool false "Fold the newsletters, notifications and promotions into a digest with a line per sender"
+// @Success 200 {array} integrations.Email "Returns the retrieved emails, or an EmailDigest if digest is set"
+// @Failure 400 {object} Response "Returns an error message if a category is invalid"
 // @Failure 401 {Object} Response "Returns a message if the Gmail session has expired"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
 // @Failure 500 {object} Response "Returns an error message if there is a Redis related error that is not due to the token key not being found"
+// @Header 200 {string} X-Account-Errors "JSON array of the accounts left out because their emails could not be retrieved"
 // @Router /v1/email/google [get]
 func GetGmailEmails(c *fiber.Ctx) error {
 
-	emails, err := gmail.GetEmails()
+	emails, failed, err := getSyncedEmails(callerID(c), "google", c.Query("account"), sinceLastSyncCaller(c))
 
 	if err != nil {
 
+		if errors.Is(err, utils.ErrAccountNotFound) {
+			return accountError(c, "google", err)
+		}
+
 		// Redis related errors that are not due to the token key not being found
 		if strings.Contains(err.Error(), "redis") && err != redis.Nil {
 			log.Printf("Error getting emails due to redis connection: %v", err)
@@ -83,5 +268,364 @@ func GetGmailEmails(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusUnauthorized).JSON(Response{Error: "You gmail session has expired, please re-authenticate using provider=google"})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(emails)
+	reportAccountErrors(c, failed)
+
+	return sendEmails(c, emails)
+}
+
+// GetAllEmails returns the indexed emails of every provider merged, the ingested ones included.
+// @Summary Get All Emails
+// @ID getAllEmails
+// @Description This endpoint returns the indexed emails of the connected Gmail and Outlook accounts along with the ingested emails, merged newest first. Every email carries the provider it was received by.
+// @Tags Email
+// @Accept json
+// @Produce json
+// @Param account query string false "Only return the emails of the connected account with this email, the ingested emails are left out"
+// @Param sort query string false "Set to priority to sort the emails by priority score, highest first"
+// @Param category query string false "Only return the emails of the given categories, comma-separated (personal, newsletter, notification, transactional or promotional)"
+// @Param digest query bool false "Fold the newsletters, notifications and promotions into a digest with a line per sender"
+// @Success 200 {array} integrations.Email "Returns the merged emails, or an EmailDigest if digest is set"
+// @Failure 400 {object} Response "Returns an error message if a category is invalid"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 500 {object} Response "Returns an error message if the emails could not be retrieved from Redis"
+// @Header 200 {string} X-Account-Errors "JSON array of the accounts left out because their emails could not be retrieved"
+// @Router /v1/email [get]
+func GetAllEmails(c *fiber.Ctx) error {
+
+	byProvider, failed, err := mailsync.GetAllEmails(callerID(c), c.Query("account"))
+	if errors.Is(err, utils.ErrAccountNotFound) {
+		return accountError(c, "", err)
+	}
+	if err != nil {
+		log.Printf("Error getting emails: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve emails"})
+	}
+
+	emails := []integrations.Email{}
+	for provider, providerEmails := range byProvider {
+		for _, email := range providerEmails {
+			email.Provider = provider
+			emails = append(emails, email)
+		}
+	}
+
+	integrations.SortNewestFirst(emails)
+
+	reportAccountErrors(c, failed)
+
+	return sendEmails(c, emails)
+}
+
+// GetIngestedEmails returns the emails received through the ingest endpoint.
+// @Summary Get Ingested Emails
+// @ID getIngestedEmails
+// @Description This endpoint retrieves the emails that were forwarded to the portal and are still within the retention period. They are listed along with the Gmail and Outlook emails by /v1/email as well.
+// @Tags Email
+// @Accept json
+// @Produce json
+// @Param sort query string false "Set to priority to sort the emails by priority score, highest first"
+// @Param category query string false "Only return the emails of the given categories, comma-separated (personal, newsletter, notification, transactional or promotional)"
+// @Param digest query bool false "Fold the newsletters, notifications and promotions into a digest with a line per sender"
+// @Success 200 {array} integrations.Email "Returns the retrieved emails, or an EmailDigest if digest is set"
+// @Failure 400 {object} Response "Returns an error message if a category is invalid"
+// @Failure 500 {object} Response "Returns an error message if the emails could not be retrieved from Redis"
+// @Router /v1/email/ingested [get]
+func GetIngestedEmails(c *fiber.Ctx) error {
+
+	emails, err := ingested.GetEmails(callerID(c))
+	if err != nil {
+		log.Printf("Error getting ingested emails: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve ingested emails"})
+	}
+
+	return sendEmails(c, emails)
+}
+
+// GetStructuredData returns the schema.org data embedded in the indexed emails.
+// @Summary Get Structured Data
+// @ID getStructuredData
+// @Description This endpoint returns the flight, hotel, parcel and event reservations embedded as schema.org JSON-LD or microdata in the Gmail, Outlook and ingested emails, newest email first.
+// @Tags Email
+// @Accept json
+// @Produce json
+// @Param type query string false "Only return one schema.org type (FlightReservation, LodgingReservation, ParcelDelivery or EventReservation)"
+// @Param account query string false "Only return the data of the emails of the connected account with this email, the ingested emails are left out"
+// @Success 200 {array} StructuredEmail "Returns the structured data by email"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 500 {object} Response "Returns an error message if the emails could not be retrieved from Redis"
+// @Header 200 {string} X-Account-Errors "JSON array of the accounts left out because their emails could not be retrieved"
+// @Router /v1/email/structured [get]
+func GetStructuredData(c *fiber.Ctx) error {
+
+	emails, failed, err := mailsync.GetAllEmails(callerID(c), c.Query("account"))
+	if errors.Is(err, utils.ErrAccountNotFound) {
+		return accountError(c, "", err)
+	}
+	if err != nil {
+		log.Printf("Error getting emails: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve the emails"})
+	}
+
+	wanted := c.Query("type")
+
+	results := []StructuredEmail{}
+	for provider, providerEmails := range emails {
+		for _, email := range providerEmails {
+			data := []integrations.StructuredData{}
+			for _, item := range email.Structured {
+				if wanted == "" || strings.EqualFold(item.Type, wanted) {
+					data = append(data, item)
+				}
+			}
+
+			if len(data) == 0 {
+				continue
+			}
+
+			results = append(results, StructuredEmail{
+				Provider:         provider,
+				Account:          email.Account,
+				EmailID:          email.ID,
+				Subject:          email.Subject,
+				Sender:           email.Sender,
+				RecievedDateTime: email.RecievedDateTime,
+				Data:             data,
+			})
+		}
+	}
+
+	// The providers are listed in no particular order, so the emails are sorted across them
+	sort.SliceStable(results, func(i, j int) bool {
+		received := func(result StructuredEmail) time.Time {
+			parsed, _ := integrations.Email{RecievedDateTime: result.RecievedDateTime}.ReceivedTime()
+			return parsed
+		}
+		return received(results[i]).After(received(results[j]))
+	})
+
+	reportAccountErrors(c, failed)
+
+	return c.Status(fiber.StatusOK).JSON(results)
+}
+
+// GetActionItems returns the consolidated to-do list of the indexed emails.
+// @Summary Get Action Items
+// @ID getActionItems
+// @Description This endpoint returns the requests, questions addressed to the user and deadlines found in the Gmail, Outlook and ingested emails. The items with a deadline come first, soonest first.
+// @Tags Email
+// @Accept json
+// @Produce json
+// @Param kind query string false "Only return one kind of item (request, question or deadline)"
+// @Param account query string false "Only return the items of the emails of the connected account with this email, the ingested emails are left out"
+// @Success 200 {array} todo.Item "Returns the to-do list"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 500 {object} Response "Returns an error message if the emails could not be retrieved from Redis"
+// @Header 200 {string} X-Account-Errors "JSON array of the accounts left out because their emails could not be retrieved"
+// @Router /v1/email/actions [get]
+func GetActionItems(c *fiber.Ctx) error {
+
+	items, failed, err := todo.GetTodos(callerID(c), c.Query("account"))
+	if errors.Is(err, utils.ErrAccountNotFound) {
+		return accountError(c, "", err)
+	}
+	if err != nil {
+		log.Printf("Error getting action items: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve the action items"})
+	}
+
+	reportAccountErrors(c, failed)
+
+	kind := c.Query("kind")
+	if kind == "" {
+		return c.Status(fiber.StatusOK).JSON(items)
+	}
+
+	filtered := []todo.Item{}
+	for _, item := range items {
+		if strings.EqualFold(item.Kind, kind) {
+			filtered = append(filtered, item)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(filtered)
+}
+
+// PostIngestEmail stores a raw email forwarded to the portal.
+// @Summary Ingest Email
+// @ID postIngestEmail
+// @Description This endpoint accepts a raw RFC 5322 message, or a JSON wrapper with the raw message in one of the raw, email, body-mime or RawEmail fields, and stores it as an ingested email of the caller's user.
+// @Tags Email
+// @Accept plain
+// @Accept json
+// @Produce json
+// @Success 201 {object} integrations.Email "Returns the parsed email"
+// @Failure 400 {object} Response "Returns an error message if the message could not be parsed"
+// @Failure 500 {object} Response "Returns an error message if the email could not be saved in Redis"
+// @Router /v1/email/ingest [post]
+func PostIngestEmail(c *fiber.Ctx) error {
+
+	raw, err := ingested.ExtractRawMessage(c.Get(fiber.HeaderContentType), c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	}
+
+	email, err := ingested.ParseMessage(raw)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	}
+
+	err = ingested.SaveEmail(callerID(c), email)
+	if err != nil {
+		log.Printf("Error saving ingested email: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to save ingested email"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(email)
+}
+
+// PostEmailAction applies an action to an email.
+// @Summary Apply Email Action
+// @ID postEmailAction
+// @Description This endpoint applies one of the mark_read, mark_unread, archive, star, flag, add_label or move_to_folder actions to an email and records it in the audit log.
+// @Tags Email
+// @Accept json
+// @Produce json
+// @Param provider path string true "Name of the email provider (google or outlook)"
+// @Param id path string true "ID of the email"
+// @Param account query string false "Email of the account that received the email, required if several accounts of the provider are connected"
+// @Param action body integrations.EmailAction true "Action to apply. add_label requires label, move_to_folder requires folder"
+// @Success 200 {object} Response "Returns a message confirming the action"
+// @Failure 400 {object} Response "Returns an error message if the provider or the action is invalid, or if the account is needed"
+// @Failure 401 {object} Response "Returns an error message if the provider is not connected"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 500 {object} Response "Returns an error message if the action could not be applied"
+// @Router /v1/email/{provider}/messages/{id}/actions [post]
+func PostEmailAction(c *fiber.Ctx) error {
+
+	provider := c.Params("provider")
+	id := c.Params("id")
+
+	var action integrations.EmailAction
+	err := c.BodyParser(&action)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid request body"})
+	}
+
+	err = action.Validate()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	}
+
+	if provider != "google" && provider != "outlook" {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
+	}
+
+	account, ok, err := resolveAccount(c, provider)
+	if !ok {
+		return err
+	}
+
+	switch provider {
+	case "google":
+		err = gmail.ApplyAction(account, id, action)
+	case "outlook":
+		err = outlook.ApplyAction(account, id, action)
+	}
+
+	// Every attempt is recorded, including the failed ones
+	entry := utils.AuditEntry{
+		Provider: provider,
+		Account:  utils.AccountName(account),
+		Target:   id,
+		Action:   action.Action,
+		Argument: action.Label,
+	}
+	if action.Action == "move_to_folder" {
+		entry.Argument = action.Folder
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	auditErr := utils.RecordAudit(callerID(c), entry)
+	if auditErr != nil {
+		log.Printf("Error recording audit entry: %v", auditErr)
+	}
+
+	if err != nil {
+		log.Printf("Error applying %s to %s email %s: %v", action.Action, provider, id, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to apply the action to the email"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(Response{Data: fmt.Sprintf("Applied %s to the email", action.Action)})
+}
+
+// PostDraft creates a draft reply to an email without sending it.
+// @Summary Create Draft Reply
+// @ID postDraft
+// @Description This endpoint creates a draft reply in the thread of the given email. The draft is not sent, it has to be reviewed and sent from the mail client.
+// @Tags Email
+// @Accept json
+// @Produce json
+// @Param provider path string true "Name of the email provider (google or outlook)"
+// @Param account query string false "Email of the account that received the email, required if several accounts of the provider are connected"
+// @Param draft body integrations.DraftRequest true "ID of the email to reply to, body of the reply and whether to quote the original email"
+// @Success 201 {object} integrations.Draft "Returns the ID of the draft and a link to it"
+// @Failure 400 {object} Response "Returns an error message if the provider or the request body is invalid, or if the account is needed"
+// @Failure 401 {object} Response "Returns an error message if the provider is not connected"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 500 {object} Response "Returns an error message if the draft could not be created"
+// @Router /v1/email/{provider}/drafts [post]
+func PostDraft(c *fiber.Ctx) error {
+
+	provider := c.Params("provider")
+
+	var request integrations.DraftRequest
+	err := c.BodyParser(&request)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid request body"})
+	}
+
+	if request.MessageID == "" || request.Body == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "message_id and body are required"})
+	}
+
+	if provider != "google" && provider != "outlook" {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
+	}
+
+	account, ok, err := resolveAccount(c, provider)
+	if !ok {
+		return err
+	}
+
+	var draft *integrations.Draft
+	switch provider {
+	case "google":
+		draft, err = gmail.CreateDraft(account, request)
+	case "outlook":
+		draft, err = outlook.CreateDraft(account, request)
+	}
+
+	entry := utils.AuditEntry{
+		Provider: provider,
+		Account:  utils.AccountName(account),
+		Target:   request.MessageID,
+		Action:   "create_draft",
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	auditErr := utils.RecordAudit(callerID(c), entry)
+	if auditErr != nil {
+		log.Printf("Error recording audit entry: %v", auditErr)
+	}
+
+	if err != nil {
+		log.Printf("Error creating %s draft for email %s: %v", provider, request.MessageID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to create the draft"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(draft)
 }
@@ -17,3 +17,27 @@ func GetHome(c *fiber.Ctx) error {
 
 	return c.Status(fiber.StatusOK).JSON(Response{Data: "Welcome to the Fiber API"})
 }
+
+// GetLiveness answers the liveness probe.
+// @Summary Liveness Probe
+// @ID getLivez
+// @Description This endpoint returns 200 while the portal is running.
+// @Tags Home
+// @Success 200 "The portal is running"
+// @Router /livez [get]
+func GetLiveness(c *fiber.Ctx) error {
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// GetReadiness answers the readiness probe.
+// @Summary Readiness Probe
+// @ID getReadyz
+// @Description This endpoint returns 200 once the portal accepts requests.
+// @Tags Home
+// @Success 200 "The portal accepts requests"
+// @Router /readyz [get]
+func GetReadiness(c *fiber.Ctx) error {
+
+	return c.SendStatus(fiber.StatusOK)
+}
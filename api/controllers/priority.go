@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"log"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/priority"
+	"github.com/gofiber/fiber/v2"
+)
+
+// prioritizeEmails scores the emails with the user's priority rules and sorts them by priority if sort=priority was asked for
+func prioritizeEmails(c *fiber.Ctx, emails []integrations.Email) error {
+
+	rules, err := priority.GetRules(callerID(c))
+	if err != nil {
+		return err
+	}
+
+	priority.Score(emails, rules, time.Now())
+
+	if c.Query("sort") == "priority" {
+		priority.Sort(emails)
+	}
+
+	return nil
+}
+
+// GetPriorityRules returns the rules used to score the emails.
+// @Summary Get Priority Rules
+// @ID getPriorityRules
+// @Description This endpoint returns the rules used to compute the priority of the emails, the default rules are returned if none were saved.
+// @Tags Priority
+// @Accept json
+// @Produce json
+// @Success 200 {object} priority.Rules "Returns the priority rules"
+// @Failure 500 {object} Response "Returns an error message if the rules could not be retrieved from Redis"
+// @Router /v1/priority/rules [get]
+func GetPriorityRules(c *fiber.Ctx) error {
+
+	rules, err := priority.GetRules(callerID(c))
+	if err != nil {
+		log.Printf("Error getting priority rules: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve the priority rules"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(rules)
+}
+
+// PutPriorityRules replaces the rules used to score the emails.
+// @Summary Update Priority Rules
+// @ID putPriorityRules
+// @Description This endpoint replaces the rules used to compute the priority of the emails: VIP senders, the user's own addresses, keywords, label weights and the weights of direct recipients, copies, thread activity and upcoming deadlines.
+// @Tags Priority
+// @Accept json
+// @Produce json
+// @Param rules body priority.Rules true "Priority rules"
+// @Success 200 {object} priority.Rules "Returns the saved priority rules"
+// @Failure 400 {object} Response "Returns an error message if the rules are invalid"
+// @Failure 500 {object} Response "Returns an error message if the rules could not be saved to Redis"
+// @Router /v1/priority/rules [put]
+func PutPriorityRules(c *fiber.Ctx) error {
+
+	var rules priority.Rules
+	if err := c.BodyParser(&rules); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Unable to parse the priority rules"})
+	}
+
+	if err := rules.Validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	}
+
+	if err := priority.SaveRules(callerID(c), rules); err != nil {
+		log.Printf("Error saving priority rules: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to save the priority rules"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(rules)
+}
+
+// DeletePriorityRules restores the default rules used to score the emails.
+// @Summary Reset Priority Rules
+// @ID deletePriorityRules
+// @Description This endpoint removes the saved priority rules so that the default ones apply again.
+// @Tags Priority
+// @Accept json
+// @Produce json
+// @Success 200 {object} priority.Rules "Returns the default priority rules"
+// @Failure 500 {object} Response "Returns an error message if the rules could not be deleted from Redis"
+// @Router /v1/priority/rules [delete]
+func DeletePriorityRules(c *fiber.Ctx) error {
+
+	if err := priority.ResetRules(callerID(c)); err != nil {
+		log.Printf("Error resetting priority rules: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to reset the priority rules"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(priority.DefaultRules())
+}
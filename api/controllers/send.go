@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/gmail"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/outlook"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/smtprelay"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// senders maps the providers that can send emails to their send function, the relay sends from the configured address whatever the account
+var senders = map[string]func(account string, email integrations.OutgoingEmail) error{
+	"google":  gmail.SendEmail,
+	"outlook": outlook.SendEmail,
+	smtprelay.Provider: func(account string, email integrations.OutgoingEmail) error {
+		return smtprelay.SendEmail(email)
+	},
+}
+
+// sendingAccount returns the account to send the email from, the SMTP relay has no accounts and is identified by its provider name.
+// If no account can be resolved, the request is answered and the returned error is the one of sending the answer.
+func sendingAccount(c *fiber.Ctx, provider string) (string, bool, error) {
+
+	if provider == smtprelay.Provider {
+		return provider, true, nil
+	}
+
+	return resolveAccount(c, provider)
+}
+
+// PostSendPreview validates an email and returns the confirm token needed to send it.
+// @Summary Preview Email
+// @ID postSendPreview
+// @Description This endpoint checks the recipients against the send allowlist and returns a preview of the email with a confirm token. The token is valid for 10 minutes and only for this exact email.
+// @Tags Email
+// @Accept json
+// @Produce json
+// @Param provider path string true "Name of the provider to send the email with (google, outlook or smtp)"
+// @Param account query string false "Email of the account to send from, required if several accounts of the provider are connected"
+// @Param email body integrations.OutgoingEmail true "Email to send"
+// @Success 200 {object} SendPreview "Returns the email, the confirm token and the remaining daily quota"
+// @Failure 400 {object} Response "Returns an error message if the provider or the email is invalid, or if the account is needed"
+// @Failure 401 {object} Response "Returns an error message if the provider is not connected"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 403 {object} Response "Returns an error message if a recipient is not on the send allowlist"
+// @Failure 429 {object} Response "Returns an error message if the daily send quota has been used up"
+// @Failure 500 {object} Response "Returns an error message if the confirm token could not be created"
+// @Router /v1/email/{provider}/send/preview [post]
+func PostSendPreview(c *fiber.Ctx) error {
+
+	provider := c.Params("provider")
+	if _, ok := senders[provider]; !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
+	}
+
+	var email integrations.OutgoingEmail
+	err := c.BodyParser(&email)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid request body"})
+	}
+
+	if email.Subject == "" || email.Body == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "subject and body are required"})
+	}
+
+	err = utils.CheckRecipients(email.Recipients())
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(Response{Error: err.Error()})
+	}
+
+	account, ok, err := sendingAccount(c, provider)
+	if !ok {
+		return err
+	}
+
+	remaining, err := utils.GetRemainingSendQuota(callerID(c))
+	if err != nil {
+		log.Printf("Error getting send quota: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to check the send quota"})
+	}
+
+	if remaining == 0 {
+		return c.Status(fiber.StatusTooManyRequests).JSON(Response{Error: "The daily send quota has been used up"})
+	}
+
+	confirm, err := utils.CreateSendConfirmation(callerID(c), account, email)
+	if err != nil {
+		log.Printf("Error creating send confirmation: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to create the confirm token"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(SendPreview{
+		Email:          email,
+		Confirm:        confirm,
+		ExpiresAt:      time.Now().Add(utils.SendConfirmationTTL).UTC().Format("2006-01-02T15:04:05Z"),
+		RemainingQuota: remaining,
+	})
+}
+
+// PostSend sends an email that was previewed before.
+// @Summary Send Email
+// @ID postSend
+// @Description This endpoint sends an email with the given provider. The email must be identical to the previewed one, sent from the same account, and carry the confirm token returned by the preview endpoint.
+// @Tags Email
+// @Accept json
+// @Produce json
+// @Param provider path string true "Name of the provider to send the email with (google, outlook or smtp)"
+// @Param account query string false "Email of the account to send from, required if several accounts of the provider are connected"
+// @Param email body SendRequest true "Email to send with the confirm token"
+// @Success 200 {object} Response "Returns a message confirming the email was sent"
+// @Failure 400 {object} Response "Returns an error message if the provider, the email or the confirm token is invalid, or if the account is needed"
+// @Failure 401 {object} Response "Returns an error message if the provider is not connected"
+// @Failure 404 {object} Response "Returns an error message if no connected account matches the account"
+// @Failure 403 {object} Response "Returns an error message if a recipient is not on the send allowlist"
+// @Failure 429 {object} Response "Returns an error message if the daily send quota has been used up"
+// @Failure 500 {object} Response "Returns an error message if the email could not be sent"
+// @Router /v1/email/{provider}/send [post]
+func PostSend(c *fiber.Ctx) error {
+
+	provider := c.Params("provider")
+	send, ok := senders[provider]
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid provider"})
+	}
+
+	var request SendRequest
+	err := c.BodyParser(&request)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid request body"})
+	}
+
+	// The allowlist is checked again in case it changed since the preview
+	err = utils.CheckRecipients(request.Recipients())
+	if err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(Response{Error: err.Error()})
+	}
+
+	account, ok, err := sendingAccount(c, provider)
+	if !ok {
+		return err
+	}
+
+	// The quota is reserved first so that the confirm token is kept if the quota has been used up
+	err = utils.ReserveSendQuota(callerID(c))
+	if err == utils.ErrSendQuotaExceeded {
+		return c.Status(fiber.StatusTooManyRequests).JSON(Response{Error: "The daily send quota has been used up"})
+	}
+	if err != nil {
+		log.Printf("Error reserving send quota: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to check the send quota"})
+	}
+
+	confirmed, err := utils.ConsumeSendConfirmation(callerID(c), account, request.OutgoingEmail, request.Confirm)
+	if err != nil || !confirmed {
+		releaseErr := utils.ReleaseSendQuota(callerID(c))
+		if releaseErr != nil {
+			log.Printf("Error releasing send quota: %v", releaseErr)
+		}
+	}
+	if err != nil {
+		log.Printf("Error checking send confirmation: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to check the confirm token"})
+	}
+
+	if !confirmed {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid or expired confirm token, preview the email again to get a new one"})
+	}
+
+	err = send(account, request.OutgoingEmail)
+
+	entry := utils.AuditEntry{
+		Provider: provider,
+		Account:  utils.AccountName(account),
+		Target:   strings.Join(request.Recipients(), ", "),
+		Action:   "send",
+		Argument: request.Subject,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	auditErr := utils.RecordAudit(callerID(c), entry)
+	if auditErr != nil {
+		log.Printf("Error recording audit entry: %v", auditErr)
+	}
+
+	if err != nil {
+		log.Printf("Error sending email with %s: %v", provider, err)
+
+		releaseErr := utils.ReleaseSendQuota(callerID(c))
+		if releaseErr != nil {
+			log.Printf("Error releasing send quota: %v", releaseErr)
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to send the email"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(Response{Data: "Email sent"})
+}
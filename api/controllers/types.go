@@ -1,7 +1,83 @@
 package controllers
 
+import (
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/agenda"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/classify"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/users"
+)
+
 // Response struct
 type Response struct {
 	Data  string `json:"data,omitempty"`
 	Error string `json:"error,omitempty"`
 }
+
+// EmailDigest is returned by the email endpoints when the bulk emails are folded into a digest
+type EmailDigest struct {
+	// Emails are the personal and transactional emails
+	Emails []integrations.Email `json:"emails"`
+	// Digest has a line per sender of newsletters, notifications and promotions
+	Digest []classify.DigestEntry `json:"digest"`
+}
+
+// SendRequest is the body of the send endpoint
+type SendRequest struct {
+	integrations.OutgoingEmail
+	Confirm string `json:"confirm"`
+}
+
+// SendPreview is returned by the send preview endpoint
+type SendPreview struct {
+	Email          integrations.OutgoingEmail `json:"email"`
+	Confirm        string                     `json:"confirm"`
+	ExpiresAt      string                     `json:"expires_at"`
+	RemainingQuota int64                      `json:"remaining_quota"`
+}
+
+// EventResponseResult is returned by the event response endpoint
+type EventResponseResult struct {
+	Response string        `json:"response"`
+	Agenda   []agenda.Item `json:"agenda"`
+}
+
+// StructuredEmail is returned by the structured data endpoint
+type StructuredEmail struct {
+	Provider         string                        `json:"provider"`
+	Account          string                        `json:"account,omitempty"`
+	EmailID          string                        `json:"emailId"`
+	Subject          string                        `json:"subject"`
+	Sender           string                        `json:"sender"`
+	RecievedDateTime string                        `json:"recievedDateTime"`
+	Data             []integrations.StructuredData `json:"data"`
+}
+
+// APIKeyRequest is the body of the API key creation endpoint
+type APIKeyRequest struct {
+	Label  string   `json:"label"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt is when the key stops working, it never does if not set
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// CreatedAPIKey is returned when an API key is created or rotated, the key is not shown again
+type CreatedAPIKey struct {
+	Key    apikeys.Key `json:"key"`
+	APIKey string      `json:"apiKey"`
+}
+
+// InvitationRequest is the body of the invitation endpoint
+type InvitationRequest struct {
+	Name string `json:"name"`
+	// Role is admin or member
+	Role string `json:"role"`
+}
+
+// CreatedInvitation is returned when a user is invited, the enrollment link can be used once
+type CreatedInvitation struct {
+	Invitation     users.Invitation `json:"invitation"`
+	EnrollmentLink string           `json:"enrollmentLink"`
+}
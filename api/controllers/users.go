@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/users"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetUsers lists the users.
+// @Summary List Users
+// @ID getUsers
+// @Description This endpoint lists the users of the portal with their role, oldest first. It needs an admin API key of a user with the admin role.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Success 200 {array} users.User "Returns the users"
+// @Failure 403 {object} Response "Returns an error message if the caller's user is not an admin"
+// @Failure 500 {object} Response "Returns an error message if the users could not be retrieved from Redis"
+// @Router /v1/users [get]
+func GetUsers(c *fiber.Ctx) error {
+
+	list, err := users.List()
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to list the users"})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(list)
+}
+
+// PostInvitation invites a user and returns the enrollment link.
+// @Summary Invite User
+// @ID postInvitation
+// @Description This endpoint invites a user with a name and a role (admin or member). The returned enrollment link can be used once within 7 days, the user is created along with their first API key when it is used. It needs an admin API key of a user with the admin role.
+// @Tags Users
+// @Accept json
+// @Produce json
+// @Param invitation body InvitationRequest true "Name and role of the user"
+// @Success 201 {object} CreatedInvitation "Returns the invitation and its enrollment link"
+// @Failure 400 {object} Response "Returns an error message if the name or the role is invalid"
+// @Failure 403 {object} Response "Returns an error message if the caller's user is not an admin"
+// @Failure 500 {object} Response "Returns an error message if the invitation could not be saved to Redis"
+// @Router /v1/users/invitations [post]
+func PostInvitation(c *fiber.Ctx) error {
+
+	var request InvitationRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Unable to parse the invitation request"})
+	}
+
+	if request.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "A name is required"})
+	}
+
+	if err := users.ValidateRole(request.Role); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: err.Error()})
+	}
+
+	invitation, err := users.Invite(request.Name, request.Role, callerID(c))
+	if err != nil {
+		log.Printf("Error inviting user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to create the invitation"})
+	}
+
+	link, err := users.EnrollmentLink(invitation)
+	if err != nil {
+		log.Printf("Error signing enrollment link: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to create the enrollment link"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(CreatedInvitation{Invitation: invitation, EnrollmentLink: c.BaseURL() + link})
+}
+
+// GetEnrollment returns the page to accept an invitation
+// @Summary Enrollment Page
+// @ID getEnrollment
+// @Description This endpoint is the enrollment link sent to an invited user. It renders a form to accept the invitation, the link must be signed by the portal.
+// @Tags Users
+// @Produce html
+// @Param id path string true "ID of the invitation"
+// @Param expires query string true "Expiry of the signed link"
+// @Param signature query string true "Signature of the link"
+// @Success 200 {string} string "Renders the enrollment form"
+// @Failure 403 {object} Response "Returns an error message if the link is not signed or expired"
+// @Failure 410 {object} Response "Returns an error message if the invitation was used or expired"
+// @Failure 500 {object} Response "Returns an error message if the invitation could not be retrieved from Redis"
+// @Router /v1/users/enroll/{id} [get]
+func GetEnrollment(c *fiber.Ctx) error {
+
+	invitation, err := users.GetInvitation(c.Params("id"))
+	if errors.Is(err, users.ErrInvalidInvitation) {
+		return c.Status(fiber.StatusGone).JSON(Response{Error: err.Error()})
+	}
+	if err != nil {
+		log.Printf("Error getting invitation: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to retrieve the invitation"})
+	}
+
+	// The form posts to its own signed URL, which expires along with the invitation
+	action, err := utils.SignURL(http.MethodPost, users.EnrollmentPath(invitation.ID), time.Until(invitation.ExpiresAt))
+	if err != nil {
+		log.Printf("Error signing enrollment link: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to create the enrollment form"})
+	}
+
+	return c.Render("enroll_form", fiber.Map{
+		"Name":   invitation.Name,
+		"Role":   invitation.Role,
+		"Action": action,
+	})
+}
+
+// PostEnrollment accepts an invitation and returns the first API key of the new user
+// @Summary Enroll
+// @ID postEnrollment
+// @Description This endpoint creates the invited user along with an admin API key without expiry, the other keys of the user can be created with it. A recovery link issues the new key to the existing user instead. The invitation can only be used once.
+// @Tags Users
+// @Produce json
+// @Param id path string true "ID of the invitation"
+// @Param expires query string true "Expiry of the signed link"
+// @Param signature query string true "Signature of the link"
+// @Success 201 {object} Response "Returns the API key of the new user"
+// @Failure 403 {object} Response "Returns an error message if the link is not signed or expired"
+// @Failure 410 {object} Response "Returns an error message if the invitation was used or expired"
+// @Failure 500 {object} Response "Returns an error message if the user or the API key could not be created"
+// @Router /v1/users/enroll/{id} [post]
+func PostEnrollment(c *fiber.Ctx) error {
+
+	user, err := users.Enroll(c.Params("id"))
+	if errors.Is(err, users.ErrInvalidInvitation) {
+		return c.Status(fiber.StatusGone).JSON(Response{Error: err.Error()})
+	}
+	if err != nil {
+		log.Printf("Error enrolling user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to create the user"})
+	}
+
+	// The key only carries the admin scope, the admin role is what lets a user manage the other users
+	_, apiKey, err := apikeys.Create(user.ID, "enrollment", []string{apikeys.ScopeAdmin}, nil)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to create the API key"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(Response{Data: fmt.Sprintf("API key: %s", apiKey)})
+}
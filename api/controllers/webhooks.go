@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/outlook"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/notifications"
+	"github.com/gofiber/fiber/v2"
+)
+
+// PostOutlookNotification handles the change notifications sent by Microsoft Graph.
+// @Summary Outlook Change Notification
+// @ID postOutlookNotification
+// @Description This endpoint answers the validation handshake of Microsoft Graph and enqueues an incremental sync of the Outlook inbox for every genuine change notification.
+// @Tags Webhooks
+// @Accept json
+// @Produce plain
+// @Param validationToken query string false "Token sent by Graph when the subscription is created, it is echoed back as plain text"
+// @Success 200 {string} string "Returns the validation token"
+// @Success 202 {string} string "The notifications were accepted"
+// @Failure 400 {object} Response "Returns an error message if the notifications could not be parsed"
+// @Failure 403 {object} Response "Returns an error message if none of the notifications belongs to the subscription"
+// @Failure 500 {object} Response "Returns an error message if the subscription could not be retrieved from Redis"
+// @Router /v1/webhooks/outlook [post]
+func PostOutlookNotification(c *fiber.Ctx) error {
+
+	// Graph checks that the endpoint is ours by sending a token that has to be echoed back within 10 seconds
+	validationToken := c.Query("validationToken")
+	if validationToken != "" {
+		c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+		return c.Status(fiber.StatusOK).SendString(validationToken)
+	}
+
+	var collection outlook.ChangeNotificationCollection
+	err := c.BodyParser(&collection)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid change notifications"})
+	}
+
+	valid, err := notifications.HandleOutlookNotifications(collection)
+	if err != nil {
+		log.Printf("Error handling Outlook notifications: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to handle the notifications"})
+	}
+
+	if valid == 0 {
+		return c.Status(fiber.StatusForbidden).JSON(Response{Error: "Unknown subscription or client state"})
+	}
+
+	return c.SendStatus(fiber.StatusAccepted)
+}
+
+// PostGmailNotification handles the Gmail push notifications delivered by Pub/Sub.
+// @Summary Gmail Push Notification
+// @ID postGmailNotification
+// @Description This endpoint receives the Pub/Sub push requests of the Gmail watch and enqueues an incremental sync of the Gmail inbox. If push keys are configured, the bearer token attached by Pub/Sub must be signed by one of them.
+// @Tags Webhooks
+// @Accept json
+// @Produce json
+// @Param Authorization header string false "Bearer token signed by Pub/Sub"
+// @Success 204 {string} string "The notification was accepted"
+// @Failure 400 {object} Response "Returns an error message if the push request could not be decoded"
+// @Failure 401 {object} Response "Returns an error message if the bearer token is missing or invalid"
+// @Failure 500 {object} Response "Returns an error message if the push keys could not be loaded"
+// @Router /v1/webhooks/gmail [post]
+func PostGmailNotification(c *fiber.Ctx) error {
+
+	err := notifications.VerifyGmailPush(c.Get(fiber.HeaderAuthorization))
+	if errors.Is(err, notifications.ErrInvalidPushToken) {
+		log.Printf("Rejected Gmail push request: %v", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(Response{Error: "Invalid push token"})
+	}
+	if err != nil {
+		log.Printf("Error verifying Gmail push request: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(Response{Error: "Unable to verify the push request"})
+	}
+
+	notification, err := notifications.DecodeGmailPush(c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(Response{Error: "Invalid push request"})
+	}
+
+	notifications.HandleGmailNotification(notification)
+
+	// Any 2xx status acknowledges the message, otherwise Pub/Sub retries the delivery
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,148 @@
+package middlewares
+
+import (
+	"log"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/users"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The access levels of a route
+const (
+	// AccessPublic routes can be called by anyone, they authenticate the caller themselves if needed (e.g. webhooks)
+	AccessPublic = "public"
+	// AccessAPIKey routes need an API key with the scope of the route
+	AccessAPIKey = "api-key"
+	// AccessAdmin routes need an API key with the admin scope, and the admin role if the route manages the users
+	AccessAdmin = "admin"
+	// AccessSignedURL routes need a URL signed by the portal, see utils.SignURL
+	AccessSignedURL = "signed-url"
+)
+
+// Policy is the access policy of a route
+type Policy struct {
+	Access string
+	// Scope is the scope the API key needs for the api-key and admin access
+	Scope string
+	// Role is the role the owner of the API key needs, any role is accepted if it is empty
+	Role string
+}
+
+// Public returns the policy of the routes anyone can call
+func Public() Policy {
+	return Policy{Access: AccessPublic}
+}
+
+// APIKey returns the policy of the routes that need an API key with the scope
+func APIKey(scope string) Policy {
+	return Policy{Access: AccessAPIKey, Scope: scope}
+}
+
+// Admin returns the policy of the routes that need an admin API key
+func Admin() Policy {
+	return Policy{Access: AccessAdmin, Scope: apikeys.ScopeAdmin}
+}
+
+// UserAdmin returns the policy of the routes that manage the users, they need an admin API key of a user with the admin role
+func UserAdmin() Policy {
+	return Policy{Access: AccessAdmin, Scope: apikeys.ScopeAdmin, Role: users.RoleAdmin}
+}
+
+// SignedURL returns the policy of the routes that need a URL signed by the portal
+func SignedURL() Policy {
+	return Policy{Access: AccessSignedURL}
+}
+
+// routePolicy is the policy of a route, segments of the pattern starting with ":" match any value
+type routePolicy struct {
+	Method  string
+	Pattern string
+	Policy  Policy
+}
+
+// routePolicies is the registry of the policies, filled in when the routes are registered
+var routePolicies []routePolicy
+
+// Router registers the routes along with their access policy
+type Router struct {
+	router fiber.Router
+}
+
+// Protect returns a router registering the routes of the app with their access policy.
+// The routes registered on the app directly have no policy and are denied.
+func Protect(router fiber.Router) Router {
+	return Router{router: router}
+}
+
+// Get registers a GET route with its policy, fiber also answers the HEAD requests with it
+func (r Router) Get(path string, policy Policy, handlers ...fiber.Handler) fiber.Router {
+	r.record(fiber.MethodGet, path, policy)
+	return r.router.Get(path, handlers...)
+}
+
+// Post registers a POST route with its policy
+func (r Router) Post(path string, policy Policy, handlers ...fiber.Handler) fiber.Router {
+	r.record(fiber.MethodPost, path, policy)
+	return r.router.Post(path, handlers...)
+}
+
+// Put registers a PUT route with its policy
+func (r Router) Put(path string, policy Policy, handlers ...fiber.Handler) fiber.Router {
+	r.record(fiber.MethodPut, path, policy)
+	return r.router.Put(path, handlers...)
+}
+
+// Delete registers a DELETE route with its policy
+func (r Router) Delete(path string, policy Policy, handlers ...fiber.Handler) fiber.Router {
+	r.record(fiber.MethodDelete, path, policy)
+	return r.router.Delete(path, handlers...)
+}
+
+// record adds the policy of the route to the registry
+func (r Router) record(method string, path string, policy Policy) {
+	routePolicies = append(routePolicies, routePolicy{Method: method, Pattern: path, Policy: policy})
+}
+
+// PolicyFor returns the policy of the route matching the method and path, false is returned if the route has none
+func PolicyFor(method string, path string) (Policy, bool) {
+
+	// Fiber answers HEAD requests with the GET routes
+	if method == fiber.MethodHead {
+		method = fiber.MethodGet
+	}
+
+	for _, route := range routePolicies {
+		if route.Method == method && matchPath(route.Pattern, path) {
+			return route.Policy, true
+		}
+	}
+
+	return Policy{}, false
+}
+
+// EnforcePolicy denies the requests to routes without a policy and checks the signature of the signed URLs.
+// The API keys are checked by the keyauth middleware, see AuthFilter.
+func EnforcePolicy(c *fiber.Ctx) error {
+
+	policy, ok := PolicyFor(c.Method(), c.Path())
+	if !ok {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Forbidden"})
+	}
+
+	c.Locals("policy", policy)
+
+	if policy.Access == AccessSignedURL {
+		err := utils.VerifySignedURL(c.Method(), c.Path(), c.Query("expires"), c.Query("signature"))
+		if err == utils.ErrInvalidSignature {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Invalid or expired link"})
+		}
+		if err != nil {
+			log.Printf("Error verifying signed URL: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Unable to verify the link"})
+		}
+	}
+
+	return c.Next()
+}
@@ -0,0 +1,51 @@
+package middlewares
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/keyauth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforcePolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	app := fiber.New()
+	app.Use(EnforcePolicy)
+	app.Use(keyauth.New(keyauth.Config{
+		Next:         AuthFilter,
+		KeyLookup:    "header:X-API-KEY",
+		Validator:    ValidateAPIKey,
+		ErrorHandler: APIKeyErrorHandler,
+	}))
+
+	ok := func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) }
+
+	r := Protect(app)
+	r.Get("/test/public", Public(), ok)
+	r.Get("/test/items/:id", APIKey("email:read"), ok)
+	app.Get("/test/unprotected", ok)
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{fiber.MethodGet, "/test/public", fiber.StatusOK},
+		{fiber.MethodHead, "/test/public", fiber.StatusOK},
+		{fiber.MethodGet, "/test/items/1", fiber.StatusUnauthorized},
+		// Registered without a policy
+		{fiber.MethodGet, "/test/unprotected", fiber.StatusForbidden},
+		// Registered for another method
+		{fiber.MethodPost, "/test/public", fiber.StatusForbidden},
+		{fiber.MethodGet, "/test/missing", fiber.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		resp, err := app.Test(httptest.NewRequest(tc.method, tc.path, nil))
+		assert.NoError(err)
+		assert.Equal(tc.status, resp.StatusCode, "%s %s", tc.method, tc.path)
+	}
+}
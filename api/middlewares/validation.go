@@ -1,52 +1,101 @@
 package middlewares
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"time"
+	"strings"
 
-	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/users"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/keyauth"
+	"github.com/redis/go-redis/v9"
 )
 
-var protectedURL = []string{"/v1/email/outlook", "/v1/email/google"}
+// ErrInsufficientScope is returned when the API key is valid but was not granted the scope of the route
+var ErrInsufficientScope = errors.New("the API key does not have the scope required by this route")
 
-// ValidateAPIKey validates the API key
+// ErrInsufficientRole is returned when the API key is valid but its user does not have the role of the route
+var ErrInsufficientRole = errors.New("the user of the API key does not have the role required by this route")
+
+// ValidateAPIKey validates the API key and checks that it has the scope of the route and that its user has the role of the route
 func ValidateAPIKey(c *fiber.Ctx, apiKey string) (bool, error) {
-	// Get the API key from Redis
-	storedKey, err := redisclient.Rdb.Get(context.Background(), fmt.Sprintf("apikey_%s", apiKey)).Result()
+	// Compare the API key from the request with the hash stored in Redis
+	key, err := apikeys.Verify(apiKey)
+	if err == apikeys.ErrInvalidAPIKey {
+		return false, nil
+	}
 	if err != nil {
 		return false, fmt.Errorf("Error getting the API key from Redis: %v", err)
 	}
 
-	// Compare the API key from Redis with the API key from the request
-	if apiKey != storedKey {
-		return false, nil
+	// AuthFilter only lets the routes with a policy through
+	policy, _ := c.Locals("policy").(Policy)
+	if !key.HasScope(policy.Scope) {
+		return false, fmt.Errorf("%w: %s", ErrInsufficientScope, policy.Scope)
 	}
 
-	// If the key is valid, refresh its TTL to 7 days
-	ttl := 7 * 24 * time.Hour
-
-	err = redisclient.Rdb.Expire(context.Background(), fmt.Sprintf("apikey_%s", apiKey), ttl).Err()
+	// The keys of a removed user stop working
+	user, err := users.Get(key.UserID)
+	if err == redis.Nil {
+		return false, nil
+	}
 	if err != nil {
-		return false, fmt.Errorf("error refreshing API key TTL: %v", err)
+		return false, fmt.Errorf("Error getting the user from Redis: %v", err)
+	}
+
+	if policy.Role != "" && user.Role != policy.Role {
+		return false, fmt.Errorf("%w: %s", ErrInsufficientRole, policy.Role)
 	}
 
+	// Make the key and its user available to the handlers
+	c.Locals("apiKey", key)
+	c.Locals("user", user)
+
 	return true, nil
 }
 
-// AuthFilter allows the request to pass through if the request is not one of the protected URLs.
-// False means the request will be blocked. True means the request will be allowed.
+// APIKeyErrorHandler answers with a 403 if the API key lacks the scope or the role of the route, and a 401 otherwise
+func APIKeyErrorHandler(c *fiber.Ctx, err error) error {
+
+	if errors.Is(err, ErrInsufficientScope) || errors.Is(err, ErrInsufficientRole) {
+		return c.Status(fiber.StatusForbidden).SendString(err.Error())
+	}
+
+	return keyauth.ConfigDefault.ErrorHandler(c, err)
+}
+
+// AuthFilter allows the request to pass through if its route does not need an API key.
+// False means the API key will be checked. True means the request will be allowed.
 func AuthFilter(c *fiber.Ctx) bool {
 
-	// Check if the request is one of the protected URLs
-	for _, url := range protectedURL {
-		if c.Path() == url {
-			// Do not allow the request to pass through directly
+	policy, ok := c.Locals("policy").(Policy)
+	if !ok {
+		// EnforcePolicy denied the routes without a policy already, check the key to be safe
+		return false
+	}
+
+	return policy.Access != AccessAPIKey && policy.Access != AccessAdmin
+}
+
+// matchPath checks if the path matches the route pattern segment by segment
+func matchPath(pattern string, path string) bool {
+
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+
+	if len(patternSegments) != len(pathSegments) {
+		return false
+	}
+
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, ":") && pathSegments[i] != "" {
+			continue
+		}
+		if segment != pathSegments[i] {
 			return false
 		}
 	}
 
-	// Otherwise, allow the request to pass through directly
 	return true
 }
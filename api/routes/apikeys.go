@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/gofiber/fiber/v2"
+)
+
+// APIKeyRoutes is the route handler for the API key management API.
+func APIKeyRoutes(app *fiber.App) {
+	r := middlewares.Protect(app)
+
+	r.Get("/v1/auth/apikeys", middlewares.Admin(), controllers.GetAPIKeys).Name("api_keys")
+	r.Post("/v1/auth/apikeys", middlewares.Admin(), controllers.PostAPIKeys).Name("api_key_create")
+	r.Delete("/v1/auth/apikeys/:id", middlewares.Admin(), controllers.DeleteAPIKey).Name("api_key_revoke")
+	r.Post("/v1/auth/apikeys/:id/rotate", middlewares.Admin(), controllers.PostRotateAPIKey).Name("api_key_rotate")
+}
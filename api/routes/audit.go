@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/gofiber/fiber/v2"
+)
+
+// AuditRoutes is the route handler for the audit log API.
+func AuditRoutes(app *fiber.App) {
+	r := middlewares.Protect(app)
+
+	r.Get("/v1/audit", middlewares.APIKey(apikeys.ScopeAuditRead), controllers.GetAuditLog).Name("audit")
+}
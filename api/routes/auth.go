@@ -2,16 +2,21 @@ package routes
 
 import (
 	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
 	"github.com/gofiber/fiber/v2"
 )
 
 // AuthRoutes is the route handler for the calendars API.
 func AuthRoutes(app *fiber.App) {
-	// app.Get("/v1/auth/oauth/google/device", controllers.GetAuthGoogleDevice).Name("google_auth_device")
-	app.Get("/v1/auth/oauth", controllers.GetOAtuh).Name("oauth_auth")
-	app.Get("/v1/auth/oauth/callback", controllers.GetOAuthCallBack).Name("oauth_callback")
-	app.Get("/v1/auth/oauth/refresh", controllers.GetNewTokenFromRefreshToken).Name("oauth_refresh")
-	app.Get("/v1/auth/success", controllers.GetAuthSuccess).Name("oauth_success")
-	app.Get("/v1/auth/internal/apikey", controllers.GetAPIKey).Name("get_api_key")
-	app.Post("/v1/auth/internal/apikey", controllers.PostAPIKey).Name("post_api_key")
+	r := middlewares.Protect(app)
+
+	r.Get("/v1/auth/oauth", middlewares.Admin(), controllers.GetOAtuh).Name("oauth_auth")
+	r.Get("/v1/auth/oauth/start/:state", middlewares.Public(), controllers.GetOAuthStart).Name("oauth_start")
+	r.Get("/v1/auth/oauth/callback", middlewares.Public(), controllers.GetOAuthCallBack).Name("oauth_callback")
+	r.Get("/v1/auth/oauth/refresh", middlewares.Admin(), controllers.GetNewTokenFromRefreshToken).Name("oauth_refresh")
+	r.Get("/v1/auth/oauth/status", middlewares.APIKey(apikeys.ScopeAuthRead), controllers.GetTokenStatus).Name("oauth_status")
+	r.Get("/v1/auth/success", middlewares.Public(), controllers.GetAuthSuccess).Name("oauth_success")
+	r.Post("/v1/auth/device", middlewares.Admin(), controllers.PostDeviceAuth).Name("device_auth")
+	r.Get("/v1/auth/device/:id", middlewares.Admin(), controllers.GetDeviceAuth).Name("device_auth_status")
 }
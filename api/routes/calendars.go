@@ -1,8 +1,16 @@
 package routes
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/gofiber/fiber/v2"
+)
 
 // CalendarRoutes is the route handler for the calendars API.
 func CalendarRoutes(app *fiber.App) {
+	r := middlewares.Protect(app)
 
+	r.Get("/v1/calendar/agenda", middlewares.APIKey(apikeys.ScopeCalendarRead), controllers.GetAgenda).Name("agenda")
+	r.Post("/v1/calendar/:provider/events/:id/respond", middlewares.APIKey(apikeys.ScopeCalendarWrite), controllers.PostEventResponse).Name("event_response")
 }
@@ -2,11 +2,24 @@ package routes
 
 import (
 	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
 	"github.com/gofiber/fiber/v2"
 )
 
 // EmailsRoutes is the route handler for the emails API.
 func EmailsRoutes(app *fiber.App) {
-	app.Get("/v1/email/outlook", controllers.GetOutlookEmails).Name("outlook")
-	app.Get("/v1/email/google", controllers.GetGmailEmails).Name("google")
+	r := middlewares.Protect(app)
+
+	r.Get("/v1/email", middlewares.APIKey(apikeys.ScopeEmailRead), controllers.GetAllEmails).Name("emails")
+	r.Get("/v1/email/outlook", middlewares.APIKey(apikeys.ScopeEmailRead), controllers.GetOutlookEmails).Name("outlook")
+	r.Get("/v1/email/google", middlewares.APIKey(apikeys.ScopeEmailRead), controllers.GetGmailEmails).Name("google")
+	r.Get("/v1/email/ingested", middlewares.APIKey(apikeys.ScopeEmailRead), controllers.GetIngestedEmails).Name("ingested")
+	r.Post("/v1/email/ingest", middlewares.APIKey(apikeys.ScopeEmailWrite), controllers.PostIngestEmail).Name("ingest")
+	r.Get("/v1/email/structured", middlewares.APIKey(apikeys.ScopeEmailRead), controllers.GetStructuredData).Name("structured")
+	r.Get("/v1/email/actions", middlewares.APIKey(apikeys.ScopeEmailRead), controllers.GetActionItems).Name("action_items")
+	r.Post("/v1/email/:provider/messages/:id/actions", middlewares.APIKey(apikeys.ScopeEmailWrite), controllers.PostEmailAction).Name("email_action")
+	r.Post("/v1/email/:provider/drafts", middlewares.APIKey(apikeys.ScopeEmailWrite), controllers.PostDraft).Name("email_draft")
+	r.Post("/v1/email/:provider/send/preview", middlewares.APIKey(apikeys.ScopeEmailSend), controllers.PostSendPreview).Name("email_send_preview")
+	r.Post("/v1/email/:provider/send", middlewares.APIKey(apikeys.ScopeEmailSend), controllers.PostSend).Name("email_send")
 }
@@ -2,10 +2,24 @@ package routes
 
 import (
 	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
 	"github.com/gofiber/fiber/v2"
 )
 
-// HomeRoutes is the route handler for the home page.
+// HomeRoutes is the route handler for the home page and the health checks.
 func HomeRoutes(app *fiber.App) {
-	app.Get("/", controllers.GetHome).Name("home")
+	r := middlewares.Protect(app)
+
+	r.Get("/", middlewares.Public(), controllers.GetHome).Name("home")
+	r.Get("/livez", middlewares.Public(), controllers.GetLiveness).Name("livez")
+	r.Get("/readyz", middlewares.Public(), controllers.GetReadiness).Name("readyz")
+}
+
+// DocsRoutes is the route handler for the Swagger UI and spec served by docs, e.g. swagger.New.
+// It is registered apart since the swagger middleware reads the spec file when it is created.
+func DocsRoutes(app *fiber.App, docs fiber.Handler) {
+	r := middlewares.Protect(app)
+
+	r.Get("/docs", middlewares.Public(), docs).Name("docs")
+	r.Get("/swagger.json", middlewares.Public(), docs).Name("swagger_spec")
 }
@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/gofiber/fiber/v2"
+)
+
+// PriorityRoutes is the route handler for the priority rules API.
+func PriorityRoutes(app *fiber.App) {
+	r := middlewares.Protect(app)
+
+	r.Get("/v1/priority/rules", middlewares.APIKey(apikeys.ScopeSettingsRead), controllers.GetPriorityRules).Name("priority_rules")
+	r.Put("/v1/priority/rules", middlewares.APIKey(apikeys.ScopeSettingsWrite), controllers.PutPriorityRules).Name("priority_rules_update")
+	r.Delete("/v1/priority/rules", middlewares.APIKey(apikeys.ScopeSettingsWrite), controllers.DeletePriorityRules).Name("priority_rules_reset")
+}
@@ -0,0 +1,16 @@
+package routes
+
+import "github.com/gofiber/fiber/v2"
+
+// Register registers the routes of the portal along with their access policy.
+func Register(app *fiber.App) {
+	HomeRoutes(app)
+	EmailsRoutes(app)
+	AuthRoutes(app)
+	CalendarRoutes(app)
+	AuditRoutes(app)
+	PriorityRoutes(app)
+	APIKeyRoutes(app)
+	UserRoutes(app)
+	WebhookRoutes(app)
+}
@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"testing"
+
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEveryRouteHasPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	app := fiber.New()
+	Register(app)
+	DocsRoutes(app, func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+
+	routes := app.GetRoutes(true)
+	assert.NotEmpty(routes)
+
+	// Routes registered on the app directly instead of through middlewares.Protect are denied
+	for _, route := range routes {
+		_, ok := middlewares.PolicyFor(route.Method, route.Path)
+		assert.True(ok, "%s %s has no access policy, register it with middlewares.Protect", route.Method, route.Path)
+	}
+}
+
+func TestProbesAndDocsArePublic(t *testing.T) {
+	assert := assert.New(t)
+
+	app := fiber.New()
+	Register(app)
+	DocsRoutes(app, func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+
+	// The probes and the docs are routes of their own, not middlewares answering before the policies
+	for _, path := range []string{"/livez", "/readyz", "/docs", "/swagger.json"} {
+		policy, ok := middlewares.PolicyFor(fiber.MethodGet, path)
+		assert.True(ok, "%s has no access policy", path)
+		assert.Equal(middlewares.Public(), policy, path)
+	}
+}
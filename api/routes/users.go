@@ -0,0 +1,17 @@
+package routes
+
+import (
+	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/gofiber/fiber/v2"
+)
+
+// UserRoutes is the route handler for the user management API.
+func UserRoutes(app *fiber.App) {
+	r := middlewares.Protect(app)
+
+	r.Get("/v1/users", middlewares.UserAdmin(), controllers.GetUsers).Name("users")
+	r.Post("/v1/users/invitations", middlewares.UserAdmin(), controllers.PostInvitation).Name("user_invite")
+	r.Get("/v1/users/enroll/:id", middlewares.SignedURL(), controllers.GetEnrollment).Name("user_enroll_form")
+	r.Post("/v1/users/enroll/:id", middlewares.SignedURL(), controllers.PostEnrollment).Name("user_enroll")
+}
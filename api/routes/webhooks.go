@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"github.com/algo7/day-planner-gpt-data-portal/api/controllers"
+	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
+	"github.com/gofiber/fiber/v2"
+)
+
+// WebhookRoutes is the route handler for the notifications sent by the providers.
+func WebhookRoutes(app *fiber.App) {
+	r := middlewares.Protect(app)
+
+	r.Post("/v1/webhooks/outlook", middlewares.Public(), controllers.PostOutlookNotification).Name("outlook_webhook")
+	r.Post("/v1/webhooks/gmail", middlewares.Public(), controllers.PostGmailNotification).Name("gmail_webhook")
+}
@@ -1,6 +1,7 @@
 module github.com/algo7/day-planner-gpt-data-portal
 
-go 1.21
+go 1.23.0
+
 toolchain go1.24.1
 
 require (
@@ -10,9 +11,9 @@ require (
 	github.com/gofiber/template/html/v2 v2.1.3
 	github.com/microsoft/kiota-abstractions-go v1.9.1
 	github.com/microsoftgraph/msgraph-sdk-go v1.67.0
-	github.com/microsoftgraph/msgraph-sdk-go-core v1.3.1
 	github.com/redis/go-redis/v9 v9.7.0
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/net v0.37.0
 	golang.org/x/oauth2 v0.28.0
 	google.golang.org/api v0.226.0
 )
@@ -60,6 +61,7 @@ require (
 	github.com/microsoft/kiota-serialization-json-go v1.1.1 // indirect
 	github.com/microsoft/kiota-serialization-multipart-go v1.1.1 // indirect
 	github.com/microsoft/kiota-serialization-text-go v1.1.1 // indirect
+	github.com/microsoftgraph/msgraph-sdk-go-core v1.3.1 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/oklog/ulid v1.3.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
@@ -75,7 +77,6 @@ require (
 	go.opentelemetry.io/otel/metric v1.35.0 // indirect
 	go.opentelemetry.io/otel/trace v1.35.0 // indirect
 	golang.org/x/crypto v0.36.0 // indirect
-	golang.org/x/net v0.37.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250313205543-e70fdf4c4cb4 // indirect
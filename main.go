@@ -1,19 +1,23 @@
 package main
 
 import (
-	"context"
 	"log"
+	"os"
 
 	"github.com/algo7/day-planner-gpt-data-portal/api/middlewares"
 	"github.com/algo7/day-planner-gpt-data-portal/api/routes"
 	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/ingested"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/smtpd"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/mailsync"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/notifications"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/users"
 	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
 	"github.com/gofiber/contrib/swagger"
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/healthcheck"
 	"github.com/gofiber/fiber/v2/middleware/keyauth"
 	"github.com/gofiber/template/html/v2"
-	"github.com/redis/go-redis/v9"
 )
 
 // @title Day Planner GPT Data Portal API
@@ -45,30 +49,144 @@ func main() {
 		log.Fatalf("Error Connecting to Redis Server: %v", err)
 	}
 
-	// Check if the initial password is already set in Redis.
-	err = redisclient.Rdb.Get(context.Background(), "initial_password").Err()
+	// Load the keys encrypting the OAuth tokens in Redis.
+	encrypted, err := utils.LoadEncryptionKeys()
 	if err != nil {
-		// If the initial password is not set in Redis, generate one and set it.
-		if err == redis.Nil {
-			log.Println("Initial Password not set in Redis. Generating...")
+		log.Fatalf("Error Loading the Token Encryption Keys: %v", err)
+	}
+	if !encrypted {
+		log.Println("Warning: TOKEN_ENCRYPTION_KEY is not set, the OAuth tokens are stored in plaintext in Redis.")
+	}
+
+	// Move the refresh tokens saved along with the access tokens to their own keys.
+	err = utils.MigrateTokenStorage()
+	if err != nil {
+		log.Fatalf("Error Migrating the Token Storage: %v", err)
+	}
+
+	// Give the data of earlier versions, which had a single user, to an admin created for it.
+	owner, err := users.LegacyOwner()
+	if err != nil {
+		log.Fatalf("Error Creating the Owner of the Existing Data: %v", err)
+	}
+
+	// Move the tokens saved under the provider's name to the keys of the account they belong to, along with its email index.
+	migrated, err := utils.MigrateAccounts(owner)
+	if err != nil {
+		log.Fatalf("Error Migrating the Accounts: %v", err)
+	}
+	for account, newAccount := range migrated {
+		err = mailsync.MoveIndex(account, newAccount)
+		if err != nil {
+			log.Fatalf("Error Moving the Email Index of %s: %v", account, err)
+		}
+	}
+
+	// Re-encrypt the stored tokens with the first key and exit, e.g. after rotating the key.
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		count, err := utils.ReencryptTokens()
+		if err != nil {
+			log.Fatalf("Error Re-encrypting the Tokens: %v", err)
+		}
+		log.Printf("Re-encrypted %d tokens.", count)
+		return
+	}
+
+	// Encrypt the tokens stored before the key was configured, the tokens in plaintext are rejected from then on.
+	if encrypted {
+		count, err := utils.EncryptPlaintextTokens()
+		if err != nil {
+			log.Fatalf("Error Encrypting the Tokens: %v", err)
+		}
+		if count > 0 {
+			log.Printf("Encrypted %d tokens stored in plaintext.", count)
+		}
+	}
+
+	if owner != "" {
+		// Turn the API keys stored by earlier versions into admin keys of the owner.
+		err = apikeys.Migrate(owner)
+		if err != nil {
+			log.Fatalf("Error Migrating the API Keys: %v", err)
+		}
+
+		err = utils.MigrateUserData(owner)
+		if err != nil {
+			log.Fatalf("Error Migrating the User Data: %v", err)
+		}
+
+		err = users.FinishLegacyMigration()
+		if err != nil {
+			log.Fatalf("Error Finishing the Migration: %v", err)
+		}
+		log.Printf("The existing data was given to the admin user %s.", owner)
+	}
 
-			// Generate an API key as the initial password.
-			apiKey, err := utils.GenerateAPIKey()
+	// Invite the first admin if there are no users yet.
+	list, err := users.List()
+	if err != nil {
+		log.Fatalf("Error Listing the Users: %v", err)
+	}
+	if len(list) == 0 {
+		invitation, err := users.Invite("admin", users.RoleAdmin, "")
+		if err != nil {
+			log.Fatalf("Error Inviting the First Admin: %v", err)
+		}
+
+		link, err := users.EnrollmentLink(invitation)
+		if err != nil {
+			log.Fatalf("Error Signing the Enrollment Link: %v", err)
+		}
+		log.Printf("No users yet. Enroll the first admin at: %s This link can be used once.", link)
+	} else {
+		// The owner of migrated data may have no usable key, e.g. if the initial password was never used or the keys expired.
+		err = recoverAdminAccess()
+		if err != nil {
+			log.Fatalf("Error Checking the Admin API Keys: %v", err)
+		}
+	}
+
+	// Start the embedded SMTP receiver if it is configured.
+	smtpConfig, err := smtpd.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Error Loading the SMTP Receiver Config: %v", err)
+	}
+
+	if smtpConfig != nil {
+		smtpConfig.Deliver = func(raw []byte) error {
+			email, err := ingested.ParseMessage(raw)
 			if err != nil {
-				log.Fatalf("Error Generating the initial password: %v", err)
+				return err
 			}
 
-			// Set the initial password in Redis.
-			err = redisclient.Rdb.Set(context.Background(), "initial_password", apiKey, 0).Err()
-			if err != nil {
-				log.Fatalf("Error Setting the initial password in Redis: %v", err)
+			// The received emails belong to SMTP_INGEST_USER, or to the first admin if it is not set
+			user := os.Getenv("SMTP_INGEST_USER")
+			if user == "" {
+				admin, err := users.FirstAdmin()
+				if err != nil {
+					return err
+				}
+				user = admin.ID
 			}
-			log.Printf("Initial Password: %s This will expire once used.", apiKey)
-		} else {
-			log.Fatalf("Error checking the initial password in Redis: %v", err)
+
+			return ingested.SaveEmail(user, email)
 		}
+
+		go func() {
+			log.Printf("SMTP Receiver listening on %s", smtpConfig.Addr)
+			err := smtpd.NewServer(*smtpConfig).ListenAndServe()
+			if err != nil {
+				log.Fatalf("Error Starting the SMTP Receiver: %v", err)
+			}
+		}()
 	}
 
+	// Refresh the tokens of the connected accounts before they expire.
+	go utils.RunTokenRefresh()
+
+	// Keep the email index of the connected accounts current.
+	go mailsync.Run()
+
 	// Initialize standard Go html template engine
 	engine := html.New("./assets", ".html")
 	engine.Layout("embed") // Optional. Default: "embed"
@@ -84,23 +202,35 @@ func main() {
 		Views:         engine,
 	})
 
+	// Access policy middleware, the routes without a policy are denied
+	app.Use(middlewares.EnforcePolicy)
+
 	// Auth middleware
 	app.Use(keyauth.New(keyauth.Config{
-		Next:      middlewares.AuthFilter,
-		KeyLookup: "header:X-API-KEY",
-		Validator: middlewares.ValidateAPIKey,
+		Next:         middlewares.AuthFilter,
+		KeyLookup:    "header:X-API-KEY",
+		Validator:    middlewares.ValidateAPIKey,
+		ErrorHandler: middlewares.APIKeyErrorHandler,
 	}))
 
-	// Healthcheck middleware /livez and /readyz routes
-	app.Use(healthcheck.New())
+	// Load the routes.
+	routes.Register(app)
 
-	// Swagger middleware
-	app.Use(swagger.New(swagger.ConfigDefault))
+	// Swagger UI and spec
+	routes.DocsRoutes(app, swagger.New(swagger.ConfigDefault))
 
-	// Load the routes.
-	routes.HomeRoutes(app)
-	routes.EmailsRoutes(app)
-	routes.AuthRoutes(app)
+	// Subscribe to Outlook change notifications once the server is listening, Graph validates the endpoint right away.
+	if notifications.OutlookNotificationURL() != "" {
+		app.Hooks().OnListen(func(fiber.ListenData) error {
+			go notifications.RunOutlookRenewal()
+			return nil
+		})
+	}
+
+	// Keep the Gmail watch alive so that Gmail publishes the changes of the inbox.
+	if notifications.GmailPushTopic() != "" {
+		go notifications.RunGmailWatchRenewal()
+	}
 
 	// Start the server.
 	err = app.Listen(":3000")
@@ -108,3 +238,48 @@ func main() {
 		log.Fatalf("Error Starting the Server: %v", err)
 	}
 }
+
+// recoverAdminAccess logs a one-time recovery link for the first admin if no admin has a usable admin API key,
+// so that the instance cannot be locked out.
+func recoverAdminAccess() error {
+
+	list, err := users.List()
+	if err != nil {
+		return err
+	}
+
+	// The users are listed oldest first
+	var admin *users.User
+	for _, user := range list {
+		if !user.IsAdmin() {
+			continue
+		}
+		usable, err := apikeys.HasUsableKey(user.ID, apikeys.ScopeAdmin)
+		if err != nil {
+			return err
+		}
+		if usable {
+			return nil
+		}
+		if admin == nil {
+			admin = &user
+		}
+	}
+
+	if admin == nil {
+		return nil
+	}
+
+	invitation, err := users.InviteRecovery(*admin)
+	if err != nil {
+		return err
+	}
+
+	link, err := users.EnrollmentLink(invitation)
+	if err != nil {
+		return err
+	}
+	log.Printf("No admin has a usable API key. Get a new key for the admin %s at: %s This link can be used once.", admin.ID, link)
+
+	return nil
+}
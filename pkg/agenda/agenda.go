@@ -0,0 +1,289 @@
+package agenda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// StatusTentative is the status of the events the user has not answered yet or tentatively accepted
+const StatusTentative = "tentative"
+
+// StatusConfirmed is the status of the events the user accepted
+const StatusConfirmed = "confirmed"
+
+// ResponseAwaiting is the response of the invitations the user has not answered yet
+const ResponseAwaiting = "awaiting response"
+
+// invitesKey is the redis key of the hash holding the latest invitation of each event by UID, under the prefix of the user
+const invitesKey = "agenda_invites"
+
+// responsesKey is the redis key of the hash holding the user's answers by event UID, under the prefix of the user
+const responsesKey = "agenda_responses"
+
+// responseStates maps the answers to the status and response of the agenda items, declined events are not listed
+var responseStates = map[string][2]string{
+	"accept":    {StatusConfirmed, "accepted"},
+	"tentative": {StatusTentative, "tentative"},
+}
+
+// Item is a struct to hold an event of the agenda
+type Item struct {
+	Provider  string                 `json:"provider"`
+	Account   string                 `json:"account,omitempty"`
+	EmailID   string                 `json:"emailId"`
+	UID       string                 `json:"uid"`
+	Summary   string                 `json:"summary"`
+	Location  string                 `json:"location,omitempty"`
+	Start     time.Time              `json:"start"`
+	End       time.Time              `json:"end"`
+	AllDay    bool                   `json:"allDay,omitempty"`
+	Organizer *integrations.Attendee `json:"organizer,omitempty"`
+	// Status is how the event stands in the agenda
+	Status string `json:"status"`
+	// Response is the user's answer to the invitation
+	Response string `json:"response"`
+}
+
+// invitation is the latest message about an event, kept until the event ends
+type invitation struct {
+	Item Item `json:"item"`
+	// Method is the iTIP method of the message, REQUEST or CANCEL
+	Method   string    `json:"method"`
+	Received time.Time `json:"received"`
+}
+
+// SaveResponse records the user's answer to the invitation with the given UID so that the agenda reflects it right away.
+// The answer is dropped along with the invitation once the event ends.
+func SaveResponse(user string, uid string, response string) error {
+
+	ctx := context.Background()
+
+	err := redisclient.Rdb.HSet(ctx, utils.UserKey(user, responsesKey), uid, response).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save event response to redis: %w", err)
+	}
+
+	return nil
+}
+
+// RecordInvites keeps the invitations found in the emails received by the user's account of the provider until their events end.
+// The agenda is read from them rather than from the email index, which only holds the recent and, for Gmail, the unread emails.
+// The latest message about an event wins, so updated invitations replace the previous ones and cancellations are kept to hide the event.
+func RecordInvites(user string, provider string, account string, emails []integrations.Email) error {
+
+	ctx := context.Background()
+
+	for _, email := range emails {
+		invite := email.Invite
+
+		// Replies are answers of the attendees to the user's own events
+		if invite == nil || (invite.Method != "REQUEST" && invite.Method != "CANCEL") {
+			continue
+		}
+
+		key := invite.UID
+		if key == "" {
+			key = provider + "/" + email.ID
+		}
+
+		received, err := email.ReceivedTime()
+		if err != nil {
+			received = time.Time{}
+		}
+
+		currentJSON, err := redisclient.Rdb.HGet(ctx, userInvitesKey(user), key).Result()
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("Unable to retrieve invitation from redis: %w", err)
+		}
+		if err == nil {
+			var current invitation
+			err = json.Unmarshal([]byte(currentJSON), &current)
+			if err == nil && current.Received.After(received) {
+				continue
+			}
+		}
+
+		inviteJSON, err := json.Marshal(invitation{
+			Method:   invite.Method,
+			Received: received,
+			Item: Item{
+				Provider:  provider,
+				Account:   account,
+				EmailID:   email.ID,
+				UID:       invite.UID,
+				Summary:   invite.Summary,
+				Location:  invite.Location,
+				Start:     invite.Start,
+				End:       invite.End,
+				AllDay:    invite.AllDay,
+				Organizer: invite.Organizer,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to marshal invitation: %w", err)
+		}
+
+		err = redisclient.Rdb.HSet(ctx, userInvitesKey(user), key, inviteJSON).Err()
+		if err != nil {
+			return fmt.Errorf("Unable to save invitation to redis: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// GetAgenda returns the upcoming events the user was invited to and did not decline, soonest first.
+// Only the invitations received by the user's accounts matching the selector are listed if it is set.
+// The invitations of the events that ended are dropped.
+func GetAgenda(user string, selector string) ([]Item, error) {
+
+	ctx := context.Background()
+
+	var selected map[string]bool
+	if selector != "" {
+		accounts, err := utils.SelectAccounts(user, "", selector)
+		if err != nil {
+			return nil, err
+		}
+
+		selected = map[string]bool{}
+		for _, account := range accounts {
+			selected[utils.AccountName(account)] = true
+		}
+	}
+
+	responses, err := redisclient.Rdb.HGetAll(ctx, utils.UserKey(user, responsesKey)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve event responses from redis: %w", err)
+	}
+
+	values, err := redisclient.Rdb.HGetAll(ctx, userInvitesKey(user)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve invitations from redis: %w", err)
+	}
+
+	invitations := map[string]invitation{}
+	for key, value := range values {
+		var invite invitation
+		err = json.Unmarshal([]byte(value), &invite)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to unmarshal invitation: %w", err)
+		}
+		invitations[key] = invite
+	}
+
+	items, ended := buildAgenda(invitations, responses, time.Now())
+
+	if len(ended) > 0 {
+		uids := []string{}
+		for _, key := range ended {
+			if uid := invitations[key].Item.UID; uid != "" {
+				uids = append(uids, uid)
+			}
+		}
+
+		err = redisclient.Rdb.HDel(ctx, userInvitesKey(user), ended...).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to prune invitations in redis: %w", err)
+		}
+
+		if len(uids) > 0 {
+			err = redisclient.Rdb.HDel(ctx, utils.UserKey(user, responsesKey), uids...).Err()
+			if err != nil {
+				return nil, fmt.Errorf("Unable to prune event responses in redis: %w", err)
+			}
+		}
+	}
+
+	if selected == nil {
+		return items, nil
+	}
+
+	selectedItems := []Item{}
+	for _, item := range items {
+		if selected[item.Provider+":"+item.Account] {
+			selectedItems = append(selectedItems, item)
+		}
+	}
+
+	return selectedItems, nil
+}
+
+// GetItem returns the agenda item of the user's invitation with the given UID, or nil if there is none, e.g. because the value is an event ID.
+func GetItem(user string, uid string) (*Item, error) {
+
+	inviteJSON, err := redisclient.Rdb.HGet(context.Background(), userInvitesKey(user), uid).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve invitation from redis: %w", err)
+	}
+
+	var invite invitation
+	err = json.Unmarshal([]byte(inviteJSON), &invite)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal invitation: %w", err)
+	}
+
+	return &invite.Item, nil
+}
+
+// userInvitesKey returns the redis key of the user's invitations, the accounts connected before the portal had several users have no user until they are migrated
+func userInvitesKey(user string) string {
+
+	if user == "" {
+		return invitesKey
+	}
+
+	return utils.UserKey(user, invitesKey)
+}
+
+// buildAgenda turns the kept invitations into agenda items and returns the keys of the invitations whose event ended.
+// Cancelled events are not listed and the answers given through the portal set the status of the items.
+func buildAgenda(invitations map[string]invitation, responses map[string]string, now time.Time) ([]Item, []string) {
+
+	items := []Item{}
+	ended := []string{}
+
+	for key, invite := range invitations {
+		if !invite.Item.End.After(now) {
+			ended = append(ended, key)
+			continue
+		}
+		if invite.Method == "CANCEL" {
+			continue
+		}
+
+		item := invite.Item
+		item.Status, item.Response = StatusTentative, ResponseAwaiting
+
+		if response, ok := responses[item.UID]; ok && item.UID != "" {
+			state, listed := responseStates[response]
+			if !listed {
+				continue
+			}
+			item.Status, item.Response = state[0], state[1]
+		}
+
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Start.Equal(items[j].Start) {
+			return items[i].UID < items[j].UID
+		}
+		return items[i].Start.Before(items[j].Start)
+	})
+	sort.Strings(ended)
+
+	return items, ended
+}
@@ -0,0 +1,122 @@
+package agenda
+
+import (
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildAgenda(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) time.Time { return now.Add(time.Duration(hour) * time.Hour) }
+
+	invitations := map[string]invitation{
+		"planning": {Method: "REQUEST", Item: Item{Provider: "google", EmailID: "2", UID: "planning", Summary: "Planning", Start: at(14), End: at(15)}},
+		"review":   {Method: "REQUEST", Item: Item{Provider: "outlook", EmailID: "A", UID: "review", Summary: "Review", Start: at(11), End: at(12)}},
+		// Cancelled after being sent
+		"standup": {Method: "CANCEL", Item: Item{Provider: "google", EmailID: "4", UID: "standup", Start: at(8), End: at(9)}},
+		// Already over
+		"past": {Method: "REQUEST", Item: Item{Provider: "google", EmailID: "5", UID: "past", Start: at(-2), End: at(-1)}},
+	}
+
+	items, ended := buildAgenda(invitations, map[string]string{}, now)
+
+	assert.Equal([]Item{
+		{Provider: "outlook", EmailID: "A", UID: "review", Summary: "Review", Start: at(11), End: at(12), Status: StatusTentative, Response: ResponseAwaiting},
+		{Provider: "google", EmailID: "2", UID: "planning", Summary: "Planning", Start: at(14), End: at(15), Status: StatusTentative, Response: ResponseAwaiting},
+	}, items)
+	assert.Equal([]string{"past"}, ended)
+
+	// Accepted events are confirmed and declined ones leave the agenda
+	items, _ = buildAgenda(invitations, map[string]string{"review": "decline", "planning": "accept"}, now)
+
+	assert.Equal([]Item{
+		{Provider: "google", EmailID: "2", UID: "planning", Summary: "Planning", Start: at(14), End: at(15), Status: StatusConfirmed, Response: "accepted"},
+	}, items)
+}
+
+func TestRecordInvites(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	start := time.Date(2024, 1, 3, 9, 0, 0, 0, time.UTC)
+	emails := []integrations.Email{
+		{ID: "1", RecievedDateTime: "2024-01-01T08:00:00Z", Invite: &integrations.Invite{Method: "REQUEST", UID: "planning", Summary: "Planning", Start: start, End: start.Add(time.Hour)}},
+		// An older copy of an invitation that was updated since
+		{ID: "2", RecievedDateTime: "2024-01-01T08:00:00Z", Invite: &integrations.Invite{Method: "REQUEST", UID: "review", Start: start, End: start.Add(time.Hour)}},
+		// An attendee answered one of the user's events
+		{ID: "3", RecievedDateTime: "2024-01-01T08:00:00Z", Invite: &integrations.Invite{Method: "REPLY", UID: "mine", Start: start, End: start.Add(time.Hour)}},
+		// Not an invitation
+		{ID: "4", RecievedDateTime: "2024-01-01T08:00:00Z"},
+	}
+
+	mock.ExpectHGet("user_u1:agenda_invites", "planning").RedisNil()
+	mock.ExpectHSet("user_u1:agenda_invites", "planning", []byte(`{"item":{"provider":"google","account":"jane@example.com","emailId":"1","uid":"planning","summary":"Planning","start":"2024-01-03T09:00:00Z","end":"2024-01-03T10:00:00Z","status":"","response":""},"method":"REQUEST","received":"2024-01-01T08:00:00Z"}`)).SetVal(1)
+	mock.ExpectHGet("user_u1:agenda_invites", "review").SetVal(`{"item":{"uid":"review"},"method":"REQUEST","received":"2024-01-01T09:00:00Z"}`)
+
+	assert.NoError(RecordInvites("u1", "google", "jane@example.com", emails))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestSaveResponse(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectHSet("user_u1:agenda_responses", "planning", "accept").SetVal(1)
+
+	assert.NoError(SaveResponse("u1", "planning", "accept"))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestGetAgendaPrunesEndedEvents(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectHGetAll("user_u1:agenda_responses").SetVal(map[string]string{"past": "accept"})
+	mock.ExpectHGetAll("user_u1:agenda_invites").SetVal(map[string]string{
+		"past": `{"item":{"provider":"google","uid":"past","start":"2024-01-01T09:00:00Z","end":"2024-01-01T10:00:00Z"},"method":"REQUEST"}`,
+	})
+	mock.ExpectHDel("user_u1:agenda_invites", "past").SetVal(1)
+	mock.ExpectHDel("user_u1:agenda_responses", "past").SetVal(1)
+
+	items, err := GetAgenda("u1", "")
+	assert.NoError(err)
+	assert.Empty(items)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestGetItem(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectHGet("user_u1:agenda_invites", "planning").SetVal(`{"item":{"provider":"outlook","account":"jane@example.com","emailId":"AAMk","uid":"planning"},"method":"REQUEST"}`)
+	mock.ExpectHGet("user_u1:agenda_invites", "AAMkEvent").RedisNil()
+
+	item, err := GetItem("u1", "planning")
+	assert.NoError(err)
+	assert.Equal(&Item{Provider: "outlook", Account: "jane@example.com", EmailID: "AAMk", UID: "planning"}, item)
+
+	// Event IDs are not listed in the agenda
+	item, err = GetItem("u1", "AAMkEvent")
+	assert.NoError(err)
+	assert.Nil(item)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
@@ -0,0 +1,533 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// The scopes that can be granted to an API key
+const (
+	ScopeEmailRead     = "email:read"
+	ScopeEmailWrite    = "email:write"
+	ScopeEmailSend     = "email:send"
+	ScopeCalendarRead  = "calendar:read"
+	ScopeCalendarWrite = "calendar:write"
+	ScopeAuditRead     = "audit:read"
+	ScopeSettingsRead  = "settings:read"
+	ScopeSettingsWrite = "settings:write"
+	ScopeAuthRead      = "auth:read"
+	// ScopeAdmin grants every scope, the API keys included
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists the valid scopes
+var Scopes = []string{
+	ScopeEmailRead,
+	ScopeEmailWrite,
+	ScopeEmailSend,
+	ScopeCalendarRead,
+	ScopeCalendarWrite,
+	ScopeAuditRead,
+	ScopeSettingsRead,
+	ScopeSettingsWrite,
+	ScopeAuthRead,
+	ScopeAdmin,
+}
+
+// indexKey is the redis set of the IDs of the API keys, under the prefix of their user.
+// The keys themselves are stored globally since the user is only known once the key is looked up.
+const indexKey = "apikeys"
+
+// ErrInvalidAPIKey is returned when the API key does not exist, was revoked or expired
+var ErrInvalidAPIKey = errors.New("invalid or expired API key")
+
+// ErrInvalidExpiry is returned when the expiry of a new API key is not in the future
+var ErrInvalidExpiry = errors.New("the expiry must be in the future")
+
+// Key is a struct to hold the metadata of an API key, the key itself is only known when it is created
+type Key struct {
+	ID string `json:"id"`
+	// UserID is the ID of the user the key belongs to, it acts on the user's data only
+	UserID     string     `json:"userId"`
+	Label      string     `json:"label"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	// ExpiresAt is when the key stops working, it never does if not set
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	hash      string
+}
+
+// HasScope checks if the key was granted the scope, admin keys have every scope
+func (k Key) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, ScopeAdmin) || slices.Contains(k.Scopes, scope)
+}
+
+// keyID returns the ID of the API key, a digest of it so that the key can be looked up without being stored
+func keyID(apiKey string) string {
+	digest := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(digest[:8])
+}
+
+// redisKey returns the redis key of the API key with the given ID
+func redisKey(id string) string {
+	return fmt.Sprintf("apikey_%s", id)
+}
+
+// userIndexKey returns the redis key of the set of the IDs of the user's API keys
+func userIndexKey(user string) string {
+	return utils.UserKey(user, indexKey)
+}
+
+// ValidateScopes checks that the scopes are known, at least one is required
+func ValidateScopes(scopes []string) error {
+
+	if len(scopes) == 0 {
+		return fmt.Errorf("At least one scope is required")
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return fmt.Errorf("Invalid scope %q, valid scopes are %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Create generates a new API key of the user with the label, scopes and optional expiry.
+// The key is returned along with its metadata, only its salted hash is stored.
+func Create(user string, label string, scopes []string, expiresAt *time.Time) (Key, string, error) {
+
+	if err := ValidateScopes(scopes); err != nil {
+		return Key{}, "", err
+	}
+
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return Key{}, "", ErrInvalidExpiry
+	}
+
+	apiKey, err := utils.GenerateAPIKey()
+	if err != nil {
+		return Key{}, "", fmt.Errorf("Unable to generate API key: %w", err)
+	}
+
+	hash, err := hashAPIKey(apiKey)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	key := Key{
+		ID:        keyID(apiKey),
+		UserID:    user,
+		Label:     label,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+		hash:      hash,
+	}
+
+	err = saveKey(key)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	return key, apiKey, nil
+}
+
+// Verify returns the metadata of the API key and records its use, ErrInvalidAPIKey is returned if it is not valid
+func Verify(apiKey string) (Key, error) {
+
+	key, err := Get(keyID(apiKey))
+	if err == redis.Nil {
+		return Key{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	saltHex, hashHex, _ := strings.Cut(key.hash, ":")
+	salt, saltErr := hex.DecodeString(saltHex)
+	hash, hashErr := hex.DecodeString(hashHex)
+	if saltErr != nil || hashErr != nil || subtle.ConstantTimeCompare(hash, saltedHash(salt, apiKey)) != 1 {
+		return Key{}, ErrInvalidAPIKey
+	}
+
+	// Redis removes expired keys lazily
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return Key{}, ErrInvalidAPIKey
+	}
+
+	now := time.Now().UTC()
+	key.LastUsedAt = &now
+
+	err = redisclient.Rdb.HSet(context.Background(), redisKey(key.ID), "lastUsedAt", now.Format(time.RFC3339Nano)).Err()
+	if err != nil {
+		return Key{}, fmt.Errorf("Unable to save API key last use to redis: %w", err)
+	}
+
+	return key, nil
+}
+
+// Authorize returns the API key with the given ID if it is still valid and has the scope, ErrInvalidAPIKey is returned otherwise.
+// It checks the key that started a flow completed without it, e.g. an OAuth callback.
+func Authorize(id string, scope string) (Key, error) {
+
+	key, err := Get(id)
+	if err == redis.Nil {
+		return Key{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	// Redis removes expired keys lazily
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return Key{}, ErrInvalidAPIKey
+	}
+
+	if !key.HasScope(scope) {
+		return Key{}, ErrInvalidAPIKey
+	}
+
+	return key, nil
+}
+
+// Get returns the metadata of the API key with the given ID, redis.Nil is returned if there is no such key
+func Get(id string) (Key, error) {
+
+	fields, err := redisclient.Rdb.HGetAll(context.Background(), redisKey(id)).Result()
+	if err != nil {
+		return Key{}, fmt.Errorf("Unable to retrieve API key from redis: %w", err)
+	}
+
+	if len(fields) == 0 {
+		return Key{}, redis.Nil
+	}
+
+	key := Key{
+		ID:     id,
+		UserID: fields["user"],
+		Label:  fields["label"],
+		Scopes: strings.Split(fields["scopes"], ","),
+		hash:   fields["hash"],
+	}
+
+	key.CreatedAt, _ = time.Parse(time.RFC3339Nano, fields["createdAt"])
+
+	if lastUsedAt, err := time.Parse(time.RFC3339Nano, fields["lastUsedAt"]); err == nil {
+		key.LastUsedAt = &lastUsedAt
+	}
+
+	if expiresAt, err := time.Parse(time.RFC3339Nano, fields["expiresAt"]); err == nil {
+		key.ExpiresAt = &expiresAt
+	}
+
+	return key, nil
+}
+
+// List returns the metadata of the user's API keys, oldest first
+func List(user string) ([]Key, error) {
+
+	ids, err := redisclient.Rdb.SMembers(context.Background(), userIndexKey(user)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve API keys from redis: %w", err)
+	}
+
+	keys := []Key{}
+	for _, id := range ids {
+		key, err := Get(id)
+		if err == redis.Nil {
+			// The key expired
+			err = redisclient.Rdb.SRem(context.Background(), userIndexKey(user), id).Err()
+			if err != nil {
+				return nil, fmt.Errorf("Unable to remove expired API key from redis: %w", err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	slices.SortFunc(keys, func(a, b Key) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	return keys, nil
+}
+
+// HasUsableKey checks if the user has an API key with the scope that has not expired
+func HasUsableKey(user string, scope string) (bool, error) {
+
+	keys, err := List(user)
+	if err != nil {
+		return false, err
+	}
+
+	for _, key := range keys {
+		if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+			continue
+		}
+		if key.HasScope(scope) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Revoke deletes the user's API key with the given ID, redis.Nil is returned if the user has no such key
+func Revoke(user string, id string) error {
+
+	// The keys of other users are not revealed
+	key, err := Get(id)
+	if err == nil && key.UserID != user {
+		return redis.Nil
+	}
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	deleted, err := redisclient.Rdb.Del(context.Background(), redisKey(id)).Result()
+	if err != nil {
+		return fmt.Errorf("Unable to delete API key from redis: %w", err)
+	}
+
+	err = redisclient.Rdb.SRem(context.Background(), userIndexKey(user), id).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to remove API key from redis: %w", err)
+	}
+
+	if deleted == 0 {
+		return redis.Nil
+	}
+
+	return nil
+}
+
+// Rotate replaces the user's API key with the given ID by a new one with the same label, scopes and expiry.
+// The old key stops working right away, redis.Nil is returned if the user has no such key.
+func Rotate(user string, id string) (Key, string, error) {
+
+	old, err := Get(id)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	// An expired key cannot be rotated into a valid one, and the keys of other users are not revealed
+	if (old.ExpiresAt != nil && time.Now().After(*old.ExpiresAt)) || old.UserID != user {
+		return Key{}, "", redis.Nil
+	}
+
+	key, apiKey, err := Create(user, old.Label, old.Scopes, old.ExpiresAt)
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	err = Revoke(user, id)
+	if err != nil && err != redis.Nil {
+		return Key{}, "", err
+	}
+
+	return key, apiKey, nil
+}
+
+// Migrate gives the API keys stored by earlier versions, which had a single user, to the owner.
+// The keys stored in plaintext or as a bare salted hash are turned into admin keys without expiry.
+func Migrate(owner string) error {
+
+	ctx := context.Background()
+
+	ids, err := redisclient.Rdb.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve API keys from redis: %w", err)
+	}
+
+	for _, id := range ids {
+		key, err := Get(id)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		key.UserID = owner
+		err = saveKey(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = redisclient.Rdb.Del(ctx, indexKey).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to delete API keys from redis: %w", err)
+	}
+
+	iter := redisclient.Rdb.Scan(ctx, 0, "apikey_*", 100).Iterator()
+	for iter.Next(ctx) {
+		name := iter.Val()
+
+		// Keys stored by this version are hashes
+		keyType, err := redisclient.Rdb.Type(ctx, name).Result()
+		if err != nil {
+			return fmt.Errorf("Unable to check API key type in redis: %w", err)
+		}
+		if keyType != "string" {
+			continue
+		}
+
+		stored, err := redisclient.Rdb.Get(ctx, name).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to retrieve API key from redis: %w", err)
+		}
+
+		key := Key{
+			ID:        strings.TrimPrefix(name, "apikey_"),
+			UserID:    owner,
+			Label:     "migrated",
+			Scopes:    []string{ScopeAdmin},
+			CreatedAt: time.Now().UTC(),
+			hash:      stored,
+		}
+
+		// Plaintext keys were stored as apikey_<key> -> <key>
+		if stored == key.ID {
+			key.ID = keyID(stored)
+			key.hash, err = hashAPIKey(stored)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Keys that expired when left unused keep their remaining lifetime
+		ttl, err := redisclient.Rdb.PTTL(ctx, name).Result()
+		if err != nil {
+			return fmt.Errorf("Unable to retrieve API key expiry from redis: %w", err)
+		}
+		if ttl > 0 {
+			expiresAt := time.Now().Add(ttl).UTC()
+			key.ExpiresAt = &expiresAt
+		}
+
+		err = migrateKey(name, key)
+		if err != nil {
+			return err
+		}
+
+		expiry := "no expiry"
+		if key.ExpiresAt != nil {
+			expiry = "expiry " + key.ExpiresAt.Format(time.RFC3339)
+		}
+		log.Printf("Migrated the API key %s, it has the admin scope and %s", key.ID, expiry)
+	}
+
+	err = iter.Err()
+	if err != nil {
+		return fmt.Errorf("Unable to scan API keys in redis: %w", err)
+	}
+
+	return nil
+}
+
+// migrateKey saves the key in place of the legacy string key and only deletes the legacy key once the key is saved.
+// A bare hash is stored under the same redis key, so it is moved aside first and moved back when the save fails.
+func migrateKey(name string, key Key) error {
+
+	ctx := context.Background()
+
+	legacy := name
+	if name == redisKey(key.ID) {
+		legacy = "legacy_" + name
+		err := redisclient.Rdb.Rename(ctx, name, legacy).Err()
+		if err != nil {
+			return fmt.Errorf("Unable to move the legacy API key in redis: %w", err)
+		}
+	}
+
+	err := saveKey(key)
+	if err != nil {
+		if legacy != name {
+			redisclient.Rdb.Del(ctx, name)
+			redisclient.Rdb.Rename(ctx, legacy, name)
+		}
+		return err
+	}
+
+	err = redisclient.Rdb.Del(ctx, legacy).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to delete the legacy API key from redis: %w", err)
+	}
+
+	return nil
+}
+
+// saveKey saves the metadata and the hash of the API key, it expires along with the key
+func saveKey(key Key) error {
+
+	ctx := context.Background()
+
+	fields := map[string]interface{}{
+		"user":      key.UserID,
+		"label":     key.Label,
+		"scopes":    strings.Join(key.Scopes, ","),
+		"createdAt": key.CreatedAt.Format(time.RFC3339Nano),
+		"hash":      key.hash,
+	}
+	if key.ExpiresAt != nil {
+		fields["expiresAt"] = key.ExpiresAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	err := redisclient.Rdb.HSet(ctx, redisKey(key.ID), fields).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save API key to redis: %w", err)
+	}
+
+	if key.ExpiresAt != nil {
+		err = redisclient.Rdb.ExpireAt(ctx, redisKey(key.ID), *key.ExpiresAt).Err()
+		if err != nil {
+			return fmt.Errorf("Unable to set API key expiry in redis: %w", err)
+		}
+	}
+
+	err = redisclient.Rdb.SAdd(ctx, userIndexKey(key.UserID), key.ID).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to index API key in redis: %w", err)
+	}
+
+	return nil
+}
+
+// hashAPIKey returns the salted hash of the API key as <hex salt>:<hex hash>
+func hashAPIKey(apiKey string) (string, error) {
+
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate API key salt: %w", err)
+	}
+
+	return fmt.Sprintf("%s:%s", hex.EncodeToString(salt), hex.EncodeToString(saltedHash(salt, apiKey))), nil
+}
+
+// saltedHash hashes the API key with the salt
+func saltedHash(salt []byte, apiKey string) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, salt...), apiKey...))
+	return hash[:]
+}
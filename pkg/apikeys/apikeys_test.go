@@ -0,0 +1,237 @@
+package apikeys
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// anyArgs matches the commands whose arguments are random, e.g. the salted hash
+func anyArgs(expected, actual []interface{}) error { return nil }
+
+func TestValidateScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateScopes([]string{ScopeEmailRead, ScopeCalendarWrite}))
+	assert.Error(ValidateScopes(nil))
+	assert.Error(ValidateScopes([]string{"email:delete"}))
+}
+
+func TestHasScope(t *testing.T) {
+	assert := assert.New(t)
+
+	key := Key{Scopes: []string{ScopeEmailRead}}
+	assert.True(key.HasScope(ScopeEmailRead))
+	assert.False(key.HasScope(ScopeEmailSend))
+
+	admin := Key{Scopes: []string{ScopeAdmin}}
+	assert.True(admin.HasScope(ScopeEmailSend))
+}
+
+func TestCreateAndVerify(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	expiresAt := time.Now().Add(24 * time.Hour).UTC()
+
+	mock.CustomMatch(anyArgs).ExpectHSet("apikey_id", "user", "", "label", "", "scopes", "", "createdAt", "", "hash", "", "expiresAt", "").SetVal(6)
+	mock.CustomMatch(anyArgs).ExpectExpireAt("apikey_id", expiresAt).SetVal(true)
+	mock.CustomMatch(anyArgs).ExpectSAdd("user_u1:apikeys", "id").SetVal(1)
+
+	key, apiKey, err := Create("u1", "assistant", []string{ScopeEmailRead}, &expiresAt)
+	assert.NoError(err)
+	assert.Len(apiKey, 64)
+	assert.Equal(keyID(apiKey), key.ID)
+	assert.NotContains(key.hash, apiKey)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+
+	stored := map[string]string{
+		"user":      "u1",
+		"label":     "assistant",
+		"scopes":    "email:read",
+		"createdAt": key.CreatedAt.Format(time.RFC3339Nano),
+		"expiresAt": expiresAt.Format(time.RFC3339Nano),
+		"hash":      key.hash,
+	}
+
+	mock.ExpectHGetAll(redisKey(key.ID)).SetVal(stored)
+	mock.CustomMatch(anyArgs).ExpectHSet(redisKey(key.ID), "lastUsedAt", "").SetVal(1)
+
+	verified, err := Verify(apiKey)
+	assert.NoError(err)
+	assert.Equal("assistant", verified.Label)
+	assert.Equal("u1", verified.UserID)
+	assert.Equal([]string{ScopeEmailRead}, verified.Scopes)
+	assert.NotNil(verified.LastUsedAt)
+
+	// Another key with the same ID is not accepted
+	mock.ExpectHGetAll(redisKey(key.ID)).SetVal(map[string]string{"hash": "00:00", "scopes": "admin"})
+	_, err = Verify(apiKey)
+	assert.Equal(ErrInvalidAPIKey, err)
+
+	mock.ExpectHGetAll(redisKey(keyID("unknown"))).SetVal(map[string]string{})
+	_, err = Verify("unknown")
+	assert.Equal(ErrInvalidAPIKey, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+
+	past := time.Now().Add(-time.Minute)
+	_, _, err = Create("u1", "expired", []string{ScopeEmailRead}, &past)
+	assert.ErrorIs(err, ErrInvalidExpiry)
+}
+
+func TestAuthorize(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339Nano)
+
+	mock.ExpectHGetAll("apikey_admin").SetVal(map[string]string{"label": "initial", "scopes": "admin"})
+	key, err := Authorize("admin", ScopeAdmin)
+	assert.NoError(err)
+	assert.Equal("initial", key.Label)
+
+	mock.ExpectHGetAll("apikey_reader").SetVal(map[string]string{"label": "assistant", "scopes": "email:read"})
+	_, err = Authorize("reader", ScopeAdmin)
+	assert.Equal(ErrInvalidAPIKey, err)
+
+	mock.ExpectHGetAll("apikey_expired").SetVal(map[string]string{"label": "old", "scopes": "admin", "expiresAt": past})
+	_, err = Authorize("expired", ScopeAdmin)
+	assert.Equal(ErrInvalidAPIKey, err)
+
+	mock.ExpectHGetAll("apikey_revoked").SetVal(map[string]string{})
+	_, err = Authorize("revoked", ScopeAdmin)
+	assert.Equal(ErrInvalidAPIKey, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestHasUsableKey(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339Nano)
+
+	// An expired admin key and a key without the admin scope
+	mock.ExpectSMembers("user_u1:apikeys").SetVal([]string{"expired", "reader"})
+	mock.ExpectHGetAll("apikey_expired").SetVal(map[string]string{"user": "u1", "scopes": "admin", "expiresAt": past})
+	mock.ExpectHGetAll("apikey_reader").SetVal(map[string]string{"user": "u1", "scopes": "email:read"})
+
+	usable, err := HasUsableKey("u1", ScopeAdmin)
+	assert.NoError(err)
+	assert.False(usable)
+
+	mock.ExpectSMembers("user_u1:apikeys").SetVal([]string{"admin"})
+	mock.ExpectHGetAll("apikey_admin").SetVal(map[string]string{"user": "u1", "scopes": "admin"})
+
+	usable, err = HasUsableKey("u1", ScopeAdmin)
+	assert.NoError(err)
+	assert.True(usable)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestRevoke(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectHGetAll("apikey_abc").SetVal(map[string]string{"user": "u1", "scopes": "admin"})
+	mock.ExpectDel("apikey_abc").SetVal(1)
+	mock.ExpectSRem("user_u1:apikeys", "abc").SetVal(1)
+	assert.NoError(Revoke("u1", "abc"))
+
+	mock.ExpectHGetAll("apikey_missing").SetVal(map[string]string{})
+	mock.ExpectDel("apikey_missing").SetVal(0)
+	mock.ExpectSRem("user_u1:apikeys", "missing").SetVal(0)
+	assert.Equal(redis.Nil, Revoke("u1", "missing"))
+
+	// The keys of other users cannot be revoked
+	mock.ExpectHGetAll("apikey_other").SetVal(map[string]string{"user": "u2", "scopes": "admin"})
+	assert.Equal(redis.Nil, Revoke("u1", "other"))
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestMigrate(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	apiKey := "5f2b6c0e8d1a4b7f9e3c2d1a0b9c8d7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c"
+
+	// A key of the single user of earlier versions is given to the owner
+	mock.ExpectSMembers(indexKey).SetVal([]string{"fedcba9876543210"})
+	mock.ExpectHGetAll("apikey_fedcba9876543210").SetVal(map[string]string{"label": "initial", "scopes": "admin", "hash": "salt:hash"})
+	mock.CustomMatch(anyArgs).ExpectHSet("apikey_fedcba9876543210", "user", "", "label", "", "scopes", "", "createdAt", "", "hash", "").SetVal(1)
+	mock.ExpectSAdd("user_u1:apikeys", "fedcba9876543210").SetVal(1)
+	mock.ExpectDel(indexKey).SetVal(1)
+
+	// A plaintext key, a bare salted hash and a key that is already migrated
+	mock.ExpectScan(0, "apikey_*", 100).SetVal([]string{"apikey_" + apiKey, "apikey_0123456789abcdef", "apikey_fedcba9876543210"}, 0)
+
+	mock.ExpectType("apikey_" + apiKey).SetVal("string")
+	mock.ExpectGet("apikey_" + apiKey).SetVal(apiKey)
+	mock.ExpectPTTL("apikey_" + apiKey).SetVal(-1)
+	mock.CustomMatch(anyArgs).ExpectHSet(redisKey(keyID(apiKey)), "user", "", "label", "", "scopes", "", "createdAt", "", "hash", "").SetVal(5)
+	mock.ExpectSAdd("user_u1:apikeys", keyID(apiKey)).SetVal(1)
+	mock.ExpectDel("apikey_" + apiKey).SetVal(1)
+
+	// The bare hash keeps its remaining lifetime
+	mock.ExpectType("apikey_0123456789abcdef").SetVal("string")
+	mock.ExpectGet("apikey_0123456789abcdef").SetVal("salt:hash")
+	mock.ExpectPTTL("apikey_0123456789abcdef").SetVal(72 * time.Hour)
+	mock.ExpectRename("apikey_0123456789abcdef", "legacy_apikey_0123456789abcdef").SetVal("OK")
+	mock.CustomMatch(anyArgs).ExpectHSet("apikey_0123456789abcdef", "user", "", "label", "", "scopes", "", "createdAt", "", "hash", "", "expiresAt", "").SetVal(6)
+	mock.CustomMatch(anyArgs).ExpectExpireAt("apikey_0123456789abcdef", time.Now()).SetVal(true)
+	mock.ExpectSAdd("user_u1:apikeys", "0123456789abcdef").SetVal(1)
+	mock.ExpectDel("legacy_apikey_0123456789abcdef").SetVal(1)
+
+	mock.ExpectType("apikey_fedcba9876543210").SetVal("hash")
+
+	assert.NoError(Migrate("u1"))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestMigrateKeepsKeyWhenSaveFails(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectSMembers(indexKey).SetVal([]string{})
+	mock.ExpectDel(indexKey).SetVal(0)
+	mock.ExpectScan(0, "apikey_*", 100).SetVal([]string{"apikey_0123456789abcdef"}, 0)
+
+	mock.ExpectType("apikey_0123456789abcdef").SetVal("string")
+	mock.ExpectGet("apikey_0123456789abcdef").SetVal("salt:hash")
+	mock.ExpectPTTL("apikey_0123456789abcdef").SetVal(-1)
+	mock.ExpectRename("apikey_0123456789abcdef", "legacy_apikey_0123456789abcdef").SetVal("OK")
+	mock.CustomMatch(anyArgs).ExpectHSet("apikey_0123456789abcdef", "user", "", "label", "", "scopes", "", "createdAt", "", "hash", "").SetErr(errors.New("OOM"))
+
+	// The legacy key is moved back
+	mock.ExpectDel("apikey_0123456789abcdef").SetVal(0)
+	mock.ExpectRename("legacy_apikey_0123456789abcdef", "apikey_0123456789abcdef").SetVal("OK")
+
+	assert.Error(Migrate("u1"))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
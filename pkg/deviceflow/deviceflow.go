@@ -0,0 +1,208 @@
+package deviceflow
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/apikeys"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"golang.org/x/oauth2"
+)
+
+// The statuses of a device flow
+const (
+	StatusPending  = "pending"
+	StatusComplete = "complete"
+	StatusExpired  = "expired"
+	StatusDenied   = "denied"
+	StatusFailed   = "failed"
+)
+
+// flowRetention is how long a flow can still be looked up after its device code expired
+const flowRetention = 10 * time.Minute
+
+// Flow is a struct to hold the state of a device authorization flow
+type Flow struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	// UserCode is the code the user enters at the verification URI
+	UserCode                string    `json:"userCode"`
+	VerificationURI         string    `json:"verificationUri"`
+	VerificationURIComplete string    `json:"verificationUriComplete,omitempty"`
+	ExpiresAt               time.Time `json:"expiresAt"`
+	// Status is pending, complete, expired, denied or failed
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// UserID is the ID of the user the account is linked to
+	UserID string `json:"userId"`
+	// KeyID is the ID of the API key that started the flow
+	KeyID string `json:"keyId"`
+	// Replace is set if the caller confirmed replacing the account that is already connected
+	Replace bool `json:"replace"`
+	// Account is the ID of the account the token was saved for once the flow is complete, without the user
+	Account string `json:"account,omitempty"`
+}
+
+// flowKey returns the redis key of the user's flow
+func flowKey(user string, id string) string {
+	return utils.UserKey(user, fmt.Sprintf("deviceFlow_%s", id))
+}
+
+// Start requests a user code from the provider and polls for the token in the background.
+// The token is saved as the token of the account the user authorized once they complete the authorization, if the API key that started the flow is still valid.
+func Start(link utils.OAuthLink) (Flow, error) {
+
+	provider := link.Provider
+
+	config, err := utils.GetOAuth2Config(provider)
+	if err != nil {
+		return Flow{}, err
+	}
+
+	// Microsoft only issues device tokens to public clients, which must not send a secret
+	if provider == "outlook" {
+		publicConfig := *config
+		publicConfig.ClientSecret = ""
+		config = &publicConfig
+	}
+
+	deviceAuth, err := utils.StartDeviceAuth(context.Background(), config)
+	if err != nil {
+		return Flow{}, err
+	}
+
+	id, err := generateFlowID()
+	if err != nil {
+		return Flow{}, err
+	}
+
+	flow := Flow{
+		ID:                      id,
+		Provider:                provider,
+		UserCode:                deviceAuth.UserCode,
+		VerificationURI:         deviceAuth.VerificationURI,
+		VerificationURIComplete: deviceAuth.VerificationURIComplete,
+		ExpiresAt:               deviceAuth.Expiry,
+		Status:                  StatusPending,
+		UserID:                  link.User,
+		KeyID:                   link.KeyID,
+		Replace:                 link.Replace,
+	}
+
+	err = saveFlow(flow)
+	if err != nil {
+		return Flow{}, err
+	}
+
+	go poll(config, deviceAuth, flow)
+
+	return flow, nil
+}
+
+// Get returns the user's flow with the given ID, redis.Nil is returned if the user has no such flow
+func Get(user string, id string) (Flow, error) {
+
+	value, err := redisclient.Rdb.Get(context.Background(), flowKey(user, id)).Result()
+	if err != nil {
+		return Flow{}, err
+	}
+
+	var flow Flow
+	err = json.Unmarshal([]byte(value), &flow)
+	if err != nil {
+		return Flow{}, fmt.Errorf("Unable to unmarshal device flow: %w", err)
+	}
+
+	// The poller may not have recorded the expiry yet
+	if flow.Status == StatusPending && !flow.ExpiresAt.IsZero() && time.Now().After(flow.ExpiresAt) {
+		flow.Status = StatusExpired
+	}
+
+	return flow, nil
+}
+
+// poll waits for the user to complete the authorization and records the outcome of the flow
+func poll(config *oauth2.Config, deviceAuth *oauth2.DeviceAuthResponse, flow Flow) {
+
+	tok, err := utils.PollToken(context.Background(), config, deviceAuth)
+	if err == nil {
+		var account string
+		account, err = completeLink(flow, tok)
+		flow.Account = utils.AccountName(account)
+	}
+
+	switch {
+	case err == nil:
+		flow.Status = StatusComplete
+	case errors.Is(err, utils.ErrDeviceCodeExpired):
+		flow.Status = StatusExpired
+	case errors.Is(err, utils.ErrDeviceAccessDenied):
+		flow.Status = StatusDenied
+	default:
+		log.Printf("Error completing the %s device flow: %v", flow.Provider, err)
+		flow.Status = StatusFailed
+		flow.Error = err.Error()
+	}
+
+	err = saveFlow(flow)
+	if err != nil {
+		log.Printf("Error saving the %s device flow: %v", flow.Provider, err)
+	}
+}
+
+// completeLink saves the token if the API key that started the flow is still valid and the connected account may be replaced, the ID of the account is returned
+func completeLink(flow Flow, tok *oauth2.Token) (string, error) {
+
+	link := utils.OAuthLink{Provider: flow.Provider, User: flow.UserID, KeyID: flow.KeyID, Replace: flow.Replace}
+
+	_, err := apikeys.Authorize(link.KeyID, apikeys.ScopeAdmin)
+	if err != nil {
+		return "", err
+	}
+
+	return utils.LinkAccount(link, tok)
+}
+
+// saveFlow saves the flow until a while after its device code expires
+func saveFlow(flow Flow) error {
+
+	value, err := json.Marshal(flow)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal device flow: %w", err)
+	}
+
+	ttl := flowRetention
+	if !flow.ExpiresAt.IsZero() {
+		ttl += time.Until(flow.ExpiresAt)
+	}
+	// Flows that are over are kept for the retention period only
+	if flow.Status != StatusPending || ttl < flowRetention {
+		ttl = flowRetention
+	}
+
+	err = redisclient.Rdb.Set(context.Background(), flowKey(flow.UserID, flow.ID), value, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save device flow to redis: %w", err)
+	}
+
+	return nil
+}
+
+// generateFlowID generates a random ID for a flow
+func generateFlowID() (string, error) {
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate device flow ID: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
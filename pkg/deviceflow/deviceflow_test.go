@@ -0,0 +1,67 @@
+package deviceflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	pending := Flow{ID: "abc", Provider: "google", UserCode: "ABCD-EFGH", VerificationURI: "https://www.google.com/device", ExpiresAt: time.Now().Add(time.Minute).UTC(), Status: StatusPending}
+	value, _ := json.Marshal(pending)
+	mock.ExpectGet("user_u1:deviceFlow_abc").SetVal(string(value))
+
+	flow, err := Get("u1", "abc")
+	assert.NoError(err)
+	assert.Equal(StatusPending, flow.Status)
+	assert.Equal("ABCD-EFGH", flow.UserCode)
+
+	// The code expired before the poller recorded it
+	pending.ExpiresAt = time.Now().Add(-time.Second).UTC()
+	value, _ = json.Marshal(pending)
+	mock.ExpectGet("user_u1:deviceFlow_abc").SetVal(string(value))
+
+	flow, err = Get("u1", "abc")
+	assert.NoError(err)
+	assert.Equal(StatusExpired, flow.Status)
+
+	mock.ExpectGet("user_u1:deviceFlow_missing").RedisNil()
+
+	_, err = Get("u1", "missing")
+	assert.Equal(redis.Nil, err)
+
+	// The flows of other users are not found
+	mock.ExpectGet("user_u2:deviceFlow_abc").RedisNil()
+
+	_, err = Get("u2", "abc")
+	assert.Equal(redis.Nil, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestSaveFlow(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// Completed flows are only kept for the retention period
+	flow := Flow{ID: "abc", Provider: "outlook", ExpiresAt: time.Now().Add(10 * time.Minute).UTC(), Status: StatusComplete, UserID: "u1"}
+	value, _ := json.Marshal(flow)
+	mock.ExpectSet("user_u1:deviceFlow_abc", value, flowRetention).SetVal("OK")
+
+	assert.NoError(saveFlow(flow))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
@@ -0,0 +1,360 @@
+package actionitems
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+)
+
+// maxTextLength is the length the sentences of the action items are cut to
+const maxTextLength = 300
+
+var (
+	// quoteStart matches the lines after which the rest of the body is quoted or a signature
+	quoteStart = regexp.MustCompile(`(?i)^(on .+ wrote:|-+ ?original message ?-+|-- ?|_{5,}|sent from my .+)$`)
+	// bullet matches the lines that start a new item of a list
+	bullet = regexp.MustCompile(`^([-*•]|\d+[.)])\s+`)
+
+	// request matches the phrases asking the user to do something
+	request = regexp.MustCompile(`(?i)\b((could|can|would|will) you|please|kindly|(i|we) need you to|let (me|us) know|make sure|remember to|don't forget)\b`)
+	// ignored matches the boilerplate that looks like a request but is not one
+	ignored = regexp.MustCompile(`(?i)(do not reply|don't reply|unsubscribe|please find attached|please see attached|please consider the environment)`)
+	// addressed matches the sentences that speak to the user
+	addressed = regexp.MustCompile(`(?i)\byou(r)?\b`)
+	// deadlineWord matches the words that make a sentence about a date a deadline
+	deadlineWord = regexp.MustCompile(`(?i)\b(by|before|until|till|due|deadline|no later than|eod|cob|eow)\b`)
+
+	monthName   = `(january|february|march|april|may|june|july|august|september|october|november|december|jan|feb|mar|apr|jun|jul|aug|sept|sep|oct|nov|dec)\b\.?`
+	weekdayName = `(monday|tuesday|wednesday|thursday|friday|saturday|sunday|mon|tues|tue|wed|thurs|thur|thu|fri|sat|sun)\b`
+
+	isoDate        = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	monthDayDate   = regexp.MustCompile(`(?i)\b` + monthName + `\s+(\d{1,2})(?:st|nd|rd|th)?\b(?:,?\s+(\d{4}))?`)
+	dayMonthDate   = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?\s+(?:of\s+)?` + monthName + `(?:,?\s+(\d{4}))?`)
+	weekdayDate    = regexp.MustCompile(`(?i)\b(?:by|before|until|till|due|on|no later than|latest)\s+(?:(this|next)\s+)?` + weekdayName)
+	inDays         = regexp.MustCompile(`(?i)\b(?:in|within)\s+(\d+|one|two|three|four|five|six|seven|eight|nine|ten)\s+(business\s+|working\s+)?(days?|weeks?)\b`)
+	tomorrow       = regexp.MustCompile(`(?i)\btomorrow\b`)
+	today          = regexp.MustCompile(`(?i)\b(today|tonight)\b`)
+	endOfWeek      = regexp.MustCompile(`(?i)\b(eow|end of (the )?week)\b`)
+	endOfMonth     = regexp.MustCompile(`(?i)\bend of (the )?month\b`)
+	endOfDay       = regexp.MustCompile(`(?i)\b(eod|cob|end of (the )?(business )?day|close of business)\b`)
+	clockTime      = regexp.MustCompile(`(?i)\b(\d{1,2})(?::(\d{2}))?\s*(am|pm)\b`)
+	twentyFourHour = regexp.MustCompile(`(?i)\b(?:at|by|before)\s+(\d{1,2}):(\d{2})\b`)
+	noon           = regexp.MustCompile(`(?i)\bnoon\b`)
+)
+
+// months maps the first 3 letters of the month names to the months
+var months = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+	"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+	"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+// weekdays maps the first 3 letters of the weekday names to the weekdays
+var weekdays = map[string]time.Weekday{
+	"mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday,
+	"fri": time.Friday, "sat": time.Saturday, "sun": time.Sunday,
+}
+
+// numbers maps the spelled out numbers to their value
+var numbers = map[string]int{
+	"one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6, "seven": 7, "eight": 8, "nine": 9, "ten": 10,
+}
+
+// Extract returns the requests, questions addressed to the user and deadlines found in the body of an email.
+// Relative deadlines such as "by Friday" are resolved against the received time in the given location.
+func Extract(body string, received time.Time, location *time.Location) []integrations.ActionItem {
+
+	reference := received.In(location)
+
+	items := []integrations.ActionItem{}
+	for _, sentence := range sentences(cleanBody(body)) {
+		if ignored.MatchString(sentence) {
+			continue
+		}
+
+		kind := ""
+		switch {
+		case request.MatchString(sentence):
+			kind = "request"
+		case strings.HasSuffix(sentence, "?") && addressed.MatchString(sentence):
+			kind = "question"
+		case deadlineWord.MatchString(sentence):
+			kind = "deadline"
+		default:
+			continue
+		}
+
+		item := integrations.ActionItem{Kind: kind, Text: truncate(sentence)}
+		due, found := findDeadline(sentence, reference)
+		if found {
+			item.Due = due.Format(time.RFC3339)
+		}
+
+		// A deadline word without a date is only a figure of speech
+		if kind == "deadline" && !found {
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	return items
+}
+
+// cleanBody drops the quoted replies and the signature, which are not addressed to the user
+func cleanBody(body string) string {
+
+	lines := []string{}
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if quoteStart.MatchString(trimmed) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		lines = append(lines, trimmed)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// sentences splits the text into sentences, joining the lines that were wrapped by the mail client
+func sentences(text string) []string {
+
+	// Blank lines and list items start a new paragraph
+	paragraphs := []string{}
+	current := []string{}
+	flush := func() {
+		if len(current) > 0 {
+			paragraphs = append(paragraphs, strings.Join(current, " "))
+			current = nil
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if line == "" || bullet.MatchString(line) {
+			flush()
+		}
+		if line != "" {
+			current = append(current, bullet.ReplaceAllString(line, ""))
+		}
+	}
+	flush()
+
+	result := []string{}
+	for _, paragraph := range paragraphs {
+		start := 0
+		runes := []rune(paragraph)
+		for i, r := range runes {
+			end := i == len(runes)-1
+			if end || ((r == '.' || r == '!' || r == '?') && runes[i+1] == ' ') {
+				sentence := strings.TrimSpace(string(runes[start : i+1]))
+				if sentence != "" {
+					result = append(result, sentence)
+				}
+				start = i + 1
+			}
+		}
+	}
+
+	return result
+}
+
+// findDeadline resolves the date and time mentioned in the sentence, days without a time end at 23:59
+func findDeadline(sentence string, reference time.Time) (time.Time, bool) {
+
+	day, dayFound := findDay(sentence, reference)
+	hour, minute, timeFound := findTime(sentence)
+
+	if !dayFound && !timeFound {
+		return time.Time{}, false
+	}
+
+	if !dayFound {
+		day = startOfDay(reference)
+	}
+
+	if !timeFound {
+		hour, minute = 23, 59
+	}
+
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location()), true
+}
+
+// findDay returns the start of the day mentioned in the sentence
+func findDay(sentence string, reference time.Time) (time.Time, bool) {
+
+	base := startOfDay(reference)
+
+	if match := isoDate.FindStringSubmatch(sentence); match != nil {
+		year, _ := strconv.Atoi(match[1])
+		month, _ := strconv.Atoi(match[2])
+		day, _ := strconv.Atoi(match[3])
+		if month >= 1 && month <= 12 && day >= 1 && day <= 31 {
+			return time.Date(year, time.Month(month), day, 0, 0, 0, 0, reference.Location()), true
+		}
+	}
+
+	if match := monthDayDate.FindStringSubmatch(sentence); match != nil {
+		day, _ := strconv.Atoi(match[2])
+		return resolveDate(base, months[strings.ToLower(match[1][:3])], day, match[3]), true
+	}
+
+	if match := dayMonthDate.FindStringSubmatch(sentence); match != nil {
+		day, _ := strconv.Atoi(match[1])
+		return resolveDate(base, months[strings.ToLower(match[2][:3])], day, match[3]), true
+	}
+
+	if match := weekdayDate.FindStringSubmatch(sentence); match != nil {
+		weekday := weekdays[strings.ToLower(match[2][:3])]
+
+		// Next means in the following calendar week, which starts on Monday
+		if strings.EqualFold(match[1], "next") {
+			nextMonday := base.AddDate(0, 0, 7-mondayIndex(base.Weekday()))
+			return nextMonday.AddDate(0, 0, mondayIndex(weekday)), true
+		}
+
+		ahead := (int(weekday) - int(base.Weekday()) + 7) % 7
+		return base.AddDate(0, 0, ahead), true
+	}
+
+	if match := inDays.FindStringSubmatch(sentence); match != nil {
+		count, err := strconv.Atoi(match[1])
+		if err != nil {
+			count = numbers[strings.ToLower(match[1])]
+		}
+		if strings.HasPrefix(strings.ToLower(match[3]), "week") {
+			return base.AddDate(0, 0, 7*count), true
+		}
+		if match[2] != "" {
+			return addBusinessDays(base, count), true
+		}
+		return base.AddDate(0, 0, count), true
+	}
+
+	if tomorrow.MatchString(sentence) {
+		return base.AddDate(0, 0, 1), true
+	}
+
+	if today.MatchString(sentence) {
+		return base, true
+	}
+
+	if endOfWeek.MatchString(sentence) {
+		ahead := (int(time.Friday) - int(base.Weekday()) + 7) % 7
+		return base.AddDate(0, 0, ahead), true
+	}
+
+	if endOfMonth.MatchString(sentence) {
+		return time.Date(base.Year(), base.Month()+1, 0, 0, 0, 0, 0, base.Location()), true
+	}
+
+	return time.Time{}, false
+}
+
+// findTime returns the time of day mentioned in the sentence, the end of the day means the end of the business day
+func findTime(sentence string) (int, int, bool) {
+
+	if match := clockTime.FindStringSubmatch(sentence); match != nil {
+		hour, _ := strconv.Atoi(match[1])
+		minute, _ := strconv.Atoi(match[2])
+		if hour >= 1 && hour <= 12 && minute < 60 {
+			hour = hour % 12
+			if strings.EqualFold(match[3], "pm") {
+				hour += 12
+			}
+			return hour, minute, true
+		}
+	}
+
+	if match := twentyFourHour.FindStringSubmatch(sentence); match != nil {
+		hour, _ := strconv.Atoi(match[1])
+		minute, _ := strconv.Atoi(match[2])
+		if hour < 24 && minute < 60 {
+			return hour, minute, true
+		}
+	}
+
+	if noon.MatchString(sentence) {
+		return 12, 0, true
+	}
+
+	if endOfDay.MatchString(sentence) || endOfWeek.MatchString(sentence) {
+		return 17, 0, true
+	}
+
+	return 0, 0, false
+}
+
+// resolveDate places a day of a month without a year in the year closest to the reference
+func resolveDate(base time.Time, month time.Month, day int, year string) time.Time {
+
+	if year != "" {
+		parsed, _ := strconv.Atoi(year)
+		return time.Date(parsed, month, day, 0, 0, 0, 0, base.Location())
+	}
+
+	// Dates up to a month back are recent ones, further back they are in the next year, and far ahead they are in the previous year
+	date := time.Date(base.Year(), month, day, 0, 0, 0, 0, base.Location())
+	if date.Before(base.AddDate(0, 0, -30)) {
+		date = date.AddDate(1, 0, 0)
+	} else if date.After(base.AddDate(0, 11, 0)) {
+		date = date.AddDate(-1, 0, 0)
+	}
+
+	return date
+}
+
+// addBusinessDays adds the number of days, skipping the weekends
+func addBusinessDays(day time.Time, count int) time.Time {
+
+	for count > 0 {
+		day = day.AddDate(0, 0, 1)
+		if day.Weekday() != time.Saturday && day.Weekday() != time.Sunday {
+			count--
+		}
+	}
+
+	return day
+}
+
+// mondayIndex returns the position of the weekday in a week starting on Monday
+func mondayIndex(weekday time.Weekday) int {
+	return (int(weekday) + 6) % 7
+}
+
+// startOfDay returns midnight of the day of the time, in its location
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// truncate cuts long sentences so that the to-do list stays readable
+func truncate(sentence string) string {
+
+	runes := []rune(sentence)
+	if len(runes) <= maxTextLength {
+		return sentence
+	}
+
+	return string(runes[:maxTextLength]) + "…"
+}
+
+// ForEmail returns the action items of the email, resolving the deadlines in the user's time zone.
+// Emails without a readable received time are read as if they had just arrived.
+func ForEmail(email integrations.Email) []integrations.ActionItem {
+
+	received, err := email.ReceivedTime()
+	if err != nil {
+		received = time.Now()
+	}
+
+	return Extract(email.Body, received, utils.GetUserLocation())
+}
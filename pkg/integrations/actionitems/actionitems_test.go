@@ -0,0 +1,83 @@
+package actionitems
+
+import (
+	"testing"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtract(t *testing.T) {
+	assert := assert.New(t)
+
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	assert.NoError(err)
+
+	// Wednesday 3 January 2024, 23:30 in Zurich
+	received := time.Date(2024, 1, 3, 22, 30, 0, 0, time.UTC)
+
+	body := "Hi,\r\n" +
+		"\r\n" +
+		"Could you send me the slides by Friday? The venue needs the final\r\n" +
+		"headcount by EOD tomorrow. Are you joining the dinner?\r\n" +
+		"\r\n" +
+		"- Please review the contract before 2024-01-15 at 14:00\r\n" +
+		"- The invoice is due on March 3rd.\r\n" +
+		"- We talked about it at length.\r\n" +
+		"\r\n" +
+		"Please do not reply to this email.\r\n" +
+		"\r\n" +
+		"On Tue, Jan 2, 2024 at 9:00 AM Bob <bob@example.com> wrote:\r\n" +
+		"> Can you book the room?\r\n"
+
+	assert.Equal([]integrations.ActionItem{
+		{Kind: "request", Text: "Could you send me the slides by Friday?", Due: "2024-01-05T23:59:00+01:00"},
+		{Kind: "deadline", Text: "The venue needs the final headcount by EOD tomorrow.", Due: "2024-01-04T17:00:00+01:00"},
+		{Kind: "question", Text: "Are you joining the dinner?"},
+		{Kind: "request", Text: "Please review the contract before 2024-01-15 at 14:00", Due: "2024-01-15T14:00:00+01:00"},
+		{Kind: "deadline", Text: "The invoice is due on March 3rd.", Due: "2024-03-03T23:59:00+01:00"},
+	}, Extract(body, received, zurich))
+
+	// The same email read in UTC was received a day earlier
+	items := Extract("Let me know today.", time.Date(2024, 1, 3, 23, 30, 0, 0, time.UTC), zurich)
+	assert.Equal("2024-01-04T23:59:00+01:00", items[0].Due)
+	items = Extract("Let me know today.", time.Date(2024, 1, 3, 23, 30, 0, 0, time.UTC), time.UTC)
+	assert.Equal("2024-01-03T23:59:00Z", items[0].Due)
+
+	assert.Nil(Extract("Thanks for the update. We shipped 3 marketing decks.", received, zurich))
+}
+
+func TestFindDay(t *testing.T) {
+	assert := assert.New(t)
+
+	// Wednesday
+	reference := time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC)
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	cases := map[string]time.Time{
+		"by Wednesday":             day(2024, 1, 3),
+		"by next Tuesday":          day(2024, 1, 9),
+		"before Monday":            day(2024, 1, 8),
+		"within two business days": day(2024, 1, 5),
+		"in 3 working days":        day(2024, 1, 8),
+		"in 2 weeks":               day(2024, 1, 17),
+		"by the end of the week":   day(2024, 1, 5),
+		"by the end of the month":  day(2024, 1, 31),
+		"on 15 February":           day(2024, 2, 15),
+		"by Dec 1":                 day(2024, 12, 1),
+		"by December 20th, 2023":   day(2023, 12, 20),
+		"around December 28":       day(2023, 12, 28),
+	}
+
+	for sentence, expected := range cases {
+		found, ok := findDay(sentence, reference)
+		assert.True(ok, sentence)
+		assert.Equal(expected, found, sentence)
+	}
+
+	_, ok := findDay("Send 3 marketing decks on sunny days", reference)
+	assert.False(ok)
+}
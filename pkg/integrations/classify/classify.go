@@ -0,0 +1,212 @@
+package classify
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+)
+
+// The categories an email can be classified as
+const (
+	Personal      = "personal"
+	Newsletter    = "newsletter"
+	Notification  = "notification"
+	Transactional = "transactional"
+	Promotional   = "promotional"
+)
+
+// ValidCategories is a map of the categories an email can be classified as
+var ValidCategories = map[string]bool{
+	Personal:      true,
+	Newsletter:    true,
+	Notification:  true,
+	Transactional: true,
+	Promotional:   true,
+}
+
+// labelCategories maps the Gmail category labels to the categories
+var labelCategories = map[string]string{
+	"CATEGORY_PROMOTIONS": Promotional,
+	"CATEGORY_SOCIAL":     Notification,
+	"CATEGORY_UPDATES":    Notification,
+	"CATEGORY_FORUMS":     Newsletter,
+}
+
+var (
+	// transactionalSubject matches receipts, orders, bookings and account emails, which matter even when sent by a machine
+	transactionalSubject = regexp.MustCompile(`(?i)\b(receipt|invoice|order (confirmation|#?\d+)|your order|has shipped|shipping confirmation|delivery|booking|reservation|itinerary|e-?ticket|payment (received|confirmation)|password reset|reset your password|verification code|verify your|security code|one-time (code|password))\b`)
+	// promotionalSubject matches sales pitches
+	promotionalSubject = regexp.MustCompile(`(?i)(\d+\s?% off|\b(sale|discount|coupon|promo(tion)? code|deal of|deals|limited time|free shipping|special offer|exclusive offer|last chance|black friday|cyber monday)\b)`)
+	// notificationSender matches the automated senders of services
+	notificationSender = regexp.MustCompile(`(?i)^(no-?reply|do-?not-?reply|notifications?|notify|alerts?|mailer-daemon|postmaster|automated|system|bounces?)[@+.-]`)
+	// newsletterSender matches the senders of newsletters
+	newsletterSender = regexp.MustCompile(`(?i)^(newsletters?|news|digest|updates|weekly|daily)[@+.-]`)
+	// promotionalSender matches the senders of marketing campaigns
+	promotionalSender = regexp.MustCompile(`(?i)^(marketing|offers?|deals|promo(tions)?|sales|shop|store)[@+.-]`)
+)
+
+// Classify returns the category of the email from its headers, its sender and the Gmail category labels.
+// The headers are matched case-insensitively, only the ones related to mailing lists and automated mail are needed.
+func Classify(email integrations.Email, headers map[string]string) string {
+
+	header := func(name string) string {
+		for key, value := range headers {
+			if strings.EqualFold(key, name) {
+				return strings.TrimSpace(value)
+			}
+		}
+		return ""
+	}
+
+	sender := strings.ToLower(integrations.SenderAddress(email.Sender))
+
+	// Receipts and bookings are often sent by automated senders and filed as updates by Gmail
+	if transactionalSubject.MatchString(email.Subject) || hasReservation(email) {
+		return Transactional
+	}
+
+	if autoSubmitted := strings.ToLower(header("Auto-Submitted")); autoSubmitted != "" && autoSubmitted != "no" {
+		return Notification
+	}
+
+	for _, label := range email.Labels {
+		if category, ok := labelCategories[label]; ok {
+			return category
+		}
+	}
+
+	precedence := strings.ToLower(header("Precedence"))
+	if header("List-Id") != "" || header("List-Unsubscribe") != "" || precedence == "bulk" || precedence == "list" || precedence == "junk" {
+		if promotionalSubject.MatchString(email.Subject) || promotionalSender.MatchString(sender) || precedence == "junk" {
+			return Promotional
+		}
+		if notificationSender.MatchString(sender) {
+			return Notification
+		}
+		return Newsletter
+	}
+
+	switch {
+	case notificationSender.MatchString(sender):
+		return Notification
+	case newsletterSender.MatchString(sender):
+		return Newsletter
+	case promotionalSender.MatchString(sender):
+		return Promotional
+	}
+
+	return Personal
+}
+
+// IsBulk tells whether the category is one of the mass-mailed ones that can be folded into a digest
+func IsBulk(category string) bool {
+	return category == Newsletter || category == Notification || category == Promotional
+}
+
+// ParseFilter parses a comma-separated list of categories, an empty filter matches every category
+func ParseFilter(filter string) (map[string]bool, error) {
+
+	categories := map[string]bool{}
+
+	for _, category := range strings.Split(filter, ",") {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category == "" {
+			continue
+		}
+		if !ValidCategories[category] {
+			return nil, fmt.Errorf("Invalid category: %s", category)
+		}
+		categories[category] = true
+	}
+
+	return categories, nil
+}
+
+// Filter returns the emails of the given categories, all the emails are returned if no category is given
+func Filter(emails []integrations.Email, categories map[string]bool) []integrations.Email {
+
+	if len(categories) == 0 {
+		return emails
+	}
+
+	filtered := []integrations.Email{}
+	for _, email := range emails {
+		if categories[email.Category] {
+			filtered = append(filtered, email)
+		}
+	}
+
+	return filtered
+}
+
+// DigestEntry is a struct to hold the bulk emails of a sender folded into a single line
+type DigestEntry struct {
+	Sender   string `json:"sender"`
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+	// Latest is the subject of the most recent email of the sender
+	Latest   string   `json:"latest"`
+	EmailIDs []string `json:"emailIds"`
+	// Line is the entry as a single line of text
+	Line string `json:"line"`
+}
+
+// Fold splits the emails into the personal and transactional ones, kept in their order, and a digest of the bulk ones with a line per sender.
+// The senders with the most emails come first in the digest.
+func Fold(emails []integrations.Email) ([]integrations.Email, []DigestEntry) {
+
+	kept := []integrations.Email{}
+	entries := map[string]*DigestEntry{}
+	latest := map[string]time.Time{}
+	order := []string{}
+
+	for _, email := range emails {
+		if !IsBulk(email.Category) {
+			kept = append(kept, email)
+			continue
+		}
+
+		key := strings.ToLower(integrations.SenderAddress(email.Sender))
+		entry, ok := entries[key]
+		if !ok {
+			entry = &DigestEntry{Sender: email.Sender, Category: email.Category, EmailIDs: []string{}}
+			entries[key] = entry
+			order = append(order, key)
+		}
+
+		entry.Count++
+		entry.EmailIDs = append(entry.EmailIDs, email.ID)
+
+		// Keep the subject of the most recent email, the emails without a valid date count as the oldest
+		received, err := email.ReceivedTime()
+		if err != nil {
+			received = time.Time{}
+		}
+		if current, ok := latest[key]; !ok || !received.Before(current) {
+			latest[key] = received
+			entry.Latest = email.Subject
+		}
+	}
+
+	digest := []DigestEntry{}
+	for _, key := range order {
+		entry := entries[key]
+		entry.Line = fmt.Sprintf("%s (%s): %d email(s), latest: %s", entry.Sender, entry.Category, entry.Count, entry.Latest)
+		digest = append(digest, *entry)
+	}
+
+	sort.SliceStable(digest, func(i, j int) bool {
+		return digest[i].Count > digest[j].Count
+	})
+
+	return kept, digest
+}
+
+// hasReservation checks if the email carries a reservation or a parcel as structured data
+func hasReservation(email integrations.Email) bool {
+	return len(email.Structured) > 0
+}
@@ -0,0 +1,117 @@
+package classify
+
+import (
+	"testing"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name     string
+		email    integrations.Email
+		headers  map[string]string
+		expected string
+	}{
+		{
+			name:     "personal",
+			email:    integrations.Email{Sender: "Jane Doe <jane@example.com>", Subject: "Lunch tomorrow?"},
+			expected: Personal,
+		},
+		{
+			name:     "mailing list",
+			email:    integrations.Email{Sender: "The Weekly <editor@weekly.example.com>", Subject: "Issue #42"},
+			headers:  map[string]string{"list-id": "<weekly.example.com>", "List-Unsubscribe": "<mailto:unsub@example.com>"},
+			expected: Newsletter,
+		},
+		{
+			name:     "mailing list selling something",
+			email:    integrations.Email{Sender: "shop@brand.example.com", Subject: "30% off everything this weekend"},
+			headers:  map[string]string{"List-Unsubscribe": "<https://brand.example.com/unsub>"},
+			expected: Promotional,
+		},
+		{
+			name:     "auto-submitted",
+			email:    integrations.Email{Sender: "ci@example.com", Subject: "Build failed"},
+			headers:  map[string]string{"Auto-Submitted": "auto-generated"},
+			expected: Notification,
+		},
+		{
+			name:     "no-reply sender",
+			email:    integrations.Email{Sender: "GitHub <noreply@github.com>", Subject: "New sign-in"},
+			expected: Notification,
+		},
+		{
+			name:     "receipt from an automated sender",
+			email:    integrations.Email{Sender: "no-reply@shop.example.com", Subject: "Your receipt from Shop", Labels: []string{"CATEGORY_UPDATES"}},
+			headers:  map[string]string{"Precedence": "bulk"},
+			expected: Transactional,
+		},
+		{
+			name:     "reservation",
+			email:    integrations.Email{Sender: "airline@example.com", Subject: "See you soon", Structured: []integrations.StructuredData{{Type: "FlightReservation"}}},
+			expected: Transactional,
+		},
+		{
+			name:     "gmail promotions",
+			email:    integrations.Email{Sender: "hello@startup.example.com", Subject: "We miss you", Labels: []string{"UNREAD", "CATEGORY_PROMOTIONS"}},
+			expected: Promotional,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.expected, Classify(test.email, test.headers), test.name)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	categories, err := ParseFilter("newsletter, Promotional")
+	assert.NoError(err)
+	assert.Equal(map[string]bool{Newsletter: true, Promotional: true}, categories)
+
+	categories, err = ParseFilter("")
+	assert.NoError(err)
+	assert.Empty(categories)
+
+	_, err = ParseFilter("spam")
+	assert.Error(err)
+}
+
+func TestFold(t *testing.T) {
+	assert := assert.New(t)
+
+	emails := []integrations.Email{
+		{ID: "1", Sender: "News <news@paper.example.com>", Subject: "Monday edition", RecievedDateTime: "2024-01-01T08:00:00Z", Category: Newsletter},
+		{ID: "2", Sender: "jane@example.com", Subject: "Hi", RecievedDateTime: "2024-01-01T09:00:00Z", Category: Personal},
+		{ID: "3", Sender: "News <NEWS@paper.example.com>", Subject: "Tuesday edition", RecievedDateTime: "2024-01-02T08:00:00Z", Category: Newsletter},
+		{ID: "4", Sender: "noreply@github.com", Subject: "New sign-in", RecievedDateTime: "2024-01-02T10:00:00Z", Category: Notification},
+		{ID: "5", Sender: "orders@shop.example.com", Subject: "Your receipt", RecievedDateTime: "2024-01-02T11:00:00Z", Category: Transactional},
+	}
+
+	kept, digest := Fold(emails)
+
+	assert.Equal([]string{"2", "5"}, []string{kept[0].ID, kept[1].ID})
+	assert.Equal([]DigestEntry{
+		{
+			Sender:   "News <news@paper.example.com>",
+			Category: Newsletter,
+			Count:    2,
+			Latest:   "Tuesday edition",
+			EmailIDs: []string{"1", "3"},
+			Line:     "News <news@paper.example.com> (newsletter): 2 email(s), latest: Tuesday edition",
+		},
+		{
+			Sender:   "noreply@github.com",
+			Category: Notification,
+			Count:    1,
+			Latest:   "New sign-in",
+			EmailIDs: []string{"4"},
+			Line:     "noreply@github.com (notification): 1 email(s), latest: New sign-in",
+		},
+	}, digest)
+}
@@ -0,0 +1,82 @@
+package gmail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"google.golang.org/api/gmail/v1"
+)
+
+// ApplyAction applies the action to the Gmail message with the given ID.
+func ApplyAction(account string, id string, action integrations.EmailAction) error {
+
+	srv, err := newService(account)
+	if err != nil {
+		return err
+	}
+
+	request := &gmail.ModifyMessageRequest{}
+
+	// Gmail has no folders, everything is expressed as adding or removing labels
+	switch action.Action {
+	case "mark_read":
+		request.RemoveLabelIds = []string{"UNREAD"}
+	case "mark_unread":
+		request.AddLabelIds = []string{"UNREAD"}
+	case "archive":
+		request.RemoveLabelIds = []string{"INBOX"}
+	case "star", "flag":
+		request.AddLabelIds = []string{"STARRED"}
+	case "add_label", "move_to_folder":
+		name := action.Label
+		if action.Action == "move_to_folder" {
+			name = action.Folder
+		}
+
+		labelID, err := getLabelID(srv, name)
+		if err != nil {
+			return err
+		}
+
+		request.AddLabelIds = []string{labelID}
+		if action.Action == "move_to_folder" && labelID != "INBOX" {
+			request.RemoveLabelIds = []string{"INBOX"}
+		}
+	default:
+		return fmt.Errorf("Invalid action: %s", action.Action)
+	}
+
+	_, err = srv.Users.Messages.Modify("me", id, request).Do()
+	if err != nil {
+		return fmt.Errorf("Unable to modify message: %w", err)
+	}
+
+	return nil
+}
+
+// getLabelID returns the ID of the label with the given name or ID, creating the label if it does not exist.
+func getLabelID(srv *gmail.Service, name string) (string, error) {
+
+	labels, err := srv.Users.Labels.List("me").Do()
+	if err != nil {
+		return "", fmt.Errorf("Unable to retrieve labels: %w", err)
+	}
+
+	for _, label := range labels.Labels {
+		if label.Id == name || strings.EqualFold(label.Name, name) {
+			return label.Id, nil
+		}
+	}
+
+	label, err := srv.Users.Labels.Create("me", &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}).Do()
+	if err != nil {
+		return "", fmt.Errorf("Unable to create label: %w", err)
+	}
+
+	return label.Id, nil
+}
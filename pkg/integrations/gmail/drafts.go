@@ -0,0 +1,89 @@
+package gmail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"google.golang.org/api/gmail/v1"
+)
+
+// CreateDraft creates a draft reply to the message in the message's thread.
+func CreateDraft(account string, request integrations.DraftRequest) (*integrations.Draft, error) {
+
+	srv, err := newService(account)
+	if err != nil {
+		return nil, err
+	}
+
+	original, err := srv.Users.Messages.Get("me", request.MessageID).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve message: %w", err)
+	}
+
+	raw := buildReply(original, request.Body, request.Quote)
+
+	draft, err := srv.Users.Drafts.Create("me", &gmail.Draft{
+		Message: &gmail.Message{
+			Raw:      base64.URLEncoding.EncodeToString(raw),
+			ThreadId: original.ThreadId,
+		},
+	}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create draft: %w", err)
+	}
+
+	return &integrations.Draft{
+		ID:   draft.Id,
+		Link: fmt.Sprintf("https://mail.google.com/mail/u/0/#drafts?compose=%s", draft.Message.Id),
+	}, nil
+}
+
+// buildReply builds the raw RFC 5322 reply to the original message.
+// The In-Reply-To and References headers are what makes mail clients other than Gmail thread the reply.
+func buildReply(original *gmail.Message, body string, quote bool) []byte {
+
+	headers := original.Payload.Headers
+
+	to := getHeader("Reply-To", headers)
+	if to == "" {
+		to = getHeader("From", headers)
+	}
+
+	subject := getHeader("Subject", headers)
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	messageID := getHeader("Message-ID", headers)
+	if messageID == "" {
+		// Some senders use a different capitalisation
+		messageID = getHeader("Message-Id", headers)
+	}
+
+	references := strings.TrimSpace(getHeader("References", headers) + " " + messageID)
+
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "To: %s\r\n", to)
+	fmt.Fprintf(&raw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	if messageID != "" {
+		fmt.Fprintf(&raw, "In-Reply-To: %s\r\n", messageID)
+		fmt.Fprintf(&raw, "References: %s\r\n", references)
+	}
+	raw.WriteString("MIME-Version: 1.0\r\n")
+	raw.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	raw.WriteString("\r\n")
+	raw.WriteString(body)
+
+	if quote {
+		fmt.Fprintf(&raw, "\r\n\r\nOn %s, %s wrote:\r\n", getHeader("Date", headers), getHeader("From", headers))
+		for _, line := range strings.Split(strings.TrimRight(getMessageBody(original.Payload), "\r\n"), "\n") {
+			fmt.Fprintf(&raw, "> %s\r\n", strings.TrimRight(line, "\r"))
+		}
+	}
+
+	return raw.Bytes()
+}
@@ -0,0 +1,44 @@
+package gmail
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestBuildReply(t *testing.T) {
+	assert := assert.New(t)
+
+	original := &gmail.Message{
+		Payload: &gmail.MessagePart{
+			MimeType: "text/plain",
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "From", Value: "Alice <alice@example.com>"},
+				{Name: "Subject", Value: "Lunch"},
+				{Name: "Date", Value: "Mon, 2 Jan 2006 15:04:05 +0000"},
+				{Name: "Message-ID", Value: "<2@example.com>"},
+				{Name: "References", Value: "<1@example.com>"},
+			},
+			Body: &gmail.MessagePartBody{
+				Data: base64.URLEncoding.EncodeToString([]byte("Noon?\r\nOr later?\r\n")),
+			},
+		},
+	}
+
+	// Scenario 1: Reply without quoting
+	raw := string(buildReply(original, "Noon works.", false))
+	assert.Contains(raw, "To: Alice <alice@example.com>\r\n")
+	assert.Contains(raw, "Subject: Re: Lunch\r\n")
+	assert.Contains(raw, "In-Reply-To: <2@example.com>\r\n")
+	assert.Contains(raw, "References: <1@example.com> <2@example.com>\r\n")
+	assert.Contains(raw, "\r\n\r\nNoon works.")
+	assert.NotContains(raw, "> Noon?")
+
+	// Scenario 2: Reply quoting the original message, to the Reply-To address
+	original.Payload.Headers = append(original.Payload.Headers, &gmail.MessagePartHeader{Name: "Reply-To", Value: "team@example.com"})
+	raw = string(buildReply(original, "Noon works.", true))
+	assert.Contains(raw, "To: team@example.com\r\n")
+	assert.Contains(raw, "On Mon, 2 Jan 2006 15:04:05 +0000, Alice <alice@example.com> wrote:\r\n> Noon?\r\n> Or later?\r\n")
+}
@@ -4,31 +4,32 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
-	"time"
+	"net/mail"
+	"net/textproto"
 
 	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/actionitems"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/classify"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/ics"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/security"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/structured"
 	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
 )
 
-// GetEmails calls the Gmail API to get the user's emails.
-func GetEmails() ([]integrations.Email, error) {
+// newService creates a Gmail service client bound to the stored token of the account.
+func newService(account string) (*gmail.Service, error) {
 
-	// Get the OAuth2 config
-	config, err := utils.GetOAuth2Config("google")
+	// Get a token source that saves the refreshed tokens to redis
+	tokenSource, err := utils.NewTokenSource(account)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the token from redis
-	token, err := utils.RetrieveToken("google")
-	if err != nil {
-		return nil, err
-	}
-
-	// Create a new HTTP client and bind it to the token
-	client := config.Client(context.Background(), token)
+	// Create a new HTTP client and bind it to the token source
+	client := oauth2.NewClient(context.Background(), tokenSource)
 
 	// Create a new Gmail service client using the HTTP client
 	srv, err := gmail.NewService(context.Background(), option.WithHTTPClient(client))
@@ -36,46 +37,49 @@ func GetEmails() ([]integrations.Email, error) {
 		return nil, fmt.Errorf("Unable to retrieve Gmail client: %w", err)
 	}
 
-	// The current logged in user
-	user := "me"
-
-	// Get the current time
-	now := time.Now()
-
-	// Subtract 2 days from the current time
-	dateDiff := now.AddDate(0, 0, -2)
-
-	// Format the time in ISO 8601 format
-	dateDiffStr := dateDiff.Format("2006-01-02")
+	return srv, nil
+}
 
-	m, err := srv.Users.Messages.List(user).Q("is:unread").Q(fmt.Sprintf("after:%s", dateDiffStr)).Do()
-	if err != nil {
-		return nil, fmt.Errorf("Unable to retrieve messages: %w", err)
-	}
-
-	if len(m.Messages) == 0 {
-		fmt.Println("No messages found.")
-		return nil, err
+// toEmail converts a Gmail message into an Email
+func toEmail(c *gmail.Message) integrations.Email {
+	email := integrations.Email{
+		ID:               c.Id,
+		Subject:          getHeader("Subject", c.Payload.Headers),
+		Body:             getMessageBody(c.Payload),
+		Sender:           getHeader("From", c.Payload.Headers),
+		RecievedDateTime: getHeader("Date", c.Payload.Headers),
+		Invite:           getInvite(c.Payload),
+		Structured:       structured.Extract(getHTMLBody(c.Payload)),
+		To:               integrations.ParseAddresses(getHeader("To", c.Payload.Headers)),
+		Cc:               integrations.ParseAddresses(getHeader("Cc", c.Payload.Headers)),
+		ThreadID:         c.ThreadId,
+		Labels:           c.LabelIds,
 	}
+	email.ActionItems = actionitems.ForEmail(email)
+	email.Category = classify.Classify(email, headerMap(c.Payload.Headers))
+	email.Security = security.Analyze(messageHeader(c.Payload.Headers))
+	return email
+}
 
-	// Get the content of each email
-	gmailEmails := []integrations.Email{}
-	for _, msg := range m.Messages {
-		c, err := srv.Users.Messages.Get(user, msg.Id).Do()
-		if err != nil {
-			return nil, fmt.Errorf("Unable to retrieve message: %w", err)
+// headerMap returns the headers of the message by name, the first value wins
+func headerMap(headers []*gmail.MessagePartHeader) map[string]string {
+	values := map[string]string{}
+	for _, header := range headers {
+		if _, ok := values[header.Name]; !ok {
+			values[header.Name] = header.Value
 		}
-
-		gmailEmails = append(gmailEmails, integrations.Email{
-			Subject:          getHeader("Subject", c.Payload.Headers),
-			Body:             getMessageBody(c.Payload),
-			Sender:           getHeader("From", c.Payload.Headers),
-			RecievedDateTime: getHeader("Date", c.Payload.Headers),
-		})
-
 	}
+	return values
+}
 
-	return gmailEmails, nil
+// messageHeader returns the headers of the message keyed by their canonical name
+func messageHeader(headers []*gmail.MessagePartHeader) mail.Header {
+	header := mail.Header{}
+	for _, h := range headers {
+		key := textproto.CanonicalMIMEHeaderKey(h.Name)
+		header[key] = append(header[key], h.Value)
+	}
+	return header
 }
 
 func getHeader(name string, headers []*gmail.MessagePartHeader) string {
@@ -105,3 +109,42 @@ func getMessageBody(payload *gmail.MessagePart) string {
 	}
 	return ""
 }
+
+// getHTMLBody returns the content of the first text/html part of the message.
+func getHTMLBody(payload *gmail.MessagePart) string {
+	if payload.MimeType == "text/html" && payload.Body != nil {
+		data, _ := base64.URLEncoding.DecodeString(payload.Body.Data)
+		return string(data)
+	}
+
+	for _, part := range payload.Parts {
+		if body := getHTMLBody(part); body != "" {
+			return body
+		}
+	}
+	return ""
+}
+
+// getInvite parses the first calendar part of the message, nil is returned if there is none.
+// Only inline parts are read, invitations sent as attachments only are skipped.
+func getInvite(payload *gmail.MessagePart) *integrations.Invite {
+	if ics.IsCalendarType(payload.MimeType) && payload.Body != nil && payload.Body.Data != "" {
+		data, err := base64.URLEncoding.DecodeString(payload.Body.Data)
+		if err != nil {
+			return nil
+		}
+
+		invite, err := ics.Parse(data)
+		if err != nil {
+			return nil
+		}
+		return invite
+	}
+
+	for _, part := range payload.Parts {
+		if invite := getInvite(part); invite != nil {
+			return invite
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package gmail
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"google.golang.org/api/gmail/v1"
+)
+
+// SendEmail sends the email from the Gmail account.
+func SendEmail(account string, email integrations.OutgoingEmail) error {
+
+	srv, err := newService(account)
+	if err != nil {
+		return err
+	}
+
+	// Gmail fills in the From header with the authenticated user
+	_, err = srv.Users.Messages.Send("me", &gmail.Message{
+		Raw: base64.URLEncoding.EncodeToString(email.Raw("")),
+	}).Do()
+	if err != nil {
+		return fmt.Errorf("Unable to send message: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// SyncEmails returns the changes to the account's unread emails since the given history ID.
+// An empty cursor, or one that Gmail no longer knows, results in a full listing of the unread emails of the past 2 days.
+func SyncEmails(account string, cursor string) (*integrations.SyncResult, error) {
+
+	srv, err := newService(account)
+	if err != nil {
+		return nil, err
+	}
+
+	if cursor != "" {
+		result, err := syncHistory(srv, cursor)
+		if err == nil {
+			return result, nil
+		}
+
+		// Gmail only keeps the history for about a week, fall back to a full sync when it is gone
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+			return nil, err
+		}
+	}
+
+	return fullSync(srv)
+}
+
+// fullSync lists the unread emails of the past 2 days.
+func fullSync(srv *gmail.Service) (*integrations.SyncResult, error) {
+
+	// The user
+	user := "me"
+
+	// Get the history ID first so that changes made during the listing are picked up by the next sync
+	profile, err := srv.Users.GetProfile(user).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve profile: %w", err)
+	}
+
+	emails, err := listEmails(srv)
+	if err != nil {
+		return nil, err
+	}
+
+	return &integrations.SyncResult{
+		Reset:    true,
+		Upserted: emails,
+		Cursor:   strconv.FormatUint(profile.HistoryId, 10),
+	}, nil
+}
+
+// listEmails lists the unread emails of the past 2 days.
+func listEmails(srv *gmail.Service) ([]integrations.Email, error) {
+
+	// The user
+	user := "me"
+
+	// Format the date 2 days ago in ISO 8601 format
+	dateDiffStr := time.Now().AddDate(0, 0, -2).Format("2006-01-02")
+
+	emails := []integrations.Email{}
+
+	err := srv.Users.Messages.List(user).Q(fmt.Sprintf("is:unread after:%s", dateDiffStr)).Pages(context.Background(), func(m *gmail.ListMessagesResponse) error {
+		for _, msg := range m.Messages {
+			c, err := srv.Users.Messages.Get(user, msg.Id).Do()
+			if err != nil {
+				return fmt.Errorf("Unable to retrieve message: %w", err)
+			}
+			emails = append(emails, toEmail(c))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve messages: %w", err)
+	}
+
+	return emails, nil
+}
+
+// syncHistory returns the changes since the given history ID.
+func syncHistory(srv *gmail.Service, cursor string) (*integrations.SyncResult, error) {
+
+	// The user
+	user := "me"
+
+	startHistoryID, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid history ID %q: %w", cursor, err)
+	}
+
+	result := &integrations.SyncResult{Cursor: cursor}
+
+	// Collect the IDs of every message touched since the last sync, in order and without duplicates
+	changed := []string{}
+	seen := map[string]bool{}
+	touch := func(msg *gmail.Message) {
+		if msg != nil && !seen[msg.Id] {
+			seen[msg.Id] = true
+			changed = append(changed, msg.Id)
+		}
+	}
+
+	err = srv.Users.History.List(user).StartHistoryId(startHistoryID).Pages(context.Background(), func(h *gmail.ListHistoryResponse) error {
+		for _, history := range h.History {
+			for _, added := range history.MessagesAdded {
+				touch(added.Message)
+			}
+			for _, deleted := range history.MessagesDeleted {
+				touch(deleted.Message)
+			}
+			for _, labelAdded := range history.LabelsAdded {
+				touch(labelAdded.Message)
+			}
+			for _, labelRemoved := range history.LabelsRemoved {
+				touch(labelRemoved.Message)
+			}
+		}
+		result.Cursor = strconv.FormatUint(h.HistoryId, 10)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve history: %w", err)
+	}
+
+	// Look at the current state of each message rather than replaying the individual changes
+	for _, id := range changed {
+		c, err := srv.Users.Messages.Get(user, id).Do()
+		if err != nil {
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+				result.Removed = append(result.Removed, id)
+				continue
+			}
+			return nil, fmt.Errorf("Unable to retrieve message: %w", err)
+		}
+
+		if isUnread(c) {
+			result.Upserted = append(result.Upserted, toEmail(c))
+		} else {
+			result.Removed = append(result.Removed, id)
+		}
+	}
+
+	return result, nil
+}
+
+// isUnread checks if the message matches the is:unread search, which excludes spam and trash
+func isUnread(c *gmail.Message) bool {
+
+	unread := false
+	for _, label := range c.LabelIds {
+		switch label {
+		case "UNREAD":
+			unread = true
+		case "SPAM", "TRASH":
+			return false
+		}
+	}
+
+	return unread
+}
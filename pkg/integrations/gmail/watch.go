@@ -0,0 +1,30 @@
+package gmail
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Watch asks Gmail to publish the changes of the account's inbox to the given Pub/Sub topic.
+// It returns when the watch expires, Gmail stops publishing after 7 days unless it is called again.
+func Watch(account string, topicName string) (time.Time, error) {
+
+	srv, err := newService(account)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	response, err := srv.Users.Watch("me", &gmail.WatchRequest{
+		TopicName:           topicName,
+		LabelIds:            []string{"INBOX"},
+		LabelFilterBehavior: "include",
+	}).Do()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Unable to watch mailbox: %w", err)
+	}
+
+	// The expiration is in milliseconds since the epoch
+	return time.UnixMilli(response.Expiration), nil
+}
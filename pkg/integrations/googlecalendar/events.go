@@ -0,0 +1,98 @@
+package googlecalendar
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+)
+
+// calendarID is the calendar the invitations are added to
+const calendarID = "primary"
+
+// responseStatuses maps the answers to the attendee response statuses of Google Calendar
+var responseStatuses = map[string]string{
+	"accept":    "accepted",
+	"tentative": "tentative",
+	"decline":   "declined",
+}
+
+// newService creates a Calendar service client bound to the stored token of the Google account.
+func newService(account string) (*calendar.Service, error) {
+
+	// Get a token source that saves the refreshed tokens to redis
+	tokenSource, err := utils.NewTokenSource(account)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a new HTTP client and bind it to the token source
+	client := oauth2.NewClient(context.Background(), tokenSource)
+
+	srv, err := calendar.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve Calendar client: %w", err)
+	}
+
+	return srv, nil
+}
+
+// RespondToEvent answers the invitation to the event with the given iCalendar UID or event ID.
+// The organizer is notified of the answer. The iCalendar UID of the event is returned.
+func RespondToEvent(account string, id string, response integrations.EventResponse) (string, error) {
+
+	srv, err := newService(account)
+	if err != nil {
+		return "", err
+	}
+
+	event, err := findEvent(srv, id)
+	if err != nil {
+		return "", err
+	}
+
+	// The user's own entry in the attendee list is marked as self
+	found := false
+	for _, attendee := range event.Attendees {
+		if attendee.Self {
+			attendee.ResponseStatus = responseStatuses[response.Response]
+			attendee.Comment = response.Comment
+			found = true
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("The user is not an attendee of the event")
+	}
+
+	// The attendee list is replaced as a whole, so the other attendees are sent back unchanged
+	_, err = srv.Events.Patch(calendarID, event.Id, &calendar.Event{Attendees: event.Attendees}).SendUpdates("all").Do()
+	if err != nil {
+		return "", fmt.Errorf("Unable to update event: %w", err)
+	}
+
+	return event.ICalUID, nil
+}
+
+// findEvent looks the event up by its iCalendar UID, as found in the invitation emails, then by its ID.
+func findEvent(srv *calendar.Service, id string) (*calendar.Event, error) {
+
+	events, err := srv.Events.List(calendarID).ICalUID(id).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve events: %w", err)
+	}
+
+	if len(events.Items) > 0 {
+		return events.Items[0], nil
+	}
+
+	event, err := srv.Events.Get(calendarID, id).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve event: %w", err)
+	}
+
+	return event, nil
+}
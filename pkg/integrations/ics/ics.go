@@ -0,0 +1,337 @@
+package ics
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+)
+
+// IsCalendarType checks if the MIME type is one used for iCalendar invitations
+func IsCalendarType(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	return mediaType == "text/calendar" || mediaType == "application/ics"
+}
+
+// property is a single content line of an iCalendar object, e.g. DTSTART;TZID=Europe/Zurich:20240102T090000
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// Parse parses the first event of an iCalendar object into an invitation.
+func Parse(data []byte) (*integrations.Invite, error) {
+
+	properties := unfold(string(data))
+
+	invite := &integrations.Invite{}
+
+	// Offsets of the time zones defined in the object, used when the TZID is not a known location (e.g. Windows names)
+	offsets := map[string]*time.Location{}
+
+	// components is the stack of the components the current line belongs to
+	components := []string{}
+	current := func() string {
+		if len(components) == 0 {
+			return ""
+		}
+		return components[len(components)-1]
+	}
+
+	var timezone string
+	var start, end property
+	found := false
+
+	for _, line := range properties {
+		prop, err := parseProperty(line)
+		if err != nil {
+			continue
+		}
+
+		switch prop.name {
+		case "BEGIN":
+			components = append(components, strings.ToUpper(prop.value))
+			continue
+		case "END":
+			if len(components) > 0 {
+				if current() == "VEVENT" {
+					found = true
+				}
+				components = components[:len(components)-1]
+			}
+			continue
+		}
+
+		switch current() {
+		case "VCALENDAR":
+			if prop.name == "METHOD" {
+				invite.Method = strings.ToUpper(prop.value)
+			}
+		case "VTIMEZONE":
+			if prop.name == "TZID" {
+				timezone = prop.value
+			}
+		case "STANDARD":
+			// Daylight saving time is ignored, the standard offset is close enough to place the event
+			if prop.name == "TZOFFSETTO" && timezone != "" {
+				if location, err := parseOffset(timezone, prop.value); err == nil {
+					offsets[timezone] = location
+				}
+			}
+		case "VEVENT":
+			// Only the first event is used, the others are exceptions of a recurring event
+			if found {
+				continue
+			}
+
+			switch prop.name {
+			case "UID":
+				invite.UID = prop.value
+			case "SUMMARY":
+				invite.Summary = unescape(prop.value)
+			case "LOCATION":
+				invite.Location = unescape(prop.value)
+			case "DTSTART":
+				start = prop
+			case "DTEND":
+				end = prop
+			case "ORGANIZER":
+				organizer := toAttendee(prop)
+				invite.Organizer = &organizer
+			case "ATTENDEE":
+				invite.Attendees = append(invite.Attendees, toAttendee(prop))
+			case "STATUS":
+				// Some clients only mark the event as cancelled instead of using the CANCEL method
+				if strings.EqualFold(prop.value, "CANCELLED") && invite.Method == "" {
+					invite.Method = "CANCEL"
+				}
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no event found in the calendar")
+	}
+
+	if start.value == "" {
+		return nil, fmt.Errorf("the event has no start time")
+	}
+
+	var err error
+	invite.Start, invite.AllDay, err = parseTime(start, offsets)
+	if err != nil {
+		return nil, err
+	}
+
+	invite.End = invite.Start
+	if end.value != "" {
+		invite.End, _, err = parseTime(end, offsets)
+		if err != nil {
+			return nil, err
+		}
+	} else if invite.AllDay {
+		invite.End = invite.Start.AddDate(0, 0, 1)
+	}
+
+	// An object without a method is published rather than sent, treat it as a request
+	if invite.Method == "" {
+		invite.Method = "REQUEST"
+	}
+
+	return invite, nil
+}
+
+// FromMessage finds the calendar part of a raw RFC 5322 message and parses it.
+// It returns nil if the message has no calendar part.
+func FromMessage(raw []byte) (*integrations.Invite, error) {
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse message: %w", err)
+	}
+
+	data, err := findCalendarPart(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// findCalendarPart returns the decoded content of the first calendar part, recursing into multipart bodies
+func findCalendarPart(contentType string, transferEncoding string, body io.Reader) ([]byte, error) {
+
+	if contentType == "" {
+		return nil, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("unable to read multipart body: %w", err)
+			}
+
+			data, err := findCalendarPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil || data != nil {
+				return data, err
+			}
+		}
+	}
+
+	if !IsCalendarType(mediaType) {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read calendar part: %w", err)
+	}
+
+	switch strings.ToLower(transferEncoding) {
+	case "base64":
+		data, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode calendar part: %w", err)
+		}
+	case "quoted-printable":
+		data, err = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode calendar part: %w", err)
+		}
+	}
+
+	return data, nil
+}
+
+// unfold joins the content lines that were folded over several lines (RFC 5545 section 3.1)
+func unfold(data string) []string {
+
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	return strings.Split(data, "\n")
+}
+
+// parseProperty splits a content line into its name, parameters and value.
+// Parameter values can be quoted and contain the ":" and ";" separators.
+func parseProperty(line string) (property, error) {
+
+	prop := property{params: map[string]string{}}
+
+	quoted := false
+	fields := []string{}
+	last := 0
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			fields = append(fields, line[last:i])
+			last = i + 1
+		case c == ':' && !quoted:
+			fields = append(fields, line[last:i])
+			prop.value = line[i+1:]
+
+			prop.name = strings.ToUpper(fields[0])
+			for _, param := range fields[1:] {
+				key, value, _ := strings.Cut(param, "=")
+				prop.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+			}
+
+			return prop, nil
+		}
+	}
+
+	return prop, fmt.Errorf("invalid content line: %s", line)
+}
+
+// parseTime parses a DATE or DATE-TIME value, it also reports whether the value is a date
+func parseTime(prop property, offsets map[string]*time.Location) (time.Time, bool, error) {
+
+	if prop.params["VALUE"] == "DATE" || len(prop.value) == len("20060102") {
+		date, err := time.Parse("20060102", prop.value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid date %s: %w", prop.value, err)
+		}
+		return date, true, nil
+	}
+
+	if strings.HasSuffix(prop.value, "Z") {
+		utc, err := time.Parse("20060102T150405Z", prop.value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("invalid time %s: %w", prop.value, err)
+		}
+		return utc, false, nil
+	}
+
+	// Times without a time zone are floating, they are read as UTC
+	location := time.UTC
+	if tzid := prop.params["TZID"]; tzid != "" {
+		if loaded, err := time.LoadLocation(tzid); err == nil {
+			location = loaded
+		} else if offset, ok := offsets[tzid]; ok {
+			location = offset
+		}
+	}
+
+	local, err := time.ParseInLocation("20060102T150405", prop.value, location)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid time %s: %w", prop.value, err)
+	}
+
+	return local.UTC(), false, nil
+}
+
+// parseOffset turns a UTC offset such as +0100 into a fixed time zone
+func parseOffset(name string, offset string) (*time.Location, error) {
+
+	parsed, err := time.Parse("-0700", offset)
+	if err != nil {
+		return nil, err
+	}
+
+	_, seconds := parsed.Zone()
+
+	return time.FixedZone(name, seconds), nil
+}
+
+// toAttendee reads the name, address and participation status of an ORGANIZER or ATTENDEE property
+func toAttendee(prop property) integrations.Attendee {
+
+	email := prop.value
+	if len(email) >= len("mailto:") && strings.EqualFold(email[:len("mailto:")], "mailto:") {
+		email = email[len("mailto:"):]
+	}
+
+	return integrations.Attendee{
+		Name:   prop.params["CN"],
+		Email:  email,
+		Status: strings.ToUpper(prop.params["PARTSTAT"]),
+	}
+}
+
+// unescape reverts the escaping of TEXT values
+func unescape(value string) string {
+
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
@@ -0,0 +1,120 @@
+package ics
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/stretchr/testify/assert"
+)
+
+const request = "BEGIN:VCALENDAR\r\n" +
+	"PRODID:-//Google Inc//Google Calendar 70.9054//EN\r\n" +
+	"VERSION:2.0\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;TZID=Europe/Zurich:20240102T090000\r\n" +
+	"DTEND;TZID=Europe/Zurich:20240102T100000\r\n" +
+	"ORGANIZER;CN=\"Doe, Jane\":mailto:jane@example.com\r\n" +
+	"UID:abc123@google.com\r\n" +
+	"ATTENDEE;CUTYPE=INDIVIDUAL;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=\r\n" +
+	" TRUE;CN=john@example.com;X-NUM-GUESTS=0:mailto:john@example.com\r\n" +
+	"SUMMARY:Planning\\, Q1\r\n" +
+	"LOCATION:Room 1\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"SUMMARY:Reminder\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+
+	invite, err := Parse([]byte(request))
+	assert.NoError(err)
+	assert.Equal(&integrations.Invite{
+		Method:    "REQUEST",
+		UID:       "abc123@google.com",
+		Summary:   "Planning, Q1",
+		Location:  "Room 1",
+		Start:     time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC),
+		End:       time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC),
+		Organizer: &integrations.Attendee{Name: "Doe, Jane", Email: "jane@example.com"},
+		Attendees: []integrations.Attendee{{Name: "john@example.com", Email: "john@example.com", Status: "NEEDS-ACTION"}},
+	}, invite)
+}
+
+func TestParseWindowsTimeZoneAndCancel(t *testing.T) {
+	assert := assert.New(t)
+
+	// Outlook names the time zones after Windows and defines them in the object
+	cancel := "BEGIN:VCALENDAR\n" +
+		"METHOD:CANCEL\n" +
+		"BEGIN:VTIMEZONE\n" +
+		"TZID:W. Europe Standard Time\n" +
+		"BEGIN:STANDARD\n" +
+		"TZOFFSETFROM:+0200\n" +
+		"TZOFFSETTO:+0100\n" +
+		"END:STANDARD\n" +
+		"END:VTIMEZONE\n" +
+		"BEGIN:VEVENT\n" +
+		"UID:040000008200E00074C5B7101A82E008\n" +
+		"DTSTART;TZID=W. Europe Standard Time:20240102T090000\n" +
+		"DTEND;TZID=W. Europe Standard Time:20240102T093000\n" +
+		"SUMMARY:Standup\n" +
+		"END:VEVENT\n" +
+		"END:VCALENDAR\n"
+
+	invite, err := Parse([]byte(cancel))
+	assert.NoError(err)
+	assert.Equal("CANCEL", invite.Method)
+	assert.Equal(time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC), invite.Start)
+	assert.Equal(time.Date(2024, 1, 2, 8, 30, 0, 0, time.UTC), invite.End)
+}
+
+func TestParseAllDay(t *testing.T) {
+	assert := assert.New(t)
+
+	invite, err := Parse([]byte("BEGIN:VCALENDAR\nBEGIN:VEVENT\nUID:1\nDTSTART;VALUE=DATE:20240102\nEND:VEVENT\nEND:VCALENDAR\n"))
+	assert.NoError(err)
+	assert.Equal("REQUEST", invite.Method)
+	assert.True(invite.AllDay)
+	assert.Equal(time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), invite.End)
+
+	_, err = Parse([]byte("BEGIN:VCALENDAR\nEND:VCALENDAR\n"))
+	assert.Error(err)
+}
+
+func TestFromMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	raw := "From: jane@example.com\r\n" +
+		"Subject: Invitation: Planning\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"You have been invited\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/calendar; charset=\"UTF-8\"; method=REQUEST\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte(request)) + "\r\n" +
+		"--inner--\r\n" +
+		"--outer--\r\n"
+
+	invite, err := FromMessage([]byte(raw))
+	assert.NoError(err)
+	assert.Equal("abc123@google.com", invite.UID)
+
+	// Messages without a calendar part have no invitation
+	invite, err = FromMessage([]byte("Subject: Hello\r\nContent-Type: text/plain\r\n\r\nHi"))
+	assert.NoError(err)
+	assert.Nil(invite)
+}
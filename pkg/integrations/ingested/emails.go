@@ -0,0 +1,117 @@
+package ingested
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/agenda"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// Provider is the name under which ingested emails are stored and listed.
+const Provider = "ingested"
+
+// defaultRetention is how long ingested emails are kept when INGEST_RETENTION is not set.
+const defaultRetention = 7 * 24 * time.Hour
+
+// getRetention checks if a custom retention period is supplied, if not, returns the default retention.
+func getRetention() time.Duration {
+
+	retention, err := time.ParseDuration(os.Getenv("INGEST_RETENTION"))
+	if err != nil || retention <= 0 {
+		return defaultRetention
+	}
+
+	return retention
+}
+
+// indexKey returns the redis key of the sorted set ordering the user's ingested emails by received time
+func indexKey(user string) string {
+	return utils.UserKey(user, fmt.Sprintf("email_%s", Provider))
+}
+
+// emailKey returns the redis key of the user's ingested email with the given ID
+func emailKey(user string, id string) string {
+	return utils.UserKey(user, fmt.Sprintf("email_%s_%s", Provider, id))
+}
+
+// SaveEmail stores a parsed email of the user in redis with the retention TTL, and the invitation it carries in the user's agenda.
+func SaveEmail(user string, email integrations.Email) error {
+
+	emailJSON, err := json.Marshal(email)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal email: %w", err)
+	}
+
+	ctx := context.Background()
+	retention := getRetention()
+
+	// The email itself expires on its own, the sorted set keeps the listing order by received time
+	err = redisclient.Rdb.Set(ctx, emailKey(user, email.ID), emailJSON, retention).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save email to redis: %w", err)
+	}
+
+	received, err := time.Parse("2006-01-02T15:04:05Z", email.RecievedDateTime)
+	if err != nil {
+		received = time.Now()
+	}
+
+	err = redisclient.Rdb.ZAdd(ctx, indexKey(user), redis.Z{
+		Score:  float64(received.Unix()),
+		Member: email.ID,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to index email in redis: %w", err)
+	}
+
+	// The invitation outlives the email so that the agenda lists the event until it ends
+	return agenda.RecordInvites(user, Provider, "", []integrations.Email{email})
+}
+
+// GetEmails returns the user's ingested emails that are still within the retention period, newest first.
+func GetEmails(user string) ([]integrations.Email, error) {
+
+	ctx := context.Background()
+	index := indexKey(user)
+
+	// Drop index entries older than the retention period
+	cutoff := time.Now().Add(-getRetention()).Unix()
+	err := redisclient.Rdb.ZRemRangeByScore(ctx, index, "-inf", fmt.Sprintf("(%d", cutoff)).Err()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to prune ingested emails in redis: %w", err)
+	}
+
+	ids, err := redisclient.Rdb.ZRevRange(ctx, index, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list ingested emails from redis: %w", err)
+	}
+
+	ingestedEmails := []integrations.Email{}
+	for _, id := range ids {
+		emailJSON, err := redisclient.Rdb.Get(ctx, emailKey(user, id)).Result()
+		if err != nil {
+			// The email expired before its index entry was pruned
+			if err == redis.Nil {
+				continue
+			}
+			return nil, fmt.Errorf("Unable to retrieve ingested email from redis: %w", err)
+		}
+
+		var email integrations.Email
+		err = json.Unmarshal([]byte(emailJSON), &email)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to unmarshal email: %w", err)
+		}
+
+		ingestedEmails = append(ingestedEmails, email)
+	}
+
+	return ingestedEmails, nil
+}
@@ -0,0 +1,232 @@
+package ingested
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/actionitems"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/classify"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/ics"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/security"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/structured"
+)
+
+// webhookPayload is the JSON wrapper sent by common inbound-parse webhooks.
+// Only one of the fields is expected to be set.
+type webhookPayload struct {
+	Raw      string `json:"raw"`
+	Email    string `json:"email"`
+	BodyMime string `json:"body-mime"`
+	RawEmail string `json:"RawEmail"`
+}
+
+// ExtractRawMessage returns the raw RFC 5322 message from the request body.
+// JSON bodies are treated as an inbound-parse webhook wrapper, anything else is treated as the raw message itself.
+func ExtractRawMessage(contentType string, body []byte) ([]byte, error) {
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	if mediaType != "application/json" {
+		return body, nil
+	}
+
+	var payload webhookPayload
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal webhook payload: %w", err)
+	}
+
+	for _, raw := range []string{payload.Raw, payload.Email, payload.BodyMime, payload.RawEmail} {
+		if raw != "" {
+			return []byte(raw), nil
+		}
+	}
+
+	return nil, fmt.Errorf("webhook payload does not contain a raw message")
+}
+
+// ParseMessage parses a raw RFC 5322 message into an Email.
+func ParseMessage(raw []byte) (integrations.Email, error) {
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return integrations.Email{}, fmt.Errorf("unable to parse message: %w", err)
+	}
+
+	decoder := new(mime.WordDecoder)
+
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+
+	sender, err := decoder.DecodeHeader(msg.Header.Get("From"))
+	if err != nil {
+		sender = msg.Header.Get("From")
+	}
+
+	// Fall back to the time of ingestion if the Date header is missing or malformed
+	received, err := msg.Header.Date()
+	if err != nil {
+		received = time.Now()
+	}
+
+	body, err := getMessageBody("text/plain", msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return integrations.Email{}, err
+	}
+
+	// The HTML body is read in a second pass, it is only needed for the structured data
+	var data []integrations.StructuredData
+	htmlMsg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err == nil {
+		htmlBody, err := getMessageBody("text/html", htmlMsg.Header.Get("Content-Type"), htmlMsg.Header.Get("Content-Transfer-Encoding"), htmlMsg.Body)
+		if err == nil {
+			data = structured.Extract(htmlBody)
+		}
+	}
+
+	// A malformed invitation does not make the message unreadable
+	invite, err := ics.FromMessage(raw)
+	if err != nil {
+		invite = nil
+	}
+
+	email := integrations.Email{
+		ID:               MessageID(raw),
+		Subject:          subject,
+		Body:             body,
+		Sender:           sender,
+		RecievedDateTime: received.UTC().Format("2006-01-02T15:04:05Z"),
+		Invite:           invite,
+		Structured:       data,
+	}
+	email.ActionItems = actionitems.ForEmail(email)
+	email.To = integrations.ParseAddresses(msg.Header.Get("To"))
+	email.Cc = integrations.ParseAddresses(msg.Header.Get("Cc"))
+	email.ThreadID = threadID(msg.Header)
+
+	headers := map[string]string{}
+	for name := range msg.Header {
+		headers[name] = msg.Header.Get(name)
+	}
+	email.Category = classify.Classify(email, headers)
+	email.Security = security.Analyze(msg.Header)
+
+	return email, nil
+}
+
+// MessageID derives a stable ID from the Message-ID header so that the same message ingested twice is stored once.
+// Messages without a Message-ID are identified by their content.
+func MessageID(raw []byte) string {
+
+	sum := sha256.Sum256(raw)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err == nil && msg.Header.Get("Message-ID") != "" {
+		sum = sha256.Sum256([]byte(msg.Header.Get("Message-ID")))
+	}
+
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+// threadID returns the Message-ID of the first message of the conversation, as referenced by the replies
+func threadID(header mail.Header) string {
+
+	if references := strings.Fields(header.Get("References")); len(references) > 0 {
+		return references[0]
+	}
+
+	if inReplyTo := strings.TrimSpace(header.Get("In-Reply-To")); inReplyTo != "" {
+		return inReplyTo
+	}
+
+	return strings.TrimSpace(header.Get("Message-ID"))
+}
+
+// getMessageBody returns the content of the first part of the wanted media type (e.g. text/plain), recursing into multipart bodies.
+func getMessageBody(want string, contentType string, transferEncoding string, body io.Reader) (string, error) {
+
+	// Messages without a Content-Type are plain text by definition
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse content type: %w", err)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", fmt.Errorf("unable to read multipart body: %w", err)
+			}
+
+			// multipart.Reader already decodes quoted-printable parts and removes the header
+			text, err := getMessageBody(want, part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			if text != "" {
+				return text, nil
+			}
+		}
+	}
+
+	if mediaType != want {
+		return "", nil
+	}
+
+	data, err := io.ReadAll(decodeTransferEncoding(transferEncoding, body))
+	if err != nil {
+		return "", fmt.Errorf("unable to read message body: %w", err)
+	}
+
+	return string(data), nil
+}
+
+// decodeTransferEncoding wraps the reader with a decoder for the given Content-Transfer-Encoding.
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, newlineStripper{body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// newlineStripper drops line breaks so that wrapped base64 content can be decoded.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n newlineStripper) Read(p []byte) (int, error) {
+	count, err := n.r.Read(p)
+	j := 0
+	for _, b := range p[:count] {
+		if b != '\r' && b != '\n' {
+			p[j] = b
+			j++
+		}
+	}
+	return j, err
+}
@@ -0,0 +1,102 @@
+package ingested
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	// Scenario 1: Plain text message with an encoded subject
+	raw := "From: Alice <alice@example.com>\r\n" +
+		"To: me@example.com\r\n" +
+		"Subject: =?UTF-8?B?TWVldGluZyB0b21vcnJvdw==?=\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0200\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"\r\n" +
+		"See you at 10.\r\n"
+
+	email, err := ParseMessage([]byte(raw))
+	assert.NoError(err)
+	assert.Equal("Meeting tomorrow", email.Subject)
+	assert.Equal("Alice <alice@example.com>", email.Sender)
+	assert.Equal("2006-01-02T13:04:05Z", email.RecievedDateTime)
+	assert.Equal("See you at 10.\r\n", email.Body)
+
+	// Scenario 2: Multipart message with a base64 encoded text part
+	raw = "From: bob@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Attached</p>\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"QXR0YWNo\r\n" +
+		"ZWQ=\r\n" +
+		"--b1--\r\n"
+
+	email, err = ParseMessage([]byte(raw))
+	assert.NoError(err)
+	assert.Equal("Report", email.Subject)
+	assert.Equal("Attached", email.Body)
+
+	// Scenario 3: The HTML part embeds a parcel delivery
+	raw = "From: shipping@example.com\r\n" +
+		"Subject: Your order has shipped\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"b2\"\r\n" +
+		"\r\n" +
+		"--b2\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"On its way\r\n" +
+		"--b2\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<script type=\"application/ld+json\">{\"@type\": \"ParcelDelivery\", \"trackingNumber\": \"1Z999\"}</script>\r\n" +
+		"--b2--\r\n"
+
+	email, err = ParseMessage([]byte(raw))
+	assert.NoError(err)
+	assert.Equal("On its way", email.Body)
+	assert.Len(email.Structured, 1)
+	assert.Equal("1Z999", email.Structured[0].Parcel.TrackingNumber)
+
+	// Scenario 4: Not a message at all
+	_, err = ParseMessage([]byte("not a message"))
+	assert.Error(err)
+}
+
+func TestExtractRawMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	// Raw bodies are returned as they are
+	raw, err := ExtractRawMessage("message/rfc822", []byte("Subject: hi\r\n\r\nbody"))
+	assert.NoError(err)
+	assert.Equal("Subject: hi\r\n\r\nbody", string(raw))
+
+	// JSON wrappers carry the message in one of the known fields
+	raw, err = ExtractRawMessage("application/json; charset=utf-8", []byte(`{"body-mime":"Subject: hi\r\n\r\nbody"}`))
+	assert.NoError(err)
+	assert.Equal("Subject: hi\r\n\r\nbody", string(raw))
+
+	// JSON wrappers without a message are rejected
+	_, err = ExtractRawMessage("application/json", []byte(`{"subject":"hi"}`))
+	assert.Error(err)
+}
+
+func TestMessageID(t *testing.T) {
+	first := MessageID([]byte("Message-ID: <1@example.com>\r\nSubject: a\r\n\r\nbody"))
+	second := MessageID([]byte("Message-ID: <1@example.com>\r\nSubject: b\r\n\r\nother body"))
+	third := MessageID([]byte("Message-ID: <2@example.com>\r\nSubject: a\r\n\r\nbody"))
+
+	assert.Equal(t, first, second, "the same Message-ID should map to the same ID")
+	assert.NotEqual(t, first, third, "different Message-IDs should map to different IDs")
+}
@@ -1,9 +1,344 @@
 package integrations
 
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
 // Email is a struct to hold the email data
 type Email struct {
-	Subject          string `json:"subject"`
-	Body             string `json:"body"`
-	Sender           string `json:"sender"`
-	RecievedDateTime string `json:"recievedDateTime"`
+	ID               string  `json:"id"`
+	Subject          string  `json:"subject"`
+	Body             string  `json:"body"`
+	Sender           string  `json:"sender"`
+	RecievedDateTime string  `json:"recievedDateTime"`
+	Invite           *Invite `json:"invite,omitempty"`
+	// Structured is the schema.org data embedded in the HTML body
+	Structured []StructuredData `json:"structured,omitempty"`
+	// ActionItems are the requests, questions and deadlines found in the body
+	ActionItems []ActionItem `json:"action_items,omitempty"`
+	// To and Cc are the addresses of the recipients
+	To []string `json:"to,omitempty"`
+	Cc []string `json:"cc,omitempty"`
+	// ThreadID groups the emails of the same conversation
+	ThreadID string `json:"threadId,omitempty"`
+	// Labels are the Gmail labels, or the Outlook categories along with the focused or other inference
+	Labels []string `json:"labels,omitempty"`
+	// Category is personal, newsletter, notification, transactional or promotional
+	Category string `json:"category,omitempty"`
+	// Security holds the authentication results and the phishing warnings
+	Security *Security `json:"security,omitempty"`
+	// Priority is computed from the priority rules when the emails are listed
+	Priority *Priority `json:"priority,omitempty"`
+	// Account is the email of the connected account the email was received by
+	Account string `json:"account,omitempty"`
+	// Provider is google, outlook or ingested, it is only set in the listings merging the providers
+	Provider string `json:"provider,omitempty"`
+}
+
+// Priority is a struct to hold the priority score of an email and the reasons for it
+type Priority struct {
+	Score   int      `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// Security is a struct to hold the authenticity checks of an email
+type Security struct {
+	// SPF, DKIM and DMARC are the results reported by the receiving server, e.g. pass, fail or none.
+	// DKIM is unverified when the email is signed but no server reported on the signature.
+	SPF        string `json:"spf,omitempty"`
+	DKIM       string `json:"dkim,omitempty"`
+	DKIMDomain string `json:"dkimDomain,omitempty"`
+	DMARC      string `json:"dmarc,omitempty"`
+	// ReplyToMismatch is set when the replies go to another domain than the sender's
+	ReplyToMismatch bool `json:"replyToMismatch"`
+	// DisplayNameSpoofing is set when the display name shows another address or a brand the sender does not belong to
+	DisplayNameSpoofing bool `json:"displayNameSpoofing"`
+	// LookalikeDomain is the well-known domain the sender domain imitates
+	LookalikeDomain string `json:"lookalikeDomain,omitempty"`
+	// Verdict is pass, unknown, suspicious or fail
+	Verdict  string   `json:"verdict"`
+	Warnings []string `json:"warnings"`
+}
+
+// ActionItem is a struct to hold something the sender expects the user to do
+type ActionItem struct {
+	// Kind is request, question or deadline
+	Kind string `json:"kind"`
+	// Text is the sentence the item was found in
+	Text string `json:"text"`
+	// Due is the deadline in RFC 3339 format, resolved against the received time in the user's time zone
+	Due string `json:"due,omitempty"`
+}
+
+// Invite is a struct to hold a calendar invitation attached to an email
+type Invite struct {
+	// Method is the iTIP method of the invitation, e.g. REQUEST, CANCEL or REPLY
+	Method    string     `json:"method"`
+	UID       string     `json:"uid"`
+	Summary   string     `json:"summary"`
+	Location  string     `json:"location,omitempty"`
+	Start     time.Time  `json:"start"`
+	End       time.Time  `json:"end"`
+	AllDay    bool       `json:"allDay,omitempty"`
+	Organizer *Attendee  `json:"organizer,omitempty"`
+	Attendees []Attendee `json:"attendees,omitempty"`
+}
+
+// Attendee is a struct to hold the organizer or an attendee of an invitation
+type Attendee struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+	// Status is the participation status, e.g. NEEDS-ACTION, ACCEPTED or DECLINED
+	Status string `json:"status,omitempty"`
+}
+
+// ReceivedTime parses the received date time, which is either in ISO 8601 format or the RFC 5322 Date header format
+func (e Email) ReceivedTime() (time.Time, error) {
+
+	received, err := time.Parse("2006-01-02T15:04:05Z", e.RecievedDateTime)
+	if err == nil {
+		return received, nil
+	}
+
+	return mail.ParseDate(e.RecievedDateTime)
+}
+
+// SortNewestFirst sorts the emails by received time, newest first. The emails whose received time cannot be parsed are kept last.
+func SortNewestFirst(emails []Email) {
+
+	sort.SliceStable(emails, func(i, j int) bool {
+		a, errA := emails[i].ReceivedTime()
+		b, errB := emails[j].ReceivedTime()
+		if errA != nil || errB != nil {
+			return errA == nil && errB != nil
+		}
+		return a.After(b)
+	})
+}
+
+// AccountError reports a connected account whose emails were left out of a listing, the emails of the other accounts are still listed
+type AccountError struct {
+	Provider string `json:"provider"`
+	Account  string `json:"account"`
+	Error    string `json:"error"`
+}
+
+// SenderAddress returns the address of a sender formatted as "Name <address>" or as a bare address
+func SenderAddress(sender string) string {
+
+	if start, end := strings.LastIndex(sender, "<"), strings.LastIndex(sender, ">"); start >= 0 && end > start {
+		return strings.TrimSpace(sender[start+1 : end])
+	}
+
+	return strings.TrimSpace(sender)
+}
+
+// ParseAddresses returns the lower-cased addresses of an address list header such as To or Cc
+func ParseAddresses(header string) []string {
+
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+
+	addresses := []string{}
+
+	list, err := mail.ParseAddressList(header)
+	if err != nil {
+		// Fall back to splitting the header as it is when it does not follow RFC 5322
+		for _, address := range strings.Split(header, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, strings.ToLower(address))
+			}
+		}
+		return addresses
+	}
+
+	for _, address := range list {
+		addresses = append(addresses, strings.ToLower(address.Address))
+	}
+
+	return addresses
+}
+
+// SyncResult is a struct to hold the changes returned by an incremental mailbox sync
+type SyncResult struct {
+	// Reset is true when the result is a full listing that replaces the index
+	Reset bool
+	// Upserted are the emails that were added or changed
+	Upserted []Email
+	// Removed are the IDs of the emails that no longer match
+	Removed []string
+	// Cursor is the state to resume the next sync from
+	Cursor string
+}
+
+// EmailAction is a struct to hold an action to apply to an email
+type EmailAction struct {
+	Action string `json:"action"`
+	Label  string `json:"label,omitempty"`
+	Folder string `json:"folder,omitempty"`
+}
+
+// ValidEmailActions is a map of the actions that can be applied to an email
+var ValidEmailActions = map[string]bool{
+	"mark_read":      true,
+	"mark_unread":    true,
+	"archive":        true,
+	"star":           true,
+	"flag":           true,
+	"add_label":      true,
+	"move_to_folder": true,
+}
+
+// Validate checks if the action is known and has the arguments it needs
+func (a EmailAction) Validate() error {
+
+	if !ValidEmailActions[a.Action] {
+		return fmt.Errorf("Invalid action: %s", a.Action)
+	}
+
+	if a.Action == "add_label" && a.Label == "" {
+		return fmt.Errorf("The add_label action requires a label")
+	}
+
+	if a.Action == "move_to_folder" && a.Folder == "" {
+		return fmt.Errorf("The move_to_folder action requires a folder")
+	}
+
+	return nil
+}
+
+// StructuredData is a struct to hold a schema.org entity embedded in an email, only the field matching the type is set.
+// Times are in RFC 3339 format when they could be parsed and as found otherwise.
+type StructuredData struct {
+	// Type is the schema.org type, e.g. FlightReservation
+	Type    string              `json:"type"`
+	Flight  *FlightReservation  `json:"flight,omitempty"`
+	Lodging *LodgingReservation `json:"lodging,omitempty"`
+	Parcel  *ParcelDelivery     `json:"parcel,omitempty"`
+	Event   *EventReservation   `json:"event,omitempty"`
+}
+
+// FlightReservation is a struct to hold a flight booking
+type FlightReservation struct {
+	ReservationNumber string `json:"reservationNumber,omitempty"`
+	Passenger         string `json:"passenger,omitempty"`
+	Airline           string `json:"airline,omitempty"`
+	FlightNumber      string `json:"flightNumber,omitempty"`
+	DepartureAirport  string `json:"departureAirport,omitempty"`
+	DepartureTime     string `json:"departureTime,omitempty"`
+	DepartureTerminal string `json:"departureTerminal,omitempty"`
+	DepartureGate     string `json:"departureGate,omitempty"`
+	ArrivalAirport    string `json:"arrivalAirport,omitempty"`
+	ArrivalTime       string `json:"arrivalTime,omitempty"`
+	ArrivalTerminal   string `json:"arrivalTerminal,omitempty"`
+	Seat              string `json:"seat,omitempty"`
+}
+
+// LodgingReservation is a struct to hold a hotel booking
+type LodgingReservation struct {
+	ReservationNumber string `json:"reservationNumber,omitempty"`
+	Guest             string `json:"guest,omitempty"`
+	Name              string `json:"name,omitempty"`
+	Address           string `json:"address,omitempty"`
+	CheckinTime       string `json:"checkinTime,omitempty"`
+	CheckoutTime      string `json:"checkoutTime,omitempty"`
+}
+
+// ParcelDelivery is a struct to hold a shipment
+type ParcelDelivery struct {
+	Carrier              string `json:"carrier,omitempty"`
+	TrackingNumber       string `json:"trackingNumber,omitempty"`
+	TrackingURL          string `json:"trackingUrl,omitempty"`
+	Item                 string `json:"item,omitempty"`
+	Status               string `json:"status,omitempty"`
+	ExpectedArrivalFrom  string `json:"expectedArrivalFrom,omitempty"`
+	ExpectedArrivalUntil string `json:"expectedArrivalUntil,omitempty"`
+}
+
+// EventReservation is a struct to hold a ticket for an event
+type EventReservation struct {
+	ReservationNumber string `json:"reservationNumber,omitempty"`
+	Attendee          string `json:"attendee,omitempty"`
+	Name              string `json:"name,omitempty"`
+	StartDate         string `json:"startDate,omitempty"`
+	EndDate           string `json:"endDate,omitempty"`
+	Location          string `json:"location,omitempty"`
+	Address           string `json:"address,omitempty"`
+}
+
+// EventResponse is a struct to hold the answer to a meeting invitation
+type EventResponse struct {
+	Response string `json:"response"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// ValidEventResponses is a map of the answers that can be given to a meeting invitation
+var ValidEventResponses = map[string]bool{
+	"accept":    true,
+	"tentative": true,
+	"decline":   true,
+}
+
+// Validate checks if the answer is known
+func (r EventResponse) Validate() error {
+
+	if !ValidEventResponses[r.Response] {
+		return fmt.Errorf("Invalid response: %s", r.Response)
+	}
+
+	return nil
+}
+
+// DraftRequest is a struct to hold the content of a draft reply
+type DraftRequest struct {
+	MessageID string `json:"message_id"`
+	Body      string `json:"body"`
+	Quote     bool   `json:"quote"`
+}
+
+// Draft is a struct to hold a draft created in the user's mailbox
+type Draft struct {
+	ID   string `json:"id"`
+	Link string `json:"link"`
+}
+
+// OutgoingEmail is a struct to hold an email to be sent
+type OutgoingEmail struct {
+	To      []string `json:"to"`
+	Cc      []string `json:"cc,omitempty"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+}
+
+// Recipients returns all the recipients of the email
+func (e OutgoingEmail) Recipients() []string {
+	return append(append([]string{}, e.To...), e.Cc...)
+}
+
+// Raw builds the RFC 5322 plain text message for the email
+func (e OutgoingEmail) Raw(from string) []byte {
+
+	var raw bytes.Buffer
+	if from != "" {
+		fmt.Fprintf(&raw, "From: %s\r\n", from)
+	}
+	fmt.Fprintf(&raw, "To: %s\r\n", strings.Join(e.To, ", "))
+	if len(e.Cc) > 0 {
+		fmt.Fprintf(&raw, "Cc: %s\r\n", strings.Join(e.Cc, ", "))
+	}
+	fmt.Fprintf(&raw, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&raw, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	raw.WriteString("MIME-Version: 1.0\r\n")
+	raw.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	raw.WriteString("\r\n")
+	raw.WriteString(e.Body)
+
+	return raw.Bytes()
 }
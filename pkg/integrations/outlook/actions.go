@@ -0,0 +1,110 @@
+package outlook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// ApplyAction applies the action to the Outlook message with the given ID.
+func ApplyAction(account string, id string, action integrations.EmailAction) error {
+
+	graphClient, err := newGraphClient(account)
+	if err != nil {
+		return err
+	}
+
+	messageRequest := graphClient.Me().Messages().ByMessageId(id)
+
+	// Moving a message is a separate request, everything else is a PATCH on the message
+	switch action.Action {
+	case "archive", "move_to_folder":
+		destination := "archive"
+		if action.Action == "move_to_folder" {
+			destination, err = getFolderID(graphClient, action.Folder)
+			if err != nil {
+				return err
+			}
+		}
+
+		requestBody := graphusers.NewItemMessagesItemMovePostRequestBody()
+		requestBody.SetDestinationId(&destination)
+
+		_, err = messageRequest.Move().Post(context.Background(), requestBody, nil)
+		if err != nil {
+			return fmt.Errorf("Error moving message: %w", err)
+		}
+
+		return nil
+	}
+
+	patch := models.NewMessage()
+
+	switch action.Action {
+	case "mark_read", "mark_unread":
+		isRead := action.Action == "mark_read"
+		patch.SetIsRead(&isRead)
+	case "star", "flag":
+		flagStatus := models.FLAGGED_FOLLOWUPFLAGSTATUS
+		flag := models.NewFollowupFlag()
+		flag.SetFlagStatus(&flagStatus)
+		patch.SetFlag(flag)
+	case "add_label":
+		// Outlook labels are categories, the PATCH replaces the whole list so the existing ones have to be kept
+		message, err := messageRequest.Get(context.Background(), &graphusers.ItemMessagesMessageItemRequestBuilderGetRequestConfiguration{
+			QueryParameters: &graphusers.ItemMessagesMessageItemRequestBuilderGetQueryParameters{
+				Select: []string{"categories"},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Error getting message: %w", err)
+		}
+
+		categories := message.GetCategories()
+		for _, category := range categories {
+			if strings.EqualFold(category, action.Label) {
+				return nil
+			}
+		}
+		patch.SetCategories(append(categories, action.Label))
+	default:
+		return fmt.Errorf("Invalid action: %s", action.Action)
+	}
+
+	_, err = messageRequest.Patch(context.Background(), patch, nil)
+	if err != nil {
+		return fmt.Errorf("Error updating message: %w", err)
+	}
+
+	return nil
+}
+
+// getFolderID returns the ID of the top level mail folder with the given display name.
+// Well-known folder names (e.g. inbox, archive, deleteditems) and folder IDs are returned as they are.
+func getFolderID(graphClient *msgraphsdk.GraphServiceClient, name string) (string, error) {
+
+	filter := fmt.Sprintf("displayName eq '%s'", strings.ReplaceAll(name, "'", "''"))
+
+	folders, err := graphClient.Me().MailFolders().Get(context.Background(), &graphusers.ItemMailFoldersRequestBuilderGetRequestConfiguration{
+		QueryParameters: &graphusers.ItemMailFoldersRequestBuilderGetQueryParameters{
+			Filter: &filter,
+			Select: []string{"id"},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error getting mail folders: %w", err)
+	}
+
+	for _, folder := range folders.GetValue() {
+		if folder.GetId() != nil {
+			return *folder.GetId(), nil
+		}
+	}
+
+	return name, nil
+}
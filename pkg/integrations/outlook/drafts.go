@@ -0,0 +1,51 @@
+package outlook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// CreateDraft creates a draft reply to the message using createReply.
+func CreateDraft(account string, request integrations.DraftRequest) (*integrations.Draft, error) {
+
+	graphClient, err := newGraphClient(account)
+	if err != nil {
+		return nil, err
+	}
+
+	// The comment is placed above the quoted original message
+	requestBody := graphusers.NewItemMessagesItemCreateReplyPostRequestBody()
+	requestBody.SetComment(&request.Body)
+
+	draft, err := graphClient.Me().Messages().ByMessageId(request.MessageID).CreateReply().Post(context.Background(), requestBody, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating draft: %w", err)
+	}
+
+	// createReply always quotes the original message, replace the body to drop it
+	if !request.Quote {
+		contentType := models.TEXT_BODYTYPE
+		body := models.NewItemBody()
+		body.SetContentType(&contentType)
+		body.SetContent(&request.Body)
+
+		patch := models.NewMessage()
+		patch.SetBody(body)
+
+		draft, err = graphClient.Me().Messages().ByMessageId(*draft.GetId()).Patch(context.Background(), patch, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Error removing the quoted message from the draft: %w", err)
+		}
+	}
+
+	result := &integrations.Draft{ID: *draft.GetId()}
+	if draft.GetWebLink() != nil {
+		result.Link = *draft.GetWebLink()
+	}
+
+	return result, nil
+}
@@ -3,15 +3,19 @@ package outlook
 import (
 	"context"
 	"fmt"
-	"time"
+	"net/mail"
+	"net/textproto"
+	"strings"
 
 	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/actionitems"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/classify"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/security"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/structured"
 	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
 	abstractions "github.com/microsoft/kiota-abstractions-go"
 	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
-	msgraphcore "github.com/microsoftgraph/msgraph-sdk-go-core"
 	"github.com/microsoftgraph/msgraph-sdk-go/models"
-	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
 )
 
 // CustomAuthenticationProvider implements the AuthenticationProvider interface
@@ -27,10 +31,10 @@ func (c *CustomAuthenticationProvider) AuthenticateRequest(ctx context.Context,
 	return nil
 }
 
-// GetEmails calls the Microsoft Graph API to get the user's emails.
-func GetEmails() ([]integrations.Email, error) {
+// newGraphClient creates a Graph service client bound to the stored token of the account.
+func newGraphClient(account string) (*msgraphsdk.GraphServiceClient, error) {
 
-	accessToken, err := utils.RetrieveToken("outlook")
+	accessToken, err := utils.GetValidToken(account)
 	if err != nil {
 		return nil, err
 	}
@@ -44,57 +48,90 @@ func GetEmails() ([]integrations.Email, error) {
 		return nil, fmt.Errorf("Could not create request adapter: %v", err)
 	}
 
-	graphClient := msgraphsdk.NewGraphServiceClient(adapter)
-
-	// Get the current time
-	now := time.Now()
+	return msgraphsdk.NewGraphServiceClient(adapter), nil
+}
 
-	// Subtract 2 days from the current time
-	dateDiff := now.AddDate(0, 0, -2)
+// toEmail converts a Graph message into an Email
+func toEmail(message models.Messageable) integrations.Email {
 
-	// Format the time in ISO 8601 format
-	dateDiffStr := dateDiff.Format("2006-01-02T15:04:05Z")
+	email := integrations.Email{
+		ID:      stringValue(message.GetId()),
+		Subject: stringValue(message.GetSubject()),
+		Body:    stringValue(message.GetBodyPreview()),
+	}
 
-	requestFilter := fmt.Sprintf("singleValueExtendedProperties/Any(ep: ep/id eq 'String 0x001A' and contains(ep/value, 'IPM.Note')) and receivedDateTime ge %s ", dateDiffStr)
+	if message.GetSender() != nil && message.GetSender().GetEmailAddress() != nil {
+		email.Sender = stringValue(message.GetSender().GetEmailAddress().GetAddress())
+	}
 
-	requestParameters := &graphusers.ItemMessagesRequestBuilderGetQueryParameters{
-		Select:  []string{"sender", "subject", "bodyPreview", "receivedDateTime"},
-		Orderby: []string{"receivedDateTime DESC"},
-		Filter:  &requestFilter,
+	if message.GetReceivedDateTime() != nil {
+		email.RecievedDateTime = message.GetReceivedDateTime().UTC().Format("2006-01-02T15:04:05Z")
 	}
-	configuration := &graphusers.ItemMessagesRequestBuilderGetRequestConfiguration{
-		QueryParameters: requestParameters,
+
+	// The full body is only read for the structured data, the preview is enough for the planner
+	body := message.GetBody()
+	if body != nil && body.GetContentType() != nil && *body.GetContentType() == models.HTML_BODYTYPE {
+		email.Structured = structured.Extract(stringValue(body.GetContent()))
 	}
 
-	messages, err := graphClient.Me().Messages().Get(context.Background(), configuration)
+	email.To = recipientAddresses(message.GetToRecipients())
+	email.Cc = recipientAddresses(message.GetCcRecipients())
+	email.ThreadID = stringValue(message.GetConversationId())
 
-	if err != nil {
-		return nil, fmt.Errorf("Error getting messages: %w", err)
+	// The focused inbox inference is kept along with the categories so that both can be used as labels
+	email.Labels = message.GetCategories()
+	if message.GetInferenceClassification() != nil {
+		email.Labels = append(email.Labels, message.GetInferenceClassification().String())
 	}
 
-	// Initialize iterator
-	pageIterator, _ := msgraphcore.NewPageIterator[*models.Message](messages, graphClient.GetAdapter(), models.CreateMessageCollectionResponseFromDiscriminatorValue)
+	email.ActionItems = actionitems.ForEmail(email)
+
+	headers := map[string]string{}
+	for _, header := range message.GetInternetMessageHeaders() {
+		name := stringValue(header.GetName())
+		if _, ok := headers[name]; !ok && name != "" {
+			headers[name] = stringValue(header.GetValue())
+		}
+	}
+	email.Category = classify.Classify(email, headers)
+	email.Security = security.Analyze(messageHeader(message.GetInternetMessageHeaders()))
 
-	OutlookEmails := []integrations.Email{}
+	return email
+}
 
-	// Iterate over all pages
-	err = pageIterator.Iterate(context.Background(), func(message *models.Message) bool {
+// messageHeader returns the headers of the message keyed by their canonical name
+func messageHeader(headers []models.InternetMessageHeaderable) mail.Header {
+	header := mail.Header{}
+	for _, h := range headers {
+		if name := stringValue(h.GetName()); name != "" {
+			key := textproto.CanonicalMIMEHeaderKey(name)
+			header[key] = append(header[key], stringValue(h.GetValue()))
+		}
+	}
+	return header
+}
 
-		OutlookEmails = append(OutlookEmails, integrations.Email{
-			Subject:          *message.GetSubject(),
-			Body:             *message.GetBodyPreview(),
-			Sender:           *message.GetSender().GetEmailAddress().GetAddress(),
-			RecievedDateTime: message.GetReceivedDateTime().Format("2006-01-02T15:04:05Z"),
-		})
+// recipientAddresses returns the lower-cased addresses of the recipients
+func recipientAddresses(recipients []models.Recipientable) []string {
 
-		// Return true to continue the iteration
-		return true
-	})
+	addresses := []string{}
+	for _, recipient := range recipients {
+		if recipient.GetEmailAddress() != nil && recipient.GetEmailAddress().GetAddress() != nil {
+			addresses = append(addresses, strings.ToLower(*recipient.GetEmailAddress().GetAddress()))
+		}
+	}
 
-	// Check for errors
-	if err != nil {
-		return nil, fmt.Errorf("Error iterating over messages: %w", err)
+	if len(addresses) == 0 {
+		return nil
 	}
 
-	return OutlookEmails, nil
+	return addresses
+}
+
+// stringValue dereferences a string pointer returned by the Graph SDK, nil becomes an empty string
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
 }
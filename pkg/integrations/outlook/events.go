@@ -0,0 +1,129 @@
+package outlook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// RespondToEvent answers the invitation to the event with the given iCalendar UID or event ID.
+// The event is resolved from the meeting request with the given email ID if it is set, e.g. the one listed in the agenda.
+// The organizer is notified of the answer. The iCalendar UID of the event is returned.
+func RespondToEvent(account string, id string, emailID string, response integrations.EventResponse) (string, error) {
+
+	graphClient, err := newGraphClient(account)
+	if err != nil {
+		return "", err
+	}
+
+	eventID, uid, err := getEventID(graphClient, id, emailID)
+	if err != nil {
+		return "", err
+	}
+
+	eventRequest := graphClient.Me().Events().ByEventId(eventID)
+	sendResponse := true
+
+	var comment *string
+	if response.Comment != "" {
+		comment = &response.Comment
+	}
+
+	switch response.Response {
+	case "accept":
+		requestBody := graphusers.NewItemEventsItemAcceptPostRequestBody()
+		requestBody.SetComment(comment)
+		requestBody.SetSendResponse(&sendResponse)
+		err = eventRequest.Accept().Post(context.Background(), requestBody, nil)
+	case "tentative":
+		requestBody := graphusers.NewItemEventsItemTentativelyAcceptPostRequestBody()
+		requestBody.SetComment(comment)
+		requestBody.SetSendResponse(&sendResponse)
+		err = eventRequest.TentativelyAccept().Post(context.Background(), requestBody, nil)
+	case "decline":
+		requestBody := graphusers.NewItemEventsItemDeclinePostRequestBody()
+		requestBody.SetComment(comment)
+		requestBody.SetSendResponse(&sendResponse)
+		err = eventRequest.Decline().Post(context.Background(), requestBody, nil)
+	default:
+		return "", fmt.Errorf("Invalid response: %s", response.Response)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("Error responding to event: %w", err)
+	}
+
+	return uid, nil
+}
+
+// getEventID returns the ID and the iCalendar UID of the event with the given UID, as found in the invitation emails.
+// The event of the meeting request with the given email ID is used if it can be read, since the iCalUId of Outlook only
+// matches the UID of the invitation for some organizers. The UID is looked up among the events otherwise.
+// Values that are not a known UID are expected to be event IDs, the UID of the event is then looked up.
+func getEventID(graphClient *msgraphsdk.GraphServiceClient, id string, emailID string) (string, string, error) {
+
+	if emailID != "" {
+		// The agenda lists the event by the UID of the invitation, which the iCalUId of the event may not match
+		eventID, err := getMessageEventID(graphClient, emailID)
+		if err == nil {
+			return eventID, id, nil
+		}
+		log.Printf("Unable to resolve the event of the meeting request %s, looking it up by UID: %v", emailID, err)
+	}
+
+	filter := fmt.Sprintf("iCalUId eq '%s'", strings.ReplaceAll(id, "'", "''"))
+
+	events, err := graphClient.Me().Events().Get(context.Background(), &graphusers.ItemEventsRequestBuilderGetRequestConfiguration{
+		QueryParameters: &graphusers.ItemEventsRequestBuilderGetQueryParameters{
+			Filter: &filter,
+			Select: []string{"id"},
+		},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("Error getting events: %w", err)
+	}
+
+	for _, event := range events.GetValue() {
+		if event.GetId() != nil {
+			return *event.GetId(), id, nil
+		}
+	}
+
+	event, err := graphClient.Me().Events().ByEventId(id).Get(context.Background(), &graphusers.ItemEventsEventItemRequestBuilderGetRequestConfiguration{
+		QueryParameters: &graphusers.ItemEventsEventItemRequestBuilderGetQueryParameters{
+			Select: []string{"id", "iCalUId"},
+		},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("Error getting event: %w", err)
+	}
+
+	return id, stringValue(event.GetICalUId()), nil
+}
+
+// getMessageEventID returns the ID of the event the meeting request with the given ID is about
+func getMessageEventID(graphClient *msgraphsdk.GraphServiceClient, emailID string) (string, error) {
+
+	message, err := graphClient.Me().Messages().ByMessageId(emailID).Get(context.Background(), &graphusers.ItemMessagesMessageItemRequestBuilderGetRequestConfiguration{
+		QueryParameters: &graphusers.ItemMessagesMessageItemRequestBuilderGetQueryParameters{
+			Select: []string{"id"},
+			Expand: []string{"microsoft.graph.eventMessage/event($select=id)"},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error getting message: %w", err)
+	}
+
+	eventMessage, ok := message.(models.EventMessageable)
+	if !ok || eventMessage.GetEvent() == nil || eventMessage.GetEvent().GetId() == nil {
+		return "", fmt.Errorf("The message is not a meeting request")
+	}
+
+	return *eventMessage.GetEvent().GetId(), nil
+}
@@ -0,0 +1,29 @@
+package outlook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/ics"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+)
+
+// isMeetingMessage checks if Graph returned the message as a meeting request, cancellation or response
+func isMeetingMessage(message models.Messageable) bool {
+	_, ok := message.(models.EventMessageable)
+	return ok
+}
+
+// getInvite parses the invitation of a meeting message.
+// Graph does not expose the calendar part of a message, so it is read from the MIME content.
+func getInvite(graphClient *msgraphsdk.GraphServiceClient, id string) (*integrations.Invite, error) {
+
+	raw, err := graphClient.Me().Messages().ByMessageId(id).Content().Get(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting message content: %w", err)
+	}
+
+	return ics.FromMessage(raw)
+}
@@ -0,0 +1,60 @@
+package outlook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/microsoftgraph/msgraph-sdk-go/models"
+	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// SendEmail sends the email from the Outlook account using sendMail.
+func SendEmail(account string, email integrations.OutgoingEmail) error {
+
+	graphClient, err := newGraphClient(account)
+	if err != nil {
+		return err
+	}
+
+	contentType := models.TEXT_BODYTYPE
+	body := models.NewItemBody()
+	body.SetContentType(&contentType)
+	body.SetContent(&email.Body)
+
+	message := models.NewMessage()
+	message.SetSubject(&email.Subject)
+	message.SetBody(body)
+	message.SetToRecipients(toRecipients(email.To))
+	message.SetCcRecipients(toRecipients(email.Cc))
+
+	saveToSentItems := true
+	requestBody := graphusers.NewItemSendMailPostRequestBody()
+	requestBody.SetMessage(message)
+	requestBody.SetSaveToSentItems(&saveToSentItems)
+
+	err = graphClient.Me().SendMail().Post(context.Background(), requestBody, nil)
+	if err != nil {
+		return fmt.Errorf("Error sending message: %w", err)
+	}
+
+	return nil
+}
+
+// toRecipients converts a list of addresses into Graph recipients
+func toRecipients(addresses []string) []models.Recipientable {
+
+	recipients := []models.Recipientable{}
+	for _, address := range addresses {
+		address := address
+		emailAddress := models.NewEmailAddress()
+		emailAddress.SetAddress(&address)
+
+		recipient := models.NewRecipient()
+		recipient.SetEmailAddress(emailAddress)
+
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients
+}
@@ -0,0 +1,113 @@
+package outlook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+)
+
+// graphBaseURL is the root of the Graph API, it is a variable so that tests can point it to a local stand-in
+var graphBaseURL = "https://graph.microsoft.com/v1.0"
+
+// SubscriptionLifetime is how long a subscription is requested for. Graph allows a bit under 3 days for messages.
+const SubscriptionLifetime = 70 * time.Hour
+
+// ErrSubscriptionNotFound is returned when Graph no longer knows the subscription
+var ErrSubscriptionNotFound = fmt.Errorf("subscription not found")
+
+// Subscription is a struct to hold a Graph change notification subscription
+type Subscription struct {
+	ID                 string    `json:"id,omitempty"`
+	ChangeType         string    `json:"changeType,omitempty"`
+	NotificationURL    string    `json:"notificationUrl,omitempty"`
+	Resource           string    `json:"resource,omitempty"`
+	ExpirationDateTime time.Time `json:"expirationDateTime"`
+	ClientState        string    `json:"clientState,omitempty"`
+}
+
+// ChangeNotification is a struct to hold a single change notification sent by Graph
+type ChangeNotification struct {
+	SubscriptionID string `json:"subscriptionId"`
+	ClientState    string `json:"clientState"`
+	ChangeType     string `json:"changeType"`
+	Resource       string `json:"resource"`
+}
+
+// ChangeNotificationCollection is the body of a change notification request sent by Graph
+type ChangeNotificationCollection struct {
+	Value []ChangeNotification `json:"value"`
+}
+
+// CreateSubscription subscribes to new messages in every folder of the account's mailbox, matching the scope of the sync.
+// Graph validates the notification URL before answering, so it has to be reachable at this point.
+func CreateSubscription(account string, notificationURL string, clientState string) (*Subscription, error) {
+
+	return subscriptionRequest(account, http.MethodPost, "/subscriptions", Subscription{
+		ChangeType:         "created",
+		NotificationURL:    notificationURL,
+		Resource:           "me/messages",
+		ExpirationDateTime: time.Now().Add(SubscriptionLifetime).UTC(),
+		ClientState:        clientState,
+	})
+}
+
+// RenewSubscription extends the expiration of the subscription.
+func RenewSubscription(account string, id string) (*Subscription, error) {
+
+	return subscriptionRequest(account, http.MethodPatch, fmt.Sprintf("/subscriptions/%s", id), Subscription{
+		ExpirationDateTime: time.Now().Add(SubscriptionLifetime).UTC(),
+	})
+}
+
+// subscriptionRequest sends the subscription to the Graph subscriptions endpoint and returns the stored subscription.
+func subscriptionRequest(account string, method string, path string, subscription Subscription) (*Subscription, error) {
+
+	accessToken, err := utils.GetValidToken(account)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(subscription)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshal subscription: %w", err)
+	}
+
+	req, err := http.NewRequest(method, graphBaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+accessToken.AccessToken)
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error sending subscription request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read subscription response body: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrSubscriptionNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("Graph answered %d to the subscription request: %s", resp.StatusCode, data)
+	}
+
+	var stored Subscription
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal subscription: %w", err)
+	}
+
+	return &stored, nil
+}
@@ -0,0 +1,68 @@
+package outlook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionRequests(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// A stand-in for the Graph subscriptions endpoint
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Bearer access", r.Header.Get("Authorization"))
+
+		var subscription Subscription
+		assert.NoError(json.NewDecoder(r.Body).Decode(&subscription))
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/subscriptions":
+			assert.Equal("https://example.com/v1/webhooks/outlook", subscription.NotificationURL)
+			assert.Equal("secret", subscription.ClientState)
+			subscription.ID = "sub-1"
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPatch && r.URL.Path == "/subscriptions/sub-1":
+			subscription.ID = "sub-1"
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(subscription)
+	}))
+	defer server.Close()
+
+	graphBaseURL = server.URL
+	defer func() { graphBaseURL = "https://graph.microsoft.com/v1.0" }()
+
+	token := map[string]string{"access_token": "access"}
+
+	mock.ExpectHGetAll("outlook").SetVal(token)
+	mock.ExpectHGetAll("refreshToken_outlook").SetVal(map[string]string{})
+	created, err := CreateSubscription("outlook", "https://example.com/v1/webhooks/outlook", "secret")
+	assert.NoError(err)
+	assert.Equal("sub-1", created.ID)
+
+	mock.ExpectHGetAll("outlook").SetVal(token)
+	mock.ExpectHGetAll("refreshToken_outlook").SetVal(map[string]string{})
+	renewed, err := RenewSubscription("outlook", "sub-1")
+	assert.NoError(err)
+	assert.Equal("sub-1", renewed.ID)
+
+	mock.ExpectHGetAll("outlook").SetVal(token)
+	mock.ExpectHGetAll("refreshToken_outlook").SetVal(map[string]string{})
+	_, err = RenewSubscription("outlook", "sub-2")
+	assert.Equal(ErrSubscriptionNotFound, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
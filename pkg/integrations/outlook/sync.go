@@ -0,0 +1,184 @@
+package outlook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	abstractions "github.com/microsoft/kiota-abstractions-go"
+	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	graphusers "github.com/microsoftgraph/msgraph-sdk-go/users"
+)
+
+// messageFields are the message properties requested from Graph
+var messageFields = []string{"id", "sender", "subject", "body", "bodyPreview", "receivedDateTime", "toRecipients", "ccRecipients", "conversationId", "inferenceClassification", "categories", "internetMessageHeaders"}
+
+// SyncEmails returns the changes to the account's emails since the given cursor.
+// Graph only tracks the changes of messages by folder, so every mail folder is synced with its own delta link,
+// the cursor holds the delta link of each folder by folder ID. A new folder is listed from scratch.
+// An empty cursor, or one with a delta link that Graph no longer accepts, results in a full listing of the emails of the past 2 days.
+func SyncEmails(account string, cursor string) (*integrations.SyncResult, error) {
+
+	graphClient, err := newGraphClient(account)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := listFolderIDs(graphClient)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cursors of earlier versions are the delta link of the inbox alone, they are replaced by a full sync
+	deltaLinks := map[string]string{}
+	if cursor != "" && json.Unmarshal([]byte(cursor), &deltaLinks) != nil {
+		deltaLinks = map[string]string{}
+	}
+
+	reset := len(deltaLinks) == 0
+	result, err := syncFolders(graphClient, folders, deltaLinks, reset)
+
+	// Graph answers 410 Gone when a delta link has expired and a full sync is required
+	var apiErr abstractions.ApiErrorable
+	if !reset && errors.As(err, &apiErr) && apiErr.GetStatusCode() == http.StatusGone {
+		return syncFolders(graphClient, folders, map[string]string{}, true)
+	}
+
+	return result, err
+}
+
+// syncFolders syncs every folder from its delta link, or lists the emails of the past 2 days of the folders without one
+func syncFolders(graphClient *msgraphsdk.GraphServiceClient, folders []string, deltaLinks map[string]string, reset bool) (*integrations.SyncResult, error) {
+
+	// Format the time 2 days ago in ISO 8601 format
+	dateDiffStr := time.Now().AddDate(0, 0, -2).UTC().Format("2006-01-02T15:04:05Z")
+	requestFilter := fmt.Sprintf("receivedDateTime ge %s", dateDiffStr)
+
+	result := &integrations.SyncResult{Reset: reset}
+	cursors := map[string]string{}
+
+	for _, folder := range folders {
+		request := graphClient.Me().MailFolders().ByMailFolderId(folder).Messages().Delta()
+		configuration := &graphusers.ItemMailFoldersItemMessagesDeltaRequestBuilderGetRequestConfiguration{
+			QueryParameters: &graphusers.ItemMailFoldersItemMessagesDeltaRequestBuilderGetQueryParameters{
+				Filter: &requestFilter,
+				Select: messageFields,
+			},
+		}
+
+		if deltaLink, ok := deltaLinks[folder]; ok {
+			request = graphusers.NewItemMailFoldersItemMessagesDeltaRequestBuilder(deltaLink, graphClient.GetAdapter())
+			configuration = nil
+		}
+
+		folderResult, err := syncDelta(graphClient, request, configuration)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Upserted = append(result.Upserted, folderResult.Upserted...)
+		result.Removed = append(result.Removed, folderResult.Removed...)
+		cursors[folder] = folderResult.Cursor
+	}
+
+	cursor, err := json.Marshal(cursors)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to marshal delta links: %w", err)
+	}
+	result.Cursor = string(cursor)
+
+	return result, nil
+}
+
+// listFolderIDs returns the IDs of the mail folders of the mailbox, the child folders included
+func listFolderIDs(graphClient *msgraphsdk.GraphServiceClient) ([]string, error) {
+
+	ids := []string{}
+
+	// The folders whose child folders are still to be listed
+	parents := []string{}
+
+	page, err := graphClient.Me().MailFolders().Get(context.Background(), &graphusers.ItemMailFoldersRequestBuilderGetRequestConfiguration{
+		QueryParameters: &graphusers.ItemMailFoldersRequestBuilderGetQueryParameters{
+			Select: []string{"id", "childFolderCount"},
+		},
+	})
+
+	for {
+		if err != nil {
+			return nil, fmt.Errorf("Error listing mail folders: %w", err)
+		}
+
+		for _, folder := range page.GetValue() {
+			ids = append(ids, stringValue(folder.GetId()))
+			if folder.GetChildFolderCount() != nil && *folder.GetChildFolderCount() > 0 {
+				parents = append(parents, stringValue(folder.GetId()))
+			}
+		}
+
+		switch {
+		case page.GetOdataNextLink() != nil:
+			page, err = graphusers.NewItemMailFoldersRequestBuilder(*page.GetOdataNextLink(), graphClient.GetAdapter()).Get(context.Background(), nil)
+		case len(parents) > 0:
+			parent := parents[0]
+			parents = parents[1:]
+			page, err = graphClient.Me().MailFolders().ByMailFolderId(parent).ChildFolders().Get(context.Background(), &graphusers.ItemMailFoldersItemChildFoldersRequestBuilderGetRequestConfiguration{
+				QueryParameters: &graphusers.ItemMailFoldersItemChildFoldersRequestBuilderGetQueryParameters{
+					Select: []string{"id", "childFolderCount"},
+				},
+			})
+		default:
+			return ids, nil
+		}
+	}
+}
+
+// syncDelta follows the next links of the delta request until Graph returns a delta link.
+// The configuration is only used for the first request, the links returned by Graph already carry the query parameters.
+func syncDelta(graphClient *msgraphsdk.GraphServiceClient, request *graphusers.ItemMailFoldersItemMessagesDeltaRequestBuilder, configuration *graphusers.ItemMailFoldersItemMessagesDeltaRequestBuilderGetRequestConfiguration) (*integrations.SyncResult, error) {
+
+	result := &integrations.SyncResult{}
+
+	for {
+		page, err := request.GetAsDeltaGetResponse(context.Background(), configuration)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting message delta: %w", err)
+		}
+		configuration = nil
+
+		for _, message := range page.GetValue() {
+			// Deleted or moved messages only carry their ID and an @removed annotation
+			if _, removed := message.GetAdditionalData()["@removed"]; removed {
+				result.Removed = append(result.Removed, stringValue(message.GetId()))
+				continue
+			}
+
+			email := toEmail(message)
+			if isMeetingMessage(message) {
+				// A missing invitation should not hold up the sync of the other messages
+				email.Invite, err = getInvite(graphClient, email.ID)
+				if err != nil {
+					log.Printf("Error reading the invitation of Outlook message %s: %v", email.ID, err)
+				}
+			}
+			result.Upserted = append(result.Upserted, email)
+		}
+
+		if page.GetOdataNextLink() != nil {
+			request = graphusers.NewItemMailFoldersItemMessagesDeltaRequestBuilder(*page.GetOdataNextLink(), graphClient.GetAdapter())
+			continue
+		}
+
+		if page.GetOdataDeltaLink() == nil {
+			return nil, fmt.Errorf("Graph returned neither a next link nor a delta link")
+		}
+
+		result.Cursor = *page.GetOdataDeltaLink()
+		return result, nil
+	}
+}
@@ -0,0 +1,220 @@
+package security
+
+import (
+	"strings"
+)
+
+// AuthResults is a struct to hold a parsed Authentication-Results header (RFC 8601)
+type AuthResults struct {
+	// AuthServID identifies the server that ran the checks, e.g. mx.google.com
+	AuthServID string
+	Results    []MethodResult
+}
+
+// MethodResult is a struct to hold the result of an authentication method, e.g. spf=pass
+type MethodResult struct {
+	Method string
+	Result string
+	Reason string
+	// Properties are keyed by ptype.property, e.g. smtp.mailfrom or header.d
+	Properties map[string]string
+}
+
+// Result returns the result of the first check of the method, false is returned if the method was not checked
+func (a AuthResults) Result(method string) (MethodResult, bool) {
+
+	for _, result := range a.Results {
+		if result.Method == method {
+			return result, true
+		}
+	}
+
+	return MethodResult{}, false
+}
+
+// ParseAuthenticationResults parses the value of an Authentication-Results header.
+// Comments are ignored, the results are lower-cased and the property values are kept as they are.
+func ParseAuthenticationResults(value string) AuthResults {
+
+	statements := splitOutsideQuotes(stripComments(value), ';')
+	if len(statements) == 0 {
+		return AuthResults{}
+	}
+
+	// The authserv-id can be followed by a version number
+	header := strings.Fields(statements[0])
+	results := AuthResults{}
+	if len(header) > 0 {
+		results.AuthServID = strings.ToLower(header[0])
+	}
+
+	for _, statement := range statements[1:] {
+		tokens := fieldsOutsideQuotes(statement)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		method, result, ok := strings.Cut(tokens[0], "=")
+		if !ok {
+			// "none" means no checks were run
+			continue
+		}
+
+		// The method can carry a version, e.g. dkim/1
+		method, _, _ = strings.Cut(method, "/")
+
+		methodResult := MethodResult{
+			Method:     strings.ToLower(method),
+			Result:     strings.ToLower(unquote(result)),
+			Properties: map[string]string{},
+		}
+
+		for _, token := range tokens[1:] {
+			key, value, ok := strings.Cut(token, "=")
+			if !ok {
+				continue
+			}
+			key = strings.ToLower(key)
+			if key == "reason" {
+				methodResult.Reason = unquote(value)
+				continue
+			}
+			methodResult.Properties[key] = unquote(value)
+		}
+
+		results.Results = append(results.Results, methodResult)
+	}
+
+	return results
+}
+
+// ParseReceivedSPF returns the result of a Received-SPF header (RFC 7208), e.g. pass or softfail
+func ParseReceivedSPF(value string) string {
+
+	fields := strings.Fields(stripComments(value))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return strings.ToLower(fields[0])
+}
+
+// ParseDKIMSignature returns the tags of a DKIM-Signature header (RFC 6376), e.g. d for the signing domain
+func ParseDKIMSignature(value string) map[string]string {
+
+	tags := map[string]string{}
+
+	for _, tag := range strings.Split(value, ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		// Folding whitespace is allowed anywhere in the values
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+
+	return tags
+}
+
+// stripComments removes the parenthesized comments, which can be nested, outside of quoted strings
+func stripComments(value string) string {
+
+	var out strings.Builder
+	depth := 0
+	quoted := false
+	escaped := false
+
+	for _, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case quoted:
+			if r == '"' {
+				quoted = false
+			}
+		case r == '"' && depth == 0:
+			quoted = true
+		case r == '(':
+			depth++
+			continue
+		case r == ')' && depth > 0:
+			depth--
+			continue
+		}
+
+		if depth == 0 {
+			out.WriteRune(r)
+		} else {
+			out.WriteRune(' ')
+		}
+	}
+
+	return out.String()
+}
+
+// splitOutsideQuotes splits the value on the separator when it is not within a quoted string
+func splitOutsideQuotes(value string, separator rune) []string {
+
+	parts := []string{}
+	var current strings.Builder
+	quoted := false
+
+	for _, r := range value {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if r == separator && !quoted {
+			parts = append(parts, strings.TrimSpace(current.String()))
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+
+	if last := strings.TrimSpace(current.String()); last != "" {
+		parts = append(parts, last)
+	}
+
+	return parts
+}
+
+// fieldsOutsideQuotes splits the value on whitespace that is not within a quoted string
+func fieldsOutsideQuotes(value string) []string {
+
+	fields := []string{}
+	var current strings.Builder
+	quoted := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			fields = append(fields, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range value {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if !quoted && (r == ' ' || r == '\t' || r == '\r' || r == '\n') {
+			flush()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	flush()
+
+	return fields
+}
+
+// unquote removes the double quotes around a value
+func unquote(value string) string {
+
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
@@ -0,0 +1,69 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAuthenticationResults(t *testing.T) {
+	assert := assert.New(t)
+
+	results := ParseAuthenticationResults(`mx.google.com;
+       dkim=pass header.i=@example.com header.s=selector1 header.b="Ab3/dE+f";
+       spf=pass (google.com: domain of bounce@example.com designates 209.85.220.41 as permitted sender) smtp.mailfrom=bounce@example.com;
+       dmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=example.com`)
+
+	assert.Equal("mx.google.com", results.AuthServID)
+	assert.Equal([]MethodResult{
+		{Method: "dkim", Result: "pass", Properties: map[string]string{"header.i": "@example.com", "header.s": "selector1", "header.b": "Ab3/dE+f"}},
+		{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "bounce@example.com"}},
+		{Method: "dmarc", Result: "pass", Properties: map[string]string{"header.from": "example.com"}},
+	}, results.Results)
+
+	dmarc, ok := results.Result("dmarc")
+	assert.True(ok)
+	assert.Equal("pass", dmarc.Result)
+
+	_, ok = results.Result("arc")
+	assert.False(ok)
+}
+
+func TestParseAuthenticationResultsEdgeCases(t *testing.T) {
+	assert := assert.New(t)
+
+	// Version, nested comments, a semicolon in a quoted reason and upper case results
+	results := ParseAuthenticationResults(`example.net 1; spf=SoftFail (sender (nested) not permitted) smtp.mailfrom=x@evil.example reason="ip; not listed"; dkim/1=none`)
+
+	assert.Equal("example.net", results.AuthServID)
+	assert.Equal([]MethodResult{
+		{Method: "spf", Result: "softfail", Reason: "ip; not listed", Properties: map[string]string{"smtp.mailfrom": "x@evil.example"}},
+		{Method: "dkim", Result: "none", Properties: map[string]string{}},
+	}, results.Results)
+
+	// No checks were run
+	results = ParseAuthenticationResults("example.net; none")
+	assert.Equal("example.net", results.AuthServID)
+	assert.Empty(results.Results)
+
+	assert.Equal(AuthResults{}, ParseAuthenticationResults(""))
+}
+
+func TestParseReceivedSPF(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("pass", ParseReceivedSPF("Pass (protection.outlook.com: domain of example.com designates 40.107.1.1 as permitted sender) receiver=protection.outlook.com; client-ip=40.107.1.1"))
+	assert.Equal("softfail", ParseReceivedSPF("(comment first) softfail client-ip=1.2.3.4"))
+	assert.Equal("", ParseReceivedSPF(""))
+}
+
+func TestParseDKIMSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	tags := ParseDKIMSignature("v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=s1;\r\n\th=from:to:subject; bh=abc\r\n\tdef=; b=XYZ")
+
+	assert.Equal("example.com", tags["d"])
+	assert.Equal("s1", tags["s"])
+	assert.Equal("abcdef=", tags["bh"])
+	assert.Equal("from:to:subject", tags["h"])
+}
@@ -0,0 +1,309 @@
+package security
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+)
+
+// The verdicts of the security check
+const (
+	// VerdictPass is given to the emails that passed DMARC, or both SPF and DKIM, and raised no warning
+	VerdictPass = "pass"
+	// VerdictUnknown is given to the emails without authentication results that raised no warning
+	VerdictUnknown = "unknown"
+	// VerdictSuspicious is given to the emails that raised a warning
+	VerdictSuspicious = "suspicious"
+	// VerdictFail is given to the emails that failed DMARC, or both SPF and DKIM
+	VerdictFail = "fail"
+)
+
+// brands are the domains that phishing emails most often imitate, by the name they go by
+var brands = map[string]string{
+	"paypal":     "paypal.com",
+	"apple":      "apple.com",
+	"microsoft":  "microsoft.com",
+	"google":     "google.com",
+	"amazon":     "amazon.com",
+	"netflix":    "netflix.com",
+	"facebook":   "facebook.com",
+	"instagram":  "instagram.com",
+	"linkedin":   "linkedin.com",
+	"dropbox":    "dropbox.com",
+	"docusign":   "docusign.net",
+	"github":     "github.com",
+	"dhl":        "dhl.com",
+	"fedex":      "fedex.com",
+	"ups":        "ups.com",
+	"wellsfargo": "wellsfargo.com",
+	"hsbc":       "hsbc.com",
+	"ubs":        "ubs.com",
+}
+
+// brandNames are the names of the brands, sorted so that the first match is always the same one
+var brandNames = sortedBrandNames()
+
+// homoglyphs are the characters swapped in lookalike domains, replaced by the ones they imitate
+var homoglyphs = strings.NewReplacer("rn", "m", "vv", "w", "0", "o", "1", "l", "3", "e", "5", "s", "!", "i", "|", "l")
+
+// embeddedAddress finds an address written in a display name, e.g. "support@paypal.com <x@evil.example>"
+var embeddedAddress = regexp.MustCompile(`[A-Za-z0-9._%+-]+@([A-Za-z0-9-]+\.)+[A-Za-z]{2,}`)
+
+// Analyze checks the authentication results and the sender of the email.
+// The headers are those of the message, the topmost Authentication-Results header is the one added by the receiving server.
+func Analyze(headers mail.Header) *integrations.Security {
+
+	security := &integrations.Security{Warnings: []string{}}
+
+	fromName, fromAddress := parseAddress(headers.Get("From"))
+	fromDomain := domainOf(fromAddress)
+
+	if values := headers["Authentication-Results"]; len(values) > 0 {
+		results := ParseAuthenticationResults(values[0])
+
+		if spf, ok := results.Result("spf"); ok {
+			security.SPF = spf.Result
+		}
+		if dkim, ok := results.Result("dkim"); ok {
+			security.DKIM = dkim.Result
+			security.DKIMDomain = strings.ToLower(dkim.Properties["header.d"])
+			if security.DKIMDomain == "" {
+				security.DKIMDomain = domainOf(dkim.Properties["header.i"])
+			}
+		}
+		if dmarc, ok := results.Result("dmarc"); ok {
+			security.DMARC = dmarc.Result
+		}
+	}
+
+	// Received-SPF is only used when the receiving server did not report SPF along with the other checks
+	if security.SPF == "" && headers.Get("Received-SPF") != "" {
+		security.SPF = ParseReceivedSPF(headers.Get("Received-SPF"))
+	}
+
+	// A signature that no server reported on could not be checked here
+	if security.DKIM == "" && headers.Get("DKIM-Signature") != "" {
+		security.DKIM = "unverified"
+		security.DKIMDomain = strings.ToLower(ParseDKIMSignature(headers.Get("DKIM-Signature"))["d"])
+	}
+
+	if _, replyTo := parseAddress(headers.Get("Reply-To")); replyTo != "" && fromDomain != "" {
+		if replyToDomain := domainOf(replyTo); registrableDomain(replyToDomain) != registrableDomain(fromDomain) {
+			security.ReplyToMismatch = true
+			security.Warnings = append(security.Warnings, fmt.Sprintf("replies go to %s instead of %s", replyToDomain, fromDomain))
+		}
+	}
+
+	if spoofed := displayNameSpoof(fromName, fromAddress); spoofed != "" {
+		security.DisplayNameSpoofing = true
+		security.Warnings = append(security.Warnings, spoofed)
+	}
+
+	if imitated := Lookalike(fromDomain); imitated != "" {
+		security.LookalikeDomain = imitated
+		security.Warnings = append(security.Warnings, fmt.Sprintf("the sender domain %s looks like %s", fromDomain, imitated))
+	}
+
+	for _, check := range []struct{ name, result string }{{"SPF", security.SPF}, {"DKIM", security.DKIM}, {"DMARC", security.DMARC}} {
+		if isFailure(check.result) {
+			security.Warnings = append(security.Warnings, fmt.Sprintf("%s check failed (%s)", check.name, check.result))
+		}
+	}
+
+	security.Verdict = verdict(security)
+
+	return security
+}
+
+// verdict sums up the checks, a failed authentication outweighs the warnings
+func verdict(security *integrations.Security) string {
+
+	switch {
+	case security.DMARC == "fail" || (isFailure(security.SPF) && isFailure(security.DKIM)):
+		return VerdictFail
+	case len(security.Warnings) > 0:
+		return VerdictSuspicious
+	case security.DMARC == "pass" || (security.SPF == "pass" && security.DKIM == "pass"):
+		return VerdictPass
+	}
+
+	return VerdictUnknown
+}
+
+// isFailure tells whether the result of an authentication method is a failure
+func isFailure(result string) bool {
+	return result == "fail" || result == "softfail" || result == "permerror"
+}
+
+// displayNameSpoof checks whether the display name impersonates another sender, either by showing another address or a brand the address does not belong to
+func displayNameSpoof(name string, address string) string {
+
+	if name == "" || address == "" {
+		return ""
+	}
+
+	domain := domainOf(address)
+
+	if shown := embeddedAddress.FindString(name); shown != "" && !strings.EqualFold(shown, address) {
+		return fmt.Sprintf("the display name shows %s but the email was sent from %s", shown, address)
+	}
+
+	normalized := strings.ToLower(strings.Join(strings.Fields(name), ""))
+	for _, brand := range brandNames {
+		// Short brand names only count as whole words
+		if len(brand) <= 3 {
+			if !containsWord(strings.ToLower(name), brand) {
+				continue
+			}
+		} else if !strings.Contains(normalized, brand) {
+			continue
+		}
+
+		// Only the brand's own domain counts, a domain merely containing the name such as paypal.evil-login.com does not
+		if registrableDomain(domain) != brands[brand] {
+			return fmt.Sprintf("the display name mentions %s but the email was sent from %s", brand, domain)
+		}
+	}
+
+	return ""
+}
+
+// Lookalike returns the well-known domain the given domain imitates, an empty string is returned if it imitates none.
+// Internationalized domains are flagged as they can use characters that look like latin ones.
+func Lookalike(domain string) string {
+
+	if domain == "" {
+		return ""
+	}
+
+	registrable := registrableDomain(domain)
+	label := strings.SplitN(registrable, ".", 2)[0]
+
+	for _, brandDomain := range brands {
+		if registrable == brandDomain {
+			return ""
+		}
+	}
+
+	if strings.HasPrefix(label, "xn--") {
+		return "an internationalized domain"
+	}
+
+	for _, brand := range brandNames {
+		brandDomain := brands[brand]
+
+		// Swapped characters, e.g. paypa1.com or rnicrosoft.com
+		if homoglyphs.Replace(label) == brand && label != brand {
+			return brandDomain
+		}
+
+		// A single typo in a long enough name, e.g. amazom.com
+		if len(brand) >= 5 && label != brand && levenshtein(label, brand) == 1 {
+			return brandDomain
+		}
+
+		// The brand name with a suffix, e.g. paypal-security.com
+		if len(brand) >= 5 && strings.HasPrefix(label, brand+"-") {
+			return brandDomain
+		}
+	}
+
+	return ""
+}
+
+// sortedBrandNames returns the names of the brands in alphabetical order
+func sortedBrandNames() []string {
+
+	names := []string{}
+	for brand := range brands {
+		names = append(names, brand)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// parseAddress returns the display name and the lower-cased address of an address header
+func parseAddress(value string) (string, string) {
+
+	if value == "" {
+		return "", ""
+	}
+
+	address, err := mail.ParseAddress(value)
+	if err != nil {
+		return "", strings.ToLower(integrations.SenderAddress(value))
+	}
+
+	return address.Name, strings.ToLower(address.Address)
+}
+
+// domainOf returns the domain of the address
+func domainOf(address string) string {
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return strings.ToLower(address)
+	}
+
+	return strings.ToLower(address[at+1:])
+}
+
+// registrableDomain returns the domain the organization registered, approximated without the public suffix list.
+// Second-level suffixes such as co.uk are recognized by their short labels.
+func registrableDomain(domain string) string {
+
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	if len(labels) <= 2 {
+		return strings.Join(labels, ".")
+	}
+
+	n := len(labels)
+	if len(labels[n-1]) == 2 && len(labels[n-2]) <= 3 {
+		return strings.Join(labels[n-3:], ".")
+	}
+
+	return strings.Join(labels[n-2:], ".")
+}
+
+// containsWord checks whether the word appears in the text on its own
+func containsWord(text string, word string) bool {
+
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}) {
+		if field == word {
+			return true
+		}
+	}
+
+	return false
+}
+
+// levenshtein returns the edit distance between the two strings
+func levenshtein(a string, b string) int {
+
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
@@ -0,0 +1,83 @@
+package security
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyze(t *testing.T) {
+	assert := assert.New(t)
+
+	// A legitimate email
+	result := Analyze(mail.Header{
+		"From":                   {"Example Bank <alerts@example.com>"},
+		"Authentication-Results": {"mx.google.com; dkim=pass header.i=@example.com; spf=pass smtp.mailfrom=example.com; dmarc=pass header.from=example.com"},
+	})
+	assert.Equal(&integrations.Security{SPF: "pass", DKIM: "pass", DKIMDomain: "example.com", DMARC: "pass", Verdict: VerdictPass, Warnings: []string{}}, result)
+
+	// Replies go elsewhere and the display name pretends to be PayPal
+	result = Analyze(mail.Header{
+		"From":                   {`"PayPal Support" <service@secure-mail.example>`},
+		"Reply-To":               {"refunds@evil.example"},
+		"Authentication-Results": {"mx.example.net; spf=pass smtp.mailfrom=secure-mail.example; dkim=none"},
+	})
+	assert.True(result.ReplyToMismatch)
+	assert.True(result.DisplayNameSpoofing)
+	assert.Equal(VerdictSuspicious, result.Verdict)
+	assert.Equal([]string{
+		"replies go to evil.example instead of secure-mail.example",
+		"the display name mentions paypal but the email was sent from secure-mail.example",
+	}, result.Warnings)
+
+	// The brand name only appears in a subdomain of another domain
+	result = Analyze(mail.Header{"From": {"PayPal <service@paypal.evil-login.com>"}})
+	assert.True(result.DisplayNameSpoofing)
+	assert.Equal(VerdictSuspicious, result.Verdict)
+	assert.Equal([]string{"the display name mentions paypal but the email was sent from paypal.evil-login.com"}, result.Warnings)
+
+	// The brand's own subdomains are fine
+	result = Analyze(mail.Header{"From": {"PayPal <service@mail.paypal.com>"}})
+	assert.False(result.DisplayNameSpoofing)
+
+	// A lookalike domain failing DMARC
+	result = Analyze(mail.Header{
+		"From":                   {"Amazon <orders@arnazon.com>"},
+		"Authentication-Results": {"mx.example.net; spf=softfail smtp.mailfrom=arnazon.com; dmarc=fail header.from=arnazon.com"},
+		"Dkim-Signature":         {"v=1; d=arnazon.com; s=s1"},
+	})
+	assert.Equal("amazon.com", result.LookalikeDomain)
+	assert.Equal("unverified", result.DKIM)
+	assert.Equal("arnazon.com", result.DKIMDomain)
+	assert.Equal(VerdictFail, result.Verdict)
+
+	// Received-SPF only, with an address in the display name
+	result = Analyze(mail.Header{
+		"From":         {`"ceo@company.example" <ceo.company@gmail.com>`},
+		"Received-Spf": {"Pass (sender permitted) client-ip=1.2.3.4"},
+	})
+	assert.Equal("pass", result.SPF)
+	assert.True(result.DisplayNameSpoofing)
+	assert.Equal(VerdictSuspicious, result.Verdict)
+
+	// Nothing to go by
+	result = Analyze(mail.Header{"From": {"jane@example.org"}})
+	assert.Equal(VerdictUnknown, result.Verdict)
+}
+
+func TestLookalike(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("paypal.com", Lookalike("paypa1.com"))
+	assert.Equal("microsoft.com", Lookalike("account.rnicrosoft.com"))
+	assert.Equal("amazon.com", Lookalike("amazom.com"))
+	assert.Equal("paypal.com", Lookalike("paypal-security.com"))
+	assert.Equal("an internationalized domain", Lookalike("xn--pypal-4ve.com"))
+
+	assert.Equal("", Lookalike("paypal.com"))
+	assert.Equal("", Lookalike("email.apple.com"))
+	assert.Equal("", Lookalike("amazon.co.uk"))
+	assert.Equal("", Lookalike("example.com"))
+}
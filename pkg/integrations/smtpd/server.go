@@ -0,0 +1,482 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxMessageBytes is the largest message accepted when Config.MaxMessageBytes is not set.
+const defaultMaxMessageBytes = 10 << 20
+
+// Config is a struct to hold the SMTP receiver configuration
+type Config struct {
+	// Addr is the address to listen on, e.g. ":2525"
+	Addr string
+	// Domain is the host name announced in the greeting
+	Domain string
+	// Recipients is the list of addresses mail is accepted for
+	Recipients []string
+	// Username and Password enable AUTH when both are set
+	Username string
+	Password string
+	// TLSConfig enables STARTTLS when set
+	TLSConfig *tls.Config
+	// MaxMessageBytes limits the size of a single message
+	MaxMessageBytes int64
+	// Deliver is called with the raw message once it has been received
+	Deliver func(raw []byte) error
+}
+
+// Server is an SMTP receiver that hands every accepted message to Config.Deliver.
+type Server struct {
+	config   Config
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// NewServer returns a new SMTP receiver for the given configuration.
+func NewServer(config Config) *Server {
+
+	if config.Domain == "" {
+		config.Domain = "localhost"
+	}
+
+	if config.MaxMessageBytes <= 0 {
+		config.MaxMessageBytes = defaultMaxMessageBytes
+	}
+
+	return &Server{config: config}
+}
+
+// ConfigFromEnv builds the SMTP receiver configuration from the environment.
+// It returns nil if SMTP_LISTEN_ADDR is not set, which means the receiver is disabled.
+func ConfigFromEnv() (*Config, error) {
+
+	addr := os.Getenv("SMTP_LISTEN_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+
+	recipients := []string{}
+	for _, recipient := range strings.Split(os.Getenv("SMTP_RECIPIENTS"), ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			recipients = append(recipients, recipient)
+		}
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("SMTP_RECIPIENTS must list at least one address")
+	}
+
+	config := &Config{
+		Addr:       addr,
+		Domain:     os.Getenv("SMTP_DOMAIN"),
+		Recipients: recipients,
+		Username:   os.Getenv("SMTP_USERNAME"),
+		Password:   os.Getenv("SMTP_PASSWORD"),
+	}
+
+	certFile, keyFile := os.Getenv("SMTP_TLS_CERT"), os.Getenv("SMTP_TLS_KEY")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the SMTP TLS certificate: %w", err)
+		}
+		config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	return config, nil
+}
+
+// ListenAndServe listens on Config.Addr and serves SMTP sessions until the server is closed.
+func (s *Server) ListenAndServe() error {
+
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", s.config.Addr, err)
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener and serves SMTP sessions until the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("unable to accept SMTP connection: %w", err)
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops the server from accepting new connections.
+func (s *Server) Close() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+// session holds the state of a single SMTP connection
+type session struct {
+	server        *Server
+	conn          net.Conn
+	text          *textproto.Conn
+	tls           bool
+	authenticated bool
+	mail          bool
+	from          string
+	recipients    []string
+}
+
+// handle runs the SMTP dialogue on the connection until the client quits or the connection breaks.
+func (s *Server) handle(conn net.Conn) {
+
+	sess := &session{
+		server: s,
+		conn:   conn,
+		text:   textproto.NewConn(conn),
+	}
+	defer sess.text.Close()
+
+	sess.reply(220, fmt.Sprintf("%s ESMTP Day Planner GPT Data Portal", s.config.Domain))
+
+	for {
+		// Idle clients are disconnected after 5 minutes
+		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+		line, err := sess.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		quit := sess.command(strings.ToUpper(verb), strings.TrimSpace(arg))
+		if quit {
+			return
+		}
+	}
+}
+
+// command handles a single SMTP command and reports whether the session should end.
+func (sess *session) command(verb string, arg string) bool {
+
+	config := sess.server.config
+
+	switch verb {
+	case "HELO":
+		sess.reset()
+		sess.reply(250, config.Domain)
+
+	case "EHLO":
+		sess.reset()
+		extensions := []string{config.Domain, "8BITMIME", fmt.Sprintf("SIZE %d", config.MaxMessageBytes)}
+		if config.TLSConfig != nil && !sess.tls {
+			extensions = append(extensions, "STARTTLS")
+		}
+		if sess.authRequired() && !sess.authenticated {
+			extensions = append(extensions, "AUTH PLAIN LOGIN")
+		}
+		sess.reply(250, extensions...)
+
+	case "STARTTLS":
+		if config.TLSConfig == nil || sess.tls {
+			sess.reply(502, "STARTTLS not available")
+			return false
+		}
+		sess.reply(220, "Ready to start TLS")
+
+		tlsConn := tls.Server(sess.conn, config.TLSConfig)
+		err := tlsConn.Handshake()
+		if err != nil {
+			log.Printf("Error during the SMTP TLS handshake: %v", err)
+			return true
+		}
+
+		// The client has to start over with EHLO after the upgrade
+		sess.conn = tlsConn
+		sess.text = textproto.NewConn(tlsConn)
+		sess.tls = true
+		sess.reset()
+
+	case "AUTH":
+		sess.auth(arg)
+
+	case "MAIL":
+		if sess.authRequired() && !sess.authenticated {
+			sess.reply(530, "Authentication required")
+			return false
+		}
+		from, ok := parsePath(arg, "FROM:")
+		if !ok {
+			sess.reply(501, "Syntax: MAIL FROM:<address>")
+			return false
+		}
+		sess.reset()
+		sess.mail = true
+		sess.from = from
+		sess.reply(250, "OK")
+
+	case "RCPT":
+		if !sess.mail {
+			sess.reply(503, "Need MAIL before RCPT")
+			return false
+		}
+		to, ok := parsePath(arg, "TO:")
+		if !ok {
+			sess.reply(501, "Syntax: RCPT TO:<address>")
+			return false
+		}
+		if !sess.server.acceptsRecipient(to) {
+			sess.reply(550, "No such user here")
+			return false
+		}
+		sess.recipients = append(sess.recipients, to)
+		sess.reply(250, "OK")
+
+	case "DATA":
+		if len(sess.recipients) == 0 {
+			sess.reply(503, "Need RCPT before DATA")
+			return false
+		}
+		sess.reply(354, "End data with <CR><LF>.<CR><LF>")
+		sess.data()
+
+	case "RSET":
+		sess.reset()
+		sess.reply(250, "OK")
+
+	case "NOOP":
+		sess.reply(250, "OK")
+
+	case "VRFY":
+		sess.reply(252, "Cannot VRFY user")
+
+	case "QUIT":
+		sess.reply(221, "Bye")
+		return true
+
+	default:
+		sess.reply(502, "Command not implemented")
+	}
+
+	return false
+}
+
+// data reads the message content and hands it to the delivery function.
+func (sess *session) data() {
+
+	config := sess.server.config
+
+	// Read one byte past the limit to tell a message of exactly the maximum size from a larger one
+	dot := sess.text.DotReader()
+	raw, err := io.ReadAll(io.LimitReader(dot, config.MaxMessageBytes+1))
+	if err != nil {
+		sess.reply(451, "Error reading message")
+		return
+	}
+
+	if int64(len(raw)) > config.MaxMessageBytes {
+		// Drain the rest of the message so that the session stays in sync, a new dot reader would read the next commands
+		io.Copy(io.Discard, dot)
+		sess.reply(552, "Message exceeds the maximum size")
+		sess.reset()
+		return
+	}
+
+	// The dot reader normalises line endings to LF, restore the CRLF line endings of RFC 5322
+	raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+
+	received := fmt.Sprintf("Received: from %s by %s; %s\r\n", sess.conn.RemoteAddr(), config.Domain, time.Now().Format(time.RFC1123Z))
+	raw = append([]byte(received), raw...)
+
+	if config.Deliver != nil {
+		err = config.Deliver(raw)
+		if err != nil {
+			log.Printf("Error delivering SMTP message: %v", err)
+			sess.reply(451, "Unable to store message")
+			sess.reset()
+			return
+		}
+	}
+
+	sess.reply(250, "OK")
+	sess.reset()
+}
+
+// auth handles the AUTH PLAIN and AUTH LOGIN mechanisms.
+func (sess *session) auth(arg string) {
+
+	if !sess.authRequired() {
+		sess.reply(503, "Authentication not enabled")
+		return
+	}
+
+	if sess.authenticated {
+		sess.reply(503, "Already authenticated")
+		return
+	}
+
+	// Credentials must not be sent in the clear when TLS is available
+	if sess.server.config.TLSConfig != nil && !sess.tls {
+		sess.reply(538, "Encryption required for requested authentication mechanism")
+		return
+	}
+
+	mechanism, initial, _ := strings.Cut(arg, " ")
+
+	var username, password string
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			sess.reply(334, "")
+			line, err := sess.text.ReadLine()
+			if err != nil {
+				return
+			}
+			initial = line
+		}
+
+		// authzid \x00 authcid \x00 passwd
+		decoded, err := base64.StdEncoding.DecodeString(initial)
+		if err != nil {
+			sess.reply(501, "Invalid base64 data")
+			return
+		}
+		fields := strings.Split(string(decoded), "\x00")
+		if len(fields) != 3 {
+			sess.reply(501, "Invalid PLAIN credentials")
+			return
+		}
+		username, password = fields[1], fields[2]
+
+	case "LOGIN":
+		var ok bool
+		username, ok = sess.challenge("Username:")
+		if !ok {
+			return
+		}
+		password, ok = sess.challenge("Password:")
+		if !ok {
+			return
+		}
+
+	default:
+		sess.reply(504, "Unrecognized authentication type")
+		return
+	}
+
+	if username != sess.server.config.Username || password != sess.server.config.Password {
+		sess.reply(535, "Authentication credentials invalid")
+		return
+	}
+
+	sess.authenticated = true
+	sess.reply(235, "Authentication successful")
+}
+
+// challenge sends a base64 encoded AUTH LOGIN prompt and returns the decoded answer.
+func (sess *session) challenge(prompt string) (string, bool) {
+
+	sess.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+
+	line, err := sess.text.ReadLine()
+	if err != nil {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		sess.reply(501, "Invalid base64 data")
+		return "", false
+	}
+
+	return string(decoded), true
+}
+
+// authRequired reports whether clients must authenticate before sending mail.
+func (sess *session) authRequired() bool {
+	return sess.server.config.Username != "" && sess.server.config.Password != ""
+}
+
+// reset clears the current mail transaction.
+func (sess *session) reset() {
+	sess.mail = false
+	sess.from = ""
+	sess.recipients = nil
+}
+
+// reply writes a single or multi-line SMTP reply.
+func (sess *session) reply(code int, lines ...string) {
+
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+
+	writer := bufio.NewWriter(sess.conn)
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		fmt.Fprintf(writer, "%d%s%s\r\n", code, separator, line)
+	}
+	writer.Flush()
+}
+
+// acceptsRecipient reports whether the address is one of the configured recipients.
+func (s *Server) acceptsRecipient(address string) bool {
+	for _, recipient := range s.config.Recipients {
+		if strings.EqualFold(recipient, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePath extracts the address from a "FROM:<address>" or "TO:<address>" argument, ignoring any ESMTP parameters.
+func parsePath(arg string, prefix string) (string, bool) {
+
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	path := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(path, "<") {
+		return "", false
+	}
+
+	end := strings.Index(path, ">")
+	if end < 0 {
+		return "", false
+	}
+
+	return path[1:end], true
+}
@@ -0,0 +1,176 @@
+package smtpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertificate generates a self-signed certificate for localhost.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTestServer starts the receiver on a loopback listener and returns its address and the delivered messages.
+func startTestServer(t *testing.T, config Config) (string, chan []byte) {
+	delivered := make(chan []byte, 1)
+	config.Deliver = func(raw []byte) error {
+		delivered <- raw
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := NewServer(config)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+
+	return listener.Addr().String(), delivered
+}
+
+func TestServerDelivers(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, delivered := startTestServer(t, Config{Recipients: []string{"planner@example.com"}})
+
+	message := "From: alice@example.com\r\nSubject: Hello\r\n\r\nHi there\r\n"
+	err := smtp.SendMail(addr, nil, "alice@example.com", []string{"Planner@example.com"}, []byte(message))
+	assert.NoError(err)
+
+	select {
+	case raw := <-delivered:
+		assert.True(strings.HasPrefix(string(raw), "Received: from "), "missing Received header")
+		assert.Contains(string(raw), message)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
+
+func TestServerRejectsUnknownRecipient(t *testing.T) {
+	addr, _ := startTestServer(t, Config{Recipients: []string{"planner@example.com"}})
+
+	err := smtp.SendMail(addr, nil, "alice@example.com", []string{"someone@example.com"}, []byte("Subject: Hello\r\n\r\nHi\r\n"))
+	assert.ErrorContains(t, err, "550")
+}
+
+func TestServerRejectsOversizeMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, delivered := startTestServer(t, Config{Recipients: []string{"planner@example.com"}, MaxMessageBytes: 64})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	// The session must answer right away instead of waiting for more data
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	client, err := smtp.NewClient(conn, "127.0.0.1")
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	require.NoError(t, client.Mail("alice@example.com"))
+	require.NoError(t, client.Rcpt("planner@example.com"))
+
+	w, err := client.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: Hello\r\n\r\n" + strings.Repeat("Hi there\r\n", 50)))
+	require.NoError(t, err)
+	assert.ErrorContains(w.Close(), "552")
+
+	// The session is still in sync and accepts the next message
+	require.NoError(t, client.Mail("alice@example.com"))
+	require.NoError(t, client.Rcpt("planner@example.com"))
+	w, err = client.Data()
+	require.NoError(t, err)
+	_, err = w.Write([]byte("Subject: Hello\r\n\r\nHi\r\n"))
+	require.NoError(t, err)
+	assert.NoError(w.Close())
+
+	select {
+	case raw := <-delivered:
+		assert.Contains(string(raw), "Subject: Hello")
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
+
+func TestServerAuthAndStartTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, delivered := startTestServer(t, Config{
+		Recipients: []string{"planner@example.com"},
+		Username:   "user",
+		Password:   "secret",
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}},
+	})
+
+	// dial connects a new client, net/smtp closes the connection after a failed AUTH
+	dial := func(startTLS bool) *smtp.Client {
+		client, err := smtp.Dial(addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		if startTLS {
+			require.NoError(t, client.StartTLS(&tls.Config{InsecureSkipVerify: true}))
+		}
+		return client
+	}
+
+	// Mail is refused before authenticating
+	client := dial(false)
+	assert.Error(client.Mail("alice@example.com"))
+
+	// Credentials are refused before TLS is established
+	ok, _ := client.Extension("STARTTLS")
+	assert.True(ok, "STARTTLS should be advertised")
+	assert.ErrorContains(client.Auth(smtp.PlainAuth("", "user", "secret", "127.0.0.1")), "538")
+
+	// Wrong credentials are refused
+	client = dial(true)
+	assert.ErrorContains(client.Auth(smtp.PlainAuth("", "user", "wrong", "127.0.0.1")), "535")
+
+	client = dial(true)
+	require.NoError(t, client.Auth(smtp.PlainAuth("", "user", "secret", "127.0.0.1")))
+	require.NoError(t, client.Mail("alice@example.com"))
+	require.NoError(t, client.Rcpt("planner@example.com"))
+
+	writer, err := client.Data()
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Subject: Over TLS\r\n\r\nHi\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	assert.NoError(client.Quit())
+
+	select {
+	case raw := <-delivered:
+		assert.Contains(string(raw), "Subject: Over TLS")
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
@@ -0,0 +1,48 @@
+package smtprelay
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+)
+
+// Provider is the name of the generic SMTP relay provider.
+const Provider = "smtp"
+
+// SendEmail sends the email through the SMTP relay configured in the environment.
+func SendEmail(email integrations.OutgoingEmail) error {
+
+	// SMTP_RELAY_ADDR is the host and port of the relay, e.g. smtp.example.com:587
+	addr := os.Getenv("SMTP_RELAY_ADDR")
+	from := os.Getenv("SMTP_RELAY_FROM")
+	if addr == "" || from == "" {
+		return fmt.Errorf("SMTP relay is not configured, set SMTP_RELAY_ADDR and SMTP_RELAY_FROM")
+	}
+
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("Invalid SMTP_RELAY_FROM address: %w", err)
+	}
+
+	// net/smtp only sends credentials over TLS, which it upgrades to with STARTTLS when the relay supports it
+	var auth smtp.Auth
+	username := os.Getenv("SMTP_RELAY_USERNAME")
+	if username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("Invalid SMTP_RELAY_ADDR: %w", err)
+		}
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_RELAY_PASSWORD"), host)
+	}
+
+	err = smtp.SendMail(addr, auth, sender.Address, email.Recipients(), email.Raw(from))
+	if err != nil {
+		return fmt.Errorf("Unable to send message through the SMTP relay: %w", err)
+	}
+
+	return nil
+}
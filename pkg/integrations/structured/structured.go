@@ -0,0 +1,419 @@
+package structured
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"golang.org/x/net/html"
+)
+
+// entity is a schema.org item as decoded from JSON-LD, microdata items are converted to the same form
+type entity = map[string]interface{}
+
+// Extract returns the supported schema.org entities embedded in the HTML as JSON-LD or microdata.
+func Extract(body string) []integrations.StructuredData {
+
+	if body == "" {
+		return nil
+	}
+
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	entities := []entity{}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if n.Data == "script" && strings.EqualFold(strings.TrimSpace(attr(n, "type")), "application/ld+json") {
+				var value interface{}
+				if json.Unmarshal([]byte(textContent(n)), &value) == nil {
+					entities = append(entities, collectJSONLD(value)...)
+				}
+				return
+			}
+
+			// Items that are the property of another item are read along with it
+			if hasAttr(n, "itemscope") && !hasAttr(n, "itemprop") {
+				entities = append(entities, parseMicrodata(n))
+				return
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	data := []integrations.StructuredData{}
+	for _, e := range entities {
+		data = append(data, normalize(e)...)
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	return data
+}
+
+// collectJSONLD returns the entities of a JSON-LD document, which can be a single entity, a list or a @graph
+func collectJSONLD(value interface{}) []entity {
+
+	switch v := value.(type) {
+	case []interface{}:
+		entities := []entity{}
+		for _, item := range v {
+			entities = append(entities, collectJSONLD(item)...)
+		}
+		return entities
+	case map[string]interface{}:
+		if graph, ok := v["@graph"]; ok {
+			return collectJSONLD(graph)
+		}
+		return []entity{v}
+	}
+
+	return nil
+}
+
+// parseMicrodata converts the microdata item rooted at n into an entity
+func parseMicrodata(n *html.Node) entity {
+
+	e := entity{"@type": attr(n, "itemtype")}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+
+			props := strings.Fields(attr(c, "itemprop"))
+
+			// An item that is not a property belongs to no one here
+			if len(props) == 0 && hasAttr(c, "itemscope") {
+				continue
+			}
+
+			if len(props) > 0 {
+				var value interface{}
+				if hasAttr(c, "itemscope") {
+					value = parseMicrodata(c)
+				} else {
+					value = propertyValue(c)
+				}
+
+				// The first value of a property wins
+				for _, prop := range props {
+					if _, ok := e[prop]; !ok {
+						e[prop] = value
+					}
+				}
+
+				if hasAttr(c, "itemscope") {
+					continue
+				}
+			}
+
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return e
+}
+
+// propertyValue returns the value of a microdata property as defined by the HTML standard
+func propertyValue(n *html.Node) string {
+
+	switch n.Data {
+	case "meta":
+		return attr(n, "content")
+	case "a", "area", "link":
+		return attr(n, "href")
+	case "audio", "embed", "iframe", "img", "source", "track", "video":
+		return attr(n, "src")
+	case "object":
+		return attr(n, "data")
+	case "data", "meter":
+		return attr(n, "value")
+	case "time":
+		if hasAttr(n, "datetime") {
+			return attr(n, "datetime")
+		}
+	}
+
+	return strings.Join(strings.Fields(textContent(n)), " ")
+}
+
+// normalize converts the entity into the typed structure of its schema.org type, unsupported types are dropped
+func normalize(e entity) []integrations.StructuredData {
+
+	switch typeName(e) {
+	case "FlightReservation":
+		return []integrations.StructuredData{{Type: "FlightReservation", Flight: toFlight(e)}}
+	case "LodgingReservation":
+		return []integrations.StructuredData{{Type: "LodgingReservation", Lodging: toLodging(e)}}
+	case "ParcelDelivery":
+		return []integrations.StructuredData{{Type: "ParcelDelivery", Parcel: toParcel(e)}}
+	case "EventReservation":
+		return []integrations.StructuredData{{Type: "EventReservation", Event: toEvent(e)}}
+	case "Order":
+		// Shipping notifications often describe the order with the delivery nested in it
+		if delivery, ok := first(e["orderDelivery"]).(map[string]interface{}); ok {
+			if typeName(delivery) == "" {
+				delivery["@type"] = "ParcelDelivery"
+			}
+			return normalize(delivery)
+		}
+	}
+
+	return nil
+}
+
+func toFlight(e entity) *integrations.FlightReservation {
+
+	iataCode := get(e, "reservationFor", "airline", "iataCode")
+	flightNumber := get(e, "reservationFor", "flightNumber")
+	if iataCode != "" && flightNumber != "" && !strings.HasPrefix(flightNumber, iataCode) {
+		flightNumber = iataCode + flightNumber
+	}
+
+	seat := get(e, "reservedTicket", "ticketedSeat", "seatNumber")
+	if seat == "" {
+		seat = get(e, "airplaneSeat")
+	}
+
+	return &integrations.FlightReservation{
+		ReservationNumber: get(e, "reservationNumber"),
+		Passenger:         getName(e, "underName"),
+		Airline:           getName(e, "reservationFor", "airline"),
+		FlightNumber:      flightNumber,
+		DepartureAirport:  getAirport(e, "departureAirport"),
+		DepartureTime:     getTime(e, "reservationFor", "departureTime"),
+		DepartureTerminal: get(e, "reservationFor", "departureTerminal"),
+		DepartureGate:     get(e, "reservationFor", "departureGate"),
+		ArrivalAirport:    getAirport(e, "arrivalAirport"),
+		ArrivalTime:       getTime(e, "reservationFor", "arrivalTime"),
+		ArrivalTerminal:   get(e, "reservationFor", "arrivalTerminal"),
+		Seat:              seat,
+	}
+}
+
+func toLodging(e entity) *integrations.LodgingReservation {
+
+	checkin := getTime(e, "checkinTime")
+	if checkin == "" {
+		checkin = getTime(e, "checkinDate")
+	}
+
+	checkout := getTime(e, "checkoutTime")
+	if checkout == "" {
+		checkout = getTime(e, "checkoutDate")
+	}
+
+	return &integrations.LodgingReservation{
+		ReservationNumber: get(e, "reservationNumber"),
+		Guest:             getName(e, "underName"),
+		Name:              getName(e, "reservationFor"),
+		Address:           getAddress(e, "reservationFor", "address"),
+		CheckinTime:       checkin,
+		CheckoutTime:      checkout,
+	}
+}
+
+func toParcel(e entity) *integrations.ParcelDelivery {
+
+	carrier := getName(e, "carrier")
+	if carrier == "" {
+		carrier = getName(e, "provider")
+	}
+
+	return &integrations.ParcelDelivery{
+		Carrier:              carrier,
+		TrackingNumber:       get(e, "trackingNumber"),
+		TrackingURL:          get(e, "trackingUrl"),
+		Item:                 getName(e, "itemShipped"),
+		Status:               trimSchema(getName(e, "deliveryStatus")),
+		ExpectedArrivalFrom:  getTime(e, "expectedArrivalFrom"),
+		ExpectedArrivalUntil: getTime(e, "expectedArrivalUntil"),
+	}
+}
+
+func toEvent(e entity) *integrations.EventReservation {
+
+	return &integrations.EventReservation{
+		ReservationNumber: get(e, "reservationNumber"),
+		Attendee:          getName(e, "underName"),
+		Name:              getName(e, "reservationFor"),
+		StartDate:         getTime(e, "reservationFor", "startDate"),
+		EndDate:           getTime(e, "reservationFor", "endDate"),
+		Location:          getName(e, "reservationFor", "location"),
+		Address:           getAddress(e, "reservationFor", "location", "address"),
+	}
+}
+
+// typeName returns the schema.org type of the entity without the vocabulary prefix
+func typeName(e entity) string {
+	return trimSchema(get(e, "@type"))
+}
+
+// trimSchema removes the schema.org vocabulary prefix, e.g. from http://schema.org/OrderInTransit
+func trimSchema(value string) string {
+
+	for _, prefix := range []string{"http://schema.org/", "https://schema.org/"} {
+		if len(value) > len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) {
+			return value[len(prefix):]
+		}
+	}
+
+	return value
+}
+
+// first returns the first value of a list, other values are returned as they are
+func first(value interface{}) interface{} {
+
+	if list, ok := value.([]interface{}); ok {
+		if len(list) == 0 {
+			return nil
+		}
+		return list[0]
+	}
+
+	return value
+}
+
+// lookup follows the path through the nested entities
+func lookup(value interface{}, path ...string) interface{} {
+
+	for _, key := range path {
+		e, ok := first(value).(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = e[key]
+	}
+
+	return first(value)
+}
+
+// get returns the text value at the end of the path, an empty string is returned if there is none
+func get(e entity, path ...string) string {
+
+	switch v := lookup(e, path...).(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+
+	return ""
+}
+
+// getName returns the name of the entity at the end of the path, which can also be given as plain text
+func getName(e entity, path ...string) string {
+
+	if name := get(e, append(path, "name")...); name != "" {
+		return name
+	}
+
+	return get(e, path...)
+}
+
+// getAirport returns the IATA code of the flight's airport, or its name if the code is missing
+func getAirport(e entity, airport string) string {
+
+	if code := get(e, "reservationFor", airport, "iataCode"); code != "" {
+		return code
+	}
+
+	return getName(e, "reservationFor", airport)
+}
+
+// getAddress returns the postal address at the end of the path on a single line
+func getAddress(e entity, path ...string) string {
+
+	if address, ok := lookup(e, path...).(string); ok {
+		return strings.TrimSpace(address)
+	}
+
+	parts := []string{}
+	for _, field := range []string{"streetAddress", "postalCode", "addressLocality", "addressRegion"} {
+		if value := get(e, append(path, field)...); value != "" {
+			parts = append(parts, value)
+		}
+	}
+	if country := getName(e, append(path, "addressCountry")...); country != "" {
+		parts = append(parts, country)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// timeLayouts are the ISO 8601 forms found in the wild, the ones without an offset are ambiguous and left as they are
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02T15:04:05-0700", "2006-01-02T15:04-0700"}
+
+// getTime returns the date or time at the end of the path in RFC 3339 format if it has an offset
+func getTime(e entity, path ...string) string {
+
+	value := get(e, path...)
+
+	for _, layout := range timeLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err == nil {
+			return parsed.Format(time.RFC3339)
+		}
+	}
+
+	return value
+}
+
+// attr returns the value of the attribute, an empty string is returned if it is not set
+func attr(n *html.Node, name string) string {
+
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+
+	return ""
+}
+
+// hasAttr checks if the attribute is set, which is all that matters for boolean attributes such as itemscope
+func hasAttr(n *html.Node, name string) bool {
+
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// textContent returns the concatenated text of the node and its descendants
+func textContent(n *html.Node) string {
+
+	var text strings.Builder
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+
+	return text.String()
+}
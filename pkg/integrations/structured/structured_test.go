@@ -0,0 +1,134 @@
+package structured
+
+import (
+	"testing"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractJSONLD(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `<html><head><script type="application/ld+json">
+[{
+  "@context": "http://schema.org",
+  "@type": "FlightReservation",
+  "reservationNumber": "RXJ34P",
+  "underName": {"@type": "Person", "name": "Eva Green"},
+  "reservationFor": {
+    "@type": "Flight",
+    "flightNumber": "110",
+    "airline": {"@type": "Airline", "name": "United", "iataCode": "UA"},
+    "departureAirport": {"@type": "Airport", "name": "San Francisco Airport", "iataCode": "SFO"},
+    "departureTime": "2027-03-04T14:05:00-08:00",
+    "departureGate": "B12",
+    "arrivalAirport": {"@type": "Airport", "name": "John F. Kennedy International Airport", "iataCode": "JFK"},
+    "arrivalTime": "2027-03-05T06:30:00-05:00"
+  },
+  "airplaneSeat": "9A"
+}, {
+  "@context": "http://schema.org",
+  "@type": "Newsletter"
+}]
+</script></head><body><p>Your flight</p></body></html>`
+
+	assert.Equal([]integrations.StructuredData{{
+		Type: "FlightReservation",
+		Flight: &integrations.FlightReservation{
+			ReservationNumber: "RXJ34P",
+			Passenger:         "Eva Green",
+			Airline:           "United",
+			FlightNumber:      "UA110",
+			DepartureAirport:  "SFO",
+			DepartureTime:     "2027-03-04T14:05:00-08:00",
+			DepartureGate:     "B12",
+			ArrivalAirport:    "JFK",
+			ArrivalTime:       "2027-03-05T06:30:00-05:00",
+			Seat:              "9A",
+		},
+	}}, Extract(body))
+}
+
+func TestExtractJSONLDGraph(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `<script type="application/ld+json">{"@context": "https://schema.org", "@graph": [{
+  "@type": "LodgingReservation",
+  "reservationNumber": "abc456",
+  "reservationFor": {
+    "@type": "LodgingBusiness",
+    "name": "Hilton San Francisco Union Square",
+    "address": {"@type": "PostalAddress", "streetAddress": "333 O'Farrell St", "addressLocality": "San Francisco", "postalCode": "94102", "addressCountry": "US"}
+  },
+  "checkinDate": "2027-04-11T16:00:00-08:00",
+  "checkoutDate": "2027-04-13"
+}, {
+  "@type": "Order",
+  "orderDelivery": {"trackingNumber": "1Z999", "carrier": "UPS", "deliveryStatus": {"@type": "DeliveryEvent", "name": "http://schema.org/OrderInTransit"}}
+}]}</script>`
+
+	assert.Equal([]integrations.StructuredData{{
+		Type: "LodgingReservation",
+		Lodging: &integrations.LodgingReservation{
+			ReservationNumber: "abc456",
+			Name:              "Hilton San Francisco Union Square",
+			Address:           "333 O'Farrell St, 94102, San Francisco, US",
+			CheckinTime:       "2027-04-11T16:00:00-08:00",
+			CheckoutTime:      "2027-04-13",
+		},
+	}, {
+		Type:   "ParcelDelivery",
+		Parcel: &integrations.ParcelDelivery{Carrier: "UPS", TrackingNumber: "1Z999", Status: "OrderInTransit"},
+	}}, Extract(body))
+}
+
+func TestExtractMicrodata(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `<div itemscope itemtype="http://schema.org/ParcelDelivery">
+  <div itemprop="carrier" itemscope itemtype="http://schema.org/Organization">
+    <meta itemprop="name" content="FedEx"/>
+  </div>
+  <div itemprop="itemShipped" itemscope itemtype="http://schema.org/Product">
+    <span itemprop="name">Google Chromecast</span>
+  </div>
+  <p>Tracking number: <span itemprop="trackingNumber">3453291231</span></p>
+  <a itemprop="trackingUrl" href="http://fedex.com/track/3453291231">Track</a>
+  <time itemprop="expectedArrivalUntil" datetime="2027-03-12T12:00:00-08:00">March 12</time>
+  <div itemscope itemtype="http://schema.org/Organization"><span itemprop="name">Unrelated</span></div>
+</div>
+<div itemscope itemtype="http://schema.org/EventReservation">
+  <meta itemprop="reservationNumber" content="E123"/>
+  <div itemprop="reservationFor" itemscope itemtype="http://schema.org/Event">
+    <span itemprop="name">Foo Fighters Concert</span>
+    <meta itemprop="startDate" content="2027-03-06T19:30:00-08:00"/>
+    <div itemprop="location" itemscope itemtype="http://schema.org/Place">
+      <span itemprop="name">AT&amp;T Park</span>
+      <span itemprop="address">24 Willie Mays Plaza, San Francisco</span>
+    </div>
+  </div>
+</div>`
+
+	assert.Equal([]integrations.StructuredData{{
+		Type: "ParcelDelivery",
+		Parcel: &integrations.ParcelDelivery{
+			Carrier:              "FedEx",
+			TrackingNumber:       "3453291231",
+			TrackingURL:          "http://fedex.com/track/3453291231",
+			Item:                 "Google Chromecast",
+			ExpectedArrivalUntil: "2027-03-12T12:00:00-08:00",
+		},
+	}, {
+		Type: "EventReservation",
+		Event: &integrations.EventReservation{
+			ReservationNumber: "E123",
+			Name:              "Foo Fighters Concert",
+			StartDate:         "2027-03-06T19:30:00-08:00",
+			Location:          "AT&T Park",
+			Address:           "24 Willie Mays Plaza, San Francisco",
+		},
+	}}, Extract(body))
+
+	assert.Nil(Extract("<p>Just text</p>"))
+}
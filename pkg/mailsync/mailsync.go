@@ -0,0 +1,487 @@
+package mailsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/agenda"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/gmail"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/ingested"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/outlook"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// indexWindow is how far back the index keeps emails, it matches the window of the full sync
+const indexWindow = 2 * 24 * time.Hour
+
+// defaultSyncInterval is how often the background sync runs when SYNC_INTERVAL is not set
+const defaultSyncInterval = 5 * time.Minute
+
+// queueSize is how many accounts can wait for a sync at the same time
+const queueSize = 16
+
+// syncers maps the providers that support incremental sync to their sync function
+var syncers = map[string]func(account string, cursor string) (*integrations.SyncResult, error){
+	"google":  gmail.SyncEmails,
+	"outlook": outlook.SyncEmails,
+}
+
+// locks prevents the background sync and a request from syncing the same account at the same time
+var (
+	locks   = map[string]*sync.Mutex{}
+	locksMu sync.Mutex
+)
+
+// queue holds the accounts that should be synced as soon as possible
+var queue = make(chan string, queueSize)
+
+// pending tracks the accounts that are in the queue so that a burst of notifications results in a single sync
+var (
+	pending   = map[string]bool{}
+	pendingMu sync.Mutex
+)
+
+// lock returns the sync lock of the account
+func lock(account string) *sync.Mutex {
+
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if locks[account] == nil {
+		locks[account] = &sync.Mutex{}
+	}
+
+	return locks[account]
+}
+
+// Enqueue asks the background sync to sync the account as soon as possible.
+func Enqueue(account string) {
+
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	if pending[account] {
+		return
+	}
+
+	select {
+	case queue <- account:
+		pending[account] = true
+	default:
+		log.Printf("Sync queue is full, %s will be synced on the next interval", account)
+	}
+}
+
+// cursorKey returns the redis key of the account's sync cursor (the Gmail history ID or the Graph delta link)
+func cursorKey(account string) string {
+	return utils.AccountKey("sync_cursor_", account)
+}
+
+// indexKey returns the redis key of the hash holding the account's indexed emails by ID
+func indexKey(account string) string {
+	return utils.AccountKey("email_index_", account)
+}
+
+// timeIndexKey returns the redis key of the sorted set ordering the account's indexed emails by received time
+func timeIndexKey(account string) string {
+	return utils.AccountKey("email_index_", account) + "_by_time"
+}
+
+// addedIndexKey returns the redis key of the sorted set ordering the account's indexed emails by the sequence number they were indexed with
+func addedIndexKey(account string) string {
+	return utils.AccountKey("email_index_", account) + "_by_added"
+}
+
+// sequenceKey returns the redis key of the counter numbering the emails added to the account's index
+func sequenceKey(account string) string {
+	return utils.AccountKey("email_index_", account) + "_seq"
+}
+
+// watermarksKey returns the redis key of the hash holding, by caller, the sequence number of the last email returned from the account's index
+func watermarksKey(account string) string {
+	return utils.AccountKey("email_watermarks_", account)
+}
+
+// MoveIndex moves the index and the sync cursor of an account whose ID changed, so that it is not synced again from scratch.
+func MoveIndex(account string, newAccount string) error {
+
+	ctx := context.Background()
+
+	for _, key := range []func(string) string{cursorKey, indexKey, timeIndexKey, addedIndexKey, sequenceKey, watermarksKey} {
+		exists, err := redisclient.Rdb.Exists(ctx, key(account)).Result()
+		if err != nil {
+			return fmt.Errorf("Unable to check email index in redis: %w", err)
+		}
+
+		if exists == 0 {
+			continue
+		}
+
+		err = redisclient.Rdb.Rename(ctx, key(account), key(newAccount)).Err()
+		if err != nil {
+			return fmt.Errorf("Unable to move email index in redis: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// IsSynced checks if the account's index has been populated by a sync.
+func IsSynced(account string) (bool, error) {
+
+	exists, err := redisclient.Rdb.Exists(context.Background(), cursorKey(account)).Result()
+	if err != nil {
+		return false, fmt.Errorf("Unable to retrieve sync cursor from redis: %w", err)
+	}
+
+	return exists == 1, nil
+}
+
+// Sync pulls the changes since the last sync into the account's index and returns the emails that are new to the index.
+// The background sync and the notifications sync the same index, use GetEmailsSince to get the emails a caller has not seen yet.
+func Sync(account string) ([]integrations.Email, error) {
+
+	syncEmails, ok := syncers[utils.AccountProvider(account)]
+	if !ok {
+		return nil, fmt.Errorf("Invalid provider: %s", utils.AccountProvider(account))
+	}
+
+	lock(account).Lock()
+	defer lock(account).Unlock()
+
+	ctx := context.Background()
+
+	cursor, err := redisclient.Rdb.Get(ctx, cursorKey(account)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("Unable to retrieve sync cursor from redis: %w", err)
+	}
+
+	// Errors are returned as they are so that callers can tell a missing token (redis.Nil) apart
+	result, err := syncEmails(account, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Reset {
+		err = redisclient.Rdb.Del(ctx, indexKey(account), timeIndexKey(account), addedIndexKey(account)).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to reset email index in redis: %w", err)
+		}
+	}
+
+	if len(result.Removed) > 0 {
+		err = redisclient.Rdb.HDel(ctx, indexKey(account), result.Removed...).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to remove emails from the index in redis: %w", err)
+		}
+
+		members := make([]interface{}, len(result.Removed))
+		for i, id := range result.Removed {
+			members[i] = id
+		}
+		err = redisclient.Rdb.ZRem(ctx, timeIndexKey(account), members...).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to remove emails from the index in redis: %w", err)
+		}
+		err = redisclient.Rdb.ZRem(ctx, addedIndexKey(account), members...).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to remove emails from the index in redis: %w", err)
+		}
+	}
+
+	newEmails := []integrations.Email{}
+	for _, email := range result.Upserted {
+		emailJSON, err := json.Marshal(email)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to marshal email: %w", err)
+		}
+
+		// HSet reports the number of fields that did not exist before
+		added, err := redisclient.Rdb.HSet(ctx, indexKey(account), email.ID, emailJSON).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to save email to the index in redis: %w", err)
+		}
+		if added > 0 {
+			newEmails = append(newEmails, email)
+
+			// The emails are numbered in the order they are indexed, whoever syncs them
+			sequence, err := redisclient.Rdb.Incr(ctx, sequenceKey(account)).Result()
+			if err != nil {
+				return nil, fmt.Errorf("Unable to number email in redis: %w", err)
+			}
+			err = redisclient.Rdb.ZAdd(ctx, addedIndexKey(account), redis.Z{Score: float64(sequence), Member: email.ID}).Err()
+			if err != nil {
+				return nil, fmt.Errorf("Unable to save email to the index in redis: %w", err)
+			}
+		}
+
+		received, err := email.ReceivedTime()
+		if err != nil {
+			received = time.Now()
+		}
+
+		err = redisclient.Rdb.ZAdd(ctx, timeIndexKey(account), redis.Z{Score: float64(received.Unix()), Member: email.ID}).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to save email to the index in redis: %w", err)
+		}
+	}
+
+	// The invitations outlive the index so that the agenda lists the events until they end
+	err = agenda.RecordInvites(utils.AccountUser(account), utils.AccountProvider(account), utils.AccountEmail(account), result.Upserted)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cursor is saved last so that a failed sync is retried from the previous state
+	err = redisclient.Rdb.Set(ctx, cursorKey(account), result.Cursor, 0).Err()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to save sync cursor to redis: %w", err)
+	}
+
+	return newEmails, nil
+}
+
+// GetEmails returns the account's indexed emails of the past 2 days, newest first.
+func GetEmails(account string) ([]integrations.Email, error) {
+
+	ctx := context.Background()
+
+	// Drop the emails that fell out of the window
+	cutoff := fmt.Sprintf("(%d", time.Now().Add(-indexWindow).Unix())
+	expired, err := redisclient.Rdb.ZRangeByScore(ctx, timeIndexKey(account), &redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve email index from redis: %w", err)
+	}
+
+	if len(expired) > 0 {
+		err = redisclient.Rdb.HDel(ctx, indexKey(account), expired...).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to prune email index in redis: %w", err)
+		}
+		err = redisclient.Rdb.ZRemRangeByScore(ctx, timeIndexKey(account), "-inf", cutoff).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to prune email index in redis: %w", err)
+		}
+
+		members := make([]interface{}, len(expired))
+		for i, id := range expired {
+			members[i] = id
+		}
+		err = redisclient.Rdb.ZRem(ctx, addedIndexKey(account), members...).Err()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to prune email index in redis: %w", err)
+		}
+	}
+
+	ids, err := redisclient.Rdb.ZRevRange(ctx, timeIndexKey(account), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve email index from redis: %w", err)
+	}
+
+	if len(ids) == 0 {
+		return []integrations.Email{}, nil
+	}
+
+	values, err := redisclient.Rdb.HMGet(ctx, indexKey(account), ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve emails from the index in redis: %w", err)
+	}
+
+	emails := []integrations.Email{}
+	for _, value := range values {
+		emailJSON, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var email integrations.Email
+		err = json.Unmarshal([]byte(emailJSON), &email)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to unmarshal email: %w", err)
+		}
+		email.Account = utils.AccountEmail(account)
+		emails = append(emails, email)
+	}
+
+	return emails, nil
+}
+
+// GetEmailsSince returns the account's indexed emails that the caller has not been returned yet, last indexed first.
+// The caller's watermark is kept apart from the sync cursor so that the syncs of other callers do not hide emails from it.
+func GetEmailsSince(account string, caller string) ([]integrations.Email, error) {
+
+	ctx := context.Background()
+
+	watermark, err := redisclient.Rdb.HGet(ctx, watermarksKey(account), caller).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("Unable to retrieve watermark from redis: %w", err)
+	}
+
+	added, err := redisclient.Rdb.ZRevRangeByScoreWithScores(ctx, addedIndexKey(account), &redis.ZRangeBy{Min: fmt.Sprintf("(%d", watermark), Max: "+inf"}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve email index from redis: %w", err)
+	}
+
+	if len(added) == 0 {
+		return []integrations.Email{}, nil
+	}
+
+	ids := make([]string, len(added))
+	for i, member := range added {
+		ids[i] = member.Member.(string)
+	}
+
+	values, err := redisclient.Rdb.HMGet(ctx, indexKey(account), ids...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve emails from the index in redis: %w", err)
+	}
+
+	emails := []integrations.Email{}
+	for _, value := range values {
+		emailJSON, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var email integrations.Email
+		err = json.Unmarshal([]byte(emailJSON), &email)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to unmarshal email: %w", err)
+		}
+		email.Account = utils.AccountEmail(account)
+		emails = append(emails, email)
+	}
+
+	err = redisclient.Rdb.HSet(ctx, watermarksKey(account), caller, int64(added[0].Score)).Err()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to save watermark to redis: %w", err)
+	}
+
+	return emails, nil
+}
+
+// GetAllEmails returns the indexed emails of the user's connected accounts that match the selector, by provider.
+// The emails of a provider's accounts are merged, newest first. The user's ingested emails are only included when every account is selected.
+// The accounts whose emails cannot be read are left out and reported, so that one failing account does not hide the others.
+// utils.ErrAccountNotFound is returned if the selector matches no account.
+func GetAllEmails(user string, selector string) (map[string][]integrations.Email, []integrations.AccountError, error) {
+
+	accounts, err := utils.SelectAccounts(user, "", selector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	emails := map[string][]integrations.Email{}
+	failed := []integrations.AccountError{}
+
+	for provider := range syncers {
+		emails[provider] = []integrations.Email{}
+	}
+
+	for _, account := range accounts {
+		provider := utils.AccountProvider(account)
+		if _, ok := syncers[provider]; !ok {
+			continue
+		}
+
+		accountEmails, err := GetEmails(account)
+		if err != nil {
+			failed = append(failed, AccountFailure(account, err))
+			continue
+		}
+		emails[provider] = append(emails[provider], accountEmails...)
+	}
+
+	for provider := range emails {
+		integrations.SortNewestFirst(emails[provider])
+	}
+
+	if selector != "" {
+		return emails, failed, nil
+	}
+
+	ingestedEmails, err := ingested.GetEmails(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	emails[ingested.Provider] = ingestedEmails
+
+	return emails, failed, nil
+}
+
+// AccountFailure logs the error of an account whose emails cannot be read and returns its report.
+// The error is only detailed if the account must be connected again, the others are left in the logs.
+func AccountFailure(account string, err error) integrations.AccountError {
+
+	log.Printf("Error getting the emails of %s, it is left out: %v", utils.AccountName(account), err)
+
+	failure := integrations.AccountError{
+		Provider: utils.AccountProvider(account),
+		Account:  utils.AccountEmail(account),
+		Error:    "Unable to retrieve the emails of the account",
+	}
+	if errors.Is(err, utils.ErrReconsentRequired) {
+		failure.Error = fmt.Sprintf("%s, please re-authenticate using provider=%s&replace=true", utils.TokenStatusNeedsReconsent, failure.Provider)
+	}
+
+	return failure
+}
+
+// getSyncInterval checks if a custom sync interval is supplied, if not, returns the default interval
+func getSyncInterval() time.Duration {
+
+	interval, err := time.ParseDuration(os.Getenv("SYNC_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultSyncInterval
+	}
+
+	return interval
+}
+
+// Run keeps the index of the connected accounts of every user current by syncing it periodically and whenever a sync is enqueued.
+// It never returns.
+func Run() {
+
+	ticker := time.NewTicker(getSyncInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			accounts, err := utils.ListAllAccounts("")
+			if err != nil {
+				log.Printf("Error listing the accounts: %v", err)
+			}
+
+			for _, account := range accounts {
+				runSync(account)
+			}
+		case account := <-queue:
+			pendingMu.Lock()
+			delete(pending, account)
+			pendingMu.Unlock()
+
+			runSync(account)
+		}
+	}
+}
+
+// runSync syncs the account in the background and logs the errors.
+func runSync(account string) {
+
+	_, err := Sync(account)
+
+	// Accounts that have been disconnected meanwhile are skipped quietly
+	if err != nil && err != redis.Nil {
+		log.Printf("Error syncing %s emails: %v", account, err)
+	}
+}
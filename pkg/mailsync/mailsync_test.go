@@ -0,0 +1,156 @@
+package mailsync
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// Register a fake provider that returns an incremental result
+	email := integrations.Email{ID: "2", Subject: "New", RecievedDateTime: "2024-01-02T03:04:05Z"}
+	syncers["test"] = func(account string, cursor string) (*integrations.SyncResult, error) {
+		assert.Equal("test:jane@example.com", account)
+		assert.Equal("cursor-1", cursor)
+		return &integrations.SyncResult{
+			Upserted: []integrations.Email{email},
+			Removed:  []string{"1"},
+			Cursor:   "cursor-2",
+		}, nil
+	}
+	defer delete(syncers, "test")
+
+	mock.ExpectGet("sync_cursor_test:jane@example.com").SetVal("cursor-1")
+	mock.ExpectHDel("email_index_test:jane@example.com", "1").SetVal(1)
+	mock.ExpectZRem("email_index_test:jane@example.com_by_time", "1").SetVal(1)
+	mock.ExpectZRem("email_index_test:jane@example.com_by_added", "1").SetVal(1)
+	mock.ExpectHSet("email_index_test:jane@example.com", "2", []byte(`{"id":"2","subject":"New","body":"","sender":"","recievedDateTime":"2024-01-02T03:04:05Z"}`)).SetVal(1)
+	mock.ExpectIncr("email_index_test:jane@example.com_seq").SetVal(7)
+	mock.ExpectZAdd("email_index_test:jane@example.com_by_added", redis.Z{Score: 7, Member: "2"}).SetVal(1)
+	mock.ExpectZAdd("email_index_test:jane@example.com_by_time", redis.Z{Score: 1704164645, Member: "2"}).SetVal(1)
+	mock.ExpectSet("sync_cursor_test:jane@example.com", "cursor-2", 0).SetVal("OK")
+
+	newEmails, err := Sync("test:jane@example.com")
+	assert.NoError(err)
+	assert.Equal([]integrations.Email{email}, newEmails)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestSyncInvalidProvider(t *testing.T) {
+	_, err := Sync("invalid")
+	assert.Error(t, err)
+}
+
+func TestGetEmails(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.Regexp().ExpectZRangeByScore("email_index_test:jane@example.com_by_time", &redis.ZRangeBy{Min: "-inf", Max: `\(\d+`}).SetVal([]string{"old"})
+	mock.ExpectHDel("email_index_test:jane@example.com", "old").SetVal(1)
+	mock.Regexp().ExpectZRemRangeByScore("email_index_test:jane@example.com_by_time", "-inf", `\(\d+`).SetVal(1)
+	mock.ExpectZRem("email_index_test:jane@example.com_by_added", "old").SetVal(1)
+	mock.ExpectZRevRange("email_index_test:jane@example.com_by_time", 0, -1).SetVal([]string{"2", "1"})
+	mock.ExpectHMGet("email_index_test:jane@example.com", "2", "1").SetVal([]interface{}{`{"id":"2"}`, nil})
+
+	emails, err := GetEmails("test:jane@example.com")
+	assert.NoError(err)
+	assert.Equal([]integrations.Email{{ID: "2", Account: "jane@example.com"}}, emails)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestGetEmailsSince(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// The caller has seen the emails up to the 5th one indexed
+	mock.ExpectHGet("email_watermarks_test:jane@example.com", "caller-1").SetVal("5")
+	mock.ExpectZRevRangeByScoreWithScores("email_index_test:jane@example.com_by_added", &redis.ZRangeBy{Min: "(5", Max: "+inf"}).SetVal([]redis.Z{{Score: 7, Member: "3"}, {Score: 6, Member: "2"}})
+	mock.ExpectHMGet("email_index_test:jane@example.com", "3", "2").SetVal([]interface{}{`{"id":"3"}`, `{"id":"2"}`})
+	mock.ExpectHSet("email_watermarks_test:jane@example.com", "caller-1", int64(7)).SetVal(0)
+
+	emails, err := GetEmailsSince("test:jane@example.com", "caller-1")
+	assert.NoError(err)
+	assert.Equal([]integrations.Email{{ID: "3", Account: "jane@example.com"}, {ID: "2", Account: "jane@example.com"}}, emails)
+
+	// A caller that has seen every email gets none
+	mock.ExpectHGet("email_watermarks_test:jane@example.com", "caller-1").SetVal("7")
+	mock.ExpectZRevRangeByScoreWithScores("email_index_test:jane@example.com_by_added", &redis.ZRangeBy{Min: "(7", Max: "+inf"}).SetVal([]redis.Z{})
+
+	emails, err = GetEmailsSince("test:jane@example.com", "caller-1")
+	assert.NoError(err)
+	assert.Empty(emails)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestGetAllEmailsSkipsFailingAccount(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectSMembers("user_u1:accounts_google").SetVal([]string{"u1/google:jane@example.com"})
+	mock.ExpectSMembers("user_u1:accounts_outlook").SetVal([]string{"u1/outlook:jane@example.com"})
+
+	// The index of the Gmail account cannot be read
+	mock.Regexp().ExpectZRangeByScore("user_u1:email_index_google:jane@example.com_by_time", &redis.ZRangeBy{Min: "-inf", Max: `\(\d+`}).SetErr(errors.New("connection reset"))
+
+	mock.Regexp().ExpectZRangeByScore("user_u1:email_index_outlook:jane@example.com_by_time", &redis.ZRangeBy{Min: "-inf", Max: `\(\d+`}).SetVal([]string{})
+	mock.ExpectZRevRange("user_u1:email_index_outlook:jane@example.com_by_time", 0, -1).SetVal([]string{"1"})
+	mock.ExpectHMGet("user_u1:email_index_outlook:jane@example.com", "1").SetVal([]interface{}{`{"id":"1"}`})
+
+	emails, failed, err := GetAllEmails("u1", "jane@example.com")
+	assert.NoError(err)
+	assert.Equal([]integrations.Email{}, emails["google"])
+	assert.Equal([]integrations.Email{{ID: "1", Account: "jane@example.com"}}, emails["outlook"])
+	assert.Equal([]integrations.AccountError{{Provider: "google", Account: "jane@example.com", Error: "Unable to retrieve the emails of the account"}}, failed)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestAccountFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	failure := AccountFailure("u1/google:jane@example.com", fmt.Errorf("%w: invalid_grant", utils.ErrReconsentRequired))
+	assert.Equal("jane@example.com", failure.Account)
+	assert.Equal("needs_reconsent, please re-authenticate using provider=google&replace=true", failure.Error)
+}
+
+func TestMoveIndex(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// The keys that do not exist are skipped
+	mock.ExpectExists("sync_cursor_google").SetVal(1)
+	mock.ExpectRename("sync_cursor_google", "sync_cursor_google:jane@example.com").SetVal("OK")
+	mock.ExpectExists("email_index_google").SetVal(1)
+	mock.ExpectRename("email_index_google", "email_index_google:jane@example.com").SetVal("OK")
+	mock.ExpectExists("email_index_google_by_time").SetVal(0)
+	mock.ExpectExists("email_index_google_by_added").SetVal(0)
+	mock.ExpectExists("email_index_google_seq").SetVal(0)
+	mock.ExpectExists("email_watermarks_google").SetVal(0)
+
+	assert.NoError(MoveIndex("google", "google:jane@example.com"))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
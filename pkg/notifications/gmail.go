@@ -0,0 +1,321 @@
+package notifications
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/gmail"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/mailsync"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// gmailWatchKey returns the redis key holding the expiration of the Gmail watch of the account
+func gmailWatchKey(account string) string {
+	return utils.AccountKey("gmail_watch_", account)
+}
+
+// gmailRenewBefore is how long before their expiration the Gmail watches are renewed, Google recommends renewing them daily
+const gmailRenewBefore = 6 * 24 * time.Hour
+
+// gmailRenewInterval is how often the Gmail watches are checked
+const gmailRenewInterval = time.Hour
+
+// ErrInvalidPushToken is returned when the bearer token of a push request cannot be verified
+var ErrInvalidPushToken = errors.New("invalid push token")
+
+// PushEnvelope is the body of a Pub/Sub push request
+type PushEnvelope struct {
+	Message struct {
+		// Data is base64 encoded in the request, encoding/json decodes it into the byte slice
+		Data        []byte `json:"data"`
+		MessageID   string `json:"messageId"`
+		PublishTime string `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// GmailNotification is the message Gmail publishes when the mailbox changes
+type GmailNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+// GmailPushTopic returns the Pub/Sub topic Gmail publishes the changes to (e.g. projects/my-project/topics/gmail).
+// Push notifications are disabled if GMAIL_PUSH_TOPIC is not set.
+func GmailPushTopic() string {
+	return os.Getenv("GMAIL_PUSH_TOPIC")
+}
+
+// DecodeGmailPush extracts the Gmail notification from a Pub/Sub push request body.
+func DecodeGmailPush(body []byte) (*GmailNotification, error) {
+
+	var envelope PushEnvelope
+	err := json.Unmarshal(body, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal push envelope: %w", err)
+	}
+
+	var notification GmailNotification
+	err = json.Unmarshal(envelope.Message.Data, &notification)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal Gmail notification: %w", err)
+	}
+
+	if notification.EmailAddress == "" || notification.HistoryID == 0 {
+		return nil, fmt.Errorf("Gmail notification is missing the email address or the history ID")
+	}
+
+	return &notification, nil
+}
+
+// HandleGmailNotification enqueues an incremental sync of the inbox of the Gmail account the notification is about, for every user who connected it.
+// The notifications about an account whose email is not known yet go to the accounts connected before several accounts were supported.
+func HandleGmailNotification(notification *GmailNotification) {
+
+	accounts, err := utils.ListAllAccounts("google")
+	if err != nil {
+		log.Printf("Error listing the Gmail accounts: %v", err)
+		return
+	}
+
+	email := strings.ToLower(notification.EmailAddress)
+	for _, candidate := range []string{email, ""} {
+		enqueued := false
+		for _, account := range accounts {
+			if utils.AccountEmail(account) == candidate {
+				mailsync.Enqueue(account)
+				enqueued = true
+			}
+		}
+
+		if enqueued {
+			return
+		}
+	}
+
+	log.Printf("Ignored Gmail notification for %s, the account is not connected", notification.EmailAddress)
+}
+
+// gmailPushKeys reads the RSA public keys allowed to sign the push tokens from the PEM file set in GMAIL_PUSH_KEYS.
+// The file can hold certificates (as published by Google) and public keys. It returns nil if GMAIL_PUSH_KEYS is not set.
+func gmailPushKeys() ([]*rsa.PublicKey, error) {
+
+	path := os.Getenv("GMAIL_PUSH_KEYS")
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read push keys: %w", err)
+	}
+
+	return parsePublicKeys(data)
+}
+
+// parsePublicKeys returns the RSA public keys of the PEM certificates and public keys in data
+func parsePublicKeys(data []byte) ([]*rsa.PublicKey, error) {
+
+	keys := []*rsa.PublicKey{}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse certificate: %w", err)
+			}
+			key = cert.PublicKey
+		case "PUBLIC KEY":
+			parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse public key: %w", err)
+			}
+			key = parsed
+		default:
+			continue
+		}
+
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Push keys must be RSA keys")
+		}
+		keys = append(keys, rsaKey)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No public key found in the push keys")
+	}
+
+	return keys, nil
+}
+
+// VerifyGmailPush checks the bearer token Pub/Sub attaches to authenticated push requests.
+// Nothing is checked if GMAIL_PUSH_KEYS is not set. If GMAIL_PUSH_AUDIENCE is set, the token must have been issued for it.
+// Errors wrapping ErrInvalidPushToken mean the request should be rejected.
+func VerifyGmailPush(authorization string) error {
+
+	keys, err := gmailPushKeys()
+	if err != nil {
+		return err
+	}
+
+	if keys == nil {
+		return nil
+	}
+
+	token, found := strings.CutPrefix(authorization, "Bearer ")
+	if !found {
+		return fmt.Errorf("%w: missing bearer token", ErrInvalidPushToken)
+	}
+
+	return verifyPushToken(token, keys, os.Getenv("GMAIL_PUSH_AUDIENCE"), time.Now())
+}
+
+// pushTokenClaims are the claims of the OIDC token Pub/Sub signs
+type pushTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	Email     string `json:"email"`
+}
+
+// verifyPushToken checks the RS256 signature of the JWT against the keys, then its issuer, expiration and audience
+func verifyPushToken(token string, keys []*rsa.PublicKey, audience string, now time.Time) error {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed token", ErrInvalidPushToken)
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("%w: malformed header", ErrInvalidPushToken)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil || header.Algorithm != "RS256" {
+		return fmt.Errorf("%w: unsupported algorithm", ErrInvalidPushToken)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: malformed signature", ErrInvalidPushToken)
+	}
+
+	// The signature covers the encoded header and claims
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	verified := false
+	for _, key := range keys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return fmt.Errorf("%w: bad signature", ErrInvalidPushToken)
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: malformed claims", ErrInvalidPushToken)
+	}
+
+	var claims pushTokenClaims
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return fmt.Errorf("%w: malformed claims", ErrInvalidPushToken)
+	}
+
+	if claims.Issuer != "accounts.google.com" && claims.Issuer != "https://accounts.google.com" {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidPushToken, claims.Issuer)
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return fmt.Errorf("%w: token expired", ErrInvalidPushToken)
+	}
+
+	if audience != "" && claims.Audience != audience {
+		return fmt.Errorf("%w: unexpected audience %q", ErrInvalidPushToken, claims.Audience)
+	}
+
+	return nil
+}
+
+// EnsureGmailWatch renews the watch of the Gmail account if there is none or it is about to expire.
+func EnsureGmailWatch(account string) error {
+
+	ctx := context.Background()
+
+	expiration, err := redisclient.Rdb.Get(ctx, gmailWatchKey(account)).Time()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("Unable to retrieve Gmail watch from redis: %w", err)
+	}
+
+	if err == nil && time.Until(expiration) > gmailRenewBefore {
+		return nil
+	}
+
+	// Calling watch again replaces the previous registration
+	expiration, err = gmail.Watch(account, GmailPushTopic())
+	if err != nil {
+		return err
+	}
+
+	err = redisclient.Rdb.Set(ctx, gmailWatchKey(account), expiration, time.Until(expiration)).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save Gmail watch to redis: %w", err)
+	}
+
+	return nil
+}
+
+// RunGmailWatchRenewal keeps the watches of the Gmail accounts of every user alive. It never returns.
+func RunGmailWatchRenewal() {
+
+	ticker := time.NewTicker(gmailRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		accounts, err := utils.ListAllAccounts("google")
+		if err != nil {
+			log.Printf("Error listing the Gmail accounts: %v", err)
+		}
+
+		for _, account := range accounts {
+			err := EnsureGmailWatch(account)
+
+			// The account may have been disconnected meanwhile
+			if err != nil && err != redis.Nil {
+				log.Printf("Error ensuring the %s watch: %v", account, err)
+			}
+		}
+
+		<-ticker.C
+	}
+}
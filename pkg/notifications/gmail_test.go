@@ -0,0 +1,128 @@
+package notifications
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signToken returns an RS256 JWT with the given claims
+func signToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+
+	claimsJSON, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	payload := base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	digest := sha256.Sum256([]byte(header + "." + payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestDecodeGmailPush(t *testing.T) {
+	assert := assert.New(t)
+
+	data := base64.StdEncoding.EncodeToString([]byte(`{"emailAddress":"user@example.com","historyId":9876543210}`))
+	body := fmt.Sprintf(`{"message":{"data":"%s","messageId":"2070443601311540","publishTime":"2021-02-26T19:13:55.749Z"},"subscription":"projects/myproject/subscriptions/mysubscription"}`, data)
+
+	notification, err := DecodeGmailPush([]byte(body))
+	assert.NoError(err)
+	assert.Equal(&GmailNotification{EmailAddress: "user@example.com", HistoryID: 9876543210}, notification)
+
+	// The data is not base64
+	_, err = DecodeGmailPush([]byte(`{"message":{"data":"not base64!"}}`))
+	assert.Error(err)
+
+	// The data does not hold a Gmail notification
+	data = base64.StdEncoding.EncodeToString([]byte(`{"foo":"bar"}`))
+	_, err = DecodeGmailPush([]byte(fmt.Sprintf(`{"message":{"data":"%s"}}`, data)))
+	assert.Error(err)
+
+	_, err = DecodeGmailPush([]byte(`not json`))
+	assert.Error(err)
+}
+
+func TestVerifyPushToken(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+
+	keys := []*rsa.PublicKey{&otherKey.PublicKey, &key.PublicKey}
+	now := time.Now()
+	audience := "https://portal.example.com/v1/webhooks/gmail"
+
+	claims := map[string]interface{}{
+		"iss":   "https://accounts.google.com",
+		"aud":   audience,
+		"exp":   now.Add(time.Hour).Unix(),
+		"email": "pubsub@example.iam.gserviceaccount.com",
+	}
+
+	assert.NoError(verifyPushToken(signToken(t, key, claims), keys, audience, now))
+
+	// The audience is only checked when configured
+	assert.NoError(verifyPushToken(signToken(t, key, claims), keys, "", now))
+
+	invalid := map[string]string{
+		"unknown key":    signToken(t, otherKey, claims),
+		"wrong audience": signToken(t, key, claims),
+		"malformed":      "abc.def",
+	}
+	for name, token := range invalid {
+		keys := keys
+		if name == "unknown key" {
+			keys = []*rsa.PublicKey{&key.PublicKey}
+		}
+		err = verifyPushToken(token, keys, audience+"/other", now)
+		assert.True(errors.Is(err, ErrInvalidPushToken), name)
+	}
+
+	expired := signToken(t, key, map[string]interface{}{"iss": "accounts.google.com", "exp": now.Add(-time.Minute).Unix()})
+	assert.ErrorIs(verifyPushToken(expired, keys, "", now), ErrInvalidPushToken)
+
+	wrongIssuer := signToken(t, key, map[string]interface{}{"iss": "evil.example.com", "exp": now.Add(time.Hour).Unix()})
+	assert.ErrorIs(verifyPushToken(wrongIssuer, keys, "", now), ErrInvalidPushToken)
+
+	// The claims were tampered with after signing
+	parts := strings.Split(signToken(t, key, claims), ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"accounts.google.com","exp":9999999999}`))
+	assert.ErrorIs(verifyPushToken(strings.Join(parts, "."), keys, "", now), ErrInvalidPushToken)
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(err)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	keys, err := parsePublicKeys(data)
+	assert.NoError(err)
+	assert.Len(keys, 1)
+	assert.True(key.PublicKey.Equal(keys[0]))
+
+	_, err = parsePublicKeys([]byte("no keys here"))
+	assert.Error(err)
+}
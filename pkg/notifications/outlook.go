@@ -0,0 +1,177 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/outlook"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/mailsync"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// outlookSubscriptionKey returns the redis key of the hash holding the Outlook subscription of the account
+func outlookSubscriptionKey(account string) string {
+	return utils.AccountKey("outlook_subscription_", account)
+}
+
+// outlookRenewBefore is how long before their expiration the Outlook subscriptions are renewed
+const outlookRenewBefore = 12 * time.Hour
+
+// outlookRenewInterval is how often the Outlook subscriptions are checked
+const outlookRenewInterval = time.Hour
+
+// OutlookNotificationURL returns the public URL Graph sends the change notifications to.
+// Change notifications are disabled if OUTLOOK_NOTIFICATION_URL is not set.
+func OutlookNotificationURL() string {
+	return os.Getenv("OUTLOOK_NOTIFICATION_URL")
+}
+
+// getOutlookSubscription retrieves the stored Outlook subscription of the account, redis.Nil is returned if there is none
+func getOutlookSubscription(account string) (*outlook.Subscription, error) {
+
+	fields, err := redisclient.Rdb.HGetAll(context.Background(), outlookSubscriptionKey(account)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve Outlook subscription from redis: %w", err)
+	}
+
+	if len(fields) == 0 {
+		return nil, redis.Nil
+	}
+
+	expiration, err := time.Parse(time.RFC3339, fields["expiration"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Outlook subscription expiration: %w", err)
+	}
+
+	return &outlook.Subscription{
+		ID:                 fields["id"],
+		ExpirationDateTime: expiration,
+		ClientState:        fields["client_state"],
+	}, nil
+}
+
+// saveOutlookSubscription stores the subscription of the account until it expires
+func saveOutlookSubscription(account string, subscription *outlook.Subscription) error {
+
+	ctx := context.Background()
+
+	err := redisclient.Rdb.HSet(ctx, outlookSubscriptionKey(account), map[string]interface{}{
+		"id":           subscription.ID,
+		"expiration":   subscription.ExpirationDateTime.UTC().Format(time.RFC3339),
+		"client_state": subscription.ClientState,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save Outlook subscription to redis: %w", err)
+	}
+
+	err = redisclient.Rdb.ExpireAt(ctx, outlookSubscriptionKey(account), subscription.ExpirationDateTime).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to set Outlook subscription expiry in redis: %w", err)
+	}
+
+	return nil
+}
+
+// EnsureOutlookSubscription creates the subscription of the Outlook account if there is none and renews it if it is about to expire.
+func EnsureOutlookSubscription(account string) error {
+
+	current, err := getOutlookSubscription(account)
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	if current != nil && time.Until(current.ExpirationDateTime) > outlookRenewBefore {
+		return nil
+	}
+
+	if current != nil {
+		renewed, err := outlook.RenewSubscription(account, current.ID)
+		if err == nil {
+			// Graph does not echo the client state on renewal
+			renewed.ClientState = current.ClientState
+			return saveOutlookSubscription(account, renewed)
+		}
+		if err != outlook.ErrSubscriptionNotFound {
+			return fmt.Errorf("Unable to renew Outlook subscription: %w", err)
+		}
+	}
+
+	// The client state is a shared secret that proves a notification comes from our subscription
+	clientState, err := utils.GenerateAPIKey()
+	if err != nil {
+		return fmt.Errorf("unable to generate client state: %w", err)
+	}
+
+	created, err := outlook.CreateSubscription(account, OutlookNotificationURL(), clientState)
+	if err != nil {
+		return err
+	}
+	created.ClientState = clientState
+
+	return saveOutlookSubscription(account, created)
+}
+
+// HandleOutlookNotifications checks the change notifications against the stored subscriptions of every user and enqueues a sync of the accounts that got a genuine one.
+// It returns the number of genuine notifications.
+func HandleOutlookNotifications(collection outlook.ChangeNotificationCollection) (int, error) {
+
+	accounts, err := utils.ListAllAccounts("outlook")
+	if err != nil {
+		return 0, err
+	}
+
+	valid := 0
+	for _, account := range accounts {
+		subscription, err := getOutlookSubscription(account)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return valid, err
+		}
+
+		matched := 0
+		for _, notification := range collection.Value {
+			if notification.SubscriptionID == subscription.ID && notification.ClientState == subscription.ClientState {
+				matched++
+			}
+		}
+
+		if matched > 0 {
+			mailsync.Enqueue(account)
+			valid += matched
+		}
+	}
+
+	return valid, nil
+}
+
+// RunOutlookRenewal keeps the subscriptions of the Outlook accounts of every user alive. It never returns.
+func RunOutlookRenewal() {
+
+	ticker := time.NewTicker(outlookRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		accounts, err := utils.ListAllAccounts("outlook")
+		if err != nil {
+			log.Printf("Error listing the Outlook accounts: %v", err)
+		}
+
+		for _, account := range accounts {
+			err := EnsureOutlookSubscription(account)
+
+			// The account may have been disconnected meanwhile
+			if err != nil && err != redis.Nil {
+				log.Printf("Error ensuring the %s subscription: %v", account, err)
+			}
+		}
+
+		<-ticker.C
+	}
+}
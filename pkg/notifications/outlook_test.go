@@ -0,0 +1,69 @@
+package notifications
+
+import (
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations/outlook"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleOutlookNotifications(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	stored := map[string]string{
+		"id":           "sub-1",
+		"expiration":   time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		"client_state": "secret",
+	}
+
+	collection := outlook.ChangeNotificationCollection{Value: []outlook.ChangeNotification{
+		{SubscriptionID: "sub-1", ClientState: "secret"},
+		{SubscriptionID: "sub-1", ClientState: "forged"},
+		{SubscriptionID: "sub-2", ClientState: "secret"},
+	}}
+
+	// The notifications are matched against the subscription of every account of every user
+	mock.ExpectSMembers("users").SetVal([]string{"u1", "u2"})
+	mock.ExpectSMembers("user_u1:accounts_outlook").SetVal([]string{"u1/outlook:jane@example.com"})
+	mock.ExpectSMembers("user_u2:accounts_outlook").SetVal([]string{"u2/outlook:john@example.com"})
+	mock.ExpectHGetAll("user_u1:outlook_subscription_outlook:jane@example.com").SetVal(map[string]string{})
+	mock.ExpectHGetAll("user_u2:outlook_subscription_outlook:john@example.com").SetVal(stored)
+	valid, err := HandleOutlookNotifications(collection)
+	assert.NoError(err)
+	assert.Equal(1, valid)
+
+	// No subscription, nothing is genuine
+	mock.ExpectSMembers("users").SetVal([]string{"u2"})
+	mock.ExpectSMembers("user_u2:accounts_outlook").SetVal([]string{"u2/outlook:john@example.com"})
+	mock.ExpectHGetAll("user_u2:outlook_subscription_outlook:john@example.com").SetVal(map[string]string{})
+	valid, err = HandleOutlookNotifications(collection)
+	assert.NoError(err)
+	assert.Equal(0, valid)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestEnsureOutlookSubscriptionNotDue(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// A subscription that expires well after the renewal window is left alone
+	mock.ExpectHGetAll("outlook_subscription_outlook:john@example.com").SetVal(map[string]string{
+		"id":           "sub-1",
+		"expiration":   time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339),
+		"client_state": "secret",
+	})
+
+	assert.NoError(EnsureOutlookSubscription("outlook:john@example.com"))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
@@ -0,0 +1,301 @@
+package priority
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// rulesKey is the redis key of the scoring rules, under the prefix of the user
+const rulesKey = "priority_rules"
+
+// Keyword is a word or phrase that changes the score of the emails containing it in their subject or body
+type Keyword struct {
+	Keyword string `json:"keyword"`
+	Weight  int    `json:"weight"`
+}
+
+// Rules is a struct to hold the weights used to score the emails
+type Rules struct {
+	// MyAddresses are the user's own addresses, used to tell whether an email was sent to the user directly or in copy
+	MyAddresses []string `json:"myAddresses"`
+	// VIPSenders are addresses, or domains starting with @, whose emails are always important
+	VIPSenders   []string `json:"vipSenders"`
+	VIPWeight    int      `json:"vipWeight"`
+	DirectWeight int      `json:"directWeight"`
+	CcWeight     int      `json:"ccWeight"`
+	// ThreadWeight is added for every other email of the same conversation, up to ThreadMax of them
+	ThreadWeight int       `json:"threadWeight"`
+	ThreadMax    int       `json:"threadMax"`
+	Keywords     []Keyword `json:"keywords"`
+	// CategoryWeights are keyed by Gmail label (e.g. IMPORTANT, CATEGORY_PROMOTIONS) or Outlook inference classification (focused, other)
+	CategoryWeights map[string]int `json:"categoryWeights"`
+	// DueSoonWeight is added when a deadline or a meeting is within 24 hours, DueWeight when it is within 7 days
+	DueSoonWeight int `json:"dueSoonWeight"`
+	DueWeight     int `json:"dueWeight"`
+}
+
+// DefaultRules returns the rules used until the user saves their own.
+func DefaultRules() Rules {
+	return Rules{
+		MyAddresses:  []string{},
+		VIPSenders:   []string{},
+		VIPWeight:    30,
+		DirectWeight: 10,
+		CcWeight:     -5,
+		ThreadWeight: 5,
+		ThreadMax:    4,
+		Keywords: []Keyword{
+			{Keyword: "urgent", Weight: 20},
+			{Keyword: "asap", Weight: 20},
+			{Keyword: "action required", Weight: 15},
+			{Keyword: "deadline", Weight: 10},
+			{Keyword: "unsubscribe", Weight: -10},
+		},
+		CategoryWeights: map[string]int{
+			"IMPORTANT":           10,
+			"STARRED":             10,
+			"CATEGORY_PROMOTIONS": -20,
+			"CATEGORY_SOCIAL":     -15,
+			"CATEGORY_UPDATES":    -5,
+			"CATEGORY_FORUMS":     -5,
+			"focused":             10,
+			"other":               -10,
+		},
+		DueSoonWeight: 25,
+		DueWeight:     10,
+	}
+}
+
+// Validate checks that the rules can be used to score the emails
+func (r Rules) Validate() error {
+
+	if r.ThreadMax < 0 {
+		return errors.New("threadMax must not be negative")
+	}
+
+	for _, keyword := range r.Keywords {
+		if strings.TrimSpace(keyword.Keyword) == "" {
+			return errors.New("keywords must not be empty")
+		}
+	}
+
+	for _, sender := range r.VIPSenders {
+		if strings.TrimSpace(sender) == "" || !strings.Contains(sender, "@") {
+			return fmt.Errorf("invalid VIP sender %q, expected an address or a domain starting with @", sender)
+		}
+	}
+
+	return nil
+}
+
+// GetRules returns the user's saved scoring rules, or the default ones if none were saved.
+func GetRules(user string) (Rules, error) {
+
+	value, err := redisclient.Rdb.Get(context.Background(), utils.UserKey(user, rulesKey)).Result()
+	if err == redis.Nil {
+		return DefaultRules(), nil
+	}
+	if err != nil {
+		return Rules{}, fmt.Errorf("Unable to retrieve priority rules from redis: %w", err)
+	}
+
+	var rules Rules
+	err = json.Unmarshal([]byte(value), &rules)
+	if err != nil {
+		return Rules{}, fmt.Errorf("Unable to unmarshal priority rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+// SaveRules replaces the user's scoring rules.
+func SaveRules(user string, rules Rules) error {
+
+	value, err := json.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal priority rules: %w", err)
+	}
+
+	err = redisclient.Rdb.Set(context.Background(), utils.UserKey(user, rulesKey), value, 0).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save priority rules to redis: %w", err)
+	}
+
+	return nil
+}
+
+// ResetRules removes the user's saved scoring rules so that the default ones apply again.
+func ResetRules(user string) error {
+
+	err := redisclient.Rdb.Del(context.Background(), utils.UserKey(user, rulesKey)).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to delete priority rules from redis: %w", err)
+	}
+
+	return nil
+}
+
+// Score sets the priority of the emails according to the rules.
+// Thread activity is measured within the given emails.
+func Score(emails []integrations.Email, rules Rules, now time.Time) {
+
+	threads := map[string]int{}
+	for _, email := range emails {
+		if email.ThreadID != "" {
+			threads[email.ThreadID]++
+		}
+	}
+
+	myAddresses := map[string]bool{}
+	for _, address := range rules.MyAddresses {
+		myAddresses[strings.ToLower(strings.TrimSpace(address))] = true
+	}
+
+	for i := range emails {
+		emails[i].Priority = score(emails[i], rules, myAddresses, threads, now)
+	}
+}
+
+// Sort orders the scored emails by priority, highest first, keeping the order of the emails with the same score.
+func Sort(emails []integrations.Email) {
+
+	sort.SliceStable(emails, func(i, j int) bool {
+		return scoreOf(emails[i]) > scoreOf(emails[j])
+	})
+}
+
+// scoreOf returns the score of the email, emails that were not scored come last
+func scoreOf(email integrations.Email) int {
+
+	if email.Priority == nil {
+		return math.MinInt
+	}
+
+	return email.Priority.Score
+}
+
+// score computes the priority of a single email
+func score(email integrations.Email, rules Rules, myAddresses map[string]bool, threads map[string]int, now time.Time) *integrations.Priority {
+
+	priority := &integrations.Priority{Reasons: []string{}}
+	add := func(weight int, reason string) {
+		if weight == 0 {
+			return
+		}
+		priority.Score += weight
+		priority.Reasons = append(priority.Reasons, fmt.Sprintf("%s (%+d)", reason, weight))
+	}
+
+	sender := strings.ToLower(integrations.SenderAddress(email.Sender))
+	for _, vip := range rules.VIPSenders {
+		vip = strings.ToLower(strings.TrimSpace(vip))
+		if sender != "" && (sender == vip || (strings.HasPrefix(vip, "@") && strings.HasSuffix(sender, vip))) {
+			add(rules.VIPWeight, "VIP sender "+vip)
+			break
+		}
+	}
+
+	switch recipientType(email, myAddresses) {
+	case "to":
+		add(rules.DirectWeight, "sent directly to you")
+	case "cc":
+		add(rules.CcWeight, "you are in copy")
+	}
+
+	if others := threads[email.ThreadID] - 1; email.ThreadID != "" && others > 0 {
+		if others > rules.ThreadMax {
+			others = rules.ThreadMax
+		}
+		add(others*rules.ThreadWeight, fmt.Sprintf("active thread with %d other emails", threads[email.ThreadID]-1))
+	}
+
+	text := strings.ToLower(email.Subject + " " + email.Body)
+	for _, keyword := range rules.Keywords {
+		if strings.Contains(text, strings.ToLower(keyword.Keyword)) {
+			add(keyword.Weight, fmt.Sprintf("mentions %q", keyword.Keyword))
+		}
+	}
+
+	for _, label := range email.Labels {
+		if weight, ok := rules.CategoryWeights[label]; ok {
+			add(weight, "labelled "+label)
+		}
+	}
+
+	if due, ok := nextDue(email, now); ok {
+		switch {
+		case due.Sub(now) <= 24*time.Hour:
+			add(rules.DueSoonWeight, "due within 24 hours")
+		case due.Sub(now) <= 7*24*time.Hour:
+			add(rules.DueWeight, "due within 7 days")
+		}
+	}
+
+	return priority
+}
+
+// recipientType tells whether the user is a direct recipient of the email or in copy.
+// When the user's addresses are not configured, an email with a single recipient and no copy is taken as direct.
+func recipientType(email integrations.Email, myAddresses map[string]bool) string {
+
+	if len(myAddresses) == 0 {
+		if len(email.To) == 1 && len(email.Cc) == 0 {
+			return "to"
+		}
+		return ""
+	}
+
+	for _, address := range email.To {
+		if myAddresses[strings.ToLower(address)] {
+			return "to"
+		}
+	}
+
+	for _, address := range email.Cc {
+		if myAddresses[strings.ToLower(address)] {
+			return "cc"
+		}
+	}
+
+	return ""
+}
+
+// nextDue returns the soonest upcoming deadline or meeting of the email
+func nextDue(email integrations.Email, now time.Time) (time.Time, bool) {
+
+	var next time.Time
+	found := false
+
+	consider := func(due time.Time) {
+		if due.Before(now) {
+			return
+		}
+		if !found || due.Before(next) {
+			next, found = due, true
+		}
+	}
+
+	for _, item := range email.ActionItems {
+		due, err := time.Parse(time.RFC3339, item.Due)
+		if err == nil {
+			consider(due)
+		}
+	}
+
+	if email.Invite != nil && email.Invite.Method == "REQUEST" {
+		consider(email.Invite.Start)
+	}
+
+	return next, found
+}
@@ -0,0 +1,111 @@
+package priority
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScore(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC)
+
+	rules := DefaultRules()
+	rules.MyAddresses = []string{"me@example.com"}
+	rules.VIPSenders = []string{"@boss.com"}
+
+	emails := []integrations.Email{
+		{ID: "1", Sender: "Jane <jane@boss.com>", Subject: "Urgent: budget", To: []string{"me@example.com"}, ThreadID: "t1"},
+		{ID: "2", Sender: "news@shop.com", Subject: "Sale", Body: "Click to unsubscribe", To: []string{"me@example.com"}, Labels: []string{"CATEGORY_PROMOTIONS"}},
+		{ID: "3", Sender: "bob@example.com", Subject: "Re: budget", Cc: []string{"me@example.com"}, ThreadID: "t1",
+			ActionItems: []integrations.ActionItem{{Kind: "deadline", Due: now.Add(3 * time.Hour).Format(time.RFC3339)}}},
+	}
+
+	Score(emails, rules, now)
+
+	assert.Equal(&integrations.Priority{Score: 65, Reasons: []string{
+		"VIP sender @boss.com (+30)",
+		"sent directly to you (+10)",
+		"active thread with 1 other emails (+5)",
+		`mentions "urgent" (+20)`,
+	}}, emails[0].Priority)
+
+	assert.Equal(&integrations.Priority{Score: -20, Reasons: []string{
+		"sent directly to you (+10)",
+		`mentions "unsubscribe" (-10)`,
+		"labelled CATEGORY_PROMOTIONS (-20)",
+	}}, emails[1].Priority)
+
+	assert.Equal(&integrations.Priority{Score: 25, Reasons: []string{
+		"you are in copy (-5)",
+		"active thread with 1 other emails (+5)",
+		"due within 24 hours (+25)",
+	}}, emails[2].Priority)
+
+	Sort(emails)
+	assert.Equal("1", emails[0].ID)
+	assert.Equal("3", emails[1].ID)
+	assert.Equal("2", emails[2].ID)
+}
+
+func TestScoreWithoutAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	emails := []integrations.Email{
+		{ID: "1", To: []string{"me@example.com"}},
+		{ID: "2", To: []string{"me@example.com", "you@example.com"}},
+	}
+
+	Score(emails, Rules{DirectWeight: 10}, time.Now())
+
+	assert.Equal(10, emails[0].Priority.Score)
+	assert.Equal(0, emails[1].Priority.Score)
+	assert.Empty(emails[1].Priority.Reasons)
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(DefaultRules().Validate())
+	assert.Error(Rules{VIPSenders: []string{"boss.com"}}.Validate())
+	assert.Error(Rules{Keywords: []Keyword{{Keyword: " ", Weight: 5}}}.Validate())
+	assert.Error(Rules{ThreadMax: -1}.Validate())
+}
+
+func TestGetRules(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// Nothing saved yet
+	mock.ExpectGet("user_u1:priority_rules").RedisNil()
+
+	rules, err := GetRules("u1")
+	assert.NoError(err)
+	assert.Equal(DefaultRules(), rules)
+
+	saved := Rules{VIPSenders: []string{"ceo@example.com"}, VIPWeight: 50}
+	value, _ := json.Marshal(saved)
+
+	mock.ExpectSet("user_u1:priority_rules", value, 0).SetVal("OK")
+	assert.NoError(SaveRules("u1", saved))
+
+	mock.ExpectGet("user_u1:priority_rules").SetVal(string(value))
+
+	rules, err = GetRules("u1")
+	assert.NoError(err)
+	assert.Equal(saved, rules)
+
+	mock.ExpectDel("user_u1:priority_rules").SetVal(1)
+	assert.NoError(ResetRules("u1"))
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
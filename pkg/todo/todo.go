@@ -0,0 +1,85 @@
+package todo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/mailsync"
+)
+
+// Item is a struct to hold an entry of the to-do list along with the email it comes from
+type Item struct {
+	integrations.ActionItem
+	Provider         string `json:"provider"`
+	Account          string `json:"account,omitempty"`
+	EmailID          string `json:"emailId"`
+	Subject          string `json:"subject"`
+	Sender           string `json:"sender"`
+	RecievedDateTime string `json:"recievedDateTime"`
+}
+
+// GetTodos returns the action items of the user's indexed and ingested emails, or of the emails of the user's accounts matching the selector.
+// The items with a deadline come first, soonest first, followed by the others, newest email first.
+// The accounts whose emails cannot be read are left out and reported.
+func GetTodos(user string, selector string) ([]Item, []integrations.AccountError, error) {
+
+	emails, failed, err := mailsync.GetAllEmails(user, selector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return buildTodos(emails), failed, nil
+}
+
+// buildTodos flattens the action items of the emails into a single sorted list
+func buildTodos(emails map[string][]integrations.Email) []Item {
+
+	items := []Item{}
+
+	for provider, providerEmails := range emails {
+		for _, email := range providerEmails {
+			for _, actionItem := range email.ActionItems {
+				items = append(items, Item{
+					ActionItem:       actionItem,
+					Provider:         provider,
+					Account:          email.Account,
+					EmailID:          email.ID,
+					Subject:          email.Subject,
+					Sender:           email.Sender,
+					RecievedDateTime: email.RecievedDateTime,
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		dueI, errI := time.Parse(time.RFC3339, items[i].Due)
+		dueJ, errJ := time.Parse(time.RFC3339, items[j].Due)
+
+		switch {
+		case errI == nil && errJ == nil:
+			if !dueI.Equal(dueJ) {
+				return dueI.Before(dueJ)
+			}
+		case errI == nil:
+			return true
+		case errJ == nil:
+			return false
+		}
+
+		receivedI, _ := integrations.Email{RecievedDateTime: items[i].RecievedDateTime}.ReceivedTime()
+		receivedJ, _ := integrations.Email{RecievedDateTime: items[j].RecievedDateTime}.ReceivedTime()
+		if !receivedI.Equal(receivedJ) {
+			return receivedI.After(receivedJ)
+		}
+
+		// Keep the items of an email in the order they appear in, whatever order the providers came in
+		if items[i].EmailID != items[j].EmailID {
+			return items[i].EmailID < items[j].EmailID
+		}
+		return false
+	})
+
+	return items
+}
@@ -0,0 +1,44 @@
+package todo
+
+import (
+	"testing"
+
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildTodos(t *testing.T) {
+	assert := assert.New(t)
+
+	emails := map[string][]integrations.Email{
+		"google": {
+			{ID: "1", Subject: "Slides", RecievedDateTime: "2024-01-03T10:00:00Z", ActionItems: []integrations.ActionItem{
+				{Kind: "request", Text: "Could you send me the slides by Friday?", Due: "2024-01-05T23:59:00Z"},
+				{Kind: "question", Text: "Are you joining the dinner?"},
+			}},
+			{ID: "2", RecievedDateTime: "2024-01-03T11:00:00Z"},
+		},
+		"outlook": {
+			{ID: "A", Subject: "Contract", RecievedDateTime: "2024-01-02T10:00:00Z", ActionItems: []integrations.ActionItem{
+				{Kind: "request", Text: "Please sign the contract today.", Due: "2024-01-02T23:59:00+01:00"},
+				{Kind: "request", Text: "Let me know what you think."},
+			}},
+		},
+	}
+
+	items := buildTodos(emails)
+
+	texts := []string{}
+	for _, item := range items {
+		texts = append(texts, item.Text)
+	}
+
+	assert.Equal([]string{
+		"Please sign the contract today.",
+		"Could you send me the slides by Friday?",
+		"Are you joining the dinner?",
+		"Let me know what you think.",
+	}, texts)
+	assert.Equal("outlook", items[0].Provider)
+	assert.Equal("Contract", items[0].Subject)
+}
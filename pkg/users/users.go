@@ -0,0 +1,343 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// The roles of a user
+const (
+	// RoleAdmin users can invite other users
+	RoleAdmin = "admin"
+	// RoleMember users can only use their own data
+	RoleMember = "member"
+)
+
+// InvitationTTL is how long an enrollment link can be used
+const InvitationTTL = 7 * 24 * time.Hour
+
+// legacyPasswordKey is the redis key of the initial password earlier versions were bootstrapped with, it marks a store of a single user
+const legacyPasswordKey = "initial_password"
+
+// ErrInvalidRole is returned when the role is neither admin nor member
+var ErrInvalidRole = errors.New("the role must be admin or member")
+
+// ErrInvalidInvitation is returned when the invitation does not exist, was used or expired
+var ErrInvalidInvitation = errors.New("invalid, used or expired invitation")
+
+// User is a struct to hold a user of the portal, who owns API keys and connected accounts
+type User struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// IsAdmin checks if the user has the admin role
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// Invitation is a struct to hold a pending invitation, the user is created when the enrollment link is used
+type Invitation struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// InvitedBy is the ID of the admin who sent the invitation, it is empty for the first admin
+	InvitedBy string `json:"invitedBy,omitempty"`
+	// UserID is the ID of the existing user the invitation recovers, a new user is created if it is empty
+	UserID    string    `json:"userId,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// profileKey returns the redis key of the user's profile
+func profileKey(id string) string {
+	return utils.UserKey(id, "profile")
+}
+
+// invitationKey returns the redis key of the invitation, it is global since the user does not exist yet
+func invitationKey(id string) string {
+	return fmt.Sprintf("invitation_%s", id)
+}
+
+// EnrollmentPath returns the path of the enrollment link of the invitation, it must match the route in api/routes
+func EnrollmentPath(id string) string {
+	return fmt.Sprintf("/v1/users/enroll/%s", id)
+}
+
+// ValidateRole checks that the role is known
+func ValidateRole(role string) error {
+
+	if role != RoleAdmin && role != RoleMember {
+		return ErrInvalidRole
+	}
+
+	return nil
+}
+
+// Create creates a user with the name and role
+func Create(name string, role string) (User, error) {
+
+	if err := ValidateRole(role); err != nil {
+		return User{}, err
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return User{}, fmt.Errorf("Unable to generate user ID: %w", err)
+	}
+
+	user := User{
+		ID:        id,
+		Name:      name,
+		Role:      role,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	ctx := context.Background()
+
+	err = redisclient.Rdb.HSet(ctx, profileKey(id), map[string]interface{}{
+		"name":      user.Name,
+		"role":      user.Role,
+		"createdAt": user.CreatedAt.Format(time.RFC3339Nano),
+	}).Err()
+	if err != nil {
+		return User{}, fmt.Errorf("Unable to save user to redis: %w", err)
+	}
+
+	err = redisclient.Rdb.SAdd(ctx, utils.UsersKey, id).Err()
+	if err != nil {
+		return User{}, fmt.Errorf("Unable to index user in redis: %w", err)
+	}
+
+	return user, nil
+}
+
+// Get returns the user with the given ID, redis.Nil is returned if there is no such user
+func Get(id string) (User, error) {
+
+	fields, err := redisclient.Rdb.HGetAll(context.Background(), profileKey(id)).Result()
+	if err != nil {
+		return User{}, fmt.Errorf("Unable to retrieve user from redis: %w", err)
+	}
+
+	if len(fields) == 0 {
+		return User{}, redis.Nil
+	}
+
+	user := User{
+		ID:   id,
+		Name: fields["name"],
+		Role: fields["role"],
+	}
+
+	user.CreatedAt, _ = time.Parse(time.RFC3339Nano, fields["createdAt"])
+
+	return user, nil
+}
+
+// List returns the users, oldest first
+func List() ([]User, error) {
+
+	ids, err := utils.ListUserIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	for _, id := range ids {
+		user, err := Get(id)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	slices.SortStableFunc(users, func(a, b User) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	return users, nil
+}
+
+// FirstAdmin returns the oldest admin, redis.Nil is returned if there is none
+func FirstAdmin() (User, error) {
+
+	users, err := List()
+	if err != nil {
+		return User{}, err
+	}
+
+	for _, user := range users {
+		if user.IsAdmin() {
+			return user, nil
+		}
+	}
+
+	return User{}, redis.Nil
+}
+
+// Invite creates an invitation for a user with the name and role, it can be used once within InvitationTTL
+func Invite(name string, role string, invitedBy string) (Invitation, error) {
+
+	if err := ValidateRole(role); err != nil {
+		return Invitation{}, err
+	}
+
+	return saveInvitation(Invitation{Name: name, Role: role, InvitedBy: invitedBy})
+}
+
+// InviteRecovery creates an invitation that issues a new admin API key to the existing user, e.g. an owner left without a usable key.
+// It can be used once within InvitationTTL.
+func InviteRecovery(user User) (Invitation, error) {
+	return saveInvitation(Invitation{Name: user.Name, Role: user.Role, UserID: user.ID})
+}
+
+// saveInvitation gives the invitation an ID and saves it until it expires
+func saveInvitation(invitation Invitation) (Invitation, error) {
+
+	id, err := utils.GenerateAPIKey()
+	if err != nil {
+		return Invitation{}, fmt.Errorf("Unable to generate invitation ID: %w", err)
+	}
+
+	invitation.ID = id
+	invitation.ExpiresAt = time.Now().Add(InvitationTTL).UTC()
+
+	invitationJSON, err := json.Marshal(invitation)
+	if err != nil {
+		return Invitation{}, fmt.Errorf("Unable to marshal invitation: %w", err)
+	}
+
+	err = redisclient.Rdb.Set(context.Background(), invitationKey(id), invitationJSON, InvitationTTL).Err()
+	if err != nil {
+		return Invitation{}, fmt.Errorf("Unable to save invitation to redis: %w", err)
+	}
+
+	return invitation, nil
+}
+
+// EnrollmentLink returns the signed enrollment link of the invitation, it expires along with the invitation
+func EnrollmentLink(invitation Invitation) (string, error) {
+	return utils.SignURL(http.MethodGet, EnrollmentPath(invitation.ID), time.Until(invitation.ExpiresAt))
+}
+
+// GetInvitation returns the pending invitation with the given ID, ErrInvalidInvitation is returned if it was used or expired
+func GetInvitation(id string) (Invitation, error) {
+
+	value, err := redisclient.Rdb.Get(context.Background(), invitationKey(id)).Result()
+	if err == redis.Nil {
+		return Invitation{}, ErrInvalidInvitation
+	}
+	if err != nil {
+		return Invitation{}, fmt.Errorf("Unable to retrieve invitation from redis: %w", err)
+	}
+
+	return unmarshalInvitation(value)
+}
+
+// Enroll creates the user of the invitation, or returns the user it recovers, and invalidates it.
+// ErrInvalidInvitation is returned if it was used or expired, or if the user it recovers no longer exists.
+func Enroll(id string) (User, error) {
+
+	// The invitation can only be used once, even if creating the user fails
+	value, err := redisclient.Rdb.GetDel(context.Background(), invitationKey(id)).Result()
+	if err == redis.Nil {
+		return User{}, ErrInvalidInvitation
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("Unable to retrieve invitation from redis: %w", err)
+	}
+
+	invitation, err := unmarshalInvitation(value)
+	if err != nil {
+		return User{}, err
+	}
+
+	if invitation.UserID != "" {
+		user, err := Get(invitation.UserID)
+		if err == redis.Nil {
+			return User{}, ErrInvalidInvitation
+		}
+		return user, err
+	}
+
+	return Create(invitation.Name, invitation.Role)
+}
+
+// unmarshalInvitation parses an invitation stored in redis
+func unmarshalInvitation(value string) (Invitation, error) {
+
+	var invitation Invitation
+	err := json.Unmarshal([]byte(value), &invitation)
+	if err != nil {
+		return Invitation{}, fmt.Errorf("Unable to unmarshal invitation: %w", err)
+	}
+
+	return invitation, nil
+}
+
+// LegacyOwner returns the ID of the admin the data of earlier versions, which had a single user, is given to.
+// It is empty if the data was migrated already. The admin is created on the first start after the upgrade.
+func LegacyOwner() (string, error) {
+
+	exists, err := redisclient.Rdb.Exists(context.Background(), legacyPasswordKey).Result()
+	if err != nil {
+		return "", fmt.Errorf("Unable to check the initial password in redis: %w", err)
+	}
+
+	if exists == 0 {
+		return "", nil
+	}
+
+	// The migration may have been interrupted after the admin was created
+	admin, err := FirstAdmin()
+	if err == nil {
+		return admin.ID, nil
+	}
+	if err != redis.Nil {
+		return "", err
+	}
+
+	admin, err = Create("admin", RoleAdmin)
+	if err != nil {
+		return "", err
+	}
+
+	return admin.ID, nil
+}
+
+// FinishLegacyMigration removes the initial password of earlier versions once their data was given to the owner
+func FinishLegacyMigration() error {
+
+	err := redisclient.Rdb.Del(context.Background(), legacyPasswordKey).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to delete the initial password from redis: %w", err)
+	}
+
+	return nil
+}
+
+// randomID returns a random ID for a user
+func randomID() (string, error) {
+
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,101 @@
+package users
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetInvitationAndEnroll(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	invitation := Invitation{ID: "abc", Name: "jane", Role: RoleMember, InvitedBy: "u1", ExpiresAt: time.Now().Add(time.Hour).UTC()}
+	value, _ := json.Marshal(invitation)
+	mock.ExpectGet("invitation_abc").SetVal(string(value))
+
+	got, err := GetInvitation("abc")
+	assert.NoError(err)
+	assert.Equal("jane", got.Name)
+	assert.Equal(RoleMember, got.Role)
+
+	mock.ExpectGet("invitation_missing").RedisNil()
+
+	_, err = GetInvitation("missing")
+	assert.ErrorIs(err, ErrInvalidInvitation)
+
+	// An invitation that was used already cannot be used again
+	mock.ExpectGetDel("invitation_abc").RedisNil()
+
+	_, err = Enroll("abc")
+	assert.ErrorIs(err, ErrInvalidInvitation)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestRecoveryEnroll(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// The invitation recovers the existing user instead of creating one
+	invitation := Invitation{ID: "abc", Name: "admin", Role: RoleAdmin, UserID: "u1", ExpiresAt: time.Now().Add(time.Hour).UTC()}
+	value, _ := json.Marshal(invitation)
+	mock.ExpectGetDel("invitation_abc").SetVal(string(value))
+	mock.ExpectHGetAll("user_u1:profile").SetVal(map[string]string{"name": "admin", "role": RoleAdmin})
+
+	user, err := Enroll("abc")
+	assert.NoError(err)
+	assert.Equal("u1", user.ID)
+	assert.True(user.IsAdmin())
+
+	// The user was deleted meanwhile
+	mock.ExpectGetDel("invitation_abc").SetVal(string(value))
+	mock.ExpectHGetAll("user_u1:profile").SetVal(map[string]string{})
+
+	_, err = Enroll("abc")
+	assert.ErrorIs(err, ErrInvalidInvitation)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestInviteInvalidRole(t *testing.T) {
+	_, err := Invite("jane", "owner", "u1")
+	assert.ErrorIs(t, err, ErrInvalidRole)
+}
+
+func TestLegacyOwner(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// The data was migrated already
+	mock.ExpectExists(legacyPasswordKey).SetVal(0)
+
+	owner, err := LegacyOwner()
+	assert.NoError(err)
+	assert.Empty(owner)
+
+	// The migration was interrupted after the admin was created
+	mock.ExpectExists(legacyPasswordKey).SetVal(1)
+	mock.ExpectSMembers("users").SetVal([]string{"u2", "u1"})
+	mock.ExpectHGetAll("user_u1:profile").SetVal(map[string]string{"name": "admin", "role": RoleAdmin, "createdAt": "2024-01-01T00:00:00Z"})
+	mock.ExpectHGetAll("user_u2:profile").SetVal(map[string]string{"name": "jane", "role": RoleMember, "createdAt": "2024-02-01T00:00:00Z"})
+
+	owner, err = LegacyOwner()
+	assert.NoError(err)
+	assert.Equal("u1", owner)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
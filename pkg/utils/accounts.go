@@ -0,0 +1,523 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// The accounts are identified by the user they belong to, the provider and the email of the mailbox, e.g. <user>/google:jane@example.com.
+// The tokens of an account are stored under keys namespaced with its ID, under the prefix of its user.
+// An account connected before several accounts were supported is identified by the provider alone until its email is known,
+// and the accounts connected before the portal had several users have no user until they are migrated.
+
+// ErrAccountNotFound is returned when no connected account matches the account selector
+var ErrAccountNotFound = errors.New("no connected account matches the account")
+
+// ErrAccountAmbiguous is returned when several accounts are connected and the request did not select one
+var ErrAccountAmbiguous = errors.New("several accounts are connected, select one with account")
+
+// The profile endpoints reporting the email of the account, they are variables so that tests can point them to a local stand-in
+var (
+	googleUserinfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+	gmailProfileURL   = "https://gmail.googleapis.com/gmail/v1/users/me/profile"
+	graphMeURL        = "https://graph.microsoft.com/v1.0/me"
+)
+
+// AccountID returns the ID of the user's account of the provider with the given email
+func AccountID(user string, provider string, email string) string {
+
+	account := fmt.Sprintf("%s:%s", provider, strings.ToLower(email))
+	if user == "" {
+		return account
+	}
+
+	return fmt.Sprintf("%s/%s", user, account)
+}
+
+// splitAccount returns the user of the account and the ID of the account without it
+func splitAccount(account string) (string, string) {
+
+	// The provider never contains a slash, the email may
+	slash := strings.Index(account, "/")
+	colon := strings.Index(account, ":")
+	if slash < 0 || (colon >= 0 && colon < slash) {
+		return "", account
+	}
+
+	return account[:slash], account[slash+1:]
+}
+
+// AccountUser returns the ID of the user the account belongs to
+func AccountUser(account string) string {
+	user, _ := splitAccount(account)
+	return user
+}
+
+// AccountName returns the ID of the account without its user, e.g. google:jane@example.com, as shown to the user
+func AccountName(account string) string {
+	_, name := splitAccount(account)
+	return name
+}
+
+// AccountProvider returns the provider of the account
+func AccountProvider(account string) string {
+	provider, _, _ := strings.Cut(AccountName(account), ":")
+	return provider
+}
+
+// AccountEmail returns the email of the account, it is empty for an account whose email is not known yet
+func AccountEmail(account string) string {
+	_, email, _ := strings.Cut(AccountName(account), ":")
+	return email
+}
+
+// AccountKey returns the redis key of the account's data with the given prefix, e.g. refreshToken_, under the prefix of its user
+func AccountKey(prefix string, account string) string {
+
+	user, name := splitAccount(account)
+	if user == "" {
+		return prefix + name
+	}
+
+	return UserKey(user, prefix+name)
+}
+
+// accountsKey returns the redis key of the set of the user's connected accounts of the provider
+func accountsKey(user string, provider string) string {
+
+	if user == "" {
+		return fmt.Sprintf("accounts_%s", provider)
+	}
+
+	return UserKey(user, fmt.Sprintf("accounts_%s", provider))
+}
+
+// AddAccount registers the account as connected
+func AddAccount(account string) error {
+
+	err := redisclient.Rdb.SAdd(context.Background(), accountsKey(AccountUser(account), AccountProvider(account)), account).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save account to redis: %w", err)
+	}
+
+	return nil
+}
+
+// ListAccounts returns the user's connected accounts of the provider, or of every provider if it is empty, sorted by ID
+func ListAccounts(user string, provider string) ([]string, error) {
+
+	providers := []string{provider}
+	if provider == "" {
+		providers = sortedProviders()
+	}
+
+	accounts := []string{}
+	for _, provider := range providers {
+		members, err := redisclient.Rdb.SMembers(context.Background(), accountsKey(user, provider)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to retrieve accounts from redis: %w", err)
+		}
+		accounts = append(accounts, members...)
+	}
+
+	sort.Strings(accounts)
+
+	return accounts, nil
+}
+
+// ListAllAccounts returns the connected accounts of the provider, or of every provider if it is empty, of every user.
+// It is used by the background tasks, which act on behalf of every user.
+func ListAllAccounts(provider string) ([]string, error) {
+
+	ids, err := ListUserIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []string{}
+	for _, user := range ids {
+		userAccounts, err := ListAccounts(user, provider)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, userAccounts...)
+	}
+
+	return accounts, nil
+}
+
+// SelectAccounts returns the user's connected accounts of the provider, or of every provider if it is empty, that match the selector.
+// The selector is the email or the ID of an account, every account matches an empty selector.
+// ErrAccountNotFound is returned if the selector matches no account.
+func SelectAccounts(user string, provider string, selector string) ([]string, error) {
+
+	accounts, err := ListAccounts(user, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	if selector == "" {
+		return accounts, nil
+	}
+
+	selected := []string{}
+	for _, account := range accounts {
+		if strings.EqualFold(AccountName(account), selector) || strings.EqualFold(AccountEmail(account), selector) {
+			selected = append(selected, account)
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, ErrAccountNotFound
+	}
+
+	return selected, nil
+}
+
+// ResolveAccount returns the user's single account of the provider that matches the selector, for the requests acting on one mailbox.
+// The selector can be left out if only one account is connected, ErrAccountAmbiguous is returned otherwise.
+// redis.Nil is returned if the provider is not connected.
+func ResolveAccount(user string, provider string, selector string) (string, error) {
+
+	accounts, err := SelectAccounts(user, provider, selector)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(accounts) {
+	case 0:
+		return "", redis.Nil
+	case 1:
+		return accounts[0], nil
+	}
+
+	return "", ErrAccountAmbiguous
+}
+
+// LinkAccount saves the token of a completed authorization flow as the token of the account it was issued for, and registers the account.
+// The account is identified by the email the provider reports for the token, and belongs to the user who started the flow.
+func LinkAccount(link OAuthLink, token *oauth2.Token) (string, error) {
+
+	email, err := FetchAccountEmail(link.Provider, token)
+	if err != nil {
+		return "", err
+	}
+
+	account := AccountID(link.User, link.Provider, email)
+
+	err = ConfirmLink(link, account)
+	if err != nil {
+		return "", err
+	}
+
+	err = SaveToken(account, token)
+	if err != nil {
+		return "", err
+	}
+
+	err = AddAccount(account)
+	if err != nil {
+		return "", err
+	}
+
+	return account, nil
+}
+
+// FetchAccountEmail returns the email of the account the token was issued for, from the OpenID userinfo of Google or the Graph profile of Microsoft
+func FetchAccountEmail(provider string, token *oauth2.Token) (string, error) {
+
+	var profile struct {
+		Email             string `json:"email"`
+		EmailAddress      string `json:"emailAddress"`
+		Mail              string `json:"mail"`
+		UserPrincipalName string `json:"userPrincipalName"`
+	}
+
+	switch provider {
+	case "google":
+		err := getProfile(googleUserinfoURL, token, &profile)
+		if err != nil {
+			// The tokens granted before the email scope was requested can still read the Gmail profile
+			fallbackErr := getProfile(gmailProfileURL, token, &profile)
+			if fallbackErr != nil {
+				return "", err
+			}
+		}
+	case "outlook":
+		err := getProfile(graphMeURL, token, &profile)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("Invalid provider: %s", provider)
+	}
+
+	for _, email := range []string{profile.Email, profile.EmailAddress, profile.Mail, profile.UserPrincipalName} {
+		if email != "" {
+			return strings.ToLower(email), nil
+		}
+	}
+
+	return "", fmt.Errorf("The %s profile does not include an email", provider)
+}
+
+// getProfile reads the profile of the account the token was issued for
+func getProfile(url string, token *oauth2.Token, profile interface{}) error {
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error sending profile request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read profile response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("The provider answered %d to the profile request: %s", resp.StatusCode, data)
+	}
+
+	err = json.Unmarshal(data, profile)
+	if err != nil {
+		return fmt.Errorf("Unable to unmarshal profile: %w", err)
+	}
+
+	return nil
+}
+
+// MigrateAccounts moves the accounts connected by earlier versions to the keys of the account they belong to:
+// the accounts connected before the portal had several users are given to the owner, if there is one,
+// and the tokens stored under the provider's name are moved to the keys of the account's email.
+// The accounts whose email cannot be retrieved, e.g. while offline, keep working under the provider's name and are migrated on the next start.
+// The IDs of the migrated accounts are returned by their previous ID, so that the data kept by account can be moved along.
+func MigrateAccounts(owner string) (map[string]string, error) {
+
+	migrated := map[string]string{}
+
+	ids, err := ListUserIDs()
+	if err != nil {
+		return migrated, err
+	}
+
+	for _, provider := range sortedProviders() {
+		if owner != "" {
+			accounts, err := legacyAccounts(provider)
+			if err != nil {
+				return migrated, err
+			}
+
+			for _, account := range accounts {
+				newAccount := fmt.Sprintf("%s/%s", owner, account)
+
+				err = moveAccount(account, newAccount)
+				if err != nil {
+					return migrated, err
+				}
+
+				migrated[account] = newAccount
+				log.Printf("Migrated the %s account to the user %s", account, owner)
+			}
+		}
+
+		for _, user := range ids {
+			account := fmt.Sprintf("%s/%s", user, provider)
+
+			exists, err := redisclient.Rdb.Exists(context.Background(), accessTokenKey(account), refreshTokenKey(account)).Result()
+			if err != nil {
+				return migrated, fmt.Errorf("Unable to check token in redis: %w", err)
+			}
+
+			if exists == 0 {
+				continue
+			}
+
+			email, err := legacyAccountEmail(account)
+			if err != nil {
+				log.Printf("Warning: unable to retrieve the email of the connected %s account, it is kept as %q until the next start: %v", provider, account, err)
+				continue
+			}
+
+			newAccount := AccountID(user, provider, email)
+
+			err = moveAccount(account, newAccount)
+			if err != nil {
+				return migrated, err
+			}
+
+			// The account may have just been given to the user
+			previous := account
+			for old, moved := range migrated {
+				if moved == account {
+					previous = old
+				}
+			}
+
+			migrated[previous] = newAccount
+			log.Printf("Migrated the %s tokens to the %s account", account, newAccount)
+		}
+	}
+
+	return migrated, nil
+}
+
+// legacyAccounts returns the provider's accounts connected before the portal had several users, including the one stored under the provider's name
+func legacyAccounts(provider string) ([]string, error) {
+
+	ctx := context.Background()
+
+	accounts, err := ListAccounts("", provider)
+	if err != nil {
+		return nil, err
+	}
+
+	// The versions before several accounts were supported did not register the account
+	exists, err := redisclient.Rdb.Exists(ctx, accessTokenKey(provider), refreshTokenKey(provider)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to check token in redis: %w", err)
+	}
+
+	if exists > 0 && !slices.Contains(accounts, provider) {
+		accounts = append(accounts, provider)
+	}
+
+	return accounts, nil
+}
+
+// moveAccount renames the tokens of the account to the keys of the new account and registers it in place of the account
+func moveAccount(account string, newAccount string) error {
+
+	for _, key := range []func(string) string{accessTokenKey, refreshTokenKey} {
+		err := moveTokens(key(account), key(newAccount))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := renameIfExists(reconsentKey(account), reconsentKey(newAccount))
+	if err != nil {
+		return err
+	}
+
+	err = AddAccount(newAccount)
+	if err != nil {
+		return err
+	}
+
+	err = redisclient.Rdb.SRem(context.Background(), accountsKey(AccountUser(account), AccountProvider(account)), account).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to remove account from redis: %w", err)
+	}
+
+	return nil
+}
+
+// moveTokens renames the hash of tokens to the new key, keeping its TTL, if it exists.
+// The encrypted tokens are bound to their key, they are encrypted again for the new key in the same transaction.
+func moveTokens(key string, newKey string) error {
+
+	ctx := context.Background()
+
+	values, err := redisclient.Rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve %s from redis: %w", key, err)
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	rebound := map[string]interface{}{}
+	for field, value := range values {
+		if !strings.HasPrefix(value, encryptedPrefix) {
+			continue
+		}
+
+		plaintext, err := DecryptValue(value, key, field)
+		if err != nil {
+			return err
+		}
+
+		rebound[field], err = EncryptValue(plaintext, newKey, field)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = redisclient.Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Rename(ctx, key, newKey)
+		if len(rebound) > 0 {
+			pipe.HSet(ctx, newKey, rebound)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to move %s in redis: %w", key, err)
+	}
+
+	return nil
+}
+
+// legacyAccountEmail returns the email of the account whose tokens are stored under the provider's name
+func legacyAccountEmail(account string) (string, error) {
+
+	token, err := GetValidToken(account)
+	if err != nil {
+		return "", err
+	}
+
+	return FetchAccountEmail(AccountProvider(account), token)
+}
+
+// renameIfExists renames the key, keeping its TTL, if it exists
+func renameIfExists(key string, newKey string) error {
+
+	ctx := context.Background()
+
+	exists, err := redisclient.Rdb.Exists(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("Unable to check %s in redis: %w", key, err)
+	}
+
+	if exists == 0 {
+		return nil
+	}
+
+	err = redisclient.Rdb.Rename(ctx, key, newKey).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to rename %s in redis: %w", key, err)
+	}
+
+	return nil
+}
+
+// sortedProviders returns the valid providers in a stable order
+func sortedProviders() []string {
+
+	providers := []string{}
+	for provider := range ValidProviders {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	return providers
+}
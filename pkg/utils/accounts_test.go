@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestAccountID(t *testing.T) {
+	assert := assert.New(t)
+
+	account := AccountID("u1", "google", "Jane@Example.com")
+	assert.Equal("u1/google:jane@example.com", account)
+	assert.Equal("u1", AccountUser(account))
+	assert.Equal("google:jane@example.com", AccountName(account))
+	assert.Equal("google", AccountProvider(account))
+	assert.Equal("jane@example.com", AccountEmail(account))
+	assert.Equal("user_u1:refreshToken_google:jane@example.com", AccountKey("refreshToken_", account))
+
+	// The email may contain a slash
+	assert.Equal("u1", AccountUser("u1/google:jane/doe@example.com"))
+	assert.Equal("jane/doe@example.com", AccountEmail("u1/google:jane/doe@example.com"))
+
+	// An account connected before several accounts were supported
+	assert.Equal("outlook", AccountProvider("u1/outlook"))
+	assert.Equal("", AccountEmail("u1/outlook"))
+
+	// An account connected before the portal had several users
+	assert.Equal("", AccountUser("google:jane/doe@example.com"))
+	assert.Equal("refreshToken_google:jane@example.com", AccountKey("refreshToken_", "google:jane@example.com"))
+	assert.Equal("google:jane@example.com", AccountID("", "google", "jane@example.com"))
+}
+
+func TestSelectAccounts(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	connected := []string{"u1/google:john@example.com", "u1/google:jane@example.com"}
+
+	// Every account matches an empty selector
+	mock.ExpectSMembers("user_u1:accounts_google").SetVal(connected)
+	accounts, err := SelectAccounts("u1", "google", "")
+	assert.NoError(err)
+	assert.Equal([]string{"u1/google:jane@example.com", "u1/google:john@example.com"}, accounts)
+
+	mock.ExpectSMembers("user_u1:accounts_google").SetVal(connected)
+	account, err := ResolveAccount("u1", "google", "Jane@example.com")
+	assert.NoError(err)
+	assert.Equal("u1/google:jane@example.com", account)
+
+	mock.ExpectSMembers("user_u1:accounts_google").SetVal(connected)
+	_, err = ResolveAccount("u1", "google", "")
+	assert.Equal(ErrAccountAmbiguous, err)
+
+	mock.ExpectSMembers("user_u1:accounts_google").SetVal(connected)
+	_, err = ResolveAccount("u1", "google", "someone@example.com")
+	assert.Equal(ErrAccountNotFound, err)
+
+	mock.ExpectSMembers("user_u1:accounts_outlook").SetVal([]string{})
+	_, err = ResolveAccount("u1", "outlook", "")
+	assert.Equal(redis.Nil, err)
+
+	// The accounts of other users are never selected
+	mock.ExpectSMembers("user_u2:accounts_google").SetVal([]string{})
+	_, err = ResolveAccount("u2", "google", "jane@example.com")
+	assert.Equal(ErrAccountNotFound, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestFetchAccountEmail(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("Bearer access", r.Header.Get("Authorization"))
+
+		switch r.URL.Path {
+		case "/userinfo":
+			// The token was granted before the email scope was requested
+			w.WriteHeader(http.StatusForbidden)
+		case "/profile":
+			json.NewEncoder(w).Encode(map[string]string{"emailAddress": "Jane@Example.com"})
+		case "/me":
+			json.NewEncoder(w).Encode(map[string]string{"userPrincipalName": "john@example.com"})
+		}
+	}))
+	defer server.Close()
+
+	googleUserinfoURL, gmailProfileURL, graphMeURL = server.URL+"/userinfo", server.URL+"/profile", server.URL+"/me"
+	defer func() {
+		googleUserinfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+		gmailProfileURL = "https://gmail.googleapis.com/gmail/v1/users/me/profile"
+		graphMeURL = "https://graph.microsoft.com/v1.0/me"
+	}()
+
+	token := &oauth2.Token{AccessToken: "access", TokenType: "Bearer"}
+
+	email, err := FetchAccountEmail("google", token)
+	assert.NoError(err)
+	assert.Equal("jane@example.com", email)
+
+	email, err = FetchAccountEmail("outlook", token)
+	assert.NoError(err)
+	assert.Equal("john@example.com", email)
+
+	_, err = FetchAccountEmail("yahoo", token)
+	assert.Error(err)
+}
+
+func TestMoveTokens(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	encryptionKeys, _ = parseKeyring("k1:" + testKey('a'))
+	defer func() { encryptionKeys = nil }()
+
+	accessToken, _ := EncryptValue("access", "google", "access_token")
+
+	// The encrypted token is bound to the new key in the transaction renaming the hash
+	var moved string
+	rebound := func(expected, actual []interface{}) error {
+		if len(actual) != 4 || actual[2] != "access_token" {
+			return fmt.Errorf("unexpected arguments %v", actual)
+		}
+		moved, _ = actual[3].(string)
+		return nil
+	}
+
+	mock.ExpectHGetAll("google").SetVal(map[string]string{"access_token": accessToken, "token_type": "Bearer"})
+	mock.ExpectTxPipeline()
+	mock.ExpectRename("google", "user_u1:google:jane@example.com").SetVal("OK")
+	mock.CustomMatch(rebound).ExpectHSet("user_u1:google:jane@example.com", "access_token", "").SetVal(0)
+	mock.ExpectTxPipelineExec()
+
+	assert.NoError(moveTokens("google", "user_u1:google:jane@example.com"))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+
+	plaintext, err := DecryptValue(moved, "user_u1:google:jane@example.com", "access_token")
+	assert.NoError(err)
+	assert.Equal("access", plaintext)
+
+	// Nothing is moved if the hash does not exist
+	mock.ExpectHGetAll("refreshToken_google").SetVal(map[string]string{})
+	assert.NoError(moveTokens("refreshToken_google", "user_u1:refreshToken_google:jane@example.com"))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+)
+
+// auditLogSize is the number of entries kept in the audit log of each user
+const auditLogSize = 1000
+
+// auditLogKey is the redis key of the audit log, under the prefix of the user
+const auditLogKey = "audit_log"
+
+// AuditEntry is a struct to hold a single entry of the audit log
+type AuditEntry struct {
+	Time     string `json:"time"`
+	Provider string `json:"provider"`
+	Account  string `json:"account,omitempty"`
+	Target   string `json:"target"`
+	Action   string `json:"action"`
+	Argument string `json:"argument,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RecordAudit appends the entry to the user's audit log in redis, newest first.
+func RecordAudit(user string, entry AuditEntry) error {
+
+	if entry.Time == "" {
+		entry.Time = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	}
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal audit entry: %w", err)
+	}
+
+	err = redisclient.Rdb.LPush(context.Background(), UserKey(user, auditLogKey), entryJSON).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save audit entry to redis: %w", err)
+	}
+
+	// Only keep the latest entries
+	err = redisclient.Rdb.LTrim(context.Background(), UserKey(user, auditLogKey), 0, auditLogSize-1).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to trim audit log in redis: %w", err)
+	}
+
+	return nil
+}
+
+// GetAuditLog returns the latest entries of the user's audit log, newest first.
+func GetAuditLog(user string, limit int64) ([]AuditEntry, error) {
+
+	entries, err := redisclient.Rdb.LRange(context.Background(), UserKey(user, auditLogKey), 0, limit-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve audit log from redis: %w", err)
+	}
+
+	auditLog := []AuditEntry{}
+	for _, entryJSON := range entries {
+		var entry AuditEntry
+		err = json.Unmarshal([]byte(entryJSON), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to unmarshal audit entry: %w", err)
+		}
+		auditLog = append(auditLog, entry)
+	}
+
+	return auditLog, nil
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"testing"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAudit(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	entry := AuditEntry{
+		Time:     "2024-01-02T03:04:05Z",
+		Provider: "google",
+		Target:   "123",
+		Action:   "add_label",
+		Argument: "Planner",
+	}
+
+	mock.ExpectLPush("user_u1:audit_log", []byte(`{"time":"2024-01-02T03:04:05Z","provider":"google","target":"123","action":"add_label","argument":"Planner"}`)).SetVal(1)
+	mock.ExpectLTrim("user_u1:audit_log", 0, auditLogSize-1).SetVal("OK")
+
+	assert.NoError(RecordAudit("u1", entry))
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestGetAuditLog(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectLRange("user_u1:audit_log", 0, 9).SetVal([]string{
+		`{"time":"2024-01-02T03:04:05Z","provider":"outlook","target":"abc","action":"archive","error":"boom"}`,
+	})
+
+	entries, err := GetAuditLog("u1", 10)
+	assert.NoError(err)
+	assert.Equal([]AuditEntry{{
+		Time:     "2024-01-02T03:04:05Z",
+		Provider: "outlook",
+		Target:   "abc",
+		Action:   "archive",
+		Error:    "boom",
+	}}, entries)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
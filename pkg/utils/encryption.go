@@ -0,0 +1,348 @@
+package utils
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+// encryptedPrefix marks the values encrypted by the portal, values without it are read as plaintext until the stored tokens are encrypted
+const encryptedPrefix = "enc:v1:"
+
+// ErrNoEncryptionKey is returned when a value has to be encrypted but no key is configured
+var ErrNoEncryptionKey = errors.New("no token encryption key is configured, set TOKEN_ENCRYPTION_KEY or TOKEN_ENCRYPTION_KEY_FILE")
+
+// ErrPlaintextValue is returned when a value is read in plaintext although the stored tokens were encrypted, e.g. because it was written to redis by hand
+var ErrPlaintextValue = errors.New("the value is stored in plaintext although the tokens are encrypted")
+
+// replaceFieldScript replaces the field only if it was not changed meanwhile, e.g. by a token refresh, and if the hash did not expire
+const replaceFieldScript = `if redis.call("hget", KEYS[1], ARGV[1]) == ARGV[2] then return redis.call("hset", KEYS[1], ARGV[1], ARGV[3]) else return -1 end`
+
+// keyring holds the key encryption keys by ID, the primary key encrypts and the others are only used to decrypt
+type keyring struct {
+	primaryID string
+	keys      map[string][]byte
+}
+
+// encryptionKeys is the keyring loaded at startup, tokens are stored in plaintext without it
+var encryptionKeys *keyring
+
+// plaintextAccepted tells if the values in plaintext are read as they are, which is only the case until the stored tokens are encrypted
+var plaintextAccepted = true
+
+// LoadEncryptionKeys loads the token encryption keys from the TOKEN_ENCRYPTION_KEY environment variable or the file at TOKEN_ENCRYPTION_KEY_FILE.
+// Each key is written as <id>:<base64 encoded 32 bytes>, separated by commas or new lines. The first key encrypts, the others are old keys kept to decrypt until the tokens are re-encrypted.
+// False is returned if no key is configured.
+func LoadEncryptionKeys() (bool, error) {
+
+	data := os.Getenv("TOKEN_ENCRYPTION_KEY")
+
+	path := os.Getenv("TOKEN_ENCRYPTION_KEY_FILE")
+	if data == "" && path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return false, fmt.Errorf("Unable to read token encryption key file: %w", err)
+		}
+		data = string(content)
+	}
+
+	if data == "" {
+		encryptionKeys = nil
+		return false, nil
+	}
+
+	ring, err := parseKeyring(data)
+	if err != nil {
+		return false, err
+	}
+
+	encryptionKeys = ring
+	plaintextAccepted = true
+
+	return true, nil
+}
+
+// parseKeyring parses the <id>:<base64 key> entries, lines starting with # are ignored
+func parseKeyring(data string) (*keyring, error) {
+
+	ring := &keyring{keys: map[string][]byte{}}
+
+	entries := strings.FieldsFunc(data, func(r rune) bool { return r == ',' || r == '\n' })
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("Invalid token encryption key entry, expected <id>:<base64 key>")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode token encryption key %s: %w", id, err)
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Token encryption key %s must be 32 bytes long, got %d", id, len(key))
+		}
+
+		if _, exists := ring.keys[id]; exists {
+			return nil, fmt.Errorf("Duplicate token encryption key ID %s", id)
+		}
+
+		if ring.primaryID == "" {
+			ring.primaryID = id
+		}
+		ring.keys[id] = key
+	}
+
+	if ring.primaryID == "" {
+		return nil, fmt.Errorf("No token encryption key found")
+	}
+
+	return ring, nil
+}
+
+// valueAAD returns the data authenticated along with a value, so that it cannot be copied to the field of another account or to another field
+func valueAAD(key string, field string) []byte {
+	return []byte(key + "\x00" + field)
+}
+
+// EncryptValue encrypts the value of the field of the hash at the redis key with a fresh data key, itself encrypted with the primary key (envelope encryption).
+// The value is bound to the key and the field, it has to be encrypted again to be moved.
+// The value is returned as it is if no key is configured.
+func EncryptValue(plaintext string, key string, field string) (string, error) {
+
+	if encryptionKeys == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	keyID := encryptionKeys.primaryID
+
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate data key: %w", err)
+	}
+
+	// The key ID is authenticated so that a wrapped key cannot be moved to another key ID
+	wrappedKey, err := seal(encryptionKeys.keys[keyID], dataKey, []byte(keyID))
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(dataKey, []byte(plaintext), valueAAD(key, field))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + keyID + ":" + base64.RawURLEncoding.EncodeToString(wrappedKey) + ":" + base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptValue decrypts the value of the field of the hash at the redis key, as encrypted by EncryptValue.
+// The values stored before encryption was enabled are returned as they are until the stored tokens are encrypted, ErrPlaintextValue is returned after.
+func DecryptValue(value string, key string, field string) (string, error) {
+
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		if encryptionKeys != nil && !plaintextAccepted && value != "" {
+			return "", ErrPlaintextValue
+		}
+		return value, nil
+	}
+
+	if encryptionKeys == nil {
+		return "", ErrNoEncryptionKey
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("Malformed encrypted value")
+	}
+
+	kek, ok := encryptionKeys.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("Unable to decrypt value: unknown token encryption key %s", parts[0])
+	}
+
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("Unable to decode data key: %w", err)
+	}
+
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("Unable to decode encrypted value: %w", err)
+	}
+
+	dataKey, err := unseal(kek, wrappedKey, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("Unable to decrypt data key: %w", err)
+	}
+
+	plaintext, err := unseal(dataKey, ciphertext, valueAAD(key, field))
+	if err != nil {
+		return "", fmt.Errorf("Unable to decrypt value: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// needsReencryption checks if the value is in plaintext or encrypted with an old key
+func needsReencryption(value string) bool {
+	if value == "" {
+		return false
+	}
+	return !strings.HasPrefix(value, encryptedPrefix+encryptionKeys.primaryID+":")
+}
+
+// ReencryptTokens encrypts the stored tokens with the primary key, the plaintext ones included.
+// It is run after adding a new primary key, the old keys can be removed once it is done.
+// The values in plaintext are rejected from then on. The number of re-encrypted tokens is returned.
+func ReencryptTokens() (int, error) {
+	return encryptTokens(needsReencryption)
+}
+
+// EncryptPlaintextTokens encrypts the tokens stored in plaintext with the primary key, e.g. the ones stored before a key was configured.
+// It is run at startup once the token storage and the accounts are migrated, the values in plaintext are rejected from then on.
+// The number of encrypted tokens is returned.
+func EncryptPlaintextTokens() (int, error) {
+	return encryptTokens(func(value string) bool {
+		return value != "" && !strings.HasPrefix(value, encryptedPrefix)
+	})
+}
+
+// encryptTokens encrypts the stored tokens that need it with the primary key, then rejects the values in plaintext
+func encryptTokens(needsEncryption func(value string) bool) (int, error) {
+
+	if encryptionKeys == nil {
+		return 0, ErrNoEncryptionKey
+	}
+
+	accounts, err := ListAllAccounts("")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, account := range accounts {
+		fields := map[string][]string{
+			accessTokenKey(account):  {"access_token", "refresh_token"},
+			refreshTokenKey(account): {"refresh_token"},
+		}
+
+		for key, names := range fields {
+			for _, name := range names {
+				reencrypted, err := reencryptField(key, name, needsEncryption)
+				if err != nil {
+					return count, err
+				}
+				if reencrypted {
+					count++
+				}
+			}
+		}
+	}
+
+	plaintextAccepted = false
+
+	return count, nil
+}
+
+// reencryptField re-encrypts a field of a hash with the primary key if it needs it, the TTL of the hash is kept
+func reencryptField(key string, field string, needsEncryption func(value string) bool) (bool, error) {
+
+	value, err := redisclient.Rdb.HGet(context.Background(), key, field).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unable to retrieve %s of %s from redis: %w", field, key, err)
+	}
+
+	if !needsEncryption(value) {
+		return false, nil
+	}
+
+	// The values in plaintext are read as they are even once they are rejected
+	plaintext := value
+	if strings.HasPrefix(value, encryptedPrefix) {
+		plaintext, err = DecryptValue(value, key, field)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	encrypted, err := EncryptValue(plaintext, key, field)
+	if err != nil {
+		return false, err
+	}
+
+	replaced, err := redisclient.Rdb.Eval(context.Background(), replaceFieldScript, []string{key}, field, value, encrypted).Int()
+	if err != nil {
+		return false, fmt.Errorf("Unable to save %s of %s to redis: %w", field, key, err)
+	}
+
+	// The token was replaced by a newer one, which is already encrypted with the primary key
+	return replaced != -1, nil
+}
+
+// seal encrypts the plaintext with AES-GCM, the nonce is prepended to the ciphertext
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// unseal decrypts a ciphertext produced by seal
+func unseal(key []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// newGCM returns an AES-GCM cipher for the key
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create cipher: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create GCM: %w", err)
+	}
+
+	return aead, nil
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// testKey returns a base64 encoded 32 byte key filled with the given byte
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestParseKeyring(t *testing.T) {
+	assert := assert.New(t)
+
+	ring, err := parseKeyring("# rotated on 2026-10-01\n2026-10:" + testKey('b') + "\n2026-01:" + testKey('a') + "\n")
+	assert.NoError(err)
+	assert.Equal("2026-10", ring.primaryID)
+	assert.Len(ring.keys, 2)
+
+	ring, err = parseKeyring("k1:" + testKey('a') + ",k0:" + testKey('b'))
+	assert.NoError(err)
+	assert.Equal("k1", ring.primaryID)
+
+	_, err = parseKeyring(testKey('a'))
+	assert.Error(err)
+
+	_, err = parseKeyring("k1:" + base64.StdEncoding.EncodeToString([]byte("too short")))
+	assert.Error(err)
+
+	_, err = parseKeyring("k1:" + testKey('a') + ",k1:" + testKey('b'))
+	assert.Error(err)
+}
+
+func TestEncryptValue(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func() { encryptionKeys = nil }()
+
+	// Without a key the values are stored as they are
+	encryptionKeys = nil
+	value, err := EncryptValue("token", "google", "access_token")
+	assert.NoError(err)
+	assert.Equal("token", value)
+
+	encryptionKeys, _ = parseKeyring("old:" + testKey('a'))
+	old, err := EncryptValue("token", "google", "access_token")
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(old, "enc:v1:old:"))
+	assert.NotContains(old, "token")
+
+	// Each value gets its own data key
+	other, _ := EncryptValue("token", "google", "access_token")
+	assert.NotEqual(old, other)
+
+	plaintext, err := DecryptValue(old, "google", "access_token")
+	assert.NoError(err)
+	assert.Equal("token", plaintext)
+
+	// The old key still decrypts after the rotation
+	encryptionKeys, _ = parseKeyring("new:" + testKey('b') + ",old:" + testKey('a'))
+	plaintext, err = DecryptValue(old, "google", "access_token")
+	assert.NoError(err)
+	assert.Equal("token", plaintext)
+	assert.True(needsReencryption(old))
+	assert.True(needsReencryption("plaintext"))
+
+	current, _ := EncryptValue("token", "google", "access_token")
+	assert.False(needsReencryption(current))
+
+	// Values stored before encryption was enabled
+	plaintext, err = DecryptValue("legacy", "google", "access_token")
+	assert.NoError(err)
+	assert.Equal("legacy", plaintext)
+
+	// The value is bound to the key and the field it was encrypted for
+	_, err = DecryptValue(current, "outlook", "access_token")
+	assert.Error(err)
+	_, err = DecryptValue(current, "google", "refresh_token")
+	assert.Error(err)
+
+	// The key ID is authenticated along with the data key
+	_, err = DecryptValue(strings.Replace(current, "enc:v1:new:", "enc:v1:old:", 1), "google", "access_token")
+	assert.Error(err)
+
+	// Removed keys
+	encryptionKeys, _ = parseKeyring("new:" + testKey('b'))
+	_, err = DecryptValue(old, "google", "access_token")
+	assert.Error(err)
+
+	encryptionKeys = nil
+	_, err = DecryptValue(current, "google", "access_token")
+	assert.ErrorIs(err, ErrNoEncryptionKey)
+}
+
+func TestReencryptTokens(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	encryptionKeys, _ = parseKeyring("old:" + testKey('a'))
+	old, _ := EncryptValue("refresh", "user_u1:refreshToken_google:jane@example.com", "refresh_token")
+
+	encryptionKeys, _ = parseKeyring("new:" + testKey('b') + ",old:" + testKey('a'))
+	current, _ := EncryptValue("access", "user_u1:outlook:jane@example.com", "access_token")
+	defer func() { encryptionKeys, plaintextAccepted = nil, true }()
+
+	// The hashes are visited in map order
+	mock.MatchExpectationsInOrder(false)
+	anyArgs := func(expected, actual []interface{}) error { return nil }
+
+	mock.ExpectSMembers(UsersKey).SetVal([]string{"u1"})
+	mock.ExpectSMembers("user_u1:accounts_google").SetVal([]string{"u1/google:jane@example.com"})
+	mock.ExpectSMembers("user_u1:accounts_outlook").SetVal([]string{"u1/outlook:jane@example.com"})
+
+	// Google has a plaintext access token and a refresh token encrypted with the old key
+	mock.ExpectHGet("user_u1:google:jane@example.com", "access_token").SetVal("plain")
+	mock.CustomMatch(anyArgs).ExpectEval(replaceFieldScript, []string{"user_u1:google:jane@example.com"}, "access_token", "plain", "encrypted").SetVal(int64(0))
+	mock.ExpectHGet("user_u1:google:jane@example.com", "refresh_token").RedisNil()
+	mock.ExpectHGet("user_u1:refreshToken_google:jane@example.com", "refresh_token").SetVal(old)
+	mock.CustomMatch(anyArgs).ExpectEval(replaceFieldScript, []string{"user_u1:refreshToken_google:jane@example.com"}, "refresh_token", old, "encrypted").SetVal(int64(0))
+
+	// Outlook is already encrypted with the new key
+	mock.ExpectHGet("user_u1:outlook:jane@example.com", "access_token").SetVal(current)
+	mock.ExpectHGet("user_u1:outlook:jane@example.com", "refresh_token").RedisNil()
+	mock.ExpectHGet("user_u1:refreshToken_outlook:jane@example.com", "refresh_token").RedisNil()
+
+	count, err := ReencryptTokens()
+	assert.NoError(err)
+	assert.Equal(2, count)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+
+	// The values in plaintext are rejected once the tokens are encrypted
+	_, err = DecryptValue("plain", "user_u1:google:jane@example.com", "access_token")
+	assert.ErrorIs(err, ErrPlaintextValue)
+
+	encryptionKeys = nil
+	_, err = ReencryptTokens()
+	assert.ErrorIs(err, ErrNoEncryptionKey)
+}
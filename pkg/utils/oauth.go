@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -17,6 +20,7 @@ import (
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/calendar/v3"
 	"google.golang.org/api/gmail/v1"
 )
 
@@ -28,6 +32,8 @@ type OAuth2Config struct {
 	Scopes       []string `json:"scopes"`
 	AuthURL      string   `json:"auth_url"`
 	TokenURL     string   `json:"token_url"`
+	// DeviceAuthURL is the device authorization endpoint, derived from the auth URL of Microsoft's identity platform if not set
+	DeviceAuthURL string `json:"device_auth_url"`
 }
 
 // ValidProviders is a slice of valid OAuth2 providers
@@ -36,6 +42,12 @@ var ValidProviders = map[string]bool{
 	"outlook": true,
 }
 
+// googleScopes are the scopes requested from Google
+var googleScopes = []string{"openid", "email", gmail.GmailModifyScope, gmail.GmailComposeScope, gmail.GmailSendScope, calendar.CalendarEventsScope}
+
+// outlookScopes are the Graph scopes requested on top of the ones in outlook_credentials.json
+var outlookScopes = []string{"https://graph.microsoft.com/User.Read", "https://graph.microsoft.com/Mail.ReadWrite", "https://graph.microsoft.com/Mail.Send", "https://graph.microsoft.com/Calendars.ReadWrite"}
+
 // GenerateStateToken generates a random state token for OAuth2 authorization
 func generateStateToken(provider string) (string, error) {
 	b := make([]byte, 16) // 16 bytes equals 128 bits
@@ -74,11 +86,14 @@ func GetOAuth2Config(provider string) (*oauth2.Config, error) {
 		}
 
 		// If modifying these scopes, delete your previously saved token.json.
-		config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+		config, err := google.ConfigFromJSON(b, googleScopes...)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to parse client secret file to config for %s: %v", provider, err)
 		}
 
+		// The credentials file has no device authorization endpoint
+		config.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
+
 		authConfig = config
 
 	case "outlook":
@@ -89,6 +104,9 @@ func GetOAuth2Config(provider string) (*oauth2.Config, error) {
 			return nil, fmt.Errorf("Unable to read client secret file for %s: %v", provider, err)
 		}
 
+		// Request the scopes the integration needs even if they are missing from the file
+		config.Scopes = appendMissingScopes(config.Scopes, outlookScopes...)
+
 		authConfig = config
 
 	default:
@@ -98,6 +116,23 @@ func GetOAuth2Config(provider string) (*oauth2.Config, error) {
 	return authConfig, nil
 }
 
+// appendMissingScopes appends the scopes that are not already in the list
+func appendMissingScopes(scopes []string, required ...string) []string {
+	for _, scope := range required {
+		found := false
+		for _, existing := range scopes {
+			if strings.EqualFold(existing, scope) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
 // oauth2ConfigFromJSON reads a JSON file and returns an OAuth2 config
 func oauth2ConfigFromJSON(fileName string) (*oauth2.Config, error) {
 
@@ -112,218 +147,341 @@ func oauth2ConfigFromJSON(fileName string) (*oauth2.Config, error) {
 		return nil, fmt.Errorf("unable to unmarshal JSON: %v", err)
 	}
 
+	// Microsoft's identity platform serves the device codes next to the authorize endpoint
+	deviceAuthURL := cfg.DeviceAuthURL
+	if deviceAuthURL == "" && strings.HasSuffix(cfg.AuthURL, "/oauth2/v2.0/authorize") {
+		deviceAuthURL = strings.TrimSuffix(cfg.AuthURL, "authorize") + "devicecode"
+	}
+
 	return &oauth2.Config{
 		ClientID:     cfg.ClientID,
 		ClientSecret: cfg.ClientSecret,
 		RedirectURL:  cfg.RedirectURL,
 		Scopes:       cfg.Scopes,
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  cfg.AuthURL,
-			TokenURL: cfg.TokenURL,
+			AuthURL:       cfg.AuthURL,
+			TokenURL:      cfg.TokenURL,
+			DeviceAuthURL: deviceAuthURL,
 		},
 	}, nil
 }
 
-// GenerateOauthURL prints the URL to visit to authorize the application
-func GenerateOauthURL(config *oauth2.Config, provider string, flowType string) (string, string, error) {
+// OAuthLink is the state record of an authorization flow, it binds the account being linked to the API key that started the flow
+type OAuthLink struct {
+	Provider string `json:"provider"`
+	// User is the ID of the user the account is linked to, the owner of the API key
+	User string `json:"user"`
+	// KeyID is the ID of the API key that started the flow
+	KeyID string `json:"keyId"`
+	// Replace is set if the caller confirmed replacing the account that is already connected
+	Replace bool `json:"replace"`
+	// AuthURL is the provider's authorization URL the browser is sent to once the flow is bound to it
+	AuthURL string `json:"authUrl,omitempty"`
+	// NonceHash is the hash of the nonce of the browser the flow is bound to, the callback is only accepted from that browser
+	NonceHash string `json:"nonceHash,omitempty"`
+}
+
+// ErrOAuthStateBound is returned when the flow is already bound to a browser
+var ErrOAuthStateBound = errors.New("the authorization flow was already started in another browser")
+
+// GenerateOauthURL returns the URL to visit to authorize the application along with the state token of the flow
+func GenerateOauthURL(config *oauth2.Config, link OAuthLink, flowType string) (string, string, error) {
 
 	switch flowType {
 	case "PCKE":
 		// Generate a random state token
-		stateToken, err := generateStateToken(provider)
+		stateToken, err := generateStateToken(link.Provider)
 		if err != nil {
 			return "", "", fmt.Errorf("unable to generate state token: %w", err)
 		}
 
-		// Save the state token to redis and set the time to live to 2 minutes
-		err = redisclient.Rdb.Set(context.Background(), fmt.Sprintf("stateToken_%s", stateToken), stateToken, 2*time.Minute).Err()
-		if err != nil {
-			return "", "", fmt.Errorf("unable to save state token to redis: %w", err)
-		}
+		// Generate the PKCE code verifier of this flow (RFC 7636)
+		verifier := oauth2.GenerateVerifier()
 
-		authURL := config.AuthCodeURL(stateToken, oauth2.AccessTypeOffline)
-		// fmt.Printf("Go to the following link in your browser then type the "+
-		// 	"authorization code: \n%v\n", authURL)
+		link.AuthURL = pkceAuthCodeURL(config, stateToken, verifier)
 
-		return authURL, "", nil
+		linkJSON, err := json.Marshal(link)
+		if err != nil {
+			return "", "", fmt.Errorf("unable to marshal state record: %w", err)
+		}
 
-	case "Device":
-		config.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
-		resp, err := config.DeviceAuth(context.Background(), oauth2.AccessTypeOffline)
+		// Save the state record to redis and set the time to live to 2 minutes
+		err = redisclient.Rdb.Set(context.Background(), fmt.Sprintf("stateToken_%s", stateToken), string(linkJSON), 2*time.Minute).Err()
 		if err != nil {
-			return "", "", fmt.Errorf("unable to retrieve device auth: %w", err)
+			return "", "", fmt.Errorf("unable to save state token to redis: %w", err)
 		}
 
-		if resp == nil {
-			return "", "", fmt.Errorf("device auth response is nil")
+		// Save the code verifier next to the state token, it is sent along with the code once the user is redirected back
+		err = redisclient.Rdb.Set(context.Background(), fmt.Sprintf("codeVerifier_%s", stateToken), verifier, 2*time.Minute).Err()
+		if err != nil {
+			return "", "", fmt.Errorf("unable to save code verifier to redis: %w", err)
 		}
 
-		return fmt.Sprintf("Please go to %s and enter the following code %s", resp.VerificationURI, resp.UserCode), resp.DeviceCode, nil
+		return link.AuthURL, stateToken, nil
 	}
 
 	return "", "", fmt.Errorf("invalid flow type: %s", flowType)
 }
 
-// PollToken Poll Google's authorization server to retrieve the token
-func PollToken(config *oauth2.Config, deviceCode string) (*oauth2.Token, error) {
+// pkceAuthCodeURL returns the authorization URL with the S256 challenge of the code verifier
+func pkceAuthCodeURL(config *oauth2.Config, stateToken string, verifier string) string {
+	return config.AuthCodeURL(stateToken, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+}
 
-	// Prepare the form data
-	// See: https://developers.google.com/identity/protocols/oauth2/limited-input-device#step-4:-poll-googles-authorization-server
-	form := url.Values{}
-	form.Add("client_id", config.ClientID)
-	form.Add("client_secret", config.ClientSecret)
-	form.Add("device_code", deviceCode)
-	form.Add("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+// GenerateOAuthNonce returns a random nonce binding a flow to the browser it is started in
+func GenerateOAuthNonce() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate nonce: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
 
-	// Start polling
-	for {
+// BindOAuthState binds the flow with the given state token to the browser holding the nonce and returns the provider's authorization URL.
+// A flow can only be bound once, ErrOAuthStateBound is returned afterwards. redis.Nil is returned if the flow has expired.
+func BindOAuthState(stateToken string, nonce string) (string, error) {
 
-		// Prepare the request
-		req, err := http.NewRequest("POST", config.Endpoint.TokenURL, strings.NewReader(form.Encode()))
-		if err != nil {
-			return nil, err
-		}
-		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	ctx := context.Background()
+	key := fmt.Sprintf("stateToken_%s", stateToken)
 
-		// Send the request
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return nil, err
+	value, err := redisclient.Rdb.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", err
 		}
+		return "", fmt.Errorf("Unable to retrieve state token from redis: %w", err)
+	}
 
-		// Read the response body
-		data, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("unable to read response body when polling: %w", err)
-		}
+	var link OAuthLink
+	err = json.Unmarshal([]byte(value), &link)
+	if err != nil {
+		return "", fmt.Errorf("Unable to unmarshal state record: %w", err)
+	}
 
-		// If the response contains an access token, return it
-		if strings.Contains(string(data), "access_token") {
-			var tok oauth2.Token
-			err = json.Unmarshal(data, &tok)
-			if err != nil {
-				return nil, fmt.Errorf("unable to unmarshal token from the polled result: %w", err)
-			}
+	if link.NonceHash != "" {
+		return "", ErrOAuthStateBound
+	}
 
-			return &tok, nil
-		}
+	link.NonceHash = hashNonce(nonce)
 
-		time.Sleep(5 * time.Second) // Polling interval
+	linkJSON, err := json.Marshal(link)
+	if err != nil {
+		return "", fmt.Errorf("Unable to marshal state record: %w", err)
 	}
-}
-
-// ExchangeCodeForToken handles the redirect from the OAuth2 provider and exchanges the code for a token
-func ExchangeCodeForToken(config *oauth2.Config, authCode string) (*oauth2.Token, error) {
 
-	// Converts authorization code into a token
-	tok, err := config.Exchange(context.TODO(), authCode)
+	// The record keeps its time to live and is not saved again if the flow expired meanwhile
+	err = redisclient.Rdb.SetArgs(ctx, key, string(linkJSON), redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
 	if err != nil {
-		return tok, fmt.Errorf("Unable to retrieve token from web: %w", err)
+		if err == redis.Nil {
+			return "", err
+		}
+		return "", fmt.Errorf("Unable to save state token to redis: %w", err)
 	}
 
-	return tok, nil
+	return link.AuthURL, nil
 }
 
-// RetrieveToken retrieves the OAuth token from redis.
-func RetrieveToken(provider string) (*oauth2.Token, error) {
+// VerifyNonce reports whether the flow is bound to the browser holding the nonce
+func (link OAuthLink) VerifyNonce(nonce string) bool {
+	if link.NonceHash == "" || nonce == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(link.NonceHash), []byte(hashNonce(nonce))) == 1
+}
+
+// hashNonce returns the hex SHA-256 hash of the nonce, only the hash is stored in the state record
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// ConsumeOAuthState returns the state record of the flow with the given state token and removes it from redis, so that it is only used once.
+// redis.Nil is returned if the flow has expired.
+func ConsumeOAuthState(stateToken string) (OAuthLink, error) {
 
-	// Retrieves the token from redis
-	token, err := redisclient.Rdb.HGetAll(context.Background(), provider).Result()
+	value, err := redisclient.Rdb.GetDel(context.Background(), fmt.Sprintf("stateToken_%s", stateToken)).Result()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, err
+			return OAuthLink{}, err
 		}
-
-		return nil, fmt.Errorf("Unable to retrieve token from redis: %w", err)
-	}
-
-	// If the token is not found in redis, return an error
-	if len(token) == 0 {
-		return nil, redis.Nil
+		return OAuthLink{}, fmt.Errorf("Unable to retrieve state token from redis: %w", err)
 	}
 
-	// Marshals the token into a JSON object in order to unmarshal it into an oauth2.Token struct
-	tokenJSON, err := json.Marshal(token)
+	var link OAuthLink
+	err = json.Unmarshal([]byte(value), &link)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to marshal token: %w", err)
+		return OAuthLink{}, fmt.Errorf("Unable to unmarshal state record: %w", err)
 	}
 
-	// Unmarshals the token into an oauth2.Token struct
-	tok := &oauth2.Token{}
+	return link, nil
+}
+
+// ConsumeCodeVerifier returns the PKCE code verifier of the flow with the given state token and removes it from redis.
+// redis.Nil is returned if the flow has expired.
+func ConsumeCodeVerifier(stateToken string) (string, error) {
 
-	err = json.Unmarshal(tokenJSON, tok)
+	verifier, err := redisclient.Rdb.GetDel(context.Background(), fmt.Sprintf("codeVerifier_%s", stateToken)).Result()
 	if err != nil {
-		return nil, fmt.Errorf("Unable to unmarshal token: %w", err)
+		if err == redis.Nil {
+			return "", err
+		}
+		return "", fmt.Errorf("Unable to retrieve code verifier from redis: %w", err)
 	}
 
-	return tok, nil
+	return verifier, nil
 }
 
-// SaveToken saves the token to redis.
-func SaveToken(provider string, token *oauth2.Token) error {
+// ErrDeviceAccessDenied is returned when the user denied the device authorization request
+var ErrDeviceAccessDenied = errors.New("the user denied the authorization request")
 
-	// Calculates the time to live for the token
-	ttl := token.Expiry.Sub(time.Now().UTC())
+// ErrDeviceCodeExpired is returned when the device code expired before the user completed the authorization
+var ErrDeviceCodeExpired = errors.New("the device code has expired")
 
-	// Marshals the token into a JSON object
-	var tokenMap map[string]interface{}
+// defaultPollInterval is the polling interval used when the authorization server does not give one (RFC 8628 section 3.2)
+var defaultPollInterval = 5 * time.Second
 
-	// Marshals the token into a JSON object in order to unmarshal it into an oauth2.Token struct
-	tokenJSON, err := json.Marshal(token)
-	if err != nil {
-		return fmt.Errorf("Unable to marshal token: %w", err)
+// slowDownIncrease is added to the polling interval every time the authorization server asks to slow down (RFC 8628 section 3.5)
+var slowDownIncrease = 5 * time.Second
+
+// StartDeviceAuth requests a device code and a user code from the authorization server (RFC 8628 section 3.1)
+func StartDeviceAuth(ctx context.Context, config *oauth2.Config) (*oauth2.DeviceAuthResponse, error) {
+
+	if config.Endpoint.DeviceAuthURL == "" {
+		return nil, fmt.Errorf("The provider has no device authorization endpoint")
 	}
 
-	// Unmarshals the token into a map
-	err = json.Unmarshal(tokenJSON, &tokenMap)
+	deviceAuth, err := config.DeviceAuth(ctx, oauth2.AccessTypeOffline)
 	if err != nil {
-		return fmt.Errorf("Unable to unmarshal token: %w", err)
+		return nil, fmt.Errorf("Unable to retrieve device auth: %w", err)
 	}
 
-	// Saves the token to redis
-	err = redisclient.Rdb.HSet(context.Background(), provider, tokenMap).Err()
-	if err != nil {
-		return fmt.Errorf("Unable to save token to redis: %w", err)
+	return deviceAuth, nil
+}
+
+// PollToken polls the token endpoint until the user completes the device authorization (RFC 8628 section 3.4).
+// It waits for the interval given by the server, slows down when asked to, and stops when the device code expires or the context is cancelled.
+func PollToken(ctx context.Context, config *oauth2.Config, deviceAuth *oauth2.DeviceAuthResponse) (*oauth2.Token, error) {
+
+	interval := time.Duration(deviceAuth.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultPollInterval
 	}
 
-	// Sets the time to live for the token
-	err = redisclient.Rdb.Expire(context.Background(), provider, ttl).Err()
+	// Stop polling once the device code expires
+	if !deviceAuth.Expiry.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deviceAuth.Expiry)
+		defer cancel()
+	}
 
-	return nil
-}
+	form := url.Values{}
+	form.Set("client_id", config.ClientID)
+	if config.ClientSecret != "" {
+		form.Set("client_secret", config.ClientSecret)
+	}
+	form.Set("device_code", deviceAuth.DeviceCode)
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && !deviceAuth.Expiry.IsZero() && !time.Now().Before(deviceAuth.Expiry) {
+				return nil, ErrDeviceCodeExpired
+			}
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
 
-// UpdateToken updates the token in redis.
-func UpdateToken(provider string, token *oauth2.Token) error {
+		tok, errorCode, err := requestDeviceToken(ctx, config.Endpoint.TokenURL, form)
+		if err != nil {
+			// The request was cut short by the deadline or the cancellation, which is handled at the top of the loop
+			if ctx.Err() != nil {
+				continue
+			}
+			return nil, err
+		}
+
+		switch errorCode {
+		case "":
+			return tok, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += slowDownIncrease
+		case "access_denied":
+			return nil, ErrDeviceAccessDenied
+		case "expired_token":
+			return nil, ErrDeviceCodeExpired
+		default:
+			return nil, fmt.Errorf("Unable to retrieve token from device code: %s", errorCode)
+		}
+	}
+}
 
-	// Calculates the time to live for the token
-	ttl := token.Expiry.Sub(time.Now().UTC())
+// requestDeviceToken sends a single token request, the error code of the response is returned if the token was not issued
+func requestDeviceToken(ctx context.Context, tokenURL string, form url.Values) (*oauth2.Token, string, error) {
 
-	// Marshals the token into a JSON object
-	var tokenMap map[string]interface{}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
 
-	// Marshals the token into a JSON object in order to unmarshal it into an oauth2.Token struct
-	tokenJSON, err := json.Marshal(token)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("Unable to marshal token: %w", err)
+		return nil, "", fmt.Errorf("Unable to send token request: %w", err)
 	}
+	defer resp.Body.Close()
 
-	// Unmarshals the token into a map
-	err = json.Unmarshal(tokenJSON, &tokenMap)
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("Unable to unmarshal token: %w", err)
+		return nil, "", fmt.Errorf("Unable to read response body when polling: %w", err)
 	}
 
-	// Saves the token to redis
-	err = redisclient.Rdb.HSet(context.Background(), provider, tokenMap).Err()
+	var body struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Error        string `json:"error"`
+	}
+	err = json.Unmarshal(data, &body)
 	if err != nil {
-		return fmt.Errorf("Unable to save token to redis: %w", err)
+		return nil, "", fmt.Errorf("Unable to unmarshal the polled result (status %d): %w", resp.StatusCode, err)
 	}
 
-	// Sets the time to live for the token
-	err = redisclient.Rdb.Expire(context.Background(), provider, ttl).Err()
+	if body.Error != "" {
+		return nil, body.Error, nil
+	}
 
-	return nil
+	if body.AccessToken == "" {
+		return nil, "", fmt.Errorf("The polled result has no access token (status %d)", resp.StatusCode)
+	}
+
+	tok := &oauth2.Token{
+		AccessToken:  body.AccessToken,
+		TokenType:    body.TokenType,
+		RefreshToken: body.RefreshToken,
+	}
+	if body.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+
+	return tok, "", nil
+}
+
+// ExchangeCodeForToken handles the redirect from the OAuth2 provider and exchanges the code for a token.
+// The code verifier proves that the code is redeemed by the client that started the flow.
+func ExchangeCodeForToken(config *oauth2.Config, authCode string, verifier string) (*oauth2.Token, error) {
+
+	// Converts authorization code into a token
+	tok, err := config.Exchange(context.TODO(), authCode, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return tok, fmt.Errorf("Unable to retrieve token from web: %w", err)
+	}
+
+	return tok, nil
 }
 
 // GetTokenFromRefreshToken retrieves a token from a refresh token
@@ -1,6 +1,11 @@
 package utils
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -9,6 +14,7 @@ import (
 
 	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
 	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/oauth2"
 )
@@ -77,11 +83,12 @@ func TestGenerateOauthURL(t *testing.T) {
 	// Mock Redis and Setoperation before calling the function
 	redisclient.Rdb = db
 	keyPattern := `^stateToken_[a-z]+-[0-9a-f]{64}$`
-	valuePattern := `[a-z]+-[0-9a-f]{64}$`
+	valuePattern := `^\{"provider":"google","user":"u1","keyId":"abc","replace":false,"authUrl":"http://localhost:8080/auth\?[^"]+"\}$`
 	mock.Regexp().ExpectSet(keyPattern, valuePattern, 2*time.Minute).SetVal("OK") // Simulate successful SET operation
+	mock.Regexp().ExpectSet(`^codeVerifier_[a-z]+-[0-9a-f]{64}$`, `^[A-Za-z0-9_-]{43}$`, 2*time.Minute).SetVal("OK")
 
 	// Call the function
-	resultURL, _, err := GenerateOauthURL(config, "google", "PCKE")
+	resultURL, state, err := GenerateOauthURL(config, OAuthLink{Provider: "google", User: "u1", KeyID: "abc"}, "PCKE")
 	assert.NoError(err, "GenerateOauthURL returned an error")
 
 	// Close the mock database connection
@@ -102,7 +109,236 @@ func TestGenerateOauthURL(t *testing.T) {
 
 	// Check if the URL contains the state token
 	assert.Regexp(`^[a-z]+-[0-9a-f]{64}$`, parsedURL.Query().Get("state"), "URL does not contain correct state token")
+	assert.Equal(state, parsedURL.Query().Get("state"), "The state token of the flow is not the one in the URL")
+
+	// Check if the URL contains the S256 PKCE challenge
+	assert.Equal("S256", parsedURL.Query().Get("code_challenge_method"), "URL does not contain the PKCE challenge method")
+	assert.Regexp(`^[A-Za-z0-9_-]{43}$`, parsedURL.Query().Get("code_challenge"), "URL does not contain the PKCE challenge")
 
 	// Check if Redis expectations were met
 	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
 }
+
+func TestConsumeOAuthState(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectGetDel("stateToken_google-abc").SetVal(`{"provider":"google","user":"u1","keyId":"abc","replace":true}`)
+	link, err := ConsumeOAuthState("google-abc")
+	assert.NoError(err)
+	assert.Equal(OAuthLink{Provider: "google", User: "u1", KeyID: "abc", Replace: true}, link)
+
+	// The state record can only be used once
+	mock.ExpectGetDel("stateToken_google-abc").RedisNil()
+	_, err = ConsumeOAuthState("google-abc")
+	assert.Equal(redis.Nil, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestBindOAuthState(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	nonceHash := hashNonce("nonce")
+
+	mock.ExpectGet("stateToken_google-abc").SetVal(`{"provider":"google","user":"u1","keyId":"abc","replace":false,"authUrl":"https://accounts.example/auth"}`)
+	mock.ExpectSetArgs("stateToken_google-abc", `{"provider":"google","user":"u1","keyId":"abc","replace":false,"authUrl":"https://accounts.example/auth","nonceHash":"`+nonceHash+`"}`, redis.SetArgs{Mode: "XX", KeepTTL: true}).SetVal("OK")
+	authURL, err := BindOAuthState("google-abc", "nonce")
+	assert.NoError(err)
+	assert.Equal("https://accounts.example/auth", authURL)
+
+	// The flow cannot be bound to another browser
+	mock.ExpectGet("stateToken_google-abc").SetVal(`{"provider":"google","user":"u1","keyId":"abc","replace":false,"nonceHash":"` + nonceHash + `"}`)
+	_, err = BindOAuthState("google-abc", "other")
+	assert.ErrorIs(err, ErrOAuthStateBound)
+
+	mock.ExpectGet("stateToken_google-expired").RedisNil()
+	_, err = BindOAuthState("google-expired", "nonce")
+	assert.Equal(redis.Nil, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestVerifyNonce(t *testing.T) {
+	assert := assert.New(t)
+
+	link := OAuthLink{Provider: "google", NonceHash: hashNonce("nonce")}
+	assert.True(link.VerifyNonce("nonce"))
+	assert.False(link.VerifyNonce("other"))
+	assert.False(link.VerifyNonce(""))
+
+	// A flow that was never opened in a browser is not accepted
+	assert.False(OAuthLink{Provider: "google"}.VerifyNonce(""))
+}
+
+func TestPKCEExchange(t *testing.T) {
+	assert := assert.New(t)
+
+	// Local authorization server that remembers the challenge of the authorization request and checks the verifier on exchange
+	challenges := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth":
+			query := r.URL.Query()
+			if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+				http.Error(w, "missing challenge", http.StatusBadRequest)
+				return
+			}
+			challenges["code-"+query.Get("state")] = query.Get("code_challenge")
+			http.Redirect(w, r, query.Get("redirect_uri")+"?code=code-"+query.Get("state")+"&state="+query.Get("state"), http.StatusFound)
+
+		case "/token":
+			r.ParseForm()
+			challenge, ok := challenges[r.PostForm.Get("code")]
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_grant"}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600}`))
+		}
+	}))
+	defer server.Close()
+
+	config := &oauth2.Config{
+		ClientID:    "testClientID",
+		RedirectURL: "http://localhost:8080/callback",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   server.URL + "/auth",
+			TokenURL:  server.URL + "/token",
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	// Follow the authorization request up to the redirect to the callback
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(pkceAuthCodeURL(config, "google-state", verifier))
+	assert.NoError(err)
+	resp.Body.Close()
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	assert.NoError(err)
+	code := callback.Query().Get("code")
+
+	// A verifier from another flow is rejected
+	_, err = ExchangeCodeForToken(config, code, oauth2.GenerateVerifier())
+	assert.Error(err)
+
+	tok, err := ExchangeCodeForToken(config, code, verifier)
+	assert.NoError(err)
+	assert.Equal("access", tok.AccessToken)
+	assert.Equal("refresh", tok.RefreshToken)
+}
+
+func TestConsumeCodeVerifier(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	mock.ExpectGetDel("codeVerifier_google-state").SetVal("verifier")
+
+	verifier, err := ConsumeCodeVerifier("google-state")
+	assert.NoError(err)
+	assert.Equal("verifier", verifier)
+
+	// The verifier can only be used once
+	mock.ExpectGetDel("codeVerifier_google-state").RedisNil()
+
+	_, err = ConsumeCodeVerifier("google-state")
+	assert.Equal(redis.Nil, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestPollToken(t *testing.T) {
+	assert := assert.New(t)
+
+	defaultPollInterval, slowDownIncrease = 10*time.Millisecond, 10*time.Millisecond
+	defer func() { defaultPollInterval, slowDownIncrease = 5*time.Second, 5*time.Second }()
+
+	// Local authorization server answering with the given errors before issuing the token
+	serve := func(errorCodes ...string) (*httptest.Server, *[]time.Time) {
+		requests := []time.Time{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			requests = append(requests, time.Now())
+			w.Header().Set("Content-Type", "application/json")
+
+			if r.PostForm.Get("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" || r.PostForm.Get("device_code") != "device" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_request"}`))
+				return
+			}
+
+			if len(requests) <= len(errorCodes) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "` + errorCodes[len(requests)-1] + `"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600}`))
+		}))
+		return server, &requests
+	}
+
+	server, requests := serve("authorization_pending", "slow_down", "authorization_pending")
+	config := &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{TokenURL: server.URL}}
+
+	tok, err := PollToken(context.Background(), config, &oauth2.DeviceAuthResponse{DeviceCode: "device", Expiry: time.Now().Add(time.Minute)})
+	assert.NoError(err)
+	assert.Equal("access", tok.AccessToken)
+	assert.Equal("refresh", tok.RefreshToken)
+	assert.WithinDuration(time.Now().Add(time.Hour), tok.Expiry, time.Minute)
+	assert.Len(*requests, 4)
+
+	// The interval doubled after the slow down
+	assert.GreaterOrEqual((*requests)[2].Sub((*requests)[1]), 20*time.Millisecond)
+	server.Close()
+
+	server, _ = serve("access_denied")
+	config.Endpoint.TokenURL = server.URL
+	_, err = PollToken(context.Background(), config, &oauth2.DeviceAuthResponse{DeviceCode: "device", Expiry: time.Now().Add(time.Minute)})
+	assert.ErrorIs(err, ErrDeviceAccessDenied)
+	server.Close()
+
+	// The user never completes the authorization
+	server, _ = serve("authorization_pending", "authorization_pending", "authorization_pending", "authorization_pending", "authorization_pending", "authorization_pending", "authorization_pending", "authorization_pending", "authorization_pending", "authorization_pending")
+	config.Endpoint.TokenURL = server.URL
+	_, err = PollToken(context.Background(), config, &oauth2.DeviceAuthResponse{DeviceCode: "device", Expiry: time.Now().Add(35 * time.Millisecond)})
+	assert.ErrorIs(err, ErrDeviceCodeExpired)
+
+	// The caller gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = PollToken(ctx, config, &oauth2.DeviceAuthResponse{DeviceCode: "device", Expiry: time.Now().Add(time.Minute)})
+	assert.ErrorIs(err, context.Canceled)
+	server.Close()
+}
+
+func TestOAuth2ConfigFromJSONDeviceAuthURL(t *testing.T) {
+	assert := assert.New(t)
+
+	tempFile, err := os.CreateTemp("./", "prefix-*.json")
+	assert.NoError(err)
+	defer os.Remove(tempFile.Name())
+
+	tempFile.Write([]byte(`{"client_id": "id", "auth_url": "https://login.microsoftonline.com/common/oauth2/v2.0/authorize", "token_url": "https://login.microsoftonline.com/common/oauth2/v2.0/token"}`))
+	tempFile.Close()
+
+	config, err := oauth2ConfigFromJSON(tempFile.Name())
+	assert.NoError(err)
+	assert.Equal("https://login.microsoftonline.com/common/oauth2/v2.0/devicecode", config.Endpoint.DeviceAuthURL)
+}
@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/redis/go-redis/v9"
+)
+
+// SendConfirmationTTL is how long a confirm token returned by the preview stays valid
+const SendConfirmationTTL = 10 * time.Minute
+
+// defaultSendDailyQuota is the number of emails that can be sent per day when SEND_DAILY_QUOTA is not set
+const defaultSendDailyQuota = 10
+
+// ErrSendQuotaExceeded is returned when the daily send quota has been used up
+var ErrSendQuotaExceeded = fmt.Errorf("daily send quota exceeded")
+
+// CheckRecipients checks that every recipient is on the SEND_ALLOWLIST.
+// The allowlist is a comma-separated list of addresses and @domain entries. Nothing can be sent if it is empty.
+func CheckRecipients(recipients []string) error {
+
+	allowlist := strings.Split(os.Getenv("SEND_ALLOWLIST"), ",")
+
+	if len(recipients) == 0 {
+		return fmt.Errorf("at least one recipient is required")
+	}
+
+	for _, recipient := range recipients {
+		address, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %w", recipient, err)
+		}
+
+		if !isAllowedRecipient(allowlist, address.Address) {
+			return fmt.Errorf("recipient %s is not on the send allowlist", address.Address)
+		}
+	}
+
+	return nil
+}
+
+// isAllowedRecipient checks if the address or its domain is on the allowlist
+func isAllowedRecipient(allowlist []string, address string) bool {
+
+	_, domain, _ := strings.Cut(address, "@")
+
+	for _, entry := range allowlist {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.EqualFold(entry, address) || strings.EqualFold(entry, "@"+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getSendDailyQuota checks if a custom daily send quota is supplied, if not, returns the default quota
+func getSendDailyQuota() int64 {
+
+	quota, err := strconv.ParseInt(os.Getenv("SEND_DAILY_QUOTA"), 10, 64)
+	if err != nil || quota < 0 {
+		return defaultSendDailyQuota
+	}
+
+	return quota
+}
+
+// sendQuotaKey returns the redis key of the user's send counter of today
+func sendQuotaKey(user string) string {
+	return UserKey(user, fmt.Sprintf("send_quota_%s", time.Now().UTC().Format("2006-01-02")))
+}
+
+// sendConfirmationKey returns the redis key of the user's confirm token
+func sendConfirmationKey(user string, token string) string {
+	return UserKey(user, fmt.Sprintf("send_confirm_%s", token))
+}
+
+// GetRemainingSendQuota returns how many emails the user can still send today.
+func GetRemainingSendQuota(user string) (int64, error) {
+
+	sent, err := redisclient.Rdb.Get(context.Background(), sendQuotaKey(user)).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, fmt.Errorf("Unable to retrieve send quota from redis: %w", err)
+	}
+
+	remaining := getSendDailyQuota() - sent
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return remaining, nil
+}
+
+// ReserveSendQuota counts one email against the user's quota of today, it returns ErrSendQuotaExceeded if the quota is used up.
+func ReserveSendQuota(user string) error {
+
+	ctx := context.Background()
+	key := sendQuotaKey(user)
+
+	sent, err := redisclient.Rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("Unable to update send quota in redis: %w", err)
+	}
+
+	// Keep the counter a bit longer than a day so that it covers the whole UTC day
+	err = redisclient.Rdb.Expire(ctx, key, 48*time.Hour).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to set send quota expiry in redis: %w", err)
+	}
+
+	if sent > getSendDailyQuota() {
+		// Give back the reservation so that the counter reflects what was actually sent
+		err = redisclient.Rdb.Decr(ctx, key).Err()
+		if err != nil {
+			return fmt.Errorf("Unable to update send quota in redis: %w", err)
+		}
+		return ErrSendQuotaExceeded
+	}
+
+	return nil
+}
+
+// ReleaseSendQuota gives back a reservation made by ReserveSendQuota when the email could not be sent.
+func ReleaseSendQuota(user string) error {
+
+	err := redisclient.Rdb.Decr(context.Background(), sendQuotaKey(user)).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to update send quota in redis: %w", err)
+	}
+
+	return nil
+}
+
+// sendFingerprint hashes the sender and the email so that a confirm token only works for the previewed email sent from the previewed account.
+// The sender is the ID of the account, or the provider for the providers without accounts such as the SMTP relay.
+func sendFingerprint(sender string, email integrations.OutgoingEmail) (string, error) {
+
+	emailJSON, err := json.Marshal(email)
+	if err != nil {
+		return "", fmt.Errorf("Unable to marshal email: %w", err)
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(append([]byte(sender+":"), emailJSON...))), nil
+}
+
+// CreateSendConfirmation stores a confirm token of the user for the previewed email and returns it.
+func CreateSendConfirmation(user string, sender string, email integrations.OutgoingEmail) (string, error) {
+
+	fingerprint, err := sendFingerprint(sender, email)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := GenerateAPIKey()
+	if err != nil {
+		return "", fmt.Errorf("unable to generate confirm token: %w", err)
+	}
+
+	err = redisclient.Rdb.Set(context.Background(), sendConfirmationKey(user, token), fingerprint, SendConfirmationTTL).Err()
+	if err != nil {
+		return "", fmt.Errorf("Unable to save confirm token to redis: %w", err)
+	}
+
+	return token, nil
+}
+
+// ConsumeSendConfirmation checks that the user's confirm token was issued for exactly this email and invalidates it.
+// It returns false if the token is unknown, expired or was issued for a different email.
+func ConsumeSendConfirmation(user string, sender string, email integrations.OutgoingEmail, token string) (bool, error) {
+
+	if token == "" {
+		return false, nil
+	}
+
+	// The token can only be used once, even if the email does not match
+	stored, err := redisclient.Rdb.GetDel(context.Background(), sendConfirmationKey(user, token)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("Unable to retrieve confirm token from redis: %w", err)
+	}
+
+	fingerprint, err := sendFingerprint(sender, email)
+	if err != nil {
+		return false, err
+	}
+
+	return stored == fingerprint, nil
+}
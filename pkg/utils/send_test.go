@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/algo7/day-planner-gpt-data-portal/pkg/integrations"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRecipients(t *testing.T) {
+	assert := assert.New(t)
+
+	// Nothing can be sent without an allowlist
+	t.Setenv("SEND_ALLOWLIST", "")
+	assert.Error(CheckRecipients([]string{"me@example.com"}))
+
+	t.Setenv("SEND_ALLOWLIST", "me@example.com, @team.example.com")
+	assert.NoError(CheckRecipients([]string{"Me <ME@example.com>", "anyone@team.example.com"}))
+	assert.Error(CheckRecipients([]string{"me@example.com", "someone@example.com"}))
+	assert.Error(CheckRecipients([]string{"anyone@evil-team.example.com"}))
+	assert.Error(CheckRecipients([]string{"not an address"}))
+	assert.Error(CheckRecipients(nil))
+}
+
+func TestReserveSendQuota(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	t.Setenv("SEND_DAILY_QUOTA", "2")
+	key := sendQuotaKey("u1")
+
+	// Scenario 1: Within the quota
+	mock.ExpectIncr(key).SetVal(2)
+	mock.ExpectExpire(key, 48*time.Hour).SetVal(true)
+	assert.NoError(ReserveSendQuota("u1"))
+
+	// Scenario 2: Over the quota, the reservation is given back
+	mock.ExpectIncr(key).SetVal(3)
+	mock.ExpectExpire(key, 48*time.Hour).SetVal(true)
+	mock.ExpectDecr(key).SetVal(2)
+	assert.Equal(ErrSendQuotaExceeded, ReserveSendQuota("u1"))
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestConsumeSendConfirmation(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	email := integrations.OutgoingEmail{To: []string{"me@example.com"}, Subject: "Summary", Body: "Today"}
+	fingerprint, err := sendFingerprint("google", email)
+	assert.NoError(err)
+
+	// Scenario 1: The token was issued for this email
+	mock.ExpectGetDel("user_u1:send_confirm_token").SetVal(fingerprint)
+	confirmed, err := ConsumeSendConfirmation("u1", "google", email, "token")
+	assert.NoError(err)
+	assert.True(confirmed)
+
+	// Scenario 2: The email was changed after the preview
+	changed := email
+	changed.To = []string{"someone@example.com"}
+	mock.ExpectGetDel("user_u1:send_confirm_token").SetVal(fingerprint)
+	confirmed, err = ConsumeSendConfirmation("u1", "google", changed, "token")
+	assert.NoError(err)
+	assert.False(confirmed)
+
+	// Scenario 3: The token was issued for another provider
+	mock.ExpectGetDel("user_u1:send_confirm_token").SetVal(fingerprint)
+	confirmed, err = ConsumeSendConfirmation("u1", "outlook", email, "token")
+	assert.NoError(err)
+	assert.False(confirmed)
+
+	// Scenario 3b: The token was issued for another account of the provider
+	mock.ExpectGetDel("user_u1:send_confirm_token").SetVal(fingerprint)
+	confirmed, err = ConsumeSendConfirmation("u1", "u1/google:jane@example.com", email, "token")
+	assert.NoError(err)
+	assert.False(confirmed)
+
+	// Scenario 3c: The token was issued to another user
+	mock.ExpectGetDel("user_u2:send_confirm_token").RedisNil()
+	confirmed, err = ConsumeSendConfirmation("u2", "google", email, "token")
+	assert.NoError(err)
+	assert.False(confirmed)
+
+	// Scenario 4: The token was already used or has expired
+	mock.ExpectGetDel("user_u1:send_confirm_token").RedisNil()
+	confirmed, err = ConsumeSendConfirmation("u1", "google", email, "token")
+	assert.NoError(err)
+	assert.False(confirmed)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
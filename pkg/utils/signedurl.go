@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/redis/go-redis/v9"
+)
+
+// urlSigningKey is the redis key of the secret signing the URLs, it is generated on first use
+const urlSigningKey = "url_signing_key"
+
+// ErrInvalidSignature is returned when a signed URL was tampered with, is missing its signature or expired
+var ErrInvalidSignature = errors.New("invalid or expired URL signature")
+
+// SignURL signs the method and path so that they can be called without an API key until the URL expires.
+// The path is returned with the expires and signature query parameters.
+func SignURL(method string, path string, ttl time.Duration) (string, error) {
+
+	key, err := getURLSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", urlSignature(key, method, path, expires))
+
+	return path + "?" + query.Encode(), nil
+}
+
+// VerifySignedURL checks the signature and the expiry of a URL signed by SignURL
+func VerifySignedURL(method string, path string, expires string, signature string) error {
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return ErrInvalidSignature
+	}
+
+	key, err := getURLSigningKey()
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(urlSignature(key, method, path, expires))) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// urlSignature returns the HMAC of the method, path and expiry
+func urlSignature(key []byte, method string, path string, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method + "\n" + path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getURLSigningKey returns the secret signing the URLs, generating it if there is none yet.
+// The secret is shared by the replicas through redis.
+func getURLSigningKey() ([]byte, error) {
+
+	ctx := context.Background()
+
+	key, err := redisclient.Rdb.Get(ctx, urlSigningKey).Result()
+	if err == nil {
+		return hex.DecodeString(key)
+	}
+	if err != redis.Nil {
+		return nil, fmt.Errorf("Unable to retrieve URL signing key from redis: %w", err)
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate URL signing key: %w", err)
+	}
+
+	// Another replica may have generated one meanwhile
+	err = redisclient.Rdb.SetNX(ctx, urlSigningKey, hex.EncodeToString(b), 0).Err()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to save URL signing key to redis: %w", err)
+	}
+
+	key, err = redisclient.Rdb.Get(ctx, urlSigningKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve URL signing key from redis: %w", err)
+	}
+
+	return hex.DecodeString(key)
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedURL(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	secret := hex.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	mock.ExpectGet(urlSigningKey).SetVal(secret)
+	signed, err := SignURL("GET", "/v1/enroll/abc", time.Minute)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(signed, "/v1/enroll/abc?"))
+
+	parsed, err := url.Parse(signed)
+	assert.NoError(err)
+	expires := parsed.Query().Get("expires")
+	signature := parsed.Query().Get("signature")
+
+	mock.ExpectGet(urlSigningKey).SetVal(secret)
+	assert.NoError(VerifySignedURL("GET", "/v1/enroll/abc", expires, signature))
+
+	// The signature only covers the method and path it was issued for
+	mock.ExpectGet(urlSigningKey).SetVal(secret)
+	assert.Equal(ErrInvalidSignature, VerifySignedURL("POST", "/v1/enroll/abc", expires, signature))
+
+	mock.ExpectGet(urlSigningKey).SetVal(secret)
+	assert.Equal(ErrInvalidSignature, VerifySignedURL("GET", "/v1/enroll/abd", expires, signature))
+
+	// The expiry is part of the signature, it cannot be extended
+	mock.ExpectGet(urlSigningKey).SetVal(secret)
+	assert.Equal(ErrInvalidSignature, VerifySignedURL("GET", "/v1/enroll/abc", expires+"0", signature))
+
+	// Expired or malformed links are rejected without looking up the secret
+	assert.Equal(ErrInvalidSignature, VerifySignedURL("GET", "/v1/enroll/abc", "1", signature))
+	assert.Equal(ErrInvalidSignature, VerifySignedURL("GET", "/v1/enroll/abc", "", signature))
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// GetUserLocation returns the user's time zone set in USER_TIMEZONE (e.g. Europe/Zurich), UTC is used if it is not set or unknown.
+func GetUserLocation() *time.Location {
+
+	name := os.Getenv("USER_TIMEZONE")
+	if name == "" {
+		return time.UTC
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Unknown USER_TIMEZONE %s, using UTC: %v", name, err)
+		return time.UTC
+	}
+
+	return location
+}
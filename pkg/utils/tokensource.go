@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// tokenRefreshAhead is how long before expiry the tokens are refreshed
+const tokenRefreshAhead = 10 * time.Minute
+
+// tokenRefreshInterval is how often the scheduler checks the tokens
+const tokenRefreshInterval = time.Minute
+
+// tokenRefreshLockTTL bounds how long a replica can hold the refresh lock, in case it dies while refreshing
+const tokenRefreshLockTTL = 30 * time.Second
+
+// tokenRefreshWait is how long a replica waits for another one to finish refreshing the token
+var tokenRefreshWait = 10 * time.Second
+
+// tokenRefreshPoll is how often a waiting replica checks whether the refresh lock was released
+var tokenRefreshPoll = 200 * time.Millisecond
+
+// releaseLockScript deletes the lock only if it is still held by the caller, it may have expired and been taken over in the meantime
+const releaseLockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+// refreshConfig returns the OAuth2 config used to refresh the tokens of the provider
+var refreshConfig = GetOAuth2Config
+
+// ErrTokenRefreshInProgress is returned when another replica is refreshing the token and did not finish in time
+var ErrTokenRefreshInProgress = errors.New("the token is being refreshed by another replica")
+
+// refreshLockKey returns the redis key of the refresh lock of the account
+func refreshLockKey(account string) string {
+	return AccountKey("tokenRefreshLock_", account)
+}
+
+// storedTokenSource is an oauth2.TokenSource that reads the account's token from redis and saves the refreshed ones back
+type storedTokenSource struct {
+	account string
+}
+
+// Token returns a valid token, refreshing and saving it if it is about to expire
+func (s storedTokenSource) Token() (*oauth2.Token, error) {
+	return GetValidToken(s.account)
+}
+
+// NewTokenSource returns a token source bound to the account's stored token.
+// Unlike the token source of oauth2.Config, the refreshed and rotated tokens are saved to redis so that they outlive the process.
+// redis.Nil is returned if the account is not connected.
+func NewTokenSource(account string) (oauth2.TokenSource, error) {
+
+	token, err := GetValidToken(account)
+	if err != nil {
+		return nil, err
+	}
+
+	return oauth2.ReuseTokenSource(token, storedTokenSource{account: account}), nil
+}
+
+// GetValidToken returns the account's stored token, refreshed first if it expired or expires within the next few minutes.
+// redis.Nil is returned if the account is not connected.
+func GetValidToken(account string) (*oauth2.Token, error) {
+	return RefreshStoredToken(account, false)
+}
+
+// RefreshStoredToken refreshes the account's stored token and saves the new one, rotated refresh tokens included.
+// Unless forced, the stored token is returned as it is if it does not expire soon.
+// A lock in redis makes sure that only one replica uses the refresh token at a time, the others wait for the new token.
+func RefreshStoredToken(account string, force bool) (*oauth2.Token, error) {
+
+	token, err := RetrieveToken(account)
+	if err != nil {
+		return nil, err
+	}
+
+	if !force && !needsRefresh(token, tokenRefreshAhead) {
+		return token, nil
+	}
+
+	lockValue, acquired, err := acquireRefreshLock(account)
+	if err != nil {
+		return nil, err
+	}
+
+	if !acquired {
+		return waitForRefresh(account)
+	}
+
+	defer func() {
+		err := releaseRefreshLock(account, lockValue)
+		if err != nil {
+			log.Printf("Error releasing the %s token refresh lock: %v", account, err)
+		}
+	}()
+
+	// Another replica may have refreshed the token while the lock was being acquired
+	token, err = RetrieveToken(account)
+	if err != nil {
+		return nil, err
+	}
+
+	if !force && !needsRefresh(token, tokenRefreshAhead) {
+		return token, nil
+	}
+
+	if token.RefreshToken == "" {
+		return nil, ErrReconsentRequired
+	}
+
+	config, err := refreshConfig(AccountProvider(account))
+	if err != nil {
+		return nil, err
+	}
+
+	newToken, err := GetTokenFromRefreshToken(config, token.RefreshToken)
+	if err != nil {
+		// The refresh token expired or was revoked, retrying will not help
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			reconsentErr := RequireReconsent(account, fmt.Sprintf("the provider rejected the refresh token: %s", retrieveErr.ErrorDescription))
+			if reconsentErr != nil {
+				return nil, reconsentErr
+			}
+			return nil, fmt.Errorf("%w: %v", ErrReconsentRequired, err)
+		}
+		return nil, err
+	}
+
+	// The refresh token is only sent again when it was rotated, the stored one is kept otherwise
+	err = UpdateToken(account, newToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if newToken.RefreshToken == "" {
+		newToken.RefreshToken = token.RefreshToken
+	}
+
+	return newToken, nil
+}
+
+// RunTokenRefresh refreshes the tokens of the connected accounts before they expire, so that they never lapse while the portal is running.
+func RunTokenRefresh() {
+
+	ticker := time.NewTicker(tokenRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		accounts, err := ListAllAccounts("")
+		if err != nil {
+			log.Printf("Error listing the accounts: %v", err)
+		}
+
+		for _, account := range accounts {
+			_, err := GetValidToken(account)
+
+			// The account may have been disconnected meanwhile
+			if err != nil && err != redis.Nil {
+				log.Printf("Error refreshing the %s token: %v", account, err)
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// needsRefresh checks if the token must be refreshed: it can be refreshed but is no longer valid,
+// e.g. its access token expired from redis along with its expiry, or it expires within the given duration
+func needsRefresh(token *oauth2.Token, d time.Duration) bool {
+	return (!token.Valid() && token.RefreshToken != "") || expiresWithin(token, d)
+}
+
+// expiresWithin checks if the token expires within the given duration, tokens without expiry never do
+func expiresWithin(token *oauth2.Token, d time.Duration) bool {
+	return !token.Expiry.IsZero() && time.Until(token.Expiry) < d
+}
+
+// acquireRefreshLock takes the refresh lock of the account, false is returned if another replica holds it
+func acquireRefreshLock(account string) (string, bool, error) {
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to generate token refresh lock value: %w", err)
+	}
+	lockValue := hex.EncodeToString(b)
+
+	acquired, err := redisclient.Rdb.SetNX(context.Background(), refreshLockKey(account), lockValue, tokenRefreshLockTTL).Result()
+	if err != nil {
+		return "", false, fmt.Errorf("Unable to acquire token refresh lock in redis: %w", err)
+	}
+
+	return lockValue, acquired, nil
+}
+
+// releaseRefreshLock releases the refresh lock of the account if it is still held with the given value
+func releaseRefreshLock(account string, lockValue string) error {
+
+	err := redisclient.Rdb.Eval(context.Background(), releaseLockScript, []string{refreshLockKey(account)}, lockValue).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to release token refresh lock in redis: %w", err)
+	}
+
+	return nil
+}
+
+// waitForRefresh waits for the replica holding the refresh lock to finish and returns the token it saved
+func waitForRefresh(account string) (*oauth2.Token, error) {
+
+	deadline := time.Now().Add(tokenRefreshWait)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(tokenRefreshPoll)
+
+		held, err := redisclient.Rdb.Exists(context.Background(), refreshLockKey(account)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to check token refresh lock in redis: %w", err)
+		}
+
+		if held == 0 {
+			return RetrieveToken(account)
+		}
+	}
+
+	return nil, ErrTokenRefreshInProgress
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// savedAtPattern matches the times saved along with the tokens
+const savedAtPattern = `^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?Z$`
+
+// expectTTL matches an EXPIRE of the key by about the given duration, the TTL is computed from the current time
+func expectTTL(key string, ttl time.Duration) redismock.CustomMatch {
+	return func(expected, actual []interface{}) error {
+		seconds, ok := actual[2].(int64)
+		if actual[1] != key || !ok || seconds > int64(ttl/time.Second) || seconds < int64(ttl/time.Second)-5 {
+			return fmt.Errorf("expected %s to expire in about %s, got %v", key, ttl, actual)
+		}
+		return nil
+	}
+}
+
+// expectReleaseLock expects the refresh lock of the provider to be released with the random value it was taken with
+func expectReleaseLock(mock redismock.ClientMock, provider string) {
+	mock.Regexp().ExpectEval("^"+regexp.QuoteMeta(releaseLockScript)+"$", []string{"^tokenRefreshLock_" + provider + "$"}, `^[0-9a-f]{32}$`).SetVal(int64(1))
+}
+
+// expectStoredToken expects the provider's token to be read, with an access token expiring in the given duration
+func expectStoredToken(mock redismock.ClientMock, provider string, accessToken string, refreshToken string, expiresIn time.Duration) {
+	mock.ExpectHGetAll(provider).SetVal(map[string]string{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expiry":       time.Now().Add(expiresIn).UTC().Format(time.RFC3339Nano),
+	})
+	mock.ExpectHGetAll(refreshTokenKey(provider)).SetVal(map[string]string{"refresh_token": refreshToken})
+}
+
+func TestGetValidTokenStillValid(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// No lock is taken when the token does not expire soon
+	expectStoredToken(mock, "google", "access", "refresh", time.Hour)
+
+	token, err := GetValidToken("google")
+	assert.NoError(err)
+	assert.Equal("access", token.AccessToken)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestRefreshStoredToken(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// Local authorization server rotating the refresh token
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "new-access", "refresh_token": "new-refresh", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	refreshConfig = func(provider string) (*oauth2.Config, error) {
+		return &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams}}, nil
+	}
+	defer func() { refreshConfig = GetOAuth2Config }()
+
+	expectStoredToken(mock, "google", "access", "refresh", 5*time.Minute)
+	mock.Regexp().ExpectSetNX("tokenRefreshLock_google", `^[0-9a-f]{32}$`, tokenRefreshLockTTL).SetVal(true)
+	expectStoredToken(mock, "google", "access", "refresh", 5*time.Minute)
+	// The rotated refresh token is saved first, then the new access token which expires along with the token
+	mock.ExpectTxPipeline()
+	mock.ExpectDel("refreshToken_google").SetVal(1)
+	mock.Regexp().ExpectHSet("^refreshToken_google$", "refresh_token", "^new-refresh$", "saved_at", savedAtPattern).SetVal(2)
+	mock.ExpectDel("tokenReconsent_google").SetVal(0)
+	mock.ExpectTxPipelineExec()
+	mock.ExpectTxPipeline()
+	mock.ExpectDel("google").SetVal(1)
+	mock.Regexp().ExpectHSet("^google$", "access_token", "^new-access$", "token_type", "^Bearer$", "expiry", savedAtPattern).SetVal(3)
+	mock.CustomMatch(expectTTL("google", time.Hour)).ExpectExpire("google", time.Hour).SetVal(true)
+	mock.ExpectTxPipelineExec()
+	expectReleaseLock(mock, "google")
+
+	token, err := GetValidToken("google")
+	assert.NoError(err)
+	assert.Equal("new-access", token.AccessToken)
+	assert.Equal("new-refresh", token.RefreshToken)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestRefreshExpiredAccessToken(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "new-access", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	refreshConfig = func(provider string) (*oauth2.Config, error) {
+		return &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams}}, nil
+	}
+	defer func() { refreshConfig = GetOAuth2Config }()
+
+	// The access token expired from redis along with its expiry, only the refresh token is left
+	expectMissingAccessToken := func() {
+		mock.ExpectHGetAll("google").SetVal(map[string]string{})
+		mock.ExpectHGetAll("refreshToken_google").SetVal(map[string]string{"refresh_token": "refresh"})
+	}
+	expectMissingAccessToken()
+	mock.Regexp().ExpectSetNX("^tokenRefreshLock_google$", `^[0-9a-f]{32}$`, tokenRefreshLockTTL).SetVal(true)
+	expectMissingAccessToken()
+	// The refresh token was not rotated, the oauth2 package hands the current one back along with the new access token
+	mock.ExpectTxPipeline()
+	mock.ExpectDel("refreshToken_google").SetVal(1)
+	mock.Regexp().ExpectHSet("^refreshToken_google$", "refresh_token", "^refresh$", "saved_at", savedAtPattern).SetVal(2)
+	mock.ExpectDel("tokenReconsent_google").SetVal(0)
+	mock.ExpectTxPipelineExec()
+	mock.ExpectTxPipeline()
+	mock.ExpectDel("google").SetVal(0)
+	mock.Regexp().ExpectHSet("^google$", "access_token", "^new-access$", "token_type", "^Bearer$", "expiry", savedAtPattern).SetVal(3)
+	mock.CustomMatch(expectTTL("google", time.Hour)).ExpectExpire("google", time.Hour).SetVal(true)
+	mock.ExpectTxPipelineExec()
+	expectReleaseLock(mock, "google")
+
+	token, err := GetValidToken("google")
+	assert.NoError(err)
+	assert.Equal("new-access", token.AccessToken)
+	assert.Equal("refresh", token.RefreshToken)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestRefreshStoredTokenRejected(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// The refresh token was revoked
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`))
+	}))
+	defer server.Close()
+
+	refreshConfig = func(provider string) (*oauth2.Config, error) {
+		return &oauth2.Config{ClientID: "client", Endpoint: oauth2.Endpoint{TokenURL: server.URL, AuthStyle: oauth2.AuthStyleInParams}}, nil
+	}
+	defer func() { refreshConfig = GetOAuth2Config }()
+
+	expectStoredToken(mock, "google", "access", "refresh", time.Minute)
+	mock.Regexp().ExpectSetNX("tokenRefreshLock_google", `^[0-9a-f]{32}$`, tokenRefreshLockTTL).SetVal(true)
+	expectStoredToken(mock, "google", "access", "refresh", time.Minute)
+	mock.ExpectDel("refreshToken_google").SetVal(1)
+	mock.ExpectSet("tokenReconsent_google", "the provider rejected the refresh token: Token has been expired or revoked.", 0).SetVal("OK")
+	expectReleaseLock(mock, "google")
+
+	_, err := GetValidToken("google")
+	assert.ErrorIs(err, ErrReconsentRequired)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestRefreshStoredTokenLocked(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	tokenRefreshPoll = time.Millisecond
+	defer func() { tokenRefreshPoll = 200 * time.Millisecond }()
+
+	// Another replica holds the lock, the token it saved is used once it releases it
+	expectStoredToken(mock, "outlook", "access", "refresh", time.Minute)
+	mock.Regexp().ExpectSetNX("tokenRefreshLock_outlook", `^[0-9a-f]{32}$`, tokenRefreshLockTTL).SetVal(false)
+	mock.ExpectExists("tokenRefreshLock_outlook").SetVal(1)
+	mock.ExpectExists("tokenRefreshLock_outlook").SetVal(0)
+	expectStoredToken(mock, "outlook", "refreshed-elsewhere", "rotated", time.Hour)
+
+	token, err := GetValidToken("outlook")
+	assert.NoError(err)
+	assert.Equal("refreshed-elsewhere", token.AccessToken)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
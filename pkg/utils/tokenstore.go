@@ -0,0 +1,357 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// The statuses of an account's tokens
+const (
+	// TokenStatusActive means that the access token is valid
+	TokenStatusActive = "active"
+	// TokenStatusRefreshable means that the access token expired but can be refreshed without the user
+	TokenStatusRefreshable = "refreshable"
+	// TokenStatusNeedsReconsent means that the user has to connect the account again
+	TokenStatusNeedsReconsent = "needs_reconsent"
+	// TokenStatusNotConnected means that the account was never connected
+	TokenStatusNotConnected = "not_connected"
+)
+
+// ErrReconsentRequired is returned when the refresh token is missing or was rejected by the provider
+var ErrReconsentRequired = errors.New("the refresh token is missing or no longer valid, the account must be connected again")
+
+// ErrAccountConnected is returned when linking an account would replace the tokens of the connected one without the caller's confirmation
+var ErrAccountConnected = errors.New("the account is already connected, confirm replacing its tokens with replace=true")
+
+// TokenStatus is a struct to report whether the tokens of an account can still be used
+type TokenStatus struct {
+	Provider string `json:"provider"`
+	Account  string `json:"account,omitempty"`
+	Email    string `json:"email,omitempty"`
+	// Status is active, refreshable, needs_reconsent or not_connected
+	Status               string     `json:"status"`
+	AccessTokenExpiresAt *time.Time `json:"accessTokenExpiresAt,omitempty"`
+	// Refreshable is set when a refresh token is stored, the access token is then renewed without the user
+	Refreshable bool `json:"refreshable"`
+	// RefreshTokenExpiresAt is only known if the provider reports the lifetime of its refresh tokens
+	RefreshTokenExpiresAt *time.Time `json:"refreshTokenExpiresAt,omitempty"`
+	Reason                string     `json:"reason,omitempty"`
+}
+
+// The access token is stored under the account's ID, under the prefix of its user, and expires with the token.
+// The refresh token is stored apart and only expires if the provider reports its lifetime.
+
+// accessTokenKey returns the redis key of the account's access token
+func accessTokenKey(account string) string {
+	return AccountKey("", account)
+}
+
+// refreshTokenKey returns the redis key of the account's refresh token
+func refreshTokenKey(account string) string {
+	return AccountKey("refreshToken_", account)
+}
+
+// reconsentKey returns the redis key of the reason why the account must be connected again
+func reconsentKey(account string) string {
+	return AccountKey("tokenReconsent_", account)
+}
+
+// RetrieveToken retrieves the OAuth token of the account from redis.
+// The access token is empty if it expired but the refresh token is still stored.
+// redis.Nil is returned if neither is stored.
+func RetrieveToken(account string) (*oauth2.Token, error) {
+
+	access, err := redisclient.Rdb.HGetAll(context.Background(), accessTokenKey(account)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve token from redis: %w", err)
+	}
+
+	refresh, err := redisclient.Rdb.HGetAll(context.Background(), refreshTokenKey(account)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve refresh token from redis: %w", err)
+	}
+
+	// If the token is not found in redis, return an error
+	if len(access) == 0 && len(refresh) == 0 {
+		return nil, redis.Nil
+	}
+
+	accessToken, err := DecryptValue(access["access_token"], accessTokenKey(account), "access_token")
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := DecryptValue(refresh["refresh_token"], refreshTokenKey(account), "refresh_token")
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens saved before the refresh token was stored apart still carry it
+	if refreshToken == "" {
+		refreshToken, err = DecryptValue(access["refresh_token"], accessTokenKey(account), "refresh_token")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tok := &oauth2.Token{
+		AccessToken:  accessToken,
+		TokenType:    access["token_type"],
+		RefreshToken: refreshToken,
+	}
+
+	if access["expiry"] != "" {
+		tok.Expiry, err = time.Parse(time.RFC3339Nano, access["expiry"])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse token expiry: %w", err)
+		}
+	}
+
+	return tok, nil
+}
+
+// SaveToken saves the token of the account to redis.
+// The refresh token is only replaced if the token carries one, providers that do not rotate them leave it out of the refreshed tokens.
+func SaveToken(account string, token *oauth2.Token) error {
+
+	ctx := context.Background()
+
+	// The tokens are encrypted at rest if a key is configured
+	accessToken, err := EncryptValue(token.AccessToken, accessTokenKey(account), "access_token")
+	if err != nil {
+		return err
+	}
+
+	// The refresh token is saved first so that it is never lost
+	if token.RefreshToken != "" {
+		refreshToken, err := EncryptValue(token.RefreshToken, refreshTokenKey(account), "refresh_token")
+		if err != nil {
+			return err
+		}
+
+		refresh := map[string]interface{}{
+			"refresh_token": refreshToken,
+			"saved_at":      time.Now().UTC().Format(time.RFC3339Nano),
+		}
+
+		lifetime := refreshTokenLifetime(token)
+		if lifetime > 0 {
+			refresh["expiry"] = time.Now().Add(lifetime).UTC().Format(time.RFC3339Nano)
+		}
+
+		// The hash is replaced in a transaction so that a concurrent reader never sees it missing or partly written
+		_, err = redisclient.Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, refreshTokenKey(account))
+			pipe.HSet(ctx, refreshTokenKey(account), refresh)
+			if lifetime > 0 {
+				pipe.Expire(ctx, refreshTokenKey(account), lifetime)
+			}
+			pipe.Del(ctx, reconsentKey(account))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to save refresh token to redis: %w", err)
+		}
+	} else {
+		// Without a refresh token the account must be connected again once the access token expires
+		exists, err := redisclient.Rdb.Exists(ctx, refreshTokenKey(account)).Result()
+		if err != nil {
+			return fmt.Errorf("Unable to check refresh token in redis: %w", err)
+		}
+
+		if exists == 0 {
+			err = redisclient.Rdb.Set(ctx, reconsentKey(account), "the provider did not issue a refresh token", 0).Err()
+			if err != nil {
+				return fmt.Errorf("Unable to save re-consent reason to redis: %w", err)
+			}
+		}
+	}
+
+	access := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   token.TokenType,
+		"expiry":       token.Expiry.UTC().Format(time.RFC3339Nano),
+	}
+
+	// Replaces the whole hash so that no field of the previous token is left over, in a transaction like the refresh token
+	_, err = redisclient.Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, accessTokenKey(account))
+		pipe.HSet(ctx, accessTokenKey(account), access)
+		// The access token is useless once expired
+		if !token.Expiry.IsZero() {
+			pipe.Expire(ctx, accessTokenKey(account), time.Until(token.Expiry))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to save token to redis: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateToken updates the token in redis.
+func UpdateToken(account string, token *oauth2.Token) error {
+	return SaveToken(account, token)
+}
+
+// RequireReconsent drops the account's refresh token and records why the account must be connected again
+func RequireReconsent(account string, reason string) error {
+
+	err := redisclient.Rdb.Del(context.Background(), refreshTokenKey(account)).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to delete refresh token from redis: %w", err)
+	}
+
+	err = redisclient.Rdb.Set(context.Background(), reconsentKey(account), reason, 0).Err()
+	if err != nil {
+		return fmt.Errorf("Unable to save re-consent reason to redis: %w", err)
+	}
+
+	return nil
+}
+
+// GetTokenStatus reports whether the account's access token is valid, can be refreshed or the account must be connected again
+func GetTokenStatus(account string) (TokenStatus, error) {
+
+	ctx := context.Background()
+	status := TokenStatus{Provider: AccountProvider(account), Account: AccountName(account), Email: AccountEmail(account)}
+
+	access, err := redisclient.Rdb.HGetAll(ctx, accessTokenKey(account)).Result()
+	if err != nil {
+		return status, fmt.Errorf("Unable to retrieve token from redis: %w", err)
+	}
+
+	refresh, err := redisclient.Rdb.HGetAll(ctx, refreshTokenKey(account)).Result()
+	if err != nil {
+		return status, fmt.Errorf("Unable to retrieve refresh token from redis: %w", err)
+	}
+
+	reason, err := redisclient.Rdb.Get(ctx, reconsentKey(account)).Result()
+	if err != nil && err != redis.Nil {
+		return status, fmt.Errorf("Unable to retrieve re-consent reason from redis: %w", err)
+	}
+
+	if expiry, err := time.Parse(time.RFC3339Nano, access["expiry"]); err == nil && time.Now().Before(expiry) {
+		status.AccessTokenExpiresAt = &expiry
+	}
+
+	status.Refreshable = refresh["refresh_token"] != "" || access["refresh_token"] != ""
+	if expiry, err := time.Parse(time.RFC3339Nano, refresh["expiry"]); err == nil {
+		status.RefreshTokenExpiresAt = &expiry
+	}
+
+	switch {
+	case status.AccessTokenExpiresAt != nil:
+		status.Status = TokenStatusActive
+	case status.Refreshable:
+		status.Status = TokenStatusRefreshable
+	case reason != "" || len(access) != 0:
+		status.Status = TokenStatusNeedsReconsent
+	default:
+		status.Status = TokenStatusNotConnected
+	}
+
+	if !status.Refreshable && status.Status != TokenStatusNotConnected {
+		status.Reason = reason
+		if reason == "" {
+			status.Reason = "no refresh token is stored"
+		}
+	}
+
+	return status, nil
+}
+
+// ConfirmLink checks that completing the link does not replace the tokens of a connected account, unless the caller confirmed it.
+// Linking another account of the provider adds it next to the connected ones. ErrAccountConnected is returned otherwise.
+func ConfirmLink(link OAuthLink, account string) error {
+
+	if link.Replace {
+		return nil
+	}
+
+	status, err := GetTokenStatus(account)
+	if err != nil {
+		return err
+	}
+
+	if status.Status != TokenStatusNotConnected {
+		return ErrAccountConnected
+	}
+
+	return nil
+}
+
+// MigrateTokenStorage moves the refresh tokens stored along with the access tokens to their own keys, so that they outlive the access tokens.
+// Keys that were already migrated are left as they are.
+func MigrateTokenStorage() error {
+
+	ctx := context.Background()
+
+	for provider := range ValidProviders {
+		refreshToken, err := redisclient.Rdb.HGet(ctx, provider, "refresh_token").Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to retrieve %s token from redis: %w", provider, err)
+		}
+
+		exists, err := redisclient.Rdb.Exists(ctx, refreshTokenKey(provider)).Result()
+		if err != nil {
+			return fmt.Errorf("Unable to check %s refresh token in redis: %w", provider, err)
+		}
+
+		if exists == 0 && refreshToken != "" {
+			// The encrypted values are bound to their key and field, so the refresh token is encrypted again for its own key
+			refreshToken, err = DecryptValue(refreshToken, accessTokenKey(provider), "refresh_token")
+			if err != nil {
+				return err
+			}
+
+			refreshToken, err = EncryptValue(refreshToken, refreshTokenKey(provider), "refresh_token")
+			if err != nil {
+				return err
+			}
+
+			err = redisclient.Rdb.HSet(ctx, refreshTokenKey(provider), map[string]interface{}{
+				"refresh_token": refreshToken,
+				"saved_at":      time.Now().UTC().Format(time.RFC3339Nano),
+			}).Err()
+			if err != nil {
+				return fmt.Errorf("Unable to save %s refresh token to redis: %w", provider, err)
+			}
+		}
+
+		err = redisclient.Rdb.HDel(ctx, provider, "refresh_token", "expires_in").Err()
+		if err != nil {
+			return fmt.Errorf("Unable to remove %s refresh token from the access token in redis: %w", provider, err)
+		}
+
+		log.Printf("Migrated the %s refresh token to its own key", provider)
+	}
+
+	return nil
+}
+
+// refreshTokenLifetime returns the lifetime of the refresh token if the provider reports it, e.g. Google for time-limited access
+func refreshTokenLifetime(token *oauth2.Token) time.Duration {
+
+	var seconds int64
+	switch v := token.Extra("refresh_token_expires_in").(type) {
+	case float64:
+		seconds = int64(v)
+	case string:
+		seconds, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+	"github.com/go-redis/redismock/v9"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestRetrieveToken(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// The access token expired but the refresh token outlives it
+	mock.ExpectHGetAll("google").SetVal(map[string]string{})
+	mock.ExpectHGetAll("refreshToken_google").SetVal(map[string]string{"refresh_token": "refresh"})
+
+	token, err := RetrieveToken("google")
+	assert.NoError(err)
+	assert.Equal("", token.AccessToken)
+	assert.Equal("refresh", token.RefreshToken)
+
+	// A token saved before the refresh token was stored apart
+	mock.ExpectHGetAll("outlook").SetVal(map[string]string{"access_token": "access", "refresh_token": "legacy", "expiry": "2030-01-01T00:00:00Z"})
+	mock.ExpectHGetAll("refreshToken_outlook").SetVal(map[string]string{})
+
+	token, err = RetrieveToken("outlook")
+	assert.NoError(err)
+	assert.Equal("access", token.AccessToken)
+	assert.Equal("legacy", token.RefreshToken)
+	assert.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), token.Expiry)
+
+	mock.ExpectHGetAll("google").SetVal(map[string]string{})
+	mock.ExpectHGetAll("refreshToken_google").SetVal(map[string]string{})
+
+	_, err = RetrieveToken("google")
+	assert.Equal(redis.Nil, err)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestGetTokenStatus(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// The access token expired, the refresh token reported its lifetime
+	mock.ExpectHGetAll("google").SetVal(map[string]string{})
+	mock.ExpectHGetAll("refreshToken_google").SetVal(map[string]string{"refresh_token": "refresh", "expiry": "2030-01-01T00:00:00Z"})
+	mock.ExpectGet("tokenReconsent_google").RedisNil()
+
+	status, err := GetTokenStatus("google")
+	assert.NoError(err)
+	assert.Equal(TokenStatusRefreshable, status.Status)
+	assert.True(status.Refreshable)
+	assert.Nil(status.AccessTokenExpiresAt)
+	assert.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), *status.RefreshTokenExpiresAt)
+
+	// The provider rejected the refresh token
+	mock.ExpectHGetAll("outlook").SetVal(map[string]string{})
+	mock.ExpectHGetAll("refreshToken_outlook").SetVal(map[string]string{})
+	mock.ExpectGet("tokenReconsent_outlook").SetVal("the provider rejected the refresh token: AADSTS70008")
+
+	status, err = GetTokenStatus("outlook")
+	assert.NoError(err)
+	assert.Equal(TokenStatus{Provider: "outlook", Account: "outlook", Status: TokenStatusNeedsReconsent, Reason: "the provider rejected the refresh token: AADSTS70008"}, status)
+
+	// A valid access token without a refresh token
+	expiry := time.Now().Add(time.Hour).UTC()
+	mock.ExpectHGetAll("google").SetVal(map[string]string{"access_token": "access", "expiry": expiry.Format(time.RFC3339Nano)})
+	mock.ExpectHGetAll("refreshToken_google").SetVal(map[string]string{})
+	mock.ExpectGet("tokenReconsent_google").SetVal("the provider did not issue a refresh token")
+
+	status, err = GetTokenStatus("google")
+	assert.NoError(err)
+	assert.Equal(TokenStatusActive, status.Status)
+	assert.False(status.Refreshable)
+	assert.Equal("the provider did not issue a refresh token", status.Reason)
+
+	mock.ExpectHGetAll("google").SetVal(map[string]string{})
+	mock.ExpectHGetAll("refreshToken_google").SetVal(map[string]string{})
+	mock.ExpectGet("tokenReconsent_google").RedisNil()
+
+	status, err = GetTokenStatus("google")
+	assert.NoError(err)
+	assert.Equal(TokenStatus{Provider: "google", Account: "google", Status: TokenStatusNotConnected}, status)
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestMigrateTokenStorage(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// The providers are visited in map order
+	mock.MatchExpectationsInOrder(false)
+
+	// Google still carries its refresh token along with the access token, Outlook was already migrated
+	mock.ExpectHGet("google", "refresh_token").SetVal("refresh")
+	mock.ExpectExists("refreshToken_google").SetVal(0)
+	mock.CustomMatch(func(expected, actual []interface{}) error { return nil }).ExpectHSet("refreshToken_google", "refresh_token", "", "saved_at", "").SetVal(2)
+	mock.ExpectHDel("google", "refresh_token", "expires_in").SetVal(1)
+	mock.ExpectHGet("outlook", "refresh_token").RedisNil()
+
+	assert.NoError(MigrateTokenStorage())
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
+
+func TestSaveTokenEncrypted(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	encryptionKeys, _ = parseKeyring("k1:" + testKey('a'))
+	defer func() { encryptionKeys = nil }()
+
+	// The tokens never reach redis in plaintext
+	encrypted := func(expected, actual []interface{}) error {
+		for _, arg := range actual {
+			if arg == "access" || arg == "refresh" {
+				return fmt.Errorf("token stored in plaintext")
+			}
+		}
+		return nil
+	}
+
+	mock.ExpectTxPipeline()
+	mock.ExpectDel("refreshToken_google").SetVal(1)
+	mock.CustomMatch(encrypted).ExpectHSet("refreshToken_google", "refresh_token", "", "saved_at", "").SetVal(2)
+	mock.ExpectDel("tokenReconsent_google").SetVal(0)
+	mock.ExpectTxPipelineExec()
+	mock.ExpectTxPipeline()
+	mock.ExpectDel("google").SetVal(1)
+	mock.CustomMatch(encrypted).ExpectHSet("google", "access_token", "", "token_type", "", "expiry", "").SetVal(3)
+	mock.CustomMatch(func(expected, actual []interface{}) error { return nil }).ExpectExpire("google", time.Hour).SetVal(true)
+	mock.ExpectTxPipelineExec()
+
+	err := SaveToken("google", &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)})
+	assert.NoError(err)
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+
+	accessToken, _ := EncryptValue("access", "google", "access_token")
+	refreshToken, _ := EncryptValue("refresh", "refreshToken_google", "refresh_token")
+	mock.ExpectHGetAll("google").SetVal(map[string]string{"access_token": accessToken, "token_type": "Bearer", "expiry": "2030-01-01T00:00:00Z"})
+	mock.ExpectHGetAll("refreshToken_google").SetVal(map[string]string{"refresh_token": refreshToken})
+
+	token, err := RetrieveToken("google")
+	assert.NoError(err)
+	assert.Equal("access", token.AccessToken)
+	assert.Equal("refresh", token.RefreshToken)
+
+	// A token copied to another account cannot be read
+	mock.ExpectHGetAll("outlook").SetVal(map[string]string{"access_token": accessToken, "token_type": "Bearer"})
+	mock.ExpectHGetAll("refreshToken_outlook").SetVal(map[string]string{})
+
+	_, err = RetrieveToken("outlook")
+	assert.Error(err)
+}
+
+func TestConfirmLink(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	assert := assert.New(t)
+
+	redisclient.Rdb = db
+	defer db.Close()
+
+	// Nothing is connected yet
+	mock.ExpectHGetAll("user_u1:google:jane@example.com").SetVal(map[string]string{})
+	mock.ExpectHGetAll("user_u1:refreshToken_google:jane@example.com").SetVal(map[string]string{})
+	mock.ExpectGet("user_u1:tokenReconsent_google:jane@example.com").RedisNil()
+	assert.NoError(ConfirmLink(OAuthLink{Provider: "google", User: "u1", KeyID: "abc"}, "u1/google:jane@example.com"))
+
+	// A connected account is only replaced once confirmed
+	mock.ExpectHGetAll("user_u1:google:jane@example.com").SetVal(map[string]string{})
+	mock.ExpectHGetAll("user_u1:refreshToken_google:jane@example.com").SetVal(map[string]string{"refresh_token": "refresh"})
+	mock.ExpectGet("user_u1:tokenReconsent_google:jane@example.com").RedisNil()
+	assert.Equal(ErrAccountConnected, ConfirmLink(OAuthLink{Provider: "google", User: "u1", KeyID: "abc"}, "u1/google:jane@example.com"))
+
+	assert.NoError(ConfirmLink(OAuthLink{Provider: "google", User: "u1", KeyID: "abc", Replace: true}, "u1/google:jane@example.com"))
+
+	assert.NoError(mock.ExpectationsWereMet(), "there were unfulfilled expectations")
+}
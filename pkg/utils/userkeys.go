@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	redisclient "github.com/algo7/day-planner-gpt-data-portal/internal/redis"
+)
+
+// The data of every user is stored under keys prefixed with user_<id>:, e.g. user_<id>:priority_rules.
+// The keys looked up before the user is known stay global: the API keys, the invitations, the OAuth state and the URL signing key.
+
+// UsersKey is the redis set of the IDs of the users
+const UsersKey = "users"
+
+// legacyUserKeys are the patterns of the keys stored without a user by earlier versions, which only had one
+var legacyUserKeys = []string{"agenda_responses", "agenda_invites", "priority_rules", "audit_log", "email_ingested*", "send_quota_*"}
+
+// UserKey returns the redis key of the user's data
+func UserKey(user string, key string) string {
+	return fmt.Sprintf("user_%s:%s", user, key)
+}
+
+// ListUserIDs returns the IDs of the users, sorted
+func ListUserIDs() ([]string, error) {
+
+	ids, err := redisclient.Rdb.SMembers(context.Background(), UsersKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve users from redis: %w", err)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// MigrateUserData moves the data stored without a user by earlier versions to the keys of the user, e.g. the priority rules and the audit log.
+// The keys that do not exist are skipped.
+func MigrateUserData(user string) error {
+
+	ctx := context.Background()
+
+	for _, pattern := range legacyUserKeys {
+		iter := redisclient.Rdb.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			key := iter.Val()
+
+			err := renameIfExists(key, UserKey(user, key))
+			if err != nil {
+				return err
+			}
+		}
+
+		err := iter.Err()
+		if err != nil {
+			return fmt.Errorf("Unable to scan %s in redis: %w", pattern, err)
+		}
+	}
+
+	return nil
+}